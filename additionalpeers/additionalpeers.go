@@ -0,0 +1,101 @@
+package additionalpeers
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// EncodeAdditionalPeers encodes a list of peers and their addresses into bytes
+// for the additional peers extension
+func EncodeAdditionalPeers(peers []peer.AddrInfo) ([]byte, error) {
+	list, err := fluent.Build(basicnode.Style.List, func(na fluent.NodeAssembler) {
+		na.CreateList(len(peers), func(la fluent.ListAssembler) {
+			for _, ai := range peers {
+				la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("id").AssignBytes([]byte(ai.ID))
+					ma.AssembleEntry("addrs").CreateList(len(ai.Addrs), func(la fluent.ListAssembler) {
+						for _, addr := range ai.Addrs {
+							la.AssembleValue().AssignBytes(addr.Bytes())
+						}
+					})
+				})
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(list)
+}
+
+// DecodeAdditionalPeers decodes a list of peers and their addresses from data
+// for the additional peers extension
+func DecodeAdditionalPeers(data []byte) ([]peer.AddrInfo, error) {
+	list, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	if list.ReprKind() != ipld.ReprKind_List {
+		return nil, errors.New("additional peers must be a list")
+	}
+	var peers []peer.AddrInfo
+	iter := list.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		ai, err := decodeAddrInfo(next)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, ai)
+	}
+	return peers, nil
+}
+
+func decodeAddrInfo(node ipld.Node) (peer.AddrInfo, error) {
+	idNode, err := node.LookupString("id")
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	idBytes, err := idNode.AsBytes()
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	id, err := peer.IDFromBytes(idBytes)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	addrsNode, err := node.LookupString("addrs")
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	if addrsNode.ReprKind() != ipld.ReprKind_List {
+		return peer.AddrInfo{}, errors.New("peer addresses must be a list")
+	}
+	var addrs []ma.Multiaddr
+	iter := addrsNode.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		addrBytes, err := next.AsBytes()
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		addr, err := ma.NewMultiaddrBytes(addrBytes)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return peer.AddrInfo{ID: id, Addrs: addrs}, nil
+}
@@ -0,0 +1,28 @@
+package additionalpeers
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEncodeAdditionalPeers(t *testing.T) {
+	peers := []peer.AddrInfo{
+		{ID: test.RandPeerIDFatal(t), Addrs: []ma.Multiaddr{
+			ma.StringCast("/ip4/127.0.0.1/tcp/4001"),
+			ma.StringCast("/ip6/::1/udp/4001/quic"),
+		}},
+		{ID: test.RandPeerIDFatal(t)},
+	}
+	encoded, err := EncodeAdditionalPeers(peers)
+	require.NoError(t, err, "encode errored")
+	decoded, err := DecodeAdditionalPeers(encoded)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, peers, decoded, "peers changed during encoding and decoding")
+
+	_, err = DecodeAdditionalPeers([]byte("not a peer list"))
+	require.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package budget
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// maxLimit is the largest limit the budget extension can carry
+const maxLimit = uint64(^uint(0) >> 1)
+
+// EncodeBudget encodes a budget into bytes for the budget extension. Limits
+// too large to encode are lowered to the largest limit that can be encoded,
+// which no request will reach.
+func EncodeBudget(b graphsync.Budget) ([]byte, error) {
+	node, err := fluent.Build(basicnode.Style.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(2, func(na fluent.MapAssembler) {
+			na.AssembleEntry("maxBlocks").AssignInt(clampLimit(b.MaxBlocks))
+			na.AssembleEntry("maxBytes").AssignInt(clampLimit(b.MaxBytes))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(node)
+}
+
+// DecodeBudget decodes a budget from data for the budget extension
+func DecodeBudget(data []byte) (graphsync.Budget, error) {
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return graphsync.Budget{}, err
+	}
+	maxBlocks, err := decodeLimit(node, "maxBlocks")
+	if err != nil {
+		return graphsync.Budget{}, err
+	}
+	maxBytes, err := decodeLimit(node, "maxBytes")
+	if err != nil {
+		return graphsync.Budget{}, err
+	}
+	return graphsync.Budget{MaxBlocks: maxBlocks, MaxBytes: maxBytes}, nil
+}
+
+// Min returns a budget whose limits are the stricter of the two given budgets
+func Min(a graphsync.Budget, b graphsync.Budget) graphsync.Budget {
+	return graphsync.Budget{
+		MaxBlocks: minLimit(a.MaxBlocks, b.MaxBlocks),
+		MaxBytes:  minLimit(a.MaxBytes, b.MaxBytes),
+	}
+}
+
+func decodeLimit(node ipld.Node, key string) (uint64, error) {
+	limitNode, err := node.LookupString(key)
+	if err != nil {
+		return 0, err
+	}
+	limit, err := limitNode.AsInt()
+	if err != nil {
+		return 0, err
+	}
+	if limit < 0 {
+		return 0, errors.New("budget limits cannot be negative")
+	}
+	return uint64(limit), nil
+}
+
+func clampLimit(limit uint64) int {
+	if limit > maxLimit {
+		return int(maxLimit)
+	}
+	return int(limit)
+}
+
+func minLimit(a uint64, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,45 @@
+package budget
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+func TestDecodeEncodeBudget(t *testing.T) {
+	b := graphsync.Budget{MaxBlocks: 10, MaxBytes: 1 << 20}
+	encoded, err := EncodeBudget(b)
+	require.NoError(t, err, "encode errored")
+	decoded, err := DecodeBudget(encoded)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, b, decoded, "budget changed during encoding and decoding")
+
+	_, err = DecodeBudget([]byte("not a budget"))
+	require.Error(t, err)
+}
+
+func TestEncodeBudgetClampsLargeLimits(t *testing.T) {
+	encoded, err := EncodeBudget(graphsync.Budget{MaxBlocks: math.MaxUint64, MaxBytes: 1 << 20})
+	require.NoError(t, err)
+	decoded, err := DecodeBudget(encoded)
+	require.NoError(t, err)
+	require.Equal(t, maxLimit, decoded.MaxBlocks)
+	require.Equal(t, uint64(1<<20), decoded.MaxBytes)
+}
+
+func TestBudgetLimits(t *testing.T) {
+	unlimited := graphsync.Budget{}
+	require.True(t, unlimited.Allows(1000, 1<<30))
+
+	b := graphsync.Budget{MaxBlocks: 2, MaxBytes: 300}
+	require.True(t, b.Allows(2, 300))
+	require.False(t, b.Allows(3, 300))
+	require.False(t, b.Allows(2, 301))
+
+	require.Equal(t, graphsync.Budget{MaxBlocks: 2, MaxBytes: 100},
+		Min(graphsync.Budget{MaxBlocks: 2}, graphsync.Budget{MaxBlocks: 5, MaxBytes: 100}))
+	require.Equal(t, b, Min(unlimited, b))
+}
@@ -0,0 +1,86 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// Gzip compresses block data with gzip from the standard library
+const Gzip = "gzip"
+
+// DefaultSkipCodecs are the codecs of blocks not worth compressing. Raw blocks
+// usually hold file data such as images and archives that is already
+// compressed.
+var DefaultSkipCodecs = []uint64{cid.Raw}
+
+// Compressor compresses the data of blocks worth compressing
+type Compressor struct {
+	algorithm  string
+	skipCodecs map[uint64]struct{}
+}
+
+// NewCompressor returns a compressor for the given algorithm, that leaves
+// blocks with any of the given codecs uncompressed
+func NewCompressor(algorithm string, skipCodecs []uint64) (*Compressor, error) {
+	if algorithm != Gzip {
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+	skip := make(map[uint64]struct{}, len(skipCodecs))
+	for _, codec := range skipCodecs {
+		skip[codec] = struct{}{}
+	}
+	return &Compressor{algorithm, skip}, nil
+}
+
+// Algorithm returns the name of the algorithm data is compressed with
+func (c *Compressor) Algorithm() string {
+	return c.algorithm
+}
+
+// Compress returns the compressed data for a block, and whether it should be
+// sent compressed. Blocks whose codec is skipped, or that do not shrink, are
+// sent as they are.
+func (c *Compressor) Compress(block blocks.Block) ([]byte, bool) {
+	if _, skip := c.skipCodecs[block.Cid().Type()]; skip {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(block.RawData()); err != nil {
+		return nil, false
+	}
+	if err := writer.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(block.RawData()) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// Decompress returns the original data compressed with the given algorithm.
+// It errors if the original data is larger than maxSize.
+func Decompress(algorithm string, data []byte, maxSize int) ([]byte, error) {
+	if algorithm != Gzip {
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxSize {
+		return nil, fmt.Errorf("decompressed data is larger than the maximum of %d bytes", maxSize)
+	}
+	return decompressed, nil
+}
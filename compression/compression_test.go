@@ -0,0 +1,54 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	_, err := NewCompressor("lz4", nil)
+	require.Error(t, err)
+
+	compressor, err := NewCompressor(Gzip, DefaultSkipCodecs)
+	require.NoError(t, err)
+	require.Equal(t, Gzip, compressor.Algorithm())
+
+	data := bytes.Repeat([]byte("graphsync "), 100)
+	prefix := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: 0x12, MhLength: -1}
+	c, err := prefix.Sum(data)
+	require.NoError(t, err)
+	block, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+
+	compressed, ok := compressor.Compress(block)
+	require.True(t, ok)
+	require.Less(t, len(compressed), len(data))
+	decompressed, err := Decompress(Gzip, compressed, len(data))
+	require.NoError(t, err)
+	require.Equal(t, data, decompressed)
+
+	_, err = Decompress(Gzip, compressed, len(data)-1)
+	require.Error(t, err, "should not decompress past the maximum size")
+	_, err = Decompress(Gzip, data, len(data))
+	require.Error(t, err, "should not decompress invalid data")
+
+	// skipped codecs are not compressed
+	prefix.Codec = cid.Raw
+	c, err = prefix.Sum(data)
+	require.NoError(t, err)
+	rawBlock, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+	_, ok = compressor.Compress(rawBlock)
+	require.False(t, ok)
+
+	// data that does not shrink is not compressed
+	randomBlock := blocks.NewBlock(testutil.RandomBytes(100))
+	_, ok = compressor.Compress(randomBlock)
+	require.False(t, ok)
+}
@@ -31,7 +31,7 @@ require (
 	github.com/libp2p/go-libp2p-record v0.1.1 // indirect
 	github.com/multiformats/go-multiaddr v0.2.1
 	github.com/multiformats/go-multihash v0.0.13
-	github.com/polydawn/refmt v0.0.0-20190809202753-05966cbd336a // indirect
+	github.com/polydawn/refmt v0.0.0-20190809202753-05966cbd336a
 	github.com/smartystreets/assertions v1.0.1 // indirect
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
 	github.com/stretchr/testify v1.5.1
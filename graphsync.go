@@ -3,6 +3,8 @@ package graphsync
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
@@ -42,6 +44,30 @@ const (
 	// https://github.com/ipld/specs/blob/master/block-layer/graphsync/known_extensions.md
 	ExtensionDoNotSendCIDs = ExtensionName("graphsync/do-not-send-cids")
 
+	// ExtensionPartition tells the responding peer to only send blocks for
+	// links that fall into the given partition, so that a request can be split
+	// across several peers
+	ExtensionPartition = ExtensionName("graphsync/partition")
+
+	// ExtensionBudget tells the responding peer to stop sending blocks once a
+	// response reaches a maximum number of blocks or bytes
+	ExtensionBudget = ExtensionName("graphsync/budget")
+
+	// ExtensionRetryAfter is sent by a busy responder along with
+	// RequestFailedBusy, to tell the requestor how long to wait before trying
+	// again
+	ExtensionRetryAfter = ExtensionName("graphsync/retry-after")
+
+	// ExtensionAdditionalPeers lists other peers, with their addresses, that may
+	// be able to serve the request. It is sent with the AdditionalPeers status
+	ExtensionAdditionalPeers = ExtensionName("graphsync/additional-peers")
+
+	// ExtensionPauseResponse is sent by a requestor in a request update to ask
+	// the responder to pause the response after its next block, or to resume it.
+	// The requestor offers it on the request, and a responder that supports it
+	// answers in its first response. See docs/pause-response.md
+	ExtensionPauseResponse = ExtensionName("graphsync/pause-response")
+
 	// GraphSync Response Status Codes
 
 	// Informational Response Codes (partial)
@@ -90,10 +116,16 @@ const (
 	RequestCancelled = ResponseStatusCode(35)
 )
 
-// RequestFailedBusyErr is an error message received on the error channel when the peer is busy
-type RequestFailedBusyErr struct{}
+// RequestFailedBusyErr is an error message received on the error channel when the peer is busy.
+// RetryAfter is how long the peer asked to wait before trying again, or zero if it did not say.
+type RequestFailedBusyErr struct {
+	RetryAfter time.Duration
+}
 
 func (e RequestFailedBusyErr) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("Request Failed - Peer Is Busy, Retry After %s", e.RetryAfter)
+	}
 	return "Request Failed - Peer Is Busy"
 }
 
@@ -125,6 +157,52 @@ func (e RequestCancelledErr) Error() string {
 	return "Request Failed - Responder Cancelled"
 }
 
+// RequestBudgetExceededErr is an error message received on the error channel
+// when the responder sends more blocks or bytes than the request's budget allows
+type RequestBudgetExceededErr struct{}
+
+func (e RequestBudgetExceededErr) Error() string {
+	return "Request Failed - Budget Exceeded"
+}
+
+// RequestFailedNetworkErr is an error message received on the error channel
+// when a message for the request could not be sent to the peer
+type RequestFailedNetworkErr struct {
+	Peer peer.ID
+	Err  error
+}
+
+func (e RequestFailedNetworkErr) Error() string {
+	return fmt.Sprintf("Request Failed - Network Error With Peer %s: %s", e.Peer, e.Err)
+}
+
+// Unwrap returns the underlying network error
+func (e RequestFailedNetworkErr) Unwrap() error {
+	return e.Err
+}
+
+// RequestFailedPeerDisconnectedErr is an error message received on the error
+// channel when the peer disconnects before the request finishes
+type RequestFailedPeerDisconnectedErr struct {
+	Peer peer.ID
+}
+
+func (e RequestFailedPeerDisconnectedErr) Error() string {
+	return fmt.Sprintf("Request Failed - Peer %s Disconnected", e.Peer)
+}
+
+// RequestStalledErr is an error message received on the error channel when
+// the request is cancelled because nothing was received from the peer for
+// longer than the request's inactivity timeout
+type RequestStalledErr struct {
+	Peer    peer.ID
+	Timeout time.Duration
+}
+
+func (e RequestStalledErr) Error() string {
+	return fmt.Sprintf("Request Failed - No Activity From Peer %s For %s", e.Peer, e.Timeout)
+}
+
 var (
 	// ErrExtensionAlreadyRegistered means a user extension can be registered only once
 	ErrExtensionAlreadyRegistered = errors.New("extension already registered")
@@ -140,6 +218,93 @@ type ResponseProgress struct {
 	}
 }
 
+// RawBlock is a block loaded by a request, in the order the traversal
+// reached it
+type RawBlock struct {
+	Cid  cid.Cid
+	Data []byte
+	// Local is true if the block was loaded from the local store rather than
+	// received from the peer
+	Local bool
+}
+
+// RetryPolicy describes how a request is retried when the responder fails it
+// with RequestFailedBusy or RequestFailedUnknown, or when the request cannot be
+// sent or the peer disconnects. Retries are sent with the CIDs already received
+// in the do-not-send-cids extension, so blocks are not transferred twice.
+// Links the failed peer reported missing are forgotten before each retry.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times the request is sent, including
+	// the first attempt. A value of one or less disables retries.
+	MaxAttempts int
+	// Backoff is the delay before each retry. Once the schedule runs out, the
+	// last delay is reused.
+	Backoff []time.Duration
+	// FallbackPeers are tried in order for each retry, before going back to the
+	// original peer.
+	FallbackPeers []peer.ID
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a context that makes requests made with it use the
+// given retry policy, instead of any policy chosen by outgoing request hooks
+func WithRetryPolicy(ctx context.Context, retryPolicy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, retryPolicy)
+}
+
+// RetryPolicyFromContext returns the retry policy set with WithRetryPolicy, if
+// there is one
+func RetryPolicyFromContext(ctx context.Context) (RetryPolicy, bool) {
+	retryPolicy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy)
+	return retryPolicy, ok
+}
+
+// Budget caps the blocks and bytes sent over the network for a single
+// response. Blocks the requestor already has do not count against it. A zero
+// value for either limit means no limit.
+type Budget struct {
+	MaxBlocks uint64
+	MaxBytes  uint64
+}
+
+// Allows returns true if a response that has sent the given number of blocks
+// and bytes is still within the budget
+func (b Budget) Allows(blocks uint64, bytes uint64) bool {
+	if b.MaxBlocks != 0 && blocks > b.MaxBlocks {
+		return false
+	}
+	return b.MaxBytes == 0 || bytes <= b.MaxBytes
+}
+
+// PersistedRequest describes a request that was checkpointed so it can be
+// resumed, for example after a restart.
+type PersistedRequest struct {
+	ID   string
+	Peer peer.ID
+	// Peers lists every peer for a request split across several peers
+	Peers          []peer.ID
+	Root           ipld.Link
+	Selector       ipld.Node
+	Extensions     []ExtensionData
+	BlocksReceived int
+}
+
+// RequestState is a snapshot of an in progress request or response, for
+// inspecting transfers from outside graphsync.
+type RequestState struct {
+	// Peer is the peer on the other side of the transfer
+	Peer      peer.ID
+	RequestID RequestID
+	Root      ipld.Link
+	Paused    bool
+	// Blocks is the number of blocks sent or received over the network so far
+	Blocks uint64
+	// Bytes is the size of the blocks sent or received over the network so far
+	Bytes     uint64
+	StartTime time.Time
+}
+
 // RequestData describes a received graphsync request.
 type RequestData interface {
 	// ID Returns the request ID for this Request
@@ -196,6 +361,8 @@ type IncomingRequestHookActions interface {
 	TerminateWithError(error)
 	ValidateRequest()
 	PauseResponse()
+	SendAdditionalPeers(...peer.AddrInfo)
+	SetPeerBandwidthLimit(bytesPerSecond uint64)
 }
 
 // OutgoingBlockHookActions are actions that an outgoing block hook can take to
@@ -204,6 +371,7 @@ type OutgoingBlockHookActions interface {
 	SendExtensionData(ExtensionData)
 	TerminateWithError(error)
 	PauseResponse()
+	SetPeerBandwidthLimit(bytesPerSecond uint64)
 }
 
 // OutgoingRequestHookActions are actions that an outgoing request hook can take
@@ -211,6 +379,11 @@ type OutgoingBlockHookActions interface {
 type OutgoingRequestHookActions interface {
 	UsePersistenceOption(name string)
 	UseLinkTargetNodeStyleChooser(traversal.LinkTargetNodeStyleChooser)
+	UseRetryPolicy(RetryPolicy)
+	UseBudget(Budget)
+	FollowAdditionalPeers()
+	UseInactivityTimeout(time.Duration)
+	ResolveLocallyFirst()
 }
 
 // IncomingResponseHookActions are actions that incoming response hook can take
@@ -278,6 +451,14 @@ type OnResponseCompletedListener func(p peer.ID, request RequestData, status Res
 // OnRequestorCancelledListener provides a way to listen for responses the requestor canncels
 type OnRequestorCancelledListener func(p peer.ID, request RequestData)
 
+// OnNetworkErrorListener provides a way to listen for responses that end
+// because they could not be sent to the requestor, or the requestor disconnected
+type OnNetworkErrorListener func(p peer.ID, request RequestData, err error)
+
+// OnAdditionalPeersListener provides a way to listen for other peers a responder
+// suggests for a request
+type OnAdditionalPeersListener func(p peer.ID, response ResponseData, peers []peer.AddrInfo)
+
 // UnregisterHookFunc is a function call to unregister a hook that was previously registered
 type UnregisterHookFunc func()
 
@@ -286,6 +467,25 @@ type GraphExchange interface {
 	// Request initiates a new GraphSync request to the given peer using the given selector spec.
 	Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
 
+	// RequestFromPeers initiates a new GraphSync request that is split across the given peers.
+	// Each peer is asked to send only a share of the blocks in the traversal, and the share of a peer
+	// that fails is reassigned to the remaining peers. Responses are returned in traversal order.
+	RequestFromPeers(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// RequestBlocks initiates a new GraphSync request to the given peer that returns the raw blocks
+	// of the traversal, in traversal order, instead of the nodes it visits.
+	RequestBlocks(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan RawBlock, <-chan error)
+
+	// PersistedRequests lists requests that were persisted and have not completed yet.
+	// Requests are only persisted when request persistence is enabled
+	PersistedRequests() ([]PersistedRequest, error)
+
+	// ResumeRequest sends a persisted request again, skipping the blocks that were already received
+	ResumeRequest(ctx context.Context, id string) (<-chan ResponseProgress, <-chan error)
+
+	// RemovePersistedRequest discards a persisted request so it is no longer resumable
+	RemovePersistedRequest(id string) error
+
 	// RegisterPersistenceOption registers an alternate loader/storer combo that can be substituted for the default
 	RegisterPersistenceOption(name string, loader ipld.Loader, storer ipld.Storer) error
 
@@ -314,6 +514,14 @@ type GraphExchange interface {
 	// responses cancelled by the requestor
 	RegisterRequestorCancelledListener(listener OnRequestorCancelledListener) UnregisterHookFunc
 
+	// RegisterNetworkErrorListener adds a listener on the responder for
+	// responses that end because of network errors
+	RegisterNetworkErrorListener(listener OnNetworkErrorListener) UnregisterHookFunc
+
+	// RegisterAdditionalPeersListener adds a listener on the requestor for other
+	// peers that responders suggest
+	RegisterAdditionalPeersListener(listener OnAdditionalPeersListener) UnregisterHookFunc
+
 	// UnpauseRequest unpauses a request that was paused in a block hook based request ID
 	// Can also send extensions with unpause
 	UnpauseRequest(RequestID, ...ExtensionData) error
@@ -330,4 +538,15 @@ type GraphExchange interface {
 
 	// CancelResponse cancels an in progress response
 	CancelResponse(peer.ID, RequestID) error
+
+	// InProgressRequests returns a snapshot of all requests this node is making
+	InProgressRequests() []RequestState
+
+	// InProgressResponses returns a snapshot of all responses this node is sending
+	InProgressResponses() []RequestState
+
+	// Shutdown stops accepting new requests, lets active responses finish until the
+	// context ends, cancelling any that remain, and then sends remaining messages and
+	// closes streams before stopping graphsync
+	Shutdown(ctx context.Context) error
 }
@@ -2,15 +2,19 @@ package graphsync
 
 import (
 	"context"
+	"time"
 
+	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/metrics"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/peermanager"
 	"github.com/ipfs/go-graphsync/requestmanager"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader"
 	requestorhooks "github.com/ipfs/go-graphsync/requestmanager/hooks"
+	"github.com/ipfs/go-graphsync/requestmanager/requeststore"
 	"github.com/ipfs/go-graphsync/responsemanager"
 	responderhooks "github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
@@ -24,7 +28,11 @@ import (
 
 var log = logging.Logger("graphsync")
 
-const maxRecursionDepth = 100
+const defaultMaxRecursionDepth = 100
+
+// cancelGracePeriod is how long Shutdown waits past its deadline for
+// RequestCancelled to be sent for responses that did not finish in time
+const cancelGracePeriod = 500 * time.Millisecond
 
 // GraphSync is an instance of a GraphSync exchange that implements
 // the graphsync protocol.
@@ -43,24 +51,332 @@ type GraphSync struct {
 	requestUpdatedHooks         *responderhooks.RequestUpdatedHooks
 	completedResponseListeners  *responderhooks.CompletedResponseListeners
 	requestorCancelledListeners *responderhooks.RequestorCancelledListeners
+	networkErrorListeners       *responderhooks.NetworkErrorListeners
 	incomingResponseHooks       *requestorhooks.IncomingResponseHooks
 	outgoingRequestHooks        *requestorhooks.OutgoingRequestHooks
 	incomingBlockHooks          *requestorhooks.IncomingBlockHooks
+	additionalPeersListeners    *requestorhooks.AdditionalPeersListeners
 	persistenceOptions          *persistenceoptions.PersistenceOptions
 	ctx                         context.Context
 	cancel                      context.CancelFunc
-	unregisterDefaultValidator  graphsync.UnregisterHookFunc
+	rejectAllRequestsByDefault  bool
+	metrics                     metrics.Metrics
+	maxInProcessRequests        int
+	thawSpeed                   time.Duration
+	maxBlockSize                uint64
+	maxMessageRetries           int
+	maxRecursionDepth           int
+	sendMessageTimeout          time.Duration
+	maxMessageSize              uint64
+	maxQueuedResponses          int
+	maxQueuedResponsesPerPeer   int
+	maxBandwidth                uint64
+	maxBandwidthPerPeer         uint64
+	busyRetryAfter              time.Duration
+	requestInactivityTimeout    time.Duration
+	pausedResponseIdleTimeout   time.Duration
+	separateControlStream       bool
+	localFirst                  bool
+	coalesceRequests            bool
+	coalesceDetachAfter         time.Duration
+	maxUnverifiedBlockMemory    uint64
+	unverifiedBlockSpillDir     string
 }
 
 // Option defines the functional option type that can be used to configure
-// graphsync instances
+// graphsync instances. Options do not return errors: an option given an
+// invalid value logs a warning and leaves the setting at its default.
 type Option func(*GraphSync)
 
 // RejectAllRequestsByDefault means that without hooks registered
 // that perform their own request validation, all requests are rejected
 func RejectAllRequestsByDefault() Option {
 	return func(gs *GraphSync) {
-		gs.unregisterDefaultValidator()
+		gs.rejectAllRequestsByDefault = true
+	}
+}
+
+// PersistRequests checkpoints outgoing requests and the blocks received for
+// them to the given datastore, so they can be resumed with ResumeRequest
+// after a crash or restart
+func PersistRequests(ds datastore.Datastore) Option {
+	return func(gs *GraphSync) {
+		gs.requestManager.SetRequestStore(requeststore.New(ds))
+	}
+}
+
+// UseMetrics reports measurements from requests, responses, and message
+// sending to the given metrics. Use metrics.NewInMemory for a default
+// implementation that can be read by the host application
+func UseMetrics(metrics metrics.Metrics) Option {
+	return func(gs *GraphSync) {
+		gs.metrics = metrics
+	}
+}
+
+// MaxInProcessRequests sets how many incoming requests are processed at the
+// same time. Further requests wait in the queue. A value that is not positive
+// is logged and falls back to the default of 6.
+func MaxInProcessRequests(maxInProcess int) Option {
+	return func(gs *GraphSync) {
+		if maxInProcess <= 0 {
+			log.Warnf("max in process requests must be positive, got %d; keeping the default", maxInProcess)
+			return
+		}
+		gs.maxInProcessRequests = maxInProcess
+	}
+}
+
+// ThawSpeed sets how often idle response workers check the queue for requests
+// that became ready. A value that is not positive is logged and falls back to
+// the default of 100ms.
+func ThawSpeed(thawSpeed time.Duration) Option {
+	return func(gs *GraphSync) {
+		if thawSpeed <= 0 {
+			log.Warnf("thaw speed must be positive, got %s; keeping the default", thawSpeed)
+			return
+		}
+		gs.thawSpeed = thawSpeed
+	}
+}
+
+// MaxBlockSize sets the maximum number of block bytes batched into a single
+// response message. A single block larger than this is still sent in a message
+// of its own. Zero is logged and falls back to the default of 512KiB.
+func MaxBlockSize(maxBlockSize uint64) Option {
+	return func(gs *GraphSync) {
+		if maxBlockSize == 0 {
+			log.Warn("max block size must be positive; keeping the default")
+			return
+		}
+		gs.maxBlockSize = maxBlockSize
+	}
+}
+
+// MaxMessageRetries sets how many times sending a message to a peer is
+// attempted before it is dropped. A value that is not positive is logged and
+// falls back to the default of 10.
+func MaxMessageRetries(maxRetries int) Option {
+	return func(gs *GraphSync) {
+		if maxRetries <= 0 {
+			log.Warnf("max message retries must be positive, got %d; keeping the default", maxRetries)
+			return
+		}
+		gs.maxMessageRetries = maxRetries
+	}
+}
+
+// MaxRecursionDepth sets the deepest recursion allowed in selectors of incoming
+// requests by the default validator. A value that is not positive is logged and
+// falls back to the default of 100.
+func MaxRecursionDepth(maxDepth int) Option {
+	return func(gs *GraphSync) {
+		if maxDepth <= 0 {
+			log.Warnf("max recursion depth must be positive, got %d; keeping the default", maxDepth)
+			return
+		}
+		gs.maxRecursionDepth = maxDepth
+	}
+}
+
+// SendMessageTimeout sets how long a single attempt to write a message to a
+// peer may take. A value that is not positive is logged and falls back to the
+// default of 10 minutes.
+func SendMessageTimeout(timeout time.Duration) Option {
+	return func(gs *GraphSync) {
+		if timeout <= 0 {
+			log.Warnf("send message timeout must be positive, got %s; keeping the default", timeout)
+			return
+		}
+		gs.sendMessageTimeout = timeout
+	}
+}
+
+// MaxMessageSize sets the largest encoded message sent to a peer. Larger
+// messages are split into several, keeping the order of responses and blocks
+// for each request. A single block larger than the limit is still sent whole,
+// in a message of its own. Zero is logged and falls back to the default of
+// 2MiB.
+func MaxMessageSize(maxMessageSize uint64) Option {
+	return func(gs *GraphSync) {
+		if maxMessageSize == 0 {
+			log.Warn("max message size must be positive; keeping the default")
+			return
+		}
+		gs.maxMessageSize = maxMessageSize
+	}
+}
+
+// MaxQueuedResponses limits how many incoming requests may wait in the queue.
+// Requests past the limit are rejected with RequestFailedBusy. A value that is
+// not positive is logged and falls back to the default of no limit.
+func MaxQueuedResponses(maxQueued int) Option {
+	return func(gs *GraphSync) {
+		if maxQueued <= 0 {
+			log.Warnf("max queued responses must be positive, got %d; keeping the default", maxQueued)
+			return
+		}
+		gs.maxQueuedResponses = maxQueued
+	}
+}
+
+// MaxQueuedResponsesPerPeer limits how many incoming requests from a single
+// peer may wait in the queue. Requests past the limit are rejected with
+// RequestFailedBusy. A value that is not positive is logged and falls back to
+// the default of no limit.
+func MaxQueuedResponsesPerPeer(maxQueued int) Option {
+	return func(gs *GraphSync) {
+		if maxQueued <= 0 {
+			log.Warnf("max queued responses per peer must be positive, got %d; keeping the default", maxQueued)
+			return
+		}
+		gs.maxQueuedResponsesPerPeer = maxQueued
+	}
+}
+
+// MaxOutgoingBandwidth limits how many block bytes per second are sent across
+// all peers. A response that uses up the limit is set aside, without holding
+// a worker, until there is bandwidth again, rather than queueing blocks. Zero
+// is logged and falls back to the default of no limit.
+func MaxOutgoingBandwidth(bytesPerSecond uint64) Option {
+	return func(gs *GraphSync) {
+		if bytesPerSecond == 0 {
+			log.Warn("max outgoing bandwidth must be positive; keeping the default")
+			return
+		}
+		gs.maxBandwidth = bytesPerSecond
+	}
+}
+
+// MaxOutgoingBandwidthPerPeer limits how many block bytes per second are sent
+// to each peer. Hooks can change the limit for a peer with
+// SetPeerBandwidthLimit. Zero is logged and falls back to the default of no
+// limit.
+func MaxOutgoingBandwidthPerPeer(bytesPerSecond uint64) Option {
+	return func(gs *GraphSync) {
+		if bytesPerSecond == 0 {
+			log.Warn("max outgoing bandwidth per peer must be positive; keeping the default")
+			return
+		}
+		gs.maxBandwidthPerPeer = bytesPerSecond
+	}
+}
+
+// BusyRetryAfter sets how long requestors are asked to wait before retrying
+// when their request is rejected because the queue is full. Zero sends no
+// delay. A negative value is logged and falls back to the default of one
+// second.
+func BusyRetryAfter(retryAfter time.Duration) Option {
+	return func(gs *GraphSync) {
+		if retryAfter < 0 {
+			log.Warnf("busy retry after cannot be negative, got %s; keeping the default", retryAfter)
+			return
+		}
+		gs.busyRetryAfter = retryAfter
+	}
+}
+
+// RequestInactivityTimeout cancels outgoing requests that receive no response
+// or block from the peer for the given time, failing them with a
+// RequestStalledErr. Request hooks can set a different timeout for a single
+// request with UseInactivityTimeout. A value that is not positive is logged and
+// falls back to the default of no timeout.
+func RequestInactivityTimeout(timeout time.Duration) Option {
+	return func(gs *GraphSync) {
+		if timeout <= 0 {
+			log.Warnf("request inactivity timeout must be positive, got %s; keeping the default", timeout)
+			return
+		}
+		gs.requestInactivityTimeout = timeout
+	}
+}
+
+// PausedResponseIdleTimeout cancels responses that stay paused for longer than
+// the given time, sending RequestCancelled to the requestor. A value that is
+// not positive is logged and falls back to the default of no timeout.
+func PausedResponseIdleTimeout(timeout time.Duration) Option {
+	return func(gs *GraphSync) {
+		if timeout <= 0 {
+			log.Warnf("paused response idle timeout must be positive, got %s; keeping the default", timeout)
+			return
+		}
+		gs.pausedResponseIdleTimeout = timeout
+	}
+}
+
+// SeparateControlStream sends requests, including cancels and updates, to each
+// peer over a stream of their own, and responses and blocks over another, so
+// requests are not held up behind large responses to the same peer
+func SeparateControlStream() Option {
+	return func(gs *GraphSync) {
+		gs.separateControlStream = true
+	}
+}
+
+// ResolveLocallyFirst makes outgoing requests traverse as much of the selector
+// as they can from the local store before contacting the peer. A request is
+// only sent when the traversal reaches a block that is missing locally, and
+// the blocks already traversed are sent along as do-not-send-cids. Requests
+// that resolve entirely locally never go to the network. Request hooks can
+// turn this on for individual requests with ResolveLocallyFirst.
+func ResolveLocallyFirst() Option {
+	return func(gs *GraphSync) {
+		gs.localFirst = true
+	}
+}
+
+// CoalesceRequests makes a request that is identical to one already in
+// progress -- same peers, root, selector, extensions and retry policy -- share
+// the request in progress instead of sending it again, so the peers only send
+// the data once. This covers Request and RequestFromPeers, but not
+// RequestBlocks or ResumeRequest. Every caller gets the whole response, and
+// the shared request is cancelled once all of them cancel. A caller that stops
+// reading for detachAfter gets a request of its own, which fetches the data
+// again. With a detachAfter of zero, callers are never detached, and one that
+// stops reading holds up every other caller instead. A caller that joins after
+// the shared request has returned a lot starts a new shared request. Request
+// hooks run once for each request sent. A negative detachAfter is logged and
+// falls back to the default of one second.
+func CoalesceRequests(detachAfter time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.coalesceRequests = true
+		if detachAfter < 0 {
+			log.Warnf("coalesced request detach after cannot be negative, got %s; keeping the default", detachAfter)
+			return
+		}
+		gs.coalesceDetachAfter = detachAfter
+	}
+}
+
+// MaxUnverifiedBlockMemory limits how many bytes of received blocks are held in
+// memory before the traversal reaches them, across all outgoing requests. Past
+// the limit, requests that receive more blocks ask their responders to pause,
+// and resume them once they catch up. Requests to responders that cannot pause
+// are cancelled instead, and sent again once they catch up. Blocks already on
+// their way still arrive, and without SpillUnverifiedBlocks they are kept in
+// memory, so the limit can be overrun by that much. Zero is logged and falls
+// back to the default of no limit.
+func MaxUnverifiedBlockMemory(maxBytes uint64) Option {
+	return func(gs *GraphSync) {
+		if maxBytes == 0 {
+			log.Warn("max unverified block memory must be positive; keeping the default")
+			return
+		}
+		gs.maxUnverifiedBlockMemory = maxBytes
+	}
+}
+
+// SpillUnverifiedBlocks writes received blocks past the
+// MaxUnverifiedBlockMemory limit to a temporary directory inside dir, instead
+// of keeping them in memory. The temporary directory is removed on shutdown. An empty value is logged and falls back to the
+// default of keeping blocks in memory.
+func SpillUnverifiedBlocks(dir string) Option {
+	return func(gs *GraphSync) {
+		if dir == "" {
+			log.Warn("unverified block spill directory cannot be empty; keeping the default")
+			return
+		}
+		gs.unverifiedBlockSpillDir = dir
 	}
 }
 
@@ -70,18 +386,44 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	loader ipld.Loader, storer ipld.Storer, options ...Option) graphsync.GraphExchange {
 	ctx, cancel := context.WithCancel(parent)
 
+	var graphSync *GraphSync
+	// messages that cannot be sent fail the requests and responses they carry
+	onSendError := func(p peer.ID, requestIDs []graphsync.RequestID, responseIDs []graphsync.RequestID, err error) {
+		if len(requestIDs) > 0 {
+			graphSync.requestManager.ProcessNetworkError(p, requestIDs, err)
+		}
+		if len(responseIDs) > 0 {
+			graphSync.responseManager.ProcessNetworkError(p, responseIDs, err)
+		}
+	}
 	createMessageQueue := func(ctx context.Context, p peer.ID) peermanager.PeerQueue {
-		return messagequeue.New(ctx, p, network)
+		if graphSync.separateControlStream {
+			messageQueue := messagequeue.NewControlAndBulk(ctx, p, network, graphSync.metrics, graphSync.maxMessageRetries, graphSync.sendMessageTimeout, graphSync.maxMessageSize)
+			messageQueue.SetSendErrorHandler(onSendError)
+			return messageQueue
+		}
+		messageQueue := messagequeue.New(ctx, p, network, graphSync.metrics, graphSync.maxMessageRetries, graphSync.sendMessageTimeout, graphSync.maxMessageSize)
+		messageQueue.SetSendErrorHandler(onSendError)
+		return messageQueue
 	}
 	peerManager := peermanager.NewMessageManager(ctx, createMessageQueue)
 	asyncLoader := asyncloader.New(ctx, loader, storer)
 	incomingResponseHooks := requestorhooks.NewResponseHooks()
 	outgoingRequestHooks := requestorhooks.NewRequestHooks()
 	incomingBlockHooks := requestorhooks.NewBlockHooks()
-	requestManager := requestmanager.New(ctx, asyncLoader, outgoingRequestHooks, incomingResponseHooks, incomingBlockHooks)
+	additionalPeersListeners := requestorhooks.NewAdditionalPeersListeners()
+	// make suggested peers dialable, so requests that follow them can connect
+	if addrAdder, ok := network.(gsnet.AddrAdder); ok {
+		additionalPeersListeners.Register(func(p peer.ID, response graphsync.ResponseData, peers []peer.AddrInfo) {
+			for _, ai := range peers {
+				addrAdder.AddAddrs(ai.ID, ai.Addrs)
+			}
+		})
+	}
+	requestManager := requestmanager.New(ctx, asyncLoader, outgoingRequestHooks, incomingResponseHooks, incomingBlockHooks, additionalPeersListeners)
 	peerTaskQueue := peertaskqueue.New()
 	createdResponseQueue := func(ctx context.Context, p peer.ID) peerresponsemanager.PeerResponseSender {
-		return peerresponsemanager.NewResponseSender(ctx, p, peerManager)
+		return peerresponsemanager.NewResponseSender(ctx, p, peerManager, graphSync.maxBlockSize)
 	}
 	peerResponseManager := peerresponsemanager.New(ctx, createdResponseQueue)
 	persistenceOptions := persistenceoptions.New()
@@ -90,9 +432,10 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	requestUpdatedHooks := responderhooks.NewUpdateHooks()
 	completedResponseListeners := responderhooks.NewCompletedResponseListeners()
 	requestorCancelledListeners := responderhooks.NewRequestorCancelledListeners()
+	networkErrorListeners := responderhooks.NewNetworkErrorListeners()
 	responseManager := responsemanager.New(ctx, loader, peerResponseManager, peerTaskQueue, incomingRequestHooks, outgoingBlockHooks, requestUpdatedHooks, completedResponseListeners, requestorCancelledListeners)
-	unregisterDefaultValidator := incomingRequestHooks.Register(selectorvalidator.SelectorValidator(maxRecursionDepth))
-	graphSync := &GraphSync{
+	responseManager.SetNetworkErrorListeners(networkErrorListeners)
+	graphSync = &GraphSync{
 		network:                     network,
 		loader:                      loader,
 		storer:                      storer,
@@ -105,21 +448,51 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 		requestUpdatedHooks:         requestUpdatedHooks,
 		completedResponseListeners:  completedResponseListeners,
 		requestorCancelledListeners: requestorCancelledListeners,
+		networkErrorListeners:       networkErrorListeners,
 		incomingResponseHooks:       incomingResponseHooks,
 		outgoingRequestHooks:        outgoingRequestHooks,
 		incomingBlockHooks:          incomingBlockHooks,
+		additionalPeersListeners:    additionalPeersListeners,
 		peerTaskQueue:               peerTaskQueue,
 		peerResponseManager:         peerResponseManager,
 		responseManager:             responseManager,
 		ctx:                         ctx,
 		cancel:                      cancel,
-		unregisterDefaultValidator:  unregisterDefaultValidator,
+		metrics:                     metrics.NewNoop(),
+		maxInProcessRequests:        responsemanager.DefaultMaxInProcessRequests,
+		thawSpeed:                   responsemanager.DefaultThawSpeed,
+		maxBlockSize:                peerresponsemanager.DefaultMaxBlockSize,
+		maxMessageRetries:           messagequeue.DefaultMaxRetries,
+		maxRecursionDepth:           defaultMaxRecursionDepth,
+		sendMessageTimeout:          gsnet.DefaultSendMessageTimeout,
+		maxMessageSize:              messagequeue.DefaultMaxMessageSize,
+		busyRetryAfter:              responsemanager.DefaultBusyRetryAfter,
+		coalesceDetachAfter:         requestmanager.DefaultCoalesceDetachAfter,
 	}
 
 	for _, option := range options {
 		option(graphSync)
 	}
 
+	if !graphSync.rejectAllRequestsByDefault {
+		incomingRequestHooks.Register(selectorvalidator.SelectorValidator(graphSync.maxRecursionDepth))
+	}
+	requestManager.SetMetrics(graphSync.metrics)
+	if provider, ok := network.(gsnet.ConnManagerProvider); ok {
+		requestManager.SetConnManager(provider.ConnectionManager())
+		responseManager.SetConnManager(provider.ConnectionManager())
+	}
+	requestManager.SetInactivityTimeout(graphSync.requestInactivityTimeout)
+	requestManager.SetLocalFirst(graphSync.localFirst)
+	requestManager.SetCoalesceRequests(graphSync.coalesceRequests, graphSync.coalesceDetachAfter)
+	requestManager.SetThrottleResponses(graphSync.maxUnverifiedBlockMemory != 0)
+	responseManager.SetMetrics(graphSync.metrics)
+	responseManager.SetMaxInProcessRequests(graphSync.maxInProcessRequests)
+	responseManager.SetThawSpeed(graphSync.thawSpeed)
+	responseManager.SetQueueLimits(graphSync.maxQueuedResponses, graphSync.maxQueuedResponsesPerPeer, graphSync.busyRetryAfter)
+	responseManager.SetBandwidthLimits(graphSync.maxBandwidth, graphSync.maxBandwidthPerPeer)
+	responseManager.SetPausedResponseIdleTimeout(graphSync.pausedResponseIdleTimeout)
+	asyncLoader.SetMemoryLimit(graphSync.maxUnverifiedBlockMemory, graphSync.unverifiedBlockSpillDir)
 	asyncLoader.Startup()
 	requestManager.SetDelegate(peerManager)
 	requestManager.Startup()
@@ -133,6 +506,32 @@ func (gs *GraphSync) Request(ctx context.Context, p peer.ID, root ipld.Link, sel
 	return gs.requestManager.SendRequest(ctx, p, root, selector, extensions...)
 }
 
+// RequestFromPeers initiates a new GraphSync request split across the given peers using the given selector spec.
+func (gs *GraphSync) RequestFromPeers(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	return gs.requestManager.SendRequestToPeers(ctx, peers, root, selector, extensions...)
+}
+
+// RequestBlocks initiates a new GraphSync request to the given peer that returns the raw blocks of the traversal
+// in traversal order, instead of the nodes it visits.
+func (gs *GraphSync) RequestBlocks(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.RawBlock, <-chan error) {
+	return gs.requestManager.RequestBlocks(ctx, p, root, selector, extensions...)
+}
+
+// PersistedRequests lists requests that were persisted and have not completed yet.
+func (gs *GraphSync) PersistedRequests() ([]graphsync.PersistedRequest, error) {
+	return gs.requestManager.PersistedRequests()
+}
+
+// ResumeRequest sends a persisted request again, skipping the blocks that were already received.
+func (gs *GraphSync) ResumeRequest(ctx context.Context, id string) (<-chan graphsync.ResponseProgress, <-chan error) {
+	return gs.requestManager.ResumeRequest(ctx, id)
+}
+
+// RemovePersistedRequest discards a persisted request so it is no longer resumable.
+func (gs *GraphSync) RemovePersistedRequest(id string) error {
+	return gs.requestManager.RemovePersistedRequest(id)
+}
+
 // RegisterIncomingRequestHook adds a hook that runs when a request is received
 // If overrideDefaultValidation is set to true, then if the hook does not error,
 // it is considered to have "validated" the request -- and that validation supersedes
@@ -186,6 +585,18 @@ func (gs *GraphSync) RegisterRequestorCancelledListener(listener graphsync.OnReq
 	return gs.requestorCancelledListeners.Register(listener)
 }
 
+// RegisterNetworkErrorListener adds a listener on the responder for responses
+// that end because of network errors
+func (gs *GraphSync) RegisterNetworkErrorListener(listener graphsync.OnNetworkErrorListener) graphsync.UnregisterHookFunc {
+	return gs.networkErrorListeners.Register(listener)
+}
+
+// RegisterAdditionalPeersListener adds a listener on the requestor for other
+// peers that responders suggest
+func (gs *GraphSync) RegisterAdditionalPeersListener(listener graphsync.OnAdditionalPeersListener) graphsync.UnregisterHookFunc {
+	return gs.additionalPeersListeners.Register(listener)
+}
+
 // UnpauseRequest unpauses a request that was paused in a block hook based request ID
 // Can also send extensions with unpause
 func (gs *GraphSync) UnpauseRequest(requestID graphsync.RequestID, extensions ...graphsync.ExtensionData) error {
@@ -212,6 +623,40 @@ func (gs *GraphSync) CancelResponse(p peer.ID, requestID graphsync.RequestID) er
 	return gs.responseManager.CancelResponse(p, requestID)
 }
 
+// Shutdown gracefully stops graphsync. New requests, outgoing and incoming, are
+// rejected, and active responses are given until the context ends to finish.
+// Responses still running at that point are cancelled, sending
+// RequestCancelled, which may take up to cancelGracePeriod past the deadline.
+// Outgoing requests are then cancelled, remaining messages are sent, and
+// streams are closed. An error is returned if responses had to be cancelled.
+func (gs *GraphSync) Shutdown(ctx context.Context) error {
+	gs.requestManager.StopAcceptingRequests()
+	err := gs.responseManager.Drain(ctx)
+	flushCtx := ctx
+	if err != nil {
+		var cancel context.CancelFunc
+		flushCtx, cancel = context.WithTimeout(gs.ctx, cancelGracePeriod)
+		defer cancel()
+		gs.responseManager.CancelAll()
+		_ = gs.responseManager.Drain(flushCtx)
+	}
+	gs.requestManager.CancelAll()
+	_ = gs.peerResponseManager.FlushAndShutdown(flushCtx)
+	_ = gs.peerManager.FlushAndShutdown(flushCtx)
+	gs.cancel()
+	return err
+}
+
+// InProgressRequests returns a snapshot of all requests this node is making
+func (gs *GraphSync) InProgressRequests() []graphsync.RequestState {
+	return gs.requestManager.InProgressRequests()
+}
+
+// InProgressResponses returns a snapshot of all responses this node is sending
+func (gs *GraphSync) InProgressResponses() []graphsync.RequestState {
+	return gs.responseManager.InProgressResponses()
+}
+
 type graphSyncReceiver GraphSync
 
 func (gsr *graphSyncReceiver) graphSync() *GraphSync {
@@ -232,8 +677,8 @@ func (gsr *graphSyncReceiver) ReceiveMessage(
 // errors from the network.
 func (gsr *graphSyncReceiver) ReceiveError(err error) {
 	log.Infof("Graphsync ReceiveError: %s", err)
-	// TODO log the network error
-	// TODO bubble the network error up to the parent context/error logger
+	// a bad inbound stream does not fail any requests: requests only fail when
+	// the peer disconnects or a message to it cannot be sent
 }
 
 // Connected is part of the networks 's Receiver interface and handles peers connecting
@@ -248,4 +693,6 @@ func (gsr *graphSyncReceiver) Connected(p peer.ID) {
 func (gsr *graphSyncReceiver) Disconnected(p peer.ID) {
 	gsr.graphSync().peerManager.Disconnected(p)
 	gsr.graphSync().peerResponseManager.Disconnected(p)
+	gsr.graphSync().requestManager.Disconnected(p)
+	gsr.graphSync().responseManager.Disconnected(p)
 }
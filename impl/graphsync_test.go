@@ -11,6 +11,8 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,7 +41,12 @@ import (
 	"github.com/ipfs/go-graphsync/cidset"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/metrics"
 	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/network/memnet"
+	"github.com/ipfs/go-graphsync/responsemanager"
+	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/testutil"
 	ipld "github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
@@ -235,6 +242,668 @@ func TestGraphsyncRoundTrip(t *testing.T) {
 	require.Equal(t, graphsync.RequestCompletedFull, finalResponseStatus)
 }
 
+func TestGraphsyncRoundTripInMemory(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	// an in memory network needs no libp2p hosts
+	hub, err := memnet.NewHub(ctx, 1, memnet.LinkOptions{Latency: 5 * time.Millisecond, Bandwidth: 1 << 20})
+	require.NoError(t, err)
+	peers := testutil.GeneratePeers(2)
+	network1, err := hub.NewNetwork(peers[0])
+	require.NoError(t, err)
+	network2, err := hub.NewNetwork(peers[1])
+	require.NoError(t, err)
+	blockStore1 := make(map[ipld.Link][]byte)
+	loader1, storer1 := testutil.NewTestStore(blockStore1)
+	blockStore2 := make(map[ipld.Link][]byte)
+	loader2, storer2 := testutil.NewTestStore(blockStore2)
+	requestor := New(ctx, network1, loader1, storer1)
+	New(ctx, network2, loader2, storer2)
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, loader2, storer2, 100, blockChainLength)
+	progressChan, errChan := requestor.Request(ctx, peers[1], blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, blockStore1, blockChainLength, "did not store all blocks")
+
+	// after a disconnect, the next request connects again
+	hub.Disconnect(peers[0], peers[1])
+	progressChan, errChan = requestor.Request(ctx, peers[1], blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+}
+
+func TestNetworkErrorsEndRequestsAndResponses(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	hub, err := memnet.NewHub(ctx, 1, memnet.LinkOptions{Latency: 5 * time.Millisecond})
+	require.NoError(t, err)
+	peers := testutil.GeneratePeers(2)
+	network1, err := hub.NewNetwork(peers[0])
+	require.NoError(t, err)
+	network2, err := hub.NewNetwork(peers[1])
+	require.NoError(t, err)
+	loader1, storer1 := testutil.NewTestStore(make(map[ipld.Link][]byte))
+	loader2, storer2 := testutil.NewTestStore(make(map[ipld.Link][]byte))
+	requestor := New(ctx, network1, loader1, storer1)
+	responder := New(ctx, network2, loader2, storer2)
+	blockChain := testutil.SetupBlockChain(ctx, t, loader2, storer2, 100, 10)
+
+	// hold the response after its first block, until the peers are unlinked
+	blockSent := make(chan struct{}, 1)
+	release := make(chan struct{})
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		select {
+		case blockSent <- struct{}{}:
+			<-release
+		default:
+		}
+	})
+	networkErrors := make(chan error, 1)
+	responder.RegisterNetworkErrorListener(func(p peer.ID, request graphsync.RequestData, err error) {
+		networkErrors <- err
+	})
+
+	// a disconnect ends the request and the response
+	progressChan, errChan := requestor.Request(ctx, peers[1], blockChain.TipLink, blockChain.Selector())
+	testutil.AssertDoesReceive(ctx, t, blockSent, "responder should send a block")
+	hub.Unlink(peers[0], peers[1])
+	// the responder handles messages in order, so once this returns it has
+	// handled the disconnect
+	responder.InProgressResponses()
+	close(release)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Equal(t, []error{graphsync.RequestFailedPeerDisconnectedErr{Peer: peers[1]}}, errs)
+	for range progressChan {
+	}
+	var responderErr error
+	testutil.AssertReceive(ctx, t, networkErrors, &responderErr, "responder should be told of the disconnect")
+	require.Equal(t, graphsync.RequestFailedPeerDisconnectedErr{Peer: peers[0]}, responderErr)
+	require.Eventually(t, func() bool { return len(responder.InProgressResponses()) == 0 }, time.Second, 10*time.Millisecond)
+
+	// a request that cannot be sent fails rather than waiting forever
+	progressChan, errChan = requestor.Request(ctx, peers[1], blockChain.TipLink, blockChain.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	var networkErr graphsync.RequestFailedNetworkErr
+	require.True(t, errors.As(errs[0], &networkErr))
+	require.Equal(t, peers[1], networkErr.Peer)
+}
+
+func TestGraphsyncRoundTripConfiguredLimits(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1(MaxMessageRetries(2), SendMessageTimeout(time.Second))
+	_ = td.GraphSyncHost2(
+		MaxInProcessRequests(1),
+		ThawSpeed(10*time.Millisecond),
+		MaxBlockSize(1000),
+		MaxRecursionDepth(50),
+		// smaller than a batch of blocks, so responses are split
+		MaxMessageSize(600),
+	)
+
+	// a selector within the recursion limit succeeds
+	shortChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 20)
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), shortChain.TipLink, shortChain.Selector())
+	shortChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	// a selector past the recursion limit is rejected
+	longChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 60)
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), longChain.TipLink, longChain.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	testutil.VerifySingleTerminalError(ctx, t, errChan)
+}
+
+func TestGraphsyncRejectsWhenQueueIsFull(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2(MaxInProcessRequests(1), MaxQueuedResponsesPerPeer(1), BusyRetryAfter(500*time.Millisecond))
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 10)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		select {
+		case started <- struct{}{}:
+			<-release
+		default:
+		}
+	})
+
+	// the first request occupies the only worker
+	progressChan1, errChan1 := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.AssertDoesReceive(ctx, t, started, "first response should start")
+
+	// the second waits in the queue, and the third does not fit
+	progressChan2, errChan2 := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	require.Eventually(t, func() bool { return len(responder.InProgressResponses()) == 2 }, time.Second, 10*time.Millisecond)
+	progressChan3, errChan3 := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan3)
+	errs := testutil.CollectErrors(ctx, t, errChan3)
+	require.Equal(t, []error{graphsync.RequestFailedBusyErr{RetryAfter: 500 * time.Millisecond}}, errs)
+
+	close(release)
+	blockChain.VerifyWholeChain(ctx, progressChan1)
+	testutil.VerifyEmptyErrors(ctx, t, errChan1)
+	blockChain.VerifyWholeChain(ctx, progressChan2)
+	testutil.VerifyEmptyErrors(ctx, t, errChan2)
+}
+
+func TestGraphsyncRoundTripBandwidthLimited(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	// a second of bytes goes out at once, and the rest at 5000 bytes a second
+	responder := td.GraphSyncHost2(MaxOutgoingBandwidthPerPeer(5000))
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 1000, 10)
+
+	var paidTier bool
+	var paidTierLk sync.Mutex
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		paidTierLk.Lock()
+		defer paidTierLk.Unlock()
+		if paidTier {
+			hookActions.SetPeerBandwidthLimit(0)
+		}
+	})
+
+	start := time.Now()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(800*time.Millisecond))
+
+	// a hook can lift the limit for a peer
+	paidTierLk.Lock()
+	paidTier = true
+	paidTierLk.Unlock()
+	start = time.Now()
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Less(t, int64(time.Since(start)), int64(800*time.Millisecond))
+}
+
+func TestGraphsyncBandwidthLimitedResponseFreesWorker(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// a single worker, and a limit that holds the first peer back for about a
+	// second once it has used its burst
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2(MaxInProcessRequests(1), MaxOutgoingBandwidthPerPeer(5000))
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 1000, 10)
+
+	host3, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	err = td.mn.LinkAll()
+	require.NoError(t, err, "error linking hosts")
+	loader3, storer3 := testutil.NewTestStore(make(map[ipld.Link][]byte))
+	requestor3 := New(ctx, gsnet.NewFromLibp2pHost(host3), loader3, storer3)
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		if p == host3.ID() {
+			hookActions.SetPeerBandwidthLimit(0)
+		}
+	})
+
+	start := time.Now()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, 6)
+
+	// the throttled response does not hold on to the only worker
+	progressChan3, errChan3 := requestor3.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan3)
+	testutil.VerifyEmptyErrors(ctx, t, errChan3)
+	require.Less(t, int64(time.Since(start)), int64(800*time.Millisecond))
+
+	blockChain.VerifyRemainder(ctx, progressChan, 6)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(800*time.Millisecond))
+}
+
+func TestGraphsyncRoundTripSeparateControlStream(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	stallingNetwork := newStallingNetwork(td.gsnet2)
+	td.gsnet2 = stallingNetwork
+
+	// each peer requests from and responds to the other at the same time
+	gs1 := td.GraphSyncHost1(SeparateControlStream())
+	gs2 := td.GraphSyncHost2(SeparateControlStream())
+	blockChain1 := testutil.SetupBlockChain(ctx, t, td.loader1, td.storer1, 100, 50)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 50)
+
+	progressChan1, errChan1 := gs1.Request(ctx, td.host2.ID(), blockChain2.TipLink, blockChain2.Selector())
+	testutil.AssertDoesReceive(ctx, t, stallingNetwork.stalled, "response should get stuck sending")
+
+	// the stuck response does not hold up a request to the same peer
+	progressChan2, errChan2 := gs2.Request(ctx, td.host1.ID(), blockChain1.TipLink, blockChain1.Selector())
+	blockChain1.VerifyWholeChain(ctx, progressChan2)
+	testutil.VerifyEmptyErrors(ctx, t, errChan2)
+
+	close(stallingNetwork.release)
+	blockChain2.VerifyWholeChain(ctx, progressChan1)
+	testutil.VerifyEmptyErrors(ctx, t, errChan1)
+
+	// cancelling a request goes over the control stream
+	responderCancelled := make(chan struct{}, 1)
+	gs2.RegisterRequestorCancelledListener(func(p peer.ID, request graphsync.RequestData) {
+		select {
+		case responderCancelled <- struct{}{}:
+		default:
+		}
+	})
+	gs2.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		hookActions.PauseResponse()
+	})
+	// use a chain the requestor does not already have, so the request cannot be
+	// fulfilled locally before it is cancelled
+	blockChain3 := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 10)
+	requestCtx, requestCancel := context.WithCancel(ctx)
+	progressChan, errChan := gs1.Request(requestCtx, td.host2.ID(), blockChain3.TipLink, blockChain3.Selector())
+	testutil.AssertDoesReceive(ctx, t, progressChan, "should receive first block")
+	requestCancel()
+	testutil.AssertDoesReceive(ctx, t, responderCancelled, "responder should see cancel")
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+}
+
+func TestGraphsyncRoundTripSharedStreamHeadOfLine(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	stallingNetwork := newStallingNetwork(td.gsnet2)
+	td.gsnet2 = stallingNetwork
+
+	gs1 := td.GraphSyncHost1()
+	gs2 := td.GraphSyncHost2()
+	blockChain1 := testutil.SetupBlockChain(ctx, t, td.loader1, td.storer1, 100, 5)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 5)
+
+	progressChan1, errChan1 := gs1.Request(ctx, td.host2.ID(), blockChain2.TipLink, blockChain2.Selector())
+	testutil.AssertDoesReceive(ctx, t, stallingNetwork.stalled, "response should get stuck sending")
+
+	// with a single stream, a request waits behind the stuck response
+	requestCtx, requestCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer requestCancel()
+	progressChan2, _ := gs2.Request(requestCtx, td.host1.ID(), blockChain1.TipLink, blockChain1.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan2)
+
+	close(stallingNetwork.release)
+	blockChain2.VerifyWholeChain(ctx, progressChan1)
+	testutil.VerifyEmptyErrors(ctx, t, errChan1)
+}
+
+func TestStalledRequestsAndIdleResponses(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1(RequestInactivityTimeout(100 * time.Millisecond))
+	responder := td.GraphSyncHost2(PausedResponseIdleTimeout(300 * time.Millisecond))
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 5)
+
+	// the responder pauses every response, and never unpauses
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.PauseResponse()
+	})
+	requestorCancelled := make(chan struct{}, 1)
+	responder.RegisterRequestorCancelledListener(func(p peer.ID, request graphsync.RequestData) {
+		requestorCancelled <- struct{}{}
+	})
+	completedStatuses := make(chan graphsync.ResponseStatusCode, 1)
+	responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+		completedStatuses <- status
+	})
+
+	// the requestor gives up on the silent responder first
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Equal(t, []error{graphsync.RequestStalledErr{Peer: td.host2.ID(), Timeout: 100 * time.Millisecond}}, errs)
+	testutil.AssertDoesReceive(ctx, t, requestorCancelled, "responder should receive the cancel")
+
+	// without a timeout on the request, the responder cancels the paused response
+	requestor.RegisterOutgoingRequestHook(func(p peer.ID, request graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseInactivityTimeout(time.Hour)
+	})
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	require.Equal(t, []error{graphsync.RequestCancelledErr{}}, errs)
+	var status graphsync.ResponseStatusCode
+	testutil.AssertReceive(ctx, t, completedStatuses, &status, "responder should finish the response")
+	require.Equal(t, graphsync.RequestCancelled, status)
+}
+
+func TestProtectsConnectionsDuringTransfers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	cm1 := testutil.NewTestConnManager()
+	cm2 := testutil.NewTestConnManager()
+	td.gsnet1 = gsnet.NewFromLibp2pHost(testutil.HostWithConnManager(td.host1, cm1), gsnet.ProtectActiveTransfers(10))
+	td.gsnet2 = gsnet.NewFromLibp2pHost(testutil.HostWithConnManager(td.host2, cm2), gsnet.ProtectActiveTransfers(10))
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2()
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, 5)
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.PauseResponse()
+	})
+
+	// both sides protect the connection while the response is paused
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	var responseStates []graphsync.RequestState
+	require.Eventually(t, func() bool {
+		responseStates = responder.InProgressResponses()
+		return len(responseStates) == 1 && responseStates[0].Paused
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, cm1.IsProtected(td.host2.ID(), ""))
+	require.True(t, cm2.IsProtected(td.host1.ID(), ""))
+
+	// and release it once the transfer completes
+	require.NoError(t, responder.UnpauseResponse(td.host1.ID(), responseStates[0].RequestID))
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Eventually(t, func() bool {
+		return !cm1.IsProtected(td.host2.ID(), "") && !cm2.IsProtected(td.host1.ID(), "")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestInvalidOptionsKeepDefaults(t *testing.T) {
+	gs := &GraphSync{
+		maxInProcessRequests: responsemanager.DefaultMaxInProcessRequests,
+		thawSpeed:            responsemanager.DefaultThawSpeed,
+		maxBlockSize:         peerresponsemanager.DefaultMaxBlockSize,
+		maxMessageRetries:    messagequeue.DefaultMaxRetries,
+		maxRecursionDepth:    defaultMaxRecursionDepth,
+		sendMessageTimeout:   gsnet.DefaultSendMessageTimeout,
+		maxMessageSize:       messagequeue.DefaultMaxMessageSize,
+		busyRetryAfter:       responsemanager.DefaultBusyRetryAfter,
+	}
+	defaults := *gs
+	invalidOptions := []Option{
+		MaxInProcessRequests(0),
+		ThawSpeed(-time.Second),
+		MaxBlockSize(0),
+		MaxMessageRetries(0),
+		MaxRecursionDepth(-1),
+		SendMessageTimeout(0),
+		MaxMessageSize(0),
+		MaxQueuedResponses(0),
+		MaxQueuedResponsesPerPeer(-1),
+		BusyRetryAfter(-time.Second),
+		MaxOutgoingBandwidth(0),
+		MaxOutgoingBandwidthPerPeer(0),
+		RequestInactivityTimeout(0),
+		PausedResponseIdleTimeout(-time.Second),
+		MaxUnverifiedBlockMemory(0),
+		SpillUnverifiedBlocks(""),
+	}
+	for _, option := range invalidOptions {
+		option(gs)
+	}
+	require.Equal(t, defaults, *gs)
+
+	MaxInProcessRequests(1)(gs)
+	require.Equal(t, 1, gs.maxInProcessRequests)
+	BusyRetryAfter(0)(gs)
+	require.Equal(t, time.Duration(0), gs.busyRetryAfter)
+}
+
+func TestGraphsyncRoundTripMultiplePeers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup both responders with the same chain
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+	host3, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	err = td.mn.LinkAll()
+	require.NoError(t, err, "error linking hosts")
+	blockStore3 := make(map[ipld.Link][]byte, len(td.blockStore2))
+	for link, data := range td.blockStore2 {
+		blockStore3[link] = data
+	}
+	loader3, storer3 := testutil.NewTestStore(blockStore3)
+
+	responder2 := td.GraphSyncHost2()
+	responder3 := New(ctx, gsnet.NewFromLibp2pHost(host3), loader3, storer3)
+
+	var sentLk sync.Mutex
+	sent := make(map[peer.ID]int)
+	countSent := func(responder graphsync.GraphExchange, p peer.ID) {
+		responder.RegisterOutgoingBlockHook(func(_ peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+			if blockData.BlockSizeOnWire() > 0 {
+				sentLk.Lock()
+				sent[p]++
+				sentLk.Unlock()
+			}
+		})
+	}
+	countSent(responder2, td.host2.ID())
+	countSent(responder3, host3.ID())
+
+	progressChan, errChan := requestor.RequestFromPeers(ctx, []peer.ID{td.host2.ID(), host3.ID()}, blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	// verify the blocks were split between the responders
+	sentLk.Lock()
+	defer sentLk.Unlock()
+	require.NotZero(t, sent[td.host2.ID()])
+	require.NotZero(t, sent[host3.ID()])
+	require.Equal(t, blockChainLength, sent[td.host2.ID()]+sent[host3.ID()])
+}
+
+func TestGraphsyncRoundTripAdditionalPeers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// the mirror has the chain, and the seed sends requestors to it
+	blockChainLength := 100
+	host3, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	err = td.mn.LinkAll()
+	require.NoError(t, err, "error linking hosts")
+	blockStore3 := make(map[ipld.Link][]byte)
+	loader3, storer3 := testutil.NewTestStore(blockStore3)
+	blockChain := testutil.SetupBlockChain(ctx, t, loader3, storer3, 100, blockChainLength)
+	New(ctx, gsnet.NewFromLibp2pHost(host3), loader3, storer3)
+
+	mirror := peer.AddrInfo{ID: host3.ID(), Addrs: host3.Addrs()}
+	seed := td.GraphSyncHost2()
+	seed.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.SendAdditionalPeers(mirror)
+		hookActions.TerminateWithError(errors.New("overloaded"))
+	})
+
+	requestor.RegisterOutgoingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.FollowAdditionalPeers()
+	})
+	suggested := make(chan []peer.AddrInfo, 1)
+	requestor.RegisterAdditionalPeersListener(func(p peer.ID, response graphsync.ResponseData, peers []peer.AddrInfo) {
+		require.Equal(t, td.host2.ID(), p)
+		suggested <- peers
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	var suggestedPeers []peer.AddrInfo
+	testutil.AssertReceive(ctx, t, suggested, &suggestedPeers, "should hear about the mirror")
+	require.Equal(t, []peer.AddrInfo{mirror}, suggestedPeers)
+}
+
+func TestGraphsyncResumePersistedRequest(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests, persisting them
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	requestorCtx, requestorCancel := context.WithCancel(ctx)
+	requestor := New(requestorCtx, td.gsnet1, td.loader1, td.storer1, PersistRequests(ds))
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, stalling
+	// the first request half way through
+	responder := td.GraphSyncHost2()
+	stopPoint := 50
+	var sentLk sync.Mutex
+	firstRunSent := 0
+	blocksSent := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		sentLk.Lock()
+		defer sentLk.Unlock()
+		if p == td.host1.ID() {
+			firstRunSent++
+			if firstRunSent == stopPoint {
+				hookActions.PauseResponse()
+			}
+			return
+		}
+		if blockData.BlockSizeOnWire() > 0 {
+			blocksSent++
+		}
+	})
+
+	progressChan, _ := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+
+	persistedRequests, err := requestor.PersistedRequests()
+	require.NoError(t, err)
+	require.Len(t, persistedRequests, 1)
+	persistedRequest := persistedRequests[0]
+	require.Equal(t, td.host2.ID(), persistedRequest.Peer)
+	require.Equal(t, blockChain.TipLink, persistedRequest.Root)
+	require.GreaterOrEqual(t, persistedRequest.BlocksReceived, stopPoint)
+
+	// restart the requestor on a new host, with the same datastore
+	requestorCancel()
+	host3, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	err = td.mn.LinkAll()
+	require.NoError(t, err, "error linking hosts")
+	requestor = New(ctx, gsnet.NewFromLibp2pHost(host3), td.loader1, td.storer1, PersistRequests(ds))
+
+	progressChan, errChan := requestor.ResumeRequest(ctx, persistedRequest.ID)
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	// only the blocks missing from the first attempt were sent again
+	sentLk.Lock()
+	require.Equal(t, blockChainLength-persistedRequest.BlocksReceived, blocksSent)
+	sentLk.Unlock()
+
+	// completed requests are no longer persisted
+	require.Eventually(t, func() bool {
+		persistedRequests, err := requestor.PersistedRequests()
+		return err == nil && len(persistedRequests) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGraphsyncRoundTripMetrics(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestorMetrics := metrics.NewInMemory()
+	requestor := td.GraphSyncHost1(UseMetrics(requestorMetrics))
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responderMetrics := metrics.NewInMemory()
+	td.GraphSyncHost2(UseMetrics(responderMetrics))
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	require.Eventually(t, func() bool {
+		return requestorMetrics.Snapshot().RequestsCompleted[graphsync.RequestCompletedFull] == 1 &&
+			responderMetrics.Snapshot().ResponsesCompleted[graphsync.RequestCompletedFull] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	requestorSnapshot := requestorMetrics.Snapshot()
+	require.Equal(t, uint64(1), requestorSnapshot.RequestsStarted)
+	require.Equal(t, uint64(blockChainLength), requestorSnapshot.BlocksReceived)
+	require.Zero(t, requestorSnapshot.BlocksLoadedLocally)
+	require.NotZero(t, requestorSnapshot.BytesReceived)
+	require.NotZero(t, requestorSnapshot.MessagesSent)
+
+	responderSnapshot := responderMetrics.Snapshot()
+	require.Equal(t, uint64(1), responderSnapshot.ResponsesStarted)
+	require.Equal(t, uint64(blockChainLength), responderSnapshot.BlocksSent)
+	require.Equal(t, requestorSnapshot.BytesReceived, responderSnapshot.BytesSent)
+	require.Equal(t, 1, responderSnapshot.MaxResponsesWaiting)
+	require.Equal(t, 0, responderSnapshot.ResponsesWaiting)
+	require.NotZero(t, responderSnapshot.MessagesSent)
+}
+
 func TestGraphsyncRoundTripPartial(t *testing.T) {
 	// create network
 	ctx := context.Background()
@@ -243,48 +912,225 @@ func TestGraphsyncRoundTripPartial(t *testing.T) {
 	td := newGsTestData(ctx, t)
 
 	// initialize graphsync on first node to make requests
-	requestor := td.GraphSyncHost1()
+	requestor := td.GraphSyncHost1()
+
+	// setup an IPLD tree and put all but 1 node into the second nodes block store
+	tree := testutil.NewTestIPLDTree()
+	td.blockStore2[tree.LeafAlphaLnk] = tree.LeafAlphaBlock.RawData()
+	td.blockStore2[tree.MiddleMapNodeLnk] = tree.MiddleMapBlock.RawData()
+	td.blockStore2[tree.MiddleListNodeLnk] = tree.MiddleListBlock.RawData()
+	td.blockStore2[tree.RootNodeLnk] = tree.RootBlock.RawData()
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
+	responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+		select {
+		case finalResponseStatusChan <- status:
+		default:
+		}
+	})
+	// create a selector to traverse the whole tree
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	allSelector := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	_, errChan := requestor.Request(ctx, td.host2.ID(), tree.RootNodeLnk, allSelector)
+
+	for err := range errChan {
+		// verify the error is received for leaf beta node being missing
+		require.EqualError(t, err, fmt.Sprintf("Remote Peer Is Missing Block: %s", tree.LeafBetaLnk.String()))
+	}
+	require.Equal(t, tree.LeafAlphaBlock.RawData(), td.blockStore1[tree.LeafAlphaLnk])
+	require.Equal(t, tree.MiddleListBlock.RawData(), td.blockStore1[tree.MiddleListNodeLnk])
+	require.Equal(t, tree.MiddleMapBlock.RawData(), td.blockStore1[tree.MiddleMapNodeLnk])
+	require.Equal(t, tree.RootBlock.RawData(), td.blockStore1[tree.RootNodeLnk])
+
+	// verify listener
+	var finalResponseStatus graphsync.ResponseStatusCode
+	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
+	require.Equal(t, graphsync.RequestCompletedPartial, finalResponseStatus)
+}
+
+func TestGraphsyncRoundTripBudget(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+	responder := td.GraphSyncHost2()
+
+	requestor.RegisterOutgoingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseBudget(graphsync.Budget{MaxBlocks: 20})
+	})
+	finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
+	responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+		select {
+		case finalResponseStatusChan <- status:
+		default:
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.NotEmpty(t, errs, "blocks past the budget should be missing")
+
+	var finalResponseStatus graphsync.ResponseStatusCode
+	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
+	require.Equal(t, graphsync.RequestCompletedPartial, finalResponseStatus)
+	require.Len(t, td.blockStore1, 20, "should only store blocks within the budget")
+}
+
+func TestGraphsyncRoundTripIgnoreCids(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	firstHalf := blockChain.Blocks(0, 50)
+	set := cid.NewSet()
+	for _, blk := range firstHalf {
+		td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+		set.Add(blk.Cid())
+	}
+	encodedCidSet, err := cidset.EncodeCidSet(set)
+	require.NoError(t, err)
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionDoNotSendCIDs,
+		Data: encodedCidSet,
+	}
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	totalSent := 0
+	totalSentOnWire := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		totalSent++
+		if blockData.BlockSizeOnWire() > 0 {
+			totalSentOnWire++
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), extension)
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	require.Equal(t, blockChainLength, totalSent)
+	require.Equal(t, blockChainLength-set.Len(), totalSentOnWire)
+}
+
+func TestGraphsyncRoundTripRawBlocks(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// initialize graphsync on second node to response to requests
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// the requestor already has the first few blocks
+	for _, blk := range blockChain.Blocks(0, 10) {
+		td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+	}
+
+	blocksChan, errChan := requestor.RequestBlocks(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	var received []graphsync.RawBlock
+	for rawBlock := range blocksChan {
+		received = append(received, rawBlock)
+	}
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, received, blockChainLength)
+	for i, blk := range blockChain.AllBlocks() {
+		require.Equal(t, blk.Cid(), received[i].Cid)
+		require.Equal(t, blk.RawData(), received[i].Data)
+		require.Equal(t, i < 10, received[i].Local)
+	}
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+}
+
+func TestGraphsyncRoundTripResolveLocallyFirst(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1(ResolveLocallyFirst())
 
-	// setup an IPLD tree and put all but 1 node into the second nodes block store
-	tree := testutil.NewTestIPLDTree()
-	td.blockStore2[tree.LeafAlphaLnk] = tree.LeafAlphaBlock.RawData()
-	td.blockStore2[tree.MiddleMapNodeLnk] = tree.MiddleMapBlock.RawData()
-	td.blockStore2[tree.MiddleListNodeLnk] = tree.MiddleListBlock.RawData()
-	td.blockStore2[tree.RootNodeLnk] = tree.RootBlock.RawData()
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// the requestor already has the first half of the chain
+	firstHalf := blockChain.Blocks(0, 50)
+	for _, blk := range firstHalf {
+		td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+	}
 
 	// initialize graphsync on second node to response to requests
 	responder := td.GraphSyncHost2()
 
-	finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
-	responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
-		select {
-		case finalResponseStatusChan <- status:
-		default:
+	requestsReceived := 0
+	var doNotSendCids *cid.Set
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		requestsReceived++
+		if data, has := requestData.Extension(graphsync.ExtensionDoNotSendCIDs); has {
+			doNotSendCids, _ = cidset.DecodeCidSet(data)
+		}
+		hookActions.ValidateRequest()
+	})
+	totalSentOnWire := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			totalSentOnWire++
 		}
 	})
-	// create a selector to traverse the whole tree
-	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
-	allSelector := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
-		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
 
-	_, errChan := requestor.Request(ctx, td.host2.ID(), tree.RootNodeLnk, allSelector)
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
 
-	for err := range errChan {
-		// verify the error is received for leaf beta node being missing
-		require.EqualError(t, err, fmt.Sprintf("Remote Peer Is Missing Block: %s", tree.LeafBetaLnk.String()))
-	}
-	require.Equal(t, tree.LeafAlphaBlock.RawData(), td.blockStore1[tree.LeafAlphaLnk])
-	require.Equal(t, tree.MiddleListBlock.RawData(), td.blockStore1[tree.MiddleListNodeLnk])
-	require.Equal(t, tree.MiddleMapBlock.RawData(), td.blockStore1[tree.MiddleMapNodeLnk])
-	require.Equal(t, tree.RootBlock.RawData(), td.blockStore1[tree.RootNodeLnk])
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
 
-	// verify listener
-	var finalResponseStatus graphsync.ResponseStatusCode
-	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
-	require.Equal(t, graphsync.RequestCompletedPartial, finalResponseStatus)
+	// the request went out once the requestor ran out of local blocks
+	require.Equal(t, 1, requestsReceived)
+	require.NotNil(t, doNotSendCids)
+	require.Equal(t, len(firstHalf), doNotSendCids.Len())
+	require.Equal(t, blockChainLength-len(firstHalf), totalSentOnWire)
+
+	// a request for blocks the requestor has is never sent
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Equal(t, 1, requestsReceived)
 }
 
-func TestGraphsyncRoundTripIgnoreCids(t *testing.T) {
+func TestGraphsyncRoundTripCoalesceRequests(t *testing.T) {
 	// create network
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
@@ -292,45 +1138,165 @@ func TestGraphsyncRoundTripIgnoreCids(t *testing.T) {
 	td := newGsTestData(ctx, t)
 
 	// initialize graphsync on first node to make requests
-	requestor := td.GraphSyncHost1()
+	requestor := td.GraphSyncHost1(CoalesceRequests(time.Second))
 
-	// setup receiving peer to just record message coming in
 	blockChainLength := 100
 	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
 
-	firstHalf := blockChain.Blocks(0, 50)
-	set := cid.NewSet()
-	for _, blk := range firstHalf {
-		td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
-		set.Add(blk.Cid())
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	requestsReceived := 0
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		requestsReceived++
+		hookActions.ValidateRequest()
+	})
+
+	// callers read the shared response as it arrives, so none falls behind
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses := testutil.CollectResponses(ctx, t, progressChan)
+			blockChain.VerifyWholeChainSync(responses)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+		}()
 	}
-	encodedCidSet, err := cidset.EncodeCidSet(set)
+	wg.Wait()
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	// the responder only received one request
+	require.Equal(t, 1, requestsReceived)
+}
+
+func TestGraphsyncRoundTripUnverifiedBlockMemoryLimit(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	spillDir, err := ioutil.TempDir("", "graphsync-test")
 	require.NoError(t, err)
-	extension := graphsync.ExtensionData{
-		Name: graphsync.ExtensionDoNotSendCIDs,
-		Data: encodedCidSet,
-	}
+	defer os.RemoveAll(spillDir)
+
+	// initialize graphsync on first node to make requests, with room for only
+	// a few blocks that have not been traversed
+	requestor := td.GraphSyncHost1(MaxUnverifiedBlockMemory(1000), SpillUnverifiedBlocks(spillDir))
+	// the traversal falls behind the blocks coming in
+	requestor.RegisterIncomingBlockHook(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		time.Sleep(time.Millisecond)
+	})
 
 	// initialize graphsync on second node to response to requests
-	responder := td.GraphSyncHost2()
+	_ = td.GraphSyncHost2(MaxMessageSize(1000))
 
-	totalSent := 0
-	totalSentOnWire := 0
-	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
-		totalSent++
-		if blockData.BlockSizeOnWire() > 0 {
-			totalSentOnWire++
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 500, blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	// no blocks are left on disk
+	err = filepath.Walk(spillDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
+		require.True(t, info.IsDir(), "spilled block should be removed")
+		return nil
 	})
+	require.NoError(t, err)
+}
 
-	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), extension)
+func TestGraphsyncRoundTripUnverifiedBlockMemoryLimitFromPeers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests, with room for only
+	// a few blocks that have not been traversed and nowhere to spill the rest
+	requestor := td.GraphSyncHost1(MaxUnverifiedBlockMemory(1000))
+	// the traversal falls behind the blocks coming in
+	requestor.RegisterIncomingBlockHook(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		time.Sleep(time.Millisecond)
+	})
+
+	// both responders have the chain
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 500, blockChainLength)
+	host3, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	err = td.mn.LinkAll()
+	require.NoError(t, err, "error linking hosts")
+	blockStore3 := make(map[ipld.Link][]byte, len(td.blockStore2))
+	for link, data := range td.blockStore2 {
+		blockStore3[link] = data
+	}
+	loader3, storer3 := testutil.NewTestStore(blockStore3)
+	_ = td.GraphSyncHost2(MaxMessageSize(1000))
+	New(ctx, gsnet.NewFromLibp2pHost(host3), loader3, storer3, MaxMessageSize(1000))
+
+	progressChan, errChan := requestor.RequestFromPeers(ctx, []peer.ID{td.host2.ID(), host3.ID()}, blockChain.TipLink, blockChain.Selector())
 
 	blockChain.VerifyWholeChain(ctx, progressChan)
 	testutil.VerifyEmptyErrors(ctx, t, errChan)
 	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+}
 
-	require.Equal(t, blockChainLength, totalSent)
-	require.Equal(t, blockChainLength-set.Len(), totalSentOnWire)
+func TestUnverifiedBlockMemoryLimitWithPausedRequest(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests, with room for only
+	// a few blocks that have not been traversed
+	requestor := td.GraphSyncHost1(MaxUnverifiedBlockMemory(1000))
+
+	// initialize graphsync on second node to response to requests
+	_ = td.GraphSyncHost2(MaxMessageSize(1000))
+
+	blockChainLength := 100
+	pausedChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 500, blockChainLength)
+	otherChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 500, blockChainLength)
+
+	// the first request pauses partway through, while the responder has sent
+	// blocks it has not reached yet
+	stopPoint := 10
+	pausedRequestID := make(chan graphsync.RequestID, 1)
+	var blocksReceived int32
+	requestor.RegisterIncomingBlockHook(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		if atomic.AddInt32(&blocksReceived, 1) == int32(stopPoint) {
+			pausedRequestID <- responseData.RequestID()
+			hookActions.PauseRequest()
+		}
+	})
+	pausedProgress, pausedErrs := requestor.Request(ctx, td.host2.ID(), pausedChain.TipLink, pausedChain.Selector())
+	pausedChain.VerifyResponseRange(ctx, pausedProgress, 0, stopPoint-1)
+	var requestID graphsync.RequestID
+	testutil.AssertReceive(ctx, t, pausedRequestID, &requestID, "request should pause")
+
+	// the paused request lets go of its blocks, and does not hold up another
+	// request
+	asyncLoader := requestor.(*GraphSync).asyncLoader
+	require.Eventually(t, func() bool { return !asyncLoader.AtMemoryLimit() }, time.Second, 10*time.Millisecond)
+	otherProgress, otherErrs := requestor.Request(ctx, td.host2.ID(), otherChain.TipLink, otherChain.Selector())
+	otherChain.VerifyWholeChain(ctx, otherProgress)
+	testutil.VerifyEmptyErrors(ctx, t, otherErrs)
+
+	err := requestor.UnpauseRequest(requestID)
+	require.NoError(t, err)
+	pausedChain.VerifyRemainder(ctx, pausedProgress, stopPoint-1)
+	testutil.VerifyEmptyErrors(ctx, t, pausedErrs)
+	require.Len(t, td.blockStore1, 2*blockChainLength, "did not store all blocks")
 }
 
 func TestPauseResume(t *testing.T) {
@@ -384,6 +1350,163 @@ func TestPauseResume(t *testing.T) {
 	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
 
 }
+func TestInProgressRequestsAndResponses(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	stopPoint := 50
+	blocksSent := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		blocksSent++
+		if blocksSent == stopPoint {
+			hookActions.PauseResponse()
+		}
+	})
+
+	beforeStart := time.Now()
+	require.Empty(t, requestor.InProgressRequests())
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+
+	requestStates := requestor.InProgressRequests()
+	require.Len(t, requestStates, 1)
+	requestState := requestStates[0]
+	require.Equal(t, td.host2.ID(), requestState.Peer)
+	require.Equal(t, blockChain.TipLink, requestState.Root)
+	require.False(t, requestState.Paused)
+	require.Equal(t, uint64(stopPoint), requestState.Blocks)
+	require.NotZero(t, requestState.Bytes)
+	require.False(t, requestState.StartTime.Before(beforeStart))
+
+	var responseState graphsync.RequestState
+	require.Eventually(t, func() bool {
+		responseStates := responder.InProgressResponses()
+		if len(responseStates) != 1 {
+			return false
+		}
+		responseState = responseStates[0]
+		return responseState.Paused
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, td.host1.ID(), responseState.Peer)
+	require.Equal(t, requestState.RequestID, responseState.RequestID)
+	require.Equal(t, blockChain.TipLink, responseState.Root)
+	require.Equal(t, requestState.Blocks, responseState.Blocks)
+	require.Equal(t, requestState.Bytes, responseState.Bytes)
+
+	err := responder.UnpauseResponse(td.host1.ID(), responseState.RequestID)
+	require.NoError(t, err)
+	blockChain.VerifyRemainder(ctx, progressChan, stopPoint)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	require.Eventually(t, func() bool {
+		return len(requestor.InProgressRequests()) == 0 && len(responder.InProgressResponses()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestShutdownFinishesActiveResponses(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	// shutdown the responder once the response is under way
+	blocksSent := 0
+	started := make(chan struct{}, 1)
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		blocksSent++
+		if blocksSent == 10 {
+			started <- struct{}{}
+		}
+	})
+	shutdownErr := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-started:
+			shutdownErr <- responder.Shutdown(ctx)
+		}
+	}()
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	var err error
+	testutil.AssertReceive(ctx, t, shutdownErr, &err, "shutdown should complete")
+	require.NoError(t, err)
+
+	// new requests fail once shutdown
+	_, errChan = responder.Request(ctx, td.host1.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.VerifySingleTerminalError(ctx, t, errChan)
+}
+
+func TestShutdownCancelsUnfinishedResponses(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, pausing
+	// half way so the response cannot finish
+	responder := td.GraphSyncHost2()
+	stopPoint := 50
+	blocksSent := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		blocksSent++
+		if blocksSent == stopPoint {
+			hookActions.PauseResponse()
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shutdownCancel()
+	err := responder.Shutdown(shutdownCtx)
+	require.EqualError(t, err, context.DeadlineExceeded.Error())
+
+	// the requestor is told the response was cancelled
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.RequestCancelledErr{}, errs[0])
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+}
+
 func TestPauseResumeRequest(t *testing.T) {
 	// create network
 	ctx := context.Background()
@@ -870,6 +1993,50 @@ func (td *gsTestData) GraphSyncHost2(options ...Option) graphsync.GraphExchange
 	return New(td.ctx, td.gsnet2, td.loader2, td.storer2, options...)
 }
 
+// stallingNetwork holds up the first message with blocks each of its senders
+// sends until released, as if the stream carrying it were congested
+type stallingNetwork struct {
+	gsnet.GraphSyncNetwork
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func newStallingNetwork(network gsnet.GraphSyncNetwork) *stallingNetwork {
+	return &stallingNetwork{
+		GraphSyncNetwork: network,
+		stalled:          make(chan struct{}, 1),
+		release:          make(chan struct{}),
+	}
+}
+
+func (sn *stallingNetwork) NewMessageSender(ctx context.Context, p peer.ID) (gsnet.MessageSender, error) {
+	sender, err := sn.GraphSyncNetwork.NewMessageSender(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &stallingMessageSender{sender, sn}, nil
+}
+
+type stallingMessageSender struct {
+	gsnet.MessageSender
+	sn *stallingNetwork
+}
+
+func (sms *stallingMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	if len(msg.Blocks()) > 0 {
+		select {
+		case sms.sn.stalled <- struct{}{}:
+		default:
+		}
+		select {
+		case <-sms.sn.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return sms.MessageSender.SendMsg(ctx, msg)
+}
+
 type receivedMessage struct {
 	message gsmsg.GraphSyncMessage
 	sender  peer.ID
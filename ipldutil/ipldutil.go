@@ -3,6 +3,7 @@ package ipldutil
 import (
 	"bytes"
 	"context"
+	"errors"
 
 	ipld "github.com/ipld/go-ipld-prime"
 	dagpb "github.com/ipld/go-ipld-prime-proto"
@@ -12,6 +13,9 @@ import (
 	ipldtraversal "github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/shared"
+	"github.com/polydawn/refmt/tok"
 )
 
 var (
@@ -56,14 +60,53 @@ func EncodeNode(node ipld.Node) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// DecodeNode decodes DAG-CBOR data into a node. Lists and maps are checked
+// against the data that remains as they are decoded, so short, malformed data
+// cannot make the decoder allocate far more than it was given
 func DecodeNode(encoded []byte) (ipld.Node, error) {
+	r := bytes.NewReader(encoded)
 	nb := basicnode.Style.Any.NewBuilder()
-	if err := dagcbor.Decoder(nb, bytes.NewReader(encoded)); err != nil {
+	err := dagcbor.Unmarshal(nb, &boundedTokenSource{cbor.NewDecoder(cbor.DecodeOptions{}, r), r})
+	if err != nil {
 		return nil, err
 	}
 	return nb.Build(), nil
 }
 
+// boundedTokenSource checks tokens before the node builder sees them. The
+// builder allocates lists and maps at their declared length, and every item
+// takes at least a byte, so a list or map cannot hold more items than there
+// are bytes left to read.
+type boundedTokenSource struct {
+	tokens    shared.TokenSource
+	remaining *bytes.Reader
+}
+
+func (bts *boundedTokenSource) Step(tk *tok.Token) (bool, error) {
+	done, err := bts.tokens.Step(tk)
+	if err != nil {
+		return done, err
+	}
+	switch tk.Type {
+	case tok.TArrOpen, tok.TMapOpen:
+		items := tk.Length
+		if tk.Type == tok.TMapOpen {
+			items *= 2
+		}
+		if tk.Length < 0 {
+			return done, errors.New("malformed DAG-CBOR data: indefinite length")
+		}
+		if tk.Length > bts.remaining.Len() || items > bts.remaining.Len() {
+			return done, errors.New("malformed DAG-CBOR data: declared length exceeds data")
+		}
+	case tok.TBytes:
+		if tk.Tagged && len(tk.Bytes) == 0 {
+			return done, errors.New("malformed DAG-CBOR data: empty link")
+		}
+	}
+	return done, nil
+}
+
 func ParseSelector(selector ipld.Node) (selector.Selector, error) {
 	return ipldselector.ParseSelector(selector)
 }
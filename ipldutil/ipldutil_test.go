@@ -0,0 +1,44 @@
+package ipldutil
+
+import (
+	"testing"
+
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeNode(t *testing.T) {
+	node := fluent.MustBuildMap(basicnode.Style.Map, 3, func(na fluent.MapAssembler) {
+		na.AssembleEntry("list").CreateList(2, func(la fluent.ListAssembler) {
+			la.AssembleValue().AssignInt(1)
+			la.AssembleValue().AssignString("two")
+		})
+		na.AssembleEntry("bytes").AssignBytes([]byte{1, 2, 3})
+		na.AssembleEntry("float").AssignFloat(1.5)
+	})
+	encoded, err := EncodeNode(node)
+	require.NoError(t, err)
+	decoded, err := DecodeNode(encoded)
+	require.NoError(t, err)
+	reencoded, err := EncodeNode(decoded)
+	require.NoError(t, err)
+	require.Equal(t, encoded, reencoded)
+
+	malformed := map[string][]byte{
+		"empty":                    {},
+		"huge list":                {0x9b, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00},
+		"huge map":                 {0xbb, 0x0f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"huge bytes":               {0x5a, 0xff, 0xff, 0xff, 0xff},
+		"list longer than data":    {0x83, 0x01, 0x02},
+		"truncated length":         {0x19, 0x01},
+		"indefinite length":        {0x9f, 0x01, 0xff},
+		"nested list after string": {0x82, 0x61, 0x61, 0x99, 0xff, 0xff},
+		"empty link":               {0xd8, 0x2a, 0x40},
+		"map longer than data":     {0xa2, 0x61, 0x61, 0x01},
+	}
+	for name, data := range malformed {
+		_, err := DecodeNode(data)
+		require.Error(t, err, name)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"testing"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync"
@@ -71,6 +72,24 @@ func TestTraverser(t *testing.T) {
 		close(inProgressChan)
 		testutil.AssertDoesReceive(ctx, t, done, "should have completed verification but did not")
 	})
+
+	t.Run("shuts down when started with a cancelled context", func(t *testing.T) {
+		testdata := testutil.NewTestIPLDTree()
+		ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, time.Second)
+		defer shutdownCancel()
+		// whether the traversal starts at all is racy, so try several times
+		for i := 0; i < 20; i++ {
+			traverser := TraversalBuilder{
+				Root:     testdata.RootNodeLnk,
+				Selector: ssb.Matcher().Node(),
+			}.Start(cancelledCtx)
+			traverser.Shutdown(shutdownCtx)
+			require.NoError(t, shutdownCtx.Err(), "shutdown should not wait for a traversal that never started")
+		}
+	})
 }
 
 func checkTraverseSequence(ctx context.Context, t *testing.T, traverser Traverser, expectedBlks []blocks.Block) {
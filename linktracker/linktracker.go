@@ -10,8 +10,11 @@ import (
 // has already sent a block for a given link, don't send it again.
 // Second, keep track of whether links are missing blocks so you can determine
 // at the end if a complete response has been transmitted.
+// Third, keep track of links whose blocks are present but were left for
+// another peer to send, as part of a partitioned request.
 type LinkTracker struct {
 	missingBlocks                     map[graphsync.RequestID]map[ipld.Link]struct{}
+	excludedBlocks                    map[graphsync.RequestID]map[ipld.Link]struct{}
 	linksWithBlocksTraversedByRequest map[graphsync.RequestID][]ipld.Link
 	traversalsWithBlocksInProgress    map[ipld.Link]int
 }
@@ -20,6 +23,7 @@ type LinkTracker struct {
 func New() *LinkTracker {
 	return &LinkTracker{
 		missingBlocks:                     make(map[graphsync.RequestID]map[ipld.Link]struct{}),
+		excludedBlocks:                    make(map[graphsync.RequestID]map[ipld.Link]struct{}),
 		linksWithBlocksTraversedByRequest: make(map[graphsync.RequestID][]ipld.Link),
 		traversalsWithBlocksInProgress:    make(map[ipld.Link]int),
 	}
@@ -57,12 +61,43 @@ func (lt *LinkTracker) RecordLinkTraversal(requestID graphsync.RequestID, link i
 	}
 }
 
+// ClearMissingLinks forgets the links the given request recorded as missing,
+// for when the request moves to a peer that may have them
+func (lt *LinkTracker) ClearMissingLinks(requestID graphsync.RequestID) {
+	delete(lt.missingBlocks, requestID)
+}
+
+// RecordExcludedLinkTraversal records that we traversed a link during a
+// request and had the block, but did not send it because another peer is
+// sending it. Excluded links do not count as sent, so other requests still
+// send the block.
+func (lt *LinkTracker) RecordExcludedLinkTraversal(requestID graphsync.RequestID, link ipld.Link) {
+	excludedBlocks, ok := lt.excludedBlocks[requestID]
+	if !ok {
+		excludedBlocks = make(map[ipld.Link]struct{})
+		lt.excludedBlocks[requestID] = excludedBlocks
+	}
+	excludedBlocks[link] = struct{}{}
+}
+
+// IsExcludedLink returns whether the given request recorded the given link as
+// excluded
+func (lt *LinkTracker) IsExcludedLink(requestID graphsync.RequestID, link ipld.Link) bool {
+	excludedBlocks, ok := lt.excludedBlocks[requestID]
+	if !ok {
+		return false
+	}
+	_, ok = excludedBlocks[link]
+	return ok
+}
+
 // FinishRequest records that we have completed the given request, and returns
 // true if all links traversed had blocks present.
 func (lt *LinkTracker) FinishRequest(requestID graphsync.RequestID) (hasAllBlocks bool) {
 	_, ok := lt.missingBlocks[requestID]
 	hasAllBlocks = !ok
 	delete(lt.missingBlocks, requestID)
+	delete(lt.excludedBlocks, requestID)
 	links, ok := lt.linksWithBlocksTraversedByRequest[requestID]
 	if !ok {
 		return
@@ -158,3 +158,31 @@ func TestIsKnownMissingLink(t *testing.T) {
 		})
 	}
 }
+
+func TestExcludedLinks(t *testing.T) {
+	linkTracker := New()
+	link := testutil.NewTestLink()
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+
+	linkTracker.RecordExcludedLinkTraversal(requestID1, link)
+	require.True(t, linkTracker.IsExcludedLink(requestID1, link))
+	require.False(t, linkTracker.IsExcludedLink(requestID2, link))
+	// excluded links are not counted as sent, or as missing
+	require.Equal(t, 0, linkTracker.BlockRefCount(link))
+	require.False(t, linkTracker.IsKnownMissingLink(requestID1, link))
+
+	require.True(t, linkTracker.FinishRequest(requestID1))
+	require.False(t, linkTracker.IsExcludedLink(requestID1, link))
+}
+
+func TestClearMissingLinks(t *testing.T) {
+	linkTracker := New()
+	link := testutil.NewTestLink()
+	requestID := graphsync.RequestID(rand.Int31())
+	linkTracker.RecordLinkTraversal(requestID, link, false)
+	require.True(t, linkTracker.IsKnownMissingLink(requestID, link))
+	linkTracker.ClearMissingLinks(requestID)
+	require.False(t, linkTracker.IsKnownMissingLink(requestID, link))
+	require.True(t, linkTracker.FinishRequest(requestID))
+}
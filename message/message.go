@@ -3,6 +3,7 @@ package message
 import (
 	"fmt"
 	"io"
+	"sort"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync"
@@ -10,6 +11,7 @@ import (
 
 	ggio "github.com/gogo/protobuf/io"
 	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	pb "github.com/ipfs/go-graphsync/message/pb"
 	"github.com/libp2p/go-libp2p-core/network"
@@ -60,10 +62,14 @@ type GraphSyncMessage interface {
 	Loggable() map[string]interface{}
 }
 
-// Exportable is an interface that can serialize to a protobuf
+// Exportable is an interface that can serialize to a protobuf, or to an
+// IPLD node for version 2 of the protocol
 type Exportable interface {
 	ToProto() (*pb.Message, error)
 	ToNet(w io.Writer) error
+	ToIPLD() (ipld.Node, error)
+	ToNetV2(w io.Writer) error
+	ToNetV2Compressed(w io.Writer, compressor *compression.Compressor) error
 }
 
 // GraphSyncRequest is a struct to capture data on a request contained in a
@@ -76,6 +82,9 @@ type GraphSyncRequest struct {
 	extensions map[string][]byte
 	isCancel   bool
 	isUpdate   bool
+	// selectorSize is the encoded size of the selector, worked out once when
+	// the request is built
+	selectorSize int
 }
 
 // GraphSyncResponse is an struct to capture data on a response sent back
@@ -112,17 +121,17 @@ func NewRequest(id graphsync.RequestID,
 	priority graphsync.Priority,
 	extensions ...graphsync.ExtensionData) GraphSyncRequest {
 
-	return newRequest(id, root, selector, priority, false, false, toExtensionsMap(extensions))
+	return newRequest(id, root, selector, encodedSize(selector), priority, false, false, toExtensionsMap(extensions))
 }
 
 // CancelRequest request generates a request to cancel an in progress request
 func CancelRequest(id graphsync.RequestID) GraphSyncRequest {
-	return newRequest(id, cid.Cid{}, nil, 0, true, false, nil)
+	return newRequest(id, cid.Cid{}, nil, 0, 0, true, false, nil)
 }
 
 // UpdateRequest generates a new request to update an in progress request with the given extensions
 func UpdateRequest(id graphsync.RequestID, extensions ...graphsync.ExtensionData) GraphSyncRequest {
-	return newRequest(id, cid.Cid{}, nil, 0, false, true, toExtensionsMap(extensions))
+	return newRequest(id, cid.Cid{}, nil, 0, 0, false, true, toExtensionsMap(extensions))
 }
 
 func toExtensionsMap(extensions []graphsync.ExtensionData) (extensionsMap map[string][]byte) {
@@ -138,19 +147,34 @@ func toExtensionsMap(extensions []graphsync.ExtensionData) (extensionsMap map[st
 func newRequest(id graphsync.RequestID,
 	root cid.Cid,
 	selector ipld.Node,
+	selectorSize int,
 	priority graphsync.Priority,
 	isCancel bool,
 	isUpdate bool,
 	extensions map[string][]byte) GraphSyncRequest {
 	return GraphSyncRequest{
-		id:         id,
-		root:       root,
-		selector:   selector,
-		priority:   priority,
-		isCancel:   isCancel,
-		isUpdate:   isUpdate,
-		extensions: extensions,
+		id:           id,
+		root:         root,
+		selector:     selector,
+		selectorSize: selectorSize,
+		priority:     priority,
+		isCancel:     isCancel,
+		isUpdate:     isUpdate,
+		extensions:   extensions,
+	}
+}
+
+// encodedSize returns the size of a node encoded as DAG-CBOR, or 0 if there
+// is no node or it cannot be encoded
+func encodedSize(node ipld.Node) int {
+	if node == nil {
+		return 0
 	}
+	encoded, err := ipldutil.EncodeNode(node)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
 }
 
 // NewResponse builds a new Graphsync response
@@ -187,7 +211,7 @@ func newMessageFromProto(pbm pb.Message) (GraphSyncMessage, error) {
 				return nil, err
 			}
 		}
-		gsm.AddRequest(newRequest(graphsync.RequestID(req.Id), root, selector, graphsync.Priority(req.Priority), req.Cancel, req.Update, req.GetExtensions()))
+		gsm.AddRequest(newRequest(graphsync.RequestID(req.Id), root, selector, len(req.Selector), graphsync.Priority(req.Priority), req.Cancel, req.Update, req.GetExtensions()))
 	}
 
 	for _, res := range pbm.Responses {
@@ -272,6 +296,11 @@ func FromPBReader(pbr ggio.Reader) (GraphSyncMessage, error) {
 	return newMessageFromProto(*pb)
 }
 
+// FromProto converts a protobuf message into a GraphSyncMessage
+func FromProto(pbm *pb.Message) (GraphSyncMessage, error) {
+	return newMessageFromProto(*pbm)
+}
+
 func (gsm *graphSyncMessage) ToProto() (*pb.Message, error) {
 	pbm := new(pb.Message)
 	pbm.Requests = make([]pb.Message_Request, 0, len(gsm.requests))
@@ -348,6 +377,10 @@ func (gsr GraphSyncRequest) Root() cid.Cid { return gsr.root }
 // Selector returns the byte representation of the selector for this request
 func (gsr GraphSyncRequest) Selector() ipld.Node { return gsr.selector }
 
+// SelectorSize returns the size of the request's selector once encoded, or 0
+// if it has none
+func (gsr GraphSyncRequest) SelectorSize() int { return gsr.selectorSize }
+
 // Priority returns the priority of this request
 func (gsr GraphSyncRequest) Priority() graphsync.Priority { return gsr.priority }
 
@@ -364,6 +397,20 @@ func (gsr GraphSyncRequest) Extension(name graphsync.ExtensionName) ([]byte, boo
 	return val, true
 }
 
+// ExtensionNames returns the names of all extensions present on this request
+func (gsr GraphSyncRequest) ExtensionNames() []graphsync.ExtensionName {
+	return extensionNames(gsr.extensions)
+}
+
+func extensionNames(extensions map[string][]byte) []graphsync.ExtensionName {
+	names := make([]graphsync.ExtensionName, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, graphsync.ExtensionName(name))
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
 // IsCancel returns true if this particular request is being cancelled
 func (gsr GraphSyncRequest) IsCancel() bool { return gsr.isCancel }
 
@@ -390,6 +437,11 @@ func (gsr GraphSyncResponse) Extension(name graphsync.ExtensionName) ([]byte, bo
 
 }
 
+// ExtensionNames returns the names of all extensions present on this response
+func (gsr GraphSyncResponse) ExtensionNames() []graphsync.ExtensionName {
+	return extensionNames(gsr.extensions)
+}
+
 // ReplaceExtensions merges the extensions given extensions into the request to create a new request,
 // but always uses new data
 func (gsr GraphSyncRequest) ReplaceExtensions(extensions []graphsync.ExtensionData) GraphSyncRequest {
@@ -404,7 +456,7 @@ func (gsr GraphSyncRequest) ReplaceExtensions(extensions []graphsync.ExtensionDa
 // the result
 func (gsr GraphSyncRequest) MergeExtensions(extensions []graphsync.ExtensionData, mergeFunc func(name graphsync.ExtensionName, oldData []byte, newData []byte) ([]byte, error)) (GraphSyncRequest, error) {
 	if gsr.extensions == nil {
-		return newRequest(gsr.id, gsr.root, gsr.selector, gsr.priority, gsr.isCancel, gsr.isUpdate, toExtensionsMap(extensions)), nil
+		return newRequest(gsr.id, gsr.root, gsr.selector, gsr.selectorSize, gsr.priority, gsr.isCancel, gsr.isUpdate, toExtensionsMap(extensions)), nil
 	}
 	newExtensionMap := toExtensionsMap(extensions)
 	combinedExtensions := make(map[string][]byte)
@@ -428,5 +480,5 @@ func (gsr GraphSyncRequest) MergeExtensions(extensions []graphsync.ExtensionData
 		}
 		combinedExtensions[name] = oldData
 	}
-	return newRequest(gsr.id, gsr.root, gsr.selector, gsr.priority, gsr.isCancel, gsr.isUpdate, combinedExtensions), nil
+	return newRequest(gsr.id, gsr.root, gsr.selector, gsr.selectorSize, gsr.priority, gsr.isCancel, gsr.isUpdate, combinedExtensions), nil
 }
@@ -55,6 +55,7 @@ func TestAppendingRequests(t *testing.T) {
 	require.False(t, pbRequest.Update)
 	require.Equal(t, root.Bytes(), pbRequest.Root)
 	require.Equal(t, selectorEncoded, pbRequest.Selector)
+	require.Equal(t, len(selectorEncoded), request.SelectorSize())
 	require.Equal(t, map[string][]byte{"graphsync/awesome": extension.Data}, pbRequest.Extensions)
 
 	deserialized, err := newMessageFromProto(*pbMessage)
@@ -70,8 +71,10 @@ func TestAppendingRequests(t *testing.T) {
 	require.Equal(t, priority, deserializedRequest.Priority())
 	require.Equal(t, root.String(), deserializedRequest.Root().String())
 	require.Equal(t, selector, deserializedRequest.Selector())
+	require.Equal(t, len(selectorEncoded), deserializedRequest.SelectorSize())
 	require.True(t, found)
 	require.Equal(t, extension.Data, extensionData)
+	require.Equal(t, len(selectorEncoded), deserializedRequest.ReplaceExtensions(nil).SelectorSize())
 }
 
 func TestAppendingResponses(t *testing.T) {
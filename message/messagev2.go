@@ -0,0 +1,481 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// Version 2 messages are DAG-CBOR encoded nodes matching this IPLD schema,
+// each preceded on the wire by its length as an unsigned varint:
+//
+//   type GraphSyncMessage struct {
+//     requests  [GraphSyncRequest]
+//     responses [GraphSyncResponse]
+//     blocks    [GraphSyncBlock]
+//   }
+//
+//   type GraphSyncRequest struct {
+//     id         Int
+//     root       optional Link
+//     selector   optional Any
+//     priority   Int
+//     cancel     Bool
+//     update     Bool
+//     extensions {String:Any}
+//   }
+//
+//   type GraphSyncResponse struct {
+//     id         Int
+//     status     Int
+//     metadata   optional Any
+//     extensions {String:Any}
+//   }
+//
+//   type GraphSyncBlock struct {
+//     prefix      Bytes
+//     data        Bytes
+//     compression optional String
+//   }
+//
+// The data of graphsync's own extensions, which is DAG-CBOR, is embedded as a
+// node, and any other extension data is embedded as bytes. Response metadata is carried in its own
+// field rather than as an extension. A block with a compression algorithm
+// carries its data compressed; every version 2 peer can read gzip.
+
+// ToIPLD converts a message to an IPLD node for the version 2 wire format
+func (gsm *graphSyncMessage) ToIPLD() (ipld.Node, error) {
+	return gsm.toIPLD(nil)
+}
+
+func (gsm *graphSyncMessage) toIPLD(compressor *compression.Compressor) (ipld.Node, error) {
+	return fluent.Build(basicnode.Style.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(3, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("requests").CreateList(len(gsm.requests), func(la fluent.ListAssembler) {
+				for _, request := range gsm.requests {
+					assembleRequest(la.AssembleValue(), request)
+				}
+			})
+			ma.AssembleEntry("responses").CreateList(len(gsm.responses), func(la fluent.ListAssembler) {
+				for _, response := range gsm.responses {
+					assembleResponse(la.AssembleValue(), response)
+				}
+			})
+			ma.AssembleEntry("blocks").CreateList(len(gsm.blocks), func(la fluent.ListAssembler) {
+				for _, b := range gsm.blocks {
+					data, compressed := b.RawData(), false
+					if compressor != nil {
+						if compressedData, ok := compressor.Compress(b); ok {
+							data, compressed = compressedData, true
+						}
+					}
+					la.AssembleValue().CreateMap(3, func(ma fluent.MapAssembler) {
+						ma.AssembleEntry("prefix").AssignBytes(b.Cid().Prefix().Bytes())
+						ma.AssembleEntry("data").AssignBytes(data)
+						if compressed {
+							ma.AssembleEntry("compression").AssignString(compressor.Algorithm())
+						}
+					})
+				}
+			})
+		})
+	})
+}
+
+func assembleRequest(na fluent.NodeAssembler, request GraphSyncRequest) {
+	extensions := extensionNodes(request.extensions)
+	na.CreateMap(7, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("id").AssignInt(int(request.id))
+		if request.root.Defined() {
+			ma.AssembleEntry("root").AssignLink(cidlink.Link{Cid: request.root})
+		}
+		if request.selector != nil {
+			ma.AssembleEntry("selector").AssignNode(request.selector)
+		}
+		ma.AssembleEntry("priority").AssignInt(int(request.priority))
+		ma.AssembleEntry("cancel").AssignBool(request.isCancel)
+		ma.AssembleEntry("update").AssignBool(request.isUpdate)
+		assembleExtensions(ma.AssembleEntry("extensions"), extensions)
+	})
+}
+
+func assembleResponse(na fluent.NodeAssembler, response GraphSyncResponse) {
+	extensions := extensionNodes(response.extensions)
+	metadata, hasMetadata := extensions[string(graphsync.ExtensionMetadata)]
+	hasMetadata = hasMetadata && metadata.node != nil
+	if hasMetadata {
+		delete(extensions, string(graphsync.ExtensionMetadata))
+	}
+	na.CreateMap(4, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("id").AssignInt(int(response.requestID))
+		ma.AssembleEntry("status").AssignInt(int(response.status))
+		if hasMetadata {
+			ma.AssembleEntry("metadata").AssignNode(metadata.node)
+		}
+		assembleExtensions(ma.AssembleEntry("extensions"), extensions)
+	})
+}
+
+// structuredExtensions are the known extensions whose data is DAG-CBOR.
+// Version 2 messages embed their data as nodes. The data of any other
+// extension is sent as bytes, whatever it looks like.
+var structuredExtensions = map[string]struct{}{
+	string(graphsync.ExtensionMetadata):        {},
+	string(graphsync.ExtensionDoNotSendCIDs):   {},
+	string(graphsync.ExtensionPartition):       {},
+	string(graphsync.ExtensionBudget):          {},
+	string(graphsync.ExtensionRetryAfter):      {},
+	string(graphsync.ExtensionAdditionalPeers): {},
+	string(graphsync.ExtensionPauseResponse):   {},
+}
+
+// extensionNode is the wire form of one extension's data. raw is only set
+// when the data is not embedded as a node, and is sent as bytes instead.
+type extensionNode struct {
+	node ipld.Node
+	raw  []byte
+}
+
+func extensionNodes(extensions map[string][]byte) map[string]extensionNode {
+	nodes := make(map[string]extensionNode, len(extensions))
+	for name, data := range extensions {
+		if node, ok := structuredNode(name, data); ok {
+			nodes[name] = extensionNode{node: node}
+		} else {
+			nodes[name] = extensionNode{raw: data}
+		}
+	}
+	return nodes
+}
+
+// structuredNode decodes the data of a known DAG-CBOR extension. Byte string
+// nodes are not embedded, so that bytes on the wire always mean data that was
+// sent as is.
+func structuredNode(name string, data []byte) (ipld.Node, bool) {
+	if _, ok := structuredExtensions[name]; !ok {
+		return nil, false
+	}
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil || node.ReprKind() == ipld.ReprKind_Bytes {
+		return nil, false
+	}
+	return node, true
+}
+
+func assembleExtensions(na fluent.NodeAssembler, extensions map[string]extensionNode) {
+	na.CreateMap(len(extensions), func(ma fluent.MapAssembler) {
+		for _, name := range sortedNames(extensions) {
+			extension := extensions[name]
+			if extension.node != nil {
+				ma.AssembleEntry(name).AssignNode(extension.node)
+			} else {
+				ma.AssembleEntry(name).AssignBytes(extension.raw)
+			}
+		}
+	})
+}
+
+func sortedNames(extensions map[string]extensionNode) []string {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ToNetV2 writes a message to a stream in the version 2 wire format
+func (gsm *graphSyncMessage) ToNetV2(w io.Writer) error {
+	return gsm.ToNetV2Compressed(w, nil)
+}
+
+// ToNetV2Compressed writes a message in the version 2 wire format, with the
+// data of blocks worth compressing compressed by the given compressor
+func (gsm *graphSyncMessage) ToNetV2Compressed(w io.Writer, compressor *compression.Compressor) error {
+	node, err := gsm.toIPLD(compressor)
+	if err != nil {
+		return err
+	}
+	data, err := ipldutil.EncodeNode(node)
+	if err != nil {
+		return err
+	}
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(data)))
+	if _, err := w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// FromNetV2 reads a message in the version 2 wire format from a stream
+func FromNetV2(r io.Reader) (GraphSyncMessage, error) {
+	length, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+	if length > network.MessageSizeMax {
+		return nil, fmt.Errorf("message of %d bytes is larger than the maximum of %d bytes", length, network.MessageSizeMax)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	return FromIPLD(node)
+}
+
+// byteReader reads a single byte at a time, so that reading a message length
+// never consumes the start of the message itself
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.r, b[:])
+	return b[0], err
+}
+
+// maxDecompressedSize is the most block data all the compressed blocks of a
+// single message may decompress to. Senders split messages by the size of
+// their blocks before compression, so no message needs more than the largest
+// message holds.
+const maxDecompressedSize = network.MessageSizeMax
+
+// FromIPLD converts an IPLD node in the version 2 wire format to a message
+func FromIPLD(node ipld.Node) (GraphSyncMessage, error) {
+	gsm := newMsg()
+	remaining := maxDecompressedSize
+	err := forEachInList(node, "requests", func(requestNode ipld.Node) error {
+		request, err := requestFromIPLD(requestNode)
+		if err != nil {
+			return err
+		}
+		gsm.AddRequest(request)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = forEachInList(node, "responses", func(responseNode ipld.Node) error {
+		response, err := responseFromIPLD(responseNode)
+		if err != nil {
+			return err
+		}
+		gsm.AddResponse(response)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = forEachInList(node, "blocks", func(blockNode ipld.Node) error {
+		prefixBytes, err := lookupBytes(blockNode, "prefix")
+		if err != nil {
+			return err
+		}
+		data, err := lookupBytes(blockNode, "data")
+		if err != nil {
+			return err
+		}
+		if algorithmNode, err := blockNode.LookupString("compression"); err == nil {
+			algorithm, err := algorithmNode.AsString()
+			if err != nil {
+				return err
+			}
+			data, err = compression.Decompress(algorithm, data, remaining)
+			if err != nil {
+				return fmt.Errorf("compressed blocks in message: %s", err)
+			}
+			remaining -= len(data)
+		}
+		prefix, err := cid.PrefixFromBytes(prefixBytes)
+		if err != nil {
+			return err
+		}
+		c, err := prefix.Sum(data)
+		if err != nil {
+			return err
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return err
+		}
+		gsm.AddBlock(blk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gsm, nil
+}
+
+func requestFromIPLD(node ipld.Node) (GraphSyncRequest, error) {
+	id, err := lookupInt(node, "id")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	priority, err := lookupInt(node, "priority")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	isCancel, err := lookupBool(node, "cancel")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	isUpdate, err := lookupBool(node, "update")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	var root cid.Cid
+	var selector ipld.Node
+	if !isCancel && !isUpdate {
+		rootNode, err := node.LookupString("root")
+		if err != nil {
+			return GraphSyncRequest{}, err
+		}
+		link, err := rootNode.AsLink()
+		if err != nil {
+			return GraphSyncRequest{}, err
+		}
+		asCidLink, ok := link.(cidlink.Link)
+		if !ok {
+			return GraphSyncRequest{}, errors.New("request root is not a CID link")
+		}
+		root = asCidLink.Cid
+		selector, err = node.LookupString("selector")
+		if err != nil {
+			return GraphSyncRequest{}, err
+		}
+	}
+	extensions, err := extensionsFromIPLD(node)
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	return newRequest(graphsync.RequestID(id), root, selector, encodedSize(selector), graphsync.Priority(priority), isCancel, isUpdate, extensions), nil
+}
+
+func responseFromIPLD(node ipld.Node) (GraphSyncResponse, error) {
+	id, err := lookupInt(node, "id")
+	if err != nil {
+		return GraphSyncResponse{}, err
+	}
+	status, err := lookupInt(node, "status")
+	if err != nil {
+		return GraphSyncResponse{}, err
+	}
+	extensions, err := extensionsFromIPLD(node)
+	if err != nil {
+		return GraphSyncResponse{}, err
+	}
+	if metadataNode, err := node.LookupString("metadata"); err == nil {
+		metadata, err := ipldutil.EncodeNode(metadataNode)
+		if err != nil {
+			return GraphSyncResponse{}, err
+		}
+		if extensions == nil {
+			extensions = make(map[string][]byte, 1)
+		}
+		extensions[string(graphsync.ExtensionMetadata)] = metadata
+	}
+	return newResponse(graphsync.RequestID(id), graphsync.ResponseStatusCode(status), extensions), nil
+}
+
+func extensionsFromIPLD(node ipld.Node) (map[string][]byte, error) {
+	extensionsNode, err := node.LookupString("extensions")
+	if err != nil {
+		return nil, err
+	}
+	if extensionsNode.ReprKind() != ipld.ReprKind_Map {
+		return nil, errors.New("extensions must be a map")
+	}
+	if extensionsNode.Length() == 0 {
+		return nil, nil
+	}
+	extensions := make(map[string][]byte, extensionsNode.Length())
+	iter := extensionsNode.MapIterator()
+	for !iter.Done() {
+		nameNode, dataNode, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := nameNode.AsString()
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if dataNode.ReprKind() == ipld.ReprKind_Bytes {
+			data, err = dataNode.AsBytes()
+		} else {
+			data, err = ipldutil.EncodeNode(dataNode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		extensions[name] = data
+	}
+	return extensions, nil
+}
+
+func forEachInList(node ipld.Node, key string, fn func(ipld.Node) error) error {
+	listNode, err := node.LookupString(key)
+	if err != nil {
+		return err
+	}
+	if listNode.ReprKind() != ipld.ReprKind_List {
+		return fmt.Errorf("%s must be a list", key)
+	}
+	iter := listNode.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if err := fn(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lookupInt(node ipld.Node, key string) (int, error) {
+	value, err := node.LookupString(key)
+	if err != nil {
+		return 0, err
+	}
+	return value.AsInt()
+}
+
+func lookupBool(node ipld.Node, key string) (bool, error) {
+	value, err := node.LookupString(key)
+	if err != nil {
+		return false, err
+	}
+	return value.AsBool()
+}
+
+func lookupBytes(node ipld.Node, key string) ([]byte, error) {
+	value, err := node.LookupString(key)
+	if err != nil {
+		return nil, err
+	}
+	return value.AsBytes()
+}
@@ -0,0 +1,258 @@
+package message
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/budget"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestToNetV2FromNetV2Equivalency(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	selector := ssb.Matcher().Node()
+	rawExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/raw"),
+		Data: testutil.RandomBytes(100),
+	}
+	structuredData, err := ipldutil.EncodeNode(fluent.MustBuildMap(basicnode.Style.Map, 2, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("count").AssignInt(3)
+		ma.AssembleEntry("name").AssignString("apple")
+	}))
+	require.NoError(t, err)
+	unknownStructuredExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/structured"),
+		Data: structuredData,
+	}
+	budgetData, err := budget.EncodeBudget(graphsync.Budget{MaxBlocks: 10})
+	require.NoError(t, err)
+	structuredExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionBudget,
+		Data: budgetData,
+	}
+	bytesData, err := ipldutil.EncodeNode(basicnode.NewBytes([]byte("a byte string")))
+	require.NoError(t, err)
+	bytesExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/bytes"),
+		Data: bytesData,
+	}
+	metadataData, err := metadata.EncodeMetadata(metadata.Metadata{
+		{Link: cidlink.Link{Cid: root}, BlockPresent: true},
+	})
+	require.NoError(t, err)
+	metadataExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionMetadata,
+		Data: metadataData,
+	}
+	id := graphsync.RequestID(rand.Int31())
+	priority := graphsync.Priority(rand.Int31())
+
+	gsm := New()
+	gsm.AddRequest(NewRequest(id, root, selector, priority, rawExtension, structuredExtension, bytesExtension))
+	gsm.AddRequest(CancelRequest(id + 1))
+	gsm.AddRequest(UpdateRequest(id+2, structuredExtension))
+	gsm.AddResponse(NewResponse(id, graphsync.PartialResponse, metadataExtension, rawExtension, structuredExtension, unknownStructuredExtension))
+	gsm.AddResponse(NewResponse(id+1, graphsync.RequestCompletedFull))
+	gsm.AddBlock(blocks.NewBlock([]byte("W")))
+	gsm.AddBlock(blocks.NewBlock([]byte("E")))
+
+	// messages are framed, so several can be read back from one stream
+	buf := new(bytes.Buffer)
+	require.NoError(t, gsm.ToNetV2(buf), "did not serialize message")
+	require.NoError(t, gsm.ToNetV2(buf), "did not serialize message")
+	for i := 0; i < 2; i++ {
+		deserialized, err := FromNetV2(buf)
+		require.NoError(t, err, "did not deserialize message")
+		requireSameMessage(t, gsm, deserialized)
+	}
+	require.Zero(t, buf.Len())
+
+	// known structured extensions and metadata are embedded as nodes, not
+	// bytes, while unknown extensions are always bytes
+	node, err := gsm.ToIPLD()
+	require.NoError(t, err)
+	responsesNode, err := node.LookupString("responses")
+	require.NoError(t, err)
+	iter := responsesNode.ListIterator()
+	for !iter.Done() {
+		_, responseNode, err := iter.Next()
+		require.NoError(t, err)
+		idNode, err := responseNode.LookupString("id")
+		require.NoError(t, err)
+		responseID, err := idNode.AsInt()
+		require.NoError(t, err)
+		if graphsync.RequestID(responseID) != id {
+			continue
+		}
+		metadataNode, err := responseNode.LookupString("metadata")
+		require.NoError(t, err)
+		require.Equal(t, ipld.ReprKind_List, metadataNode.ReprKind())
+		extensionsNode, err := responseNode.LookupString("extensions")
+		require.NoError(t, err)
+		require.Equal(t, 3, extensionsNode.Length())
+		structuredNode, err := extensionsNode.LookupString(string(structuredExtension.Name))
+		require.NoError(t, err)
+		require.Equal(t, ipld.ReprKind_Map, structuredNode.ReprKind())
+		rawNode, err := extensionsNode.LookupString(string(rawExtension.Name))
+		require.NoError(t, err)
+		require.Equal(t, ipld.ReprKind_Bytes, rawNode.ReprKind())
+		unknownNode, err := extensionsNode.LookupString(string(unknownStructuredExtension.Name))
+		require.NoError(t, err)
+		require.Equal(t, ipld.ReprKind_Bytes, unknownNode.ReprKind())
+	}
+
+	_, err = FromNetV2(bytes.NewReader([]byte{0x05, 0x01}))
+	require.Error(t, err, "should not read a truncated message")
+
+	// known extension data that only looks like DAG-CBOR is sent as is
+	malformedExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionBudget,
+		Data: []byte{0xbb, 0x0f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	malformed := New()
+	malformed.AddResponse(NewResponse(id, graphsync.PartialResponse, malformedExtension))
+	buf.Reset()
+	require.NoError(t, malformed.ToNetV2(buf), "did not serialize message")
+	deserialized, err := FromNetV2(buf)
+	require.NoError(t, err, "did not deserialize message")
+	requireSameMessage(t, malformed, deserialized)
+}
+
+func requireSameMessage(t *testing.T, expected GraphSyncMessage, actual GraphSyncMessage) {
+	expectedRequests := make(map[graphsync.RequestID]GraphSyncRequest)
+	for _, request := range expected.Requests() {
+		expectedRequests[request.ID()] = request
+	}
+	require.Len(t, actual.Requests(), len(expectedRequests))
+	for _, request := range actual.Requests() {
+		expectedRequest := expectedRequests[request.ID()]
+		require.Equal(t, expectedRequest.IsCancel(), request.IsCancel())
+		require.Equal(t, expectedRequest.IsUpdate(), request.IsUpdate())
+		require.Equal(t, expectedRequest.Priority(), request.Priority())
+		require.Equal(t, expectedRequest.Root(), request.Root())
+		require.Equal(t, expectedRequest.Selector(), request.Selector())
+		require.Equal(t, expectedRequest.extensions, request.extensions)
+	}
+
+	expectedResponses := make(map[graphsync.RequestID]GraphSyncResponse)
+	for _, response := range expected.Responses() {
+		expectedResponses[response.RequestID()] = response
+	}
+	require.Len(t, actual.Responses(), len(expectedResponses))
+	for _, response := range actual.Responses() {
+		expectedResponse := expectedResponses[response.RequestID()]
+		require.Equal(t, expectedResponse.Status(), response.Status())
+		require.Equal(t, expectedResponse.extensions, response.extensions)
+	}
+
+	keys := make(map[cid.Cid]bool)
+	for _, b := range actual.Blocks() {
+		keys[b.Cid()] = true
+	}
+	require.Len(t, keys, len(expected.Blocks()))
+	for _, b := range expected.Blocks() {
+		require.True(t, keys[b.Cid()])
+	}
+}
+
+func TestToNetV2CompressedBlocks(t *testing.T) {
+	compressor, err := compression.NewCompressor(compression.Gzip, compression.DefaultSkipCodecs)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("compressible "), 100)
+	prefix := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}
+	c, err := prefix.Sum(data)
+	require.NoError(t, err)
+	compressible, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+	prefix.Codec = cid.Raw
+	c, err = prefix.Sum(data)
+	require.NoError(t, err)
+	skipped, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+
+	gsm := New()
+	gsm.AddBlock(compressible)
+	gsm.AddBlock(skipped)
+
+	uncompressedBuf := new(bytes.Buffer)
+	require.NoError(t, gsm.ToNetV2(uncompressedBuf))
+	compressedBuf := new(bytes.Buffer)
+	require.NoError(t, gsm.ToNetV2Compressed(compressedBuf, compressor))
+	require.Less(t, compressedBuf.Len(), uncompressedBuf.Len()-len(data)/2)
+
+	// blocks are decompressed before their cids are computed
+	deserialized, err := FromNetV2(compressedBuf)
+	require.NoError(t, err)
+	requireSameMessage(t, gsm, deserialized)
+	for _, b := range deserialized.Blocks() {
+		require.Equal(t, data, b.RawData())
+	}
+
+	// unknown algorithms are rejected
+	node := fluent.MustBuildMap(basicnode.Style.Map, 3, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("requests").CreateList(0, func(la fluent.ListAssembler) {})
+		ma.AssembleEntry("responses").CreateList(0, func(la fluent.ListAssembler) {})
+		ma.AssembleEntry("blocks").CreateList(1, func(la fluent.ListAssembler) {
+			la.AssembleValue().CreateMap(3, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("prefix").AssignBytes(compressible.Cid().Prefix().Bytes())
+				ma.AssembleEntry("data").AssignBytes(data)
+				ma.AssembleEntry("compression").AssignString("lz4")
+			})
+		})
+	})
+	_, err = FromIPLD(node)
+	require.EqualError(t, err, `compressed blocks in message: unknown compression algorithm "lz4"`)
+}
+
+func TestFromNetV2LimitsDecompressedSize(t *testing.T) {
+	compressor, err := compression.NewCompressor(compression.Gzip, compression.DefaultSkipCodecs)
+	require.NoError(t, err)
+	prefix := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}
+	compressibleMessage := func(blockCount int, blockSize int) GraphSyncMessage {
+		gsm := New()
+		for i := 0; i < blockCount; i++ {
+			data := make([]byte, blockSize)
+			data[0] = byte(i)
+			c, err := prefix.Sum(data)
+			require.NoError(t, err)
+			blk, err := blocks.NewBlockWithCid(data, c)
+			require.NoError(t, err)
+			gsm.AddBlock(blk)
+		}
+		return gsm
+	}
+
+	// each block is under the limit, and so is their total
+	gsm := compressibleMessage(3, maxDecompressedSize/4)
+	buf := new(bytes.Buffer)
+	require.NoError(t, gsm.ToNetV2Compressed(buf, compressor))
+	deserialized, err := FromNetV2(buf)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Blocks(), 3)
+
+	// each block is under the limit, but together they decompress to more
+	// than a message may hold, from only a few kilobytes on the wire
+	gsm = compressibleMessage(16, maxDecompressedSize/4)
+	buf = new(bytes.Buffer)
+	require.NoError(t, gsm.ToNetV2Compressed(buf, compressor))
+	require.Less(t, buf.Len(), maxDecompressedSize/64)
+	_, err = FromNetV2(buf)
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+package messagequeue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metrics"
+)
+
+// ControlAndBulkQueue sends messages to a peer over two streams. Requests,
+// including cancels and updates, go over a control stream, so they are not
+// held up behind large responses queued for the same peer. Responses and their
+// blocks go over a bulk stream. Everything for a single request travels on one
+// stream, so it stays in order.
+//
+// Responses share one stream rather than one each, because a block is only
+// sent once to a peer even if several responses traverse it, and the responses
+// that refer to it must not overtake it.
+type ControlAndBulkQueue struct {
+	control *MessageQueue
+	bulk    *MessageQueue
+}
+
+// NewControlAndBulk creates a queue that sends requests and responses to a
+// peer over separate streams. The parameters are the same as for New, and
+// apply to each stream.
+func NewControlAndBulk(ctx context.Context, p peer.ID, network MessageNetwork, metrics metrics.Metrics, maxRetries int, sendMessageTimeout time.Duration, maxMessageSize uint64) *ControlAndBulkQueue {
+	return &ControlAndBulkQueue{
+		control: New(ctx, p, network, metrics, maxRetries, sendMessageTimeout, maxMessageSize),
+		bulk:    New(ctx, p, network, metrics, maxRetries, sendMessageTimeout, maxMessageSize),
+	}
+}
+
+// SetSendErrorHandler sets what is told about messages dropped from either
+// stream. It must be called before Startup.
+func (cbq *ControlAndBulkQueue) SetSendErrorHandler(onSendError SendErrorHandler) {
+	cbq.control.SetSendErrorHandler(onSendError)
+	cbq.bulk.SetSendErrorHandler(onSendError)
+}
+
+// AddRequest adds an outgoing request to the control stream.
+func (cbq *ControlAndBulkQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest) {
+	cbq.control.AddRequest(graphSyncRequest)
+}
+
+// AddResponses adds the given blocks and responses to the bulk stream and
+// returns a channel that sends a notification when sending initiates.
+func (cbq *ControlAndBulkQueue) AddResponses(responses []gsmsg.GraphSyncResponse, blks []blocks.Block) <-chan struct{} {
+	return cbq.bulk.AddResponses(responses, blks)
+}
+
+// Startup starts the processing of messages on both streams.
+func (cbq *ControlAndBulkQueue) Startup() {
+	cbq.control.Startup()
+	cbq.bulk.Startup()
+}
+
+// Shutdown stops the processing of messages on both streams.
+func (cbq *ControlAndBulkQueue) Shutdown() {
+	cbq.control.Shutdown()
+	cbq.bulk.Shutdown()
+}
+
+// Flush sends any queued messages on both streams and then closes them. Both
+// streams are flushed even if one of them fails.
+func (cbq *ControlAndBulkQueue) Flush(ctx context.Context) error {
+	controlErr := make(chan error, 1)
+	go func() {
+		controlErr <- cbq.control.Flush(ctx)
+	}()
+	bulkErr := cbq.bulk.Flush(ctx)
+	return combineFlushErrors(<-controlErr, bulkErr)
+}
+
+func combineFlushErrors(controlErr error, bulkErr error) error {
+	switch {
+	case controlErr != nil && bulkErr != nil:
+		return fmt.Errorf("flushing control stream: %s; flushing bulk stream: %s", controlErr, bulkErr)
+	case controlErr != nil:
+		return fmt.Errorf("flushing control stream: %s", controlErr)
+	case bulkErr != nil:
+		return fmt.Errorf("flushing bulk stream: %s", bulkErr)
+	default:
+		return nil
+	}
+}
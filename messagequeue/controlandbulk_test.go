@@ -0,0 +1,155 @@
+package messagequeue
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metrics"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/testutil"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// streamsMessageNetwork opens a new sender for each stream, and counts them
+type streamsMessageNetwork struct {
+	lk           sync.Mutex
+	streams      int
+	releaseBulk  chan struct{}
+	bulkSending  chan struct{}
+	messagesSent chan gsmsg.GraphSyncMessage
+}
+
+func (smn *streamsMessageNetwork) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+func (smn *streamsMessageNetwork) NewMessageSender(context.Context, peer.ID) (gsnet.MessageSender, error) {
+	smn.lk.Lock()
+	smn.streams++
+	smn.lk.Unlock()
+	return &blockingMessageSender{smn}, nil
+}
+
+// blockingMessageSender holds up messages with blocks until they are released
+type blockingMessageSender struct {
+	smn *streamsMessageNetwork
+}
+
+func (bms *blockingMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	if len(msg.Blocks()) > 0 {
+		bms.smn.bulkSending <- struct{}{}
+		<-bms.smn.releaseBulk
+	}
+	bms.smn.messagesSent <- msg
+	return nil
+}
+func (bms *blockingMessageSender) Close() error { return nil }
+func (bms *blockingMessageSender) Reset() error { return nil }
+
+func TestRequestsAreNotHeldUpByResponses(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageNetwork := &streamsMessageNetwork{
+		releaseBulk:  make(chan struct{}),
+		bulkSending:  make(chan struct{}, 1),
+		messagesSent: make(chan gsmsg.GraphSyncMessage, 2),
+	}
+	messageQueue := NewControlAndBulk(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
+	messageQueue.Startup()
+	defer messageQueue.Shutdown()
+
+	// a response with blocks is stuck sending
+	responseID := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(3, 128)
+	response := gsmsg.NewResponse(responseID, graphsync.PartialResponse)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{response}, blks)
+	testutil.AssertDoesReceive(ctx, t, messageNetwork.bulkSending, "response should begin sending")
+
+	// a cancel still goes out
+	id := graphsync.RequestID(rand.Int31())
+	messageQueue.AddRequest(gsmsg.CancelRequest(id))
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messageNetwork.messagesSent, &message, "request should send")
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, id, message.Requests()[0].ID())
+	require.Empty(t, message.Responses())
+
+	close(messageNetwork.releaseBulk)
+	testutil.AssertReceive(ctx, t, messageNetwork.messagesSent, &message, "response should send")
+	require.Empty(t, message.Requests())
+	require.Len(t, message.Responses(), 1)
+	require.Len(t, message.Blocks(), 3)
+
+	messageNetwork.lk.Lock()
+	require.Equal(t, 2, messageNetwork.streams)
+	messageNetwork.lk.Unlock()
+}
+
+func TestFlushControlAndBulk(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageNetwork := &streamsMessageNetwork{
+		releaseBulk:  make(chan struct{}),
+		bulkSending:  make(chan struct{}, 1),
+		messagesSent: make(chan gsmsg.GraphSyncMessage, 2),
+	}
+	close(messageNetwork.releaseBulk)
+	messageQueue := NewControlAndBulk(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+	messageQueue.AddRequest(gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), root, selector, graphsync.Priority(rand.Int31())))
+	response := gsmsg.NewResponse(graphsync.RequestID(rand.Int31()), graphsync.RequestCompletedFull)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{response}, testutil.GenerateBlocksOfSize(1, 128))
+	messageQueue.Startup()
+
+	// flushing sends what is queued on both streams
+	require.NoError(t, messageQueue.Flush(ctx))
+	require.Len(t, messageNetwork.messagesSent, 2)
+	messageQueue.Shutdown()
+}
+
+func TestFlushBulkWhenControlFails(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageNetwork := &streamsMessageNetwork{
+		releaseBulk:  make(chan struct{}),
+		bulkSending:  make(chan struct{}, 1),
+		messagesSent: make(chan gsmsg.GraphSyncMessage, 1),
+	}
+	close(messageNetwork.releaseBulk)
+	// the control stream's queue has already ended, so it cannot be flushed
+	controlCtx, controlCancel := context.WithCancel(ctx)
+	controlCancel()
+	messageQueue := &ControlAndBulkQueue{
+		control: New(controlCtx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize),
+		bulk:    New(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize),
+	}
+	response := gsmsg.NewResponse(graphsync.RequestID(rand.Int31()), graphsync.RequestCompletedFull)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{response}, testutil.GenerateBlocksOfSize(1, 128))
+	messageQueue.bulk.Startup()
+
+	// the bulk stream is still flushed, and the control stream's error returned
+	err := messageQueue.Flush(ctx)
+	require.EqualError(t, err, "flushing control stream: context canceled")
+	require.Len(t, messageNetwork.messagesSent, 1)
+	messageQueue.bulk.Shutdown()
+}
@@ -2,12 +2,15 @@ package messagequeue
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 
+	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metrics"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	logging "github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -15,7 +18,18 @@ import (
 
 var log = logging.Logger("graphsync")
 
-const maxRetries = 10
+// errShuttingDown is returned when a send is abandoned because the queue is
+// shutting down. It is not reported, as the queue's owner already knows.
+var errShuttingDown = errors.New("message queue shutting down")
+
+// DefaultMaxRetries is the number of times a message is retried before
+// it is dropped, if no other value is given
+const DefaultMaxRetries = 10
+
+// DefaultMaxMessageSize is the largest encoded message sent to a peer, if no
+// other value is given. It leaves room below the limit libp2p readers accept
+// for the differences between wire encodings.
+const DefaultMaxMessageSize = 2 << 20
 
 // MessageNetwork is any network that can connect peers and generate a message
 // sender.
@@ -24,13 +38,24 @@ type MessageNetwork interface {
 	ConnectTo(context.Context, peer.ID) error
 }
 
+// SendErrorHandler is called when messages cannot be sent to a peer, with the
+// IDs of the requests and responses they carried
+type SendErrorHandler func(p peer.ID, requestIDs []graphsync.RequestID, responseIDs []graphsync.RequestID, err error)
+
 // MessageQueue implements queue of want messages to send to peers.
 type MessageQueue struct {
 	p       peer.ID
 	network MessageNetwork
 	ctx     context.Context
+	metrics metrics.Metrics
+
+	maxRetries         int
+	sendMessageTimeout time.Duration
+	maxMessageSize     uint64
+	onSendError        SendErrorHandler
 
 	outgoingWork chan struct{}
+	flushes      chan chan struct{}
 	done         chan struct{}
 
 	// internal do not touch outside go routines
@@ -40,17 +65,32 @@ type MessageQueue struct {
 	sender             gsnet.MessageSender
 }
 
-// New creats a new MessageQueue.
-func New(ctx context.Context, p peer.ID, network MessageNetwork) *MessageQueue {
+// New creats a new MessageQueue. Each message is attempted up to maxRetries
+// times, and each attempt may take up to sendMessageTimeout. Messages whose
+// encoding may be larger than maxMessageSize are split into several, though a
+// single oversized block is still sent whole. Messages that still cannot be
+// sent are dropped, and reported to the handler set with SetSendErrorHandler.
+func New(ctx context.Context, p peer.ID, network MessageNetwork, metrics metrics.Metrics, maxRetries int, sendMessageTimeout time.Duration, maxMessageSize uint64) *MessageQueue {
 	return &MessageQueue{
-		ctx:          ctx,
-		network:      network,
-		p:            p,
-		outgoingWork: make(chan struct{}, 1),
-		done:         make(chan struct{}),
+		ctx:                ctx,
+		network:            network,
+		metrics:            metrics,
+		maxRetries:         maxRetries,
+		sendMessageTimeout: sendMessageTimeout,
+		maxMessageSize:     maxMessageSize,
+		p:                  p,
+		outgoingWork:       make(chan struct{}, 1),
+		flushes:            make(chan chan struct{}),
+		done:               make(chan struct{}),
 	}
 }
 
+// SetSendErrorHandler sets what is told about messages that are dropped
+// because they cannot be sent. It must be called before Startup.
+func (mq *MessageQueue) SetSendErrorHandler(onSendError SendErrorHandler) {
+	mq.onSendError = onSendError
+}
+
 // AddRequest adds an outgoing request to the message queue.
 func (mq *MessageQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest) {
 
@@ -90,11 +130,39 @@ func (mq *MessageQueue) Shutdown() {
 	close(mq.done)
 }
 
+// Flush sends any queued message and then closes the stream to the peer. It
+// returns once the message is sent, or the context ends.
+func (mq *MessageQueue) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case mq.flushes <- flushed:
+	case <-mq.done:
+		return nil
+	case <-mq.ctx.Done():
+		return mq.ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (mq *MessageQueue) runQueue() {
 	for {
 		select {
 		case <-mq.outgoingWork:
 			mq.sendMessage()
+		case flushed := <-mq.flushes:
+			mq.sendMessage()
+			if mq.sender != nil {
+				mq.sender.Close()
+				mq.sender = nil
+			}
+			close(flushed)
 		case <-mq.done:
 			if mq.sender != nil {
 				mq.sender.Close()
@@ -152,18 +220,64 @@ func (mq *MessageQueue) sendMessage() {
 		return
 	}
 
+	// later parts may depend on earlier ones, so stop at the first part that
+	// cannot be sent
+	parts := splitMessage(message, mq.maxMessageSize)
+	for i, part := range parts {
+		err := mq.sendPart(part)
+		if err == errShuttingDown {
+			return
+		}
+		if err != nil {
+			mq.reportSendError(parts[i:], err)
+			return
+		}
+	}
+}
+
+// reportSendError tells the error handler which requests and responses were
+// in messages that could not be sent
+func (mq *MessageQueue) reportSendError(messages []gsmsg.GraphSyncMessage, err error) {
+	if mq.onSendError == nil {
+		return
+	}
+	var requestIDs, responseIDs []graphsync.RequestID
+	seenRequests := make(map[graphsync.RequestID]struct{})
+	seenResponses := make(map[graphsync.RequestID]struct{})
+	for _, message := range messages {
+		for _, request := range message.Requests() {
+			if _, ok := seenRequests[request.ID()]; !ok {
+				seenRequests[request.ID()] = struct{}{}
+				requestIDs = append(requestIDs, request.ID())
+			}
+		}
+		for _, response := range message.Responses() {
+			if _, ok := seenResponses[response.RequestID()]; !ok {
+				seenResponses[response.RequestID()] = struct{}{}
+				responseIDs = append(responseIDs, response.RequestID())
+			}
+		}
+	}
+	mq.onSendError(mq.p, requestIDs, responseIDs, err)
+}
+
+func (mq *MessageQueue) sendPart(message gsmsg.GraphSyncMessage) error {
 	err := mq.initializeSender()
 	if err != nil {
 		log.Infof("cant open message sender to peer %s: %s", mq.p, err)
-		// TODO: cant connect, what now?
-		return
+		return err
 	}
 
-	for i := 0; i < maxRetries; i++ { // try to send this message until we fail.
-		if mq.attemptSendAndRecovery(message) {
-			return
+	for i := 0; i < mq.maxRetries; i++ { // try to send this message until we fail.
+		err = mq.attemptSend(message)
+		if err == nil {
+			return nil
+		}
+		if recoverErr := mq.recoverSender(); recoverErr != nil {
+			return recoverErr
 		}
 	}
+	return err
 }
 
 func (mq *MessageQueue) initializeSender() error {
@@ -178,37 +292,42 @@ func (mq *MessageQueue) initializeSender() error {
 	return nil
 }
 
-func (mq *MessageQueue) attemptSendAndRecovery(message gsmsg.GraphSyncMessage) bool {
-	err := mq.sender.SendMsg(mq.ctx, message)
+func (mq *MessageQueue) attemptSend(message gsmsg.GraphSyncMessage) error {
+	start := time.Now()
+	sendCtx, cancel := context.WithTimeout(mq.ctx, mq.sendMessageTimeout)
+	err := mq.sender.SendMsg(sendCtx, message)
+	cancel()
 	if err == nil {
-		return true
+		mq.metrics.MessageSent(time.Since(start))
+		return nil
 	}
+	mq.metrics.MessageSendFailed()
 
 	log.Infof("graphsync send error: %s", err)
 	_ = mq.sender.Reset()
 	mq.sender = nil
+	return err
+}
 
+// recoverSender opens a new sender after a failed send, giving up if the queue
+// shuts down first
+func (mq *MessageQueue) recoverSender() error {
 	select {
 	case <-mq.done:
-		return true
+		return errShuttingDown
 	case <-mq.ctx.Done():
-		return true
+		return errShuttingDown
 	case <-time.After(time.Millisecond * 100):
 		// wait 100ms in case disconnect notifications are still propogating
 		log.Warn("SendMsg errored but neither 'done' nor context.Done() were set")
 	}
 
-	err = mq.initializeSender()
+	err := mq.initializeSender()
 	if err != nil {
 		log.Infof("couldnt open sender again after SendMsg(%s) failed: %s", mq.p, err)
-		// TODO(why): what do we do now?
-		// I think the *right* answer is to probably put the message we're
-		// trying to send back, and then return to waiting for new work or
-		// a disconnect.
-		return true
+		return err
 	}
-
-	return false
+	return nil
 }
 
 func openSender(ctx context.Context, network MessageNetwork, p peer.ID) (gsnet.MessageSender, error) {
@@ -8,12 +8,14 @@ import (
 	"testing"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/testutil"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/stretchr/testify/require"
 
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metrics"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -65,7 +67,8 @@ func TestStartupAndShutdown(t *testing.T) {
 	var waitGroup sync.WaitGroup
 	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
 
-	messageQueue := New(ctx, peer, messageNetwork)
+	gsMetrics := metrics.NewInMemory()
+	messageQueue := New(ctx, peer, messageNetwork, gsMetrics, DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
 	messageQueue.Startup()
 	id := graphsync.RequestID(rand.Int31())
 	priority := graphsync.Priority(rand.Int31())
@@ -81,6 +84,7 @@ func TestStartupAndShutdown(t *testing.T) {
 	messageQueue.Shutdown()
 
 	testutil.AssertDoesReceiveFirst(t, fullClosedChan, "message sender should be closed", resetChan, ctx.Done())
+	require.Equal(t, uint64(1), gsMetrics.Snapshot().MessagesSent)
 }
 
 func TestShutdownDuringMessageSend(t *testing.T) {
@@ -100,7 +104,8 @@ func TestShutdownDuringMessageSend(t *testing.T) {
 	var waitGroup sync.WaitGroup
 	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
 
-	messageQueue := New(ctx, peer, messageNetwork)
+	gsMetrics := metrics.NewInMemory()
+	messageQueue := New(ctx, peer, messageNetwork, gsMetrics, DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
 	messageQueue.Startup()
 	id := graphsync.RequestID(rand.Int31())
 	priority := graphsync.Priority(rand.Int31())
@@ -122,6 +127,7 @@ func TestShutdownDuringMessageSend(t *testing.T) {
 
 	// verify the connection is reset after a failed send attempt
 	testutil.AssertDoesReceiveFirst(t, resetChan, "message sender was not reset", fullClosedChan, ctx.Done())
+	require.Equal(t, uint64(1), gsMetrics.Snapshot().MessageSendFailures)
 
 	// now verify after it's reset, no further retries, connection
 	// resets, or attempts to close the connection, cause the queue
@@ -132,6 +138,38 @@ func TestShutdownDuringMessageSend(t *testing.T) {
 	testutil.AssertDoesReceiveFirst(t, ctx.Done(), "further message operations should not occur", messagesSent, resetChan, fullClosedChan)
 }
 
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage, 1)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	messageQueue := New(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
+	id := graphsync.RequestID(rand.Int31())
+	priority := graphsync.Priority(rand.Int31())
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+
+	waitGroup.Add(1)
+	messageQueue.AddRequest(gsmsg.NewRequest(id, root, selector, priority))
+	messageQueue.Startup()
+
+	// flushing sends the queued message and closes the stream
+	err := messageQueue.Flush(ctx)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	testutil.AssertDoesReceiveFirst(t, fullClosedChan, "message sender should be closed", resetChan, ctx.Done())
+	messageQueue.Shutdown()
+}
+
 func TestProcessingNotification(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
@@ -145,7 +183,7 @@ func TestProcessingNotification(t *testing.T) {
 	var waitGroup sync.WaitGroup
 	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
 
-	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue := New(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
 	waitGroup.Add(1)
 	blks := testutil.GenerateBlocksOfSize(3, 128)
 
@@ -193,7 +231,7 @@ func TestDedupingMessages(t *testing.T) {
 	var waitGroup sync.WaitGroup
 	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
 
-	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue := New(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
 	messageQueue.Startup()
 	waitGroup.Add(1)
 	id := graphsync.RequestID(rand.Int31())
@@ -246,3 +284,158 @@ func TestDedupingMessages(t *testing.T) {
 		}
 	}
 }
+
+type failingMessageSender struct {
+	deadlines chan time.Time
+}
+
+func (fms *failingMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	deadline, _ := ctx.Deadline()
+	fms.deadlines <- deadline
+	return fmt.Errorf("Something went wrong")
+}
+func (fms *failingMessageSender) Close() error { return nil }
+func (fms *failingMessageSender) Reset() error { return nil }
+
+func TestMaxRetriesAndSendTimeout(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageSender := &failingMessageSender{make(chan time.Time, 10)}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	maxRetries := 2
+	sendMessageTimeout := 200 * time.Millisecond
+	gsMetrics := metrics.NewInMemory()
+	messageQueue := New(ctx, peer, messageNetwork, gsMetrics, maxRetries, sendMessageTimeout, DefaultMaxMessageSize)
+	messageQueue.Startup()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+
+	// the sender is opened once, then reopened after each failed attempt
+	waitGroup.Add(maxRetries + 1)
+	start := time.Now()
+	messageQueue.AddRequest(gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), root, selector, graphsync.Priority(rand.Int31())))
+
+	for i := 0; i < maxRetries; i++ {
+		var deadline time.Time
+		testutil.AssertReceive(ctx, t, messageSender.deadlines, &deadline, "message send not attempted")
+		require.False(t, deadline.Before(start.Add(sendMessageTimeout)))
+		require.True(t, deadline.Before(start.Add(sendMessageTimeout+500*time.Millisecond)))
+	}
+	waitGroup.Wait()
+	testutil.AssertChannelEmpty(t, messageSender.deadlines, "message sent more than max retries")
+	require.Equal(t, uint64(maxRetries), gsMetrics.Snapshot().MessageSendFailures)
+	messageQueue.Shutdown()
+}
+
+func TestReportsDroppedMessage(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageSender := &failingMessageSender{make(chan time.Time, 10)}
+	// the sender is opened once, then reopened after the failed attempt
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	sendErrors := make(chan sendError, 1)
+	messageQueue := New(ctx, peer, messageNetwork, metrics.NewNoop(), 1, time.Minute, DefaultMaxMessageSize)
+	messageQueue.SetSendErrorHandler(recordSendErrors(sendErrors))
+	messageQueue.Startup()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	requestID := graphsync.RequestID(rand.Int31())
+	messageQueue.AddRequest(gsmsg.NewRequest(requestID, testutil.GenerateCids(1)[0], ssb.Matcher().Node(), graphsync.Priority(rand.Int31())))
+
+	var reported sendError
+	testutil.AssertReceive(ctx, t, sendErrors, &reported, "send error should be reported")
+	require.Equal(t, peer, reported.p)
+	require.Equal(t, []graphsync.RequestID{requestID}, reported.requestIDs)
+	require.Empty(t, reported.responseIDs)
+	require.EqualError(t, reported.err, "Something went wrong")
+	messageQueue.Shutdown()
+}
+
+type sendError struct {
+	p           peer.ID
+	requestIDs  []graphsync.RequestID
+	responseIDs []graphsync.RequestID
+	err         error
+}
+
+func recordSendErrors(sendErrors chan<- sendError) SendErrorHandler {
+	return func(p peer.ID, requestIDs []graphsync.RequestID, responseIDs []graphsync.RequestID, err error) {
+		sendErrors <- sendError{p, requestIDs, responseIDs, err}
+	}
+}
+
+func TestReportsUnreachablePeer(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageNetwork := &fakeMessageNetwork{fmt.Errorf("no route to peer"), nil, nil, &sync.WaitGroup{}}
+	sendErrors := make(chan sendError, 1)
+	messageQueue := New(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, DefaultMaxMessageSize)
+	messageQueue.SetSendErrorHandler(recordSendErrors(sendErrors))
+	messageQueue.Startup()
+
+	id := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(id, graphsync.PartialResponse),
+		gsmsg.NewResponse(id, graphsync.RequestCompletedFull),
+	}, blks)
+
+	var reported sendError
+	testutil.AssertReceive(ctx, t, sendErrors, &reported, "send error should be reported")
+	require.Equal(t, peer, reported.p)
+	require.Empty(t, reported.requestIDs)
+	require.Equal(t, []graphsync.RequestID{id}, reported.responseIDs)
+	require.EqualError(t, reported.err, "no route to peer")
+	messageQueue.Shutdown()
+}
+
+func TestSplitsLargeMessages(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage, 10)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	maxMessageSize := uint64(1000)
+	messageQueue := New(ctx, peer, messageNetwork, metrics.NewNoop(), DefaultMaxRetries, time.Minute, maxMessageSize)
+	blks := testutil.GenerateBlocksOfSize(4, 400)
+
+	waitGroup.Add(1)
+	messageQueue.AddResponses(nil, blks)
+	messageQueue.Startup()
+	err := messageQueue.Flush(ctx)
+	require.NoError(t, err)
+
+	// the blocks arrive over several messages, each within the limit
+	var received []blocks.Block
+	for len(received) < len(blks) {
+		var message gsmsg.GraphSyncMessage
+		testutil.AssertReceive(ctx, t, messagesSent, &message, "message was not sent")
+		require.LessOrEqual(t, messageSize(message), maxMessageSize)
+		received = append(received, message.Blocks()...)
+	}
+	for _, block := range blks {
+		testutil.AssertContainsBlock(t, received, block)
+	}
+	testutil.AssertChannelEmpty(t, messagesSent, "too many messages sent")
+	messageQueue.Shutdown()
+}
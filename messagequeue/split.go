@@ -0,0 +1,313 @@
+package messagequeue
+
+import (
+	"encoding/binary"
+	"sort"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metadata"
+)
+
+// metadataSlack covers the bytes a response grows by beyond the sum of its
+// metadata items: list headers, length prefixes and status codes
+const metadataSlack = 24
+
+// splitMessage breaks a message into parts whose encoded size is at most
+// maxSize, to be sent in order. Requests go first, then blocks no response
+// refers to, then each response together with the blocks its metadata lists.
+// A response too large for one part becomes several responses for the same
+// request: the first carries its other extensions, each carries a slice of
+// its metadata along with those blocks, and only the last carries its real
+// status. Sizes are estimates that are never below the encoded size in either
+// wire format. A single request, block or metadata entry larger than maxSize
+// is still sent whole, in a part of its own, so parts can exceed maxSize.
+func splitMessage(message gsmsg.GraphSyncMessage, maxSize uint64) []gsmsg.GraphSyncMessage {
+	if messageSize(message) <= maxSize {
+		return []gsmsg.GraphSyncMessage{message}
+	}
+
+	ms := &messageSplitter{maxSize: maxSize, sentIn: make(map[cid.Cid]int)}
+	for _, request := range message.Requests() {
+		ms.addRequest(request)
+	}
+
+	blks := make(map[cid.Cid]blocks.Block)
+	for _, block := range message.Blocks() {
+		blks[block.Cid()] = block
+	}
+	responses := message.Responses()
+	sort.Slice(responses, func(i, j int) bool {
+		return responses[i].RequestID() < responses[j].RequestID()
+	})
+	responseMetadata := make([]metadata.Metadata, len(responses))
+	referenced := make(map[cid.Cid]struct{})
+	for i, response := range responses {
+		responseMetadata[i] = decodeResponseMetadata(response)
+		for _, item := range responseMetadata[i] {
+			if c, ok := presentCid(item); ok {
+				referenced[c] = struct{}{}
+			}
+		}
+	}
+
+	for _, block := range message.Blocks() {
+		if _, ok := referenced[block.Cid()]; !ok {
+			ms.addBlocks([]blocks.Block{block})
+		}
+	}
+	for i, response := range responses {
+		ms.addResponse(response, responseMetadata[i], blks)
+	}
+	ms.flush()
+	return ms.parts
+}
+
+type messageSplitter struct {
+	maxSize uint64
+	parts   []gsmsg.GraphSyncMessage
+	current gsmsg.GraphSyncMessage
+	size    uint64
+	// sentIn records the index of the part each block was last added to
+	sentIn map[cid.Cid]int
+}
+
+func (ms *messageSplitter) fits(size uint64) bool {
+	total := messageOverhead + ms.size + size
+	return total+varintSize(total) <= ms.maxSize
+}
+
+// reserve makes room for size more bytes, starting a new part if the current
+// one is too full to hold them
+func (ms *messageSplitter) reserve(size uint64) {
+	if ms.current != nil && !ms.fits(size) {
+		ms.flush()
+	}
+	if ms.current == nil {
+		ms.current = gsmsg.New()
+	}
+	ms.size += size
+}
+
+func (ms *messageSplitter) flush() {
+	if ms.current != nil && !ms.current.Empty() {
+		ms.parts = append(ms.parts, ms.current)
+	}
+	ms.current = nil
+	ms.size = 0
+}
+
+func (ms *messageSplitter) addRequest(request gsmsg.GraphSyncRequest) {
+	ms.reserve(requestSize(request))
+	ms.current.AddRequest(request)
+}
+
+// addBlocks adds blocks to the current part, skipping any it already holds
+func (ms *messageSplitter) addBlocks(blks []blocks.Block) {
+	for _, block := range blks {
+		if ms.current != nil {
+			if index, ok := ms.sentIn[block.Cid()]; ok && index == len(ms.parts) {
+				continue
+			}
+		}
+		ms.reserve(blockSize(block))
+		ms.sentIn[block.Cid()] = len(ms.parts)
+		ms.current.AddBlock(block)
+	}
+}
+
+func (ms *messageSplitter) addResponse(response gsmsg.GraphSyncResponse, md metadata.Metadata, blks map[cid.Cid]blocks.Block) {
+	responseBlocks := blocksFor(md, blks)
+	size := responseSize(response)
+	for _, block := range responseBlocks {
+		size += blockSize(block)
+	}
+	empty := messageSplitter{maxSize: ms.maxSize}
+	if ms.fits(size) || empty.fits(size) || len(md) == 0 {
+		// keep the response in the same part as its blocks
+		if !ms.fits(size) {
+			ms.flush()
+		}
+		ms.reserve(responseSize(response))
+		ms.current.AddResponse(response)
+		ms.addBlocks(responseBlocks)
+		return
+	}
+
+	// each slice of the metadata starts a part of its own
+	ms.flush()
+	extensions := otherExtensions(response)
+	var items metadata.Metadata
+	var itemsSize uint64
+	addPiece := func(status graphsync.ResponseStatusCode) {
+		pieceExtensions := extensions
+		extensions = nil
+		encodedMetadata, err := metadata.EncodeMetadata(items)
+		if err != nil {
+			log.Errorf("unable to encode metadata while splitting response %d: %s", response.RequestID(), err)
+			return
+		}
+		pieceExtensions = append(pieceExtensions[:len(pieceExtensions):len(pieceExtensions)], graphsync.ExtensionData{
+			Name: graphsync.ExtensionMetadata,
+			Data: encodedMetadata,
+		})
+		piece := gsmsg.NewResponse(response.RequestID(), status, pieceExtensions...)
+		ms.reserve(responseSize(piece))
+		ms.current.AddResponse(piece)
+		ms.addBlocks(blocksFor(items, blks))
+		items = nil
+		itemsSize = 0
+	}
+	for _, item := range md {
+		itemSize := metadataItemSize(item)
+		if c, ok := presentCid(item); ok {
+			if block, ok := blks[c]; ok {
+				itemSize += blockSize(block)
+			}
+		}
+		if len(items) > 0 && !ms.fits(baseResponseSize(response.RequestID(), extensions)+itemsSize+itemSize) {
+			addPiece(graphsync.PartialResponse)
+			ms.flush()
+		}
+		items = append(items, item)
+		itemsSize += itemSize
+	}
+	addPiece(response.Status())
+}
+
+func decodeResponseMetadata(response gsmsg.GraphSyncResponse) metadata.Metadata {
+	data, ok := response.Extension(graphsync.ExtensionMetadata)
+	if !ok {
+		return nil
+	}
+	md, err := metadata.DecodeMetadata(data)
+	if err != nil {
+		return nil
+	}
+	return md
+}
+
+func presentCid(item metadata.Item) (cid.Cid, bool) {
+	if !item.BlockPresent {
+		return cid.Undef, false
+	}
+	link, ok := item.Link.(cidlink.Link)
+	if !ok {
+		return cid.Undef, false
+	}
+	return link.Cid, true
+}
+
+// blocksFor returns the blocks in blks the metadata lists as present, in
+// metadata order
+func blocksFor(md metadata.Metadata, blks map[cid.Cid]blocks.Block) []blocks.Block {
+	var responseBlocks []blocks.Block
+	seen := make(map[cid.Cid]struct{})
+	for _, item := range md {
+		c, ok := presentCid(item)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		if block, ok := blks[c]; ok {
+			seen[c] = struct{}{}
+			responseBlocks = append(responseBlocks, block)
+		}
+	}
+	return responseBlocks
+}
+
+func otherExtensions(response gsmsg.GraphSyncResponse) []graphsync.ExtensionData {
+	var extensions []graphsync.ExtensionData
+	for _, name := range response.ExtensionNames() {
+		if name == graphsync.ExtensionMetadata {
+			continue
+		}
+		data, _ := response.Extension(name)
+		extensions = append(extensions, graphsync.ExtensionData{Name: name, Data: data})
+	}
+	return extensions
+}
+
+// Sizes are estimated from the data each entry carries, plus an allowance for
+// the framing around it that covers both the protobuf and the DAG-CBOR wire
+// formats, so messages are never marshalled just to be measured
+const (
+	messageOverhead   = 64
+	requestOverhead   = 128
+	responseOverhead  = 80
+	blockOverhead     = 64
+	extensionOverhead = 40
+)
+
+// messageSize is an upper bound on the size of a message once encoded and
+// length delimited
+func messageSize(message gsmsg.GraphSyncMessage) uint64 {
+	size := uint64(messageOverhead)
+	for _, request := range message.Requests() {
+		size += requestSize(request)
+	}
+	for _, response := range message.Responses() {
+		size += responseSize(response)
+	}
+	for _, block := range message.Blocks() {
+		size += blockSize(block)
+	}
+	return size + varintSize(size)
+}
+
+func requestSize(request gsmsg.GraphSyncRequest) uint64 {
+	size := uint64(requestOverhead)
+	if request.Root().Defined() {
+		size += uint64(len(request.Root().Bytes()))
+	}
+	size += uint64(request.SelectorSize())
+	for _, name := range request.ExtensionNames() {
+		data, _ := request.Extension(name)
+		size += extensionSize(name, data)
+	}
+	return size
+}
+
+func responseSize(response gsmsg.GraphSyncResponse) uint64 {
+	size := uint64(responseOverhead)
+	for _, name := range response.ExtensionNames() {
+		data, _ := response.Extension(name)
+		size += extensionSize(name, data)
+	}
+	return size
+}
+
+func blockSize(block blocks.Block) uint64 {
+	return blockOverhead + uint64(len(block.Cid().Prefix().Bytes())+len(block.RawData()))
+}
+
+func extensionSize(name graphsync.ExtensionName, data []byte) uint64 {
+	return extensionOverhead + uint64(len(name)+len(data))
+}
+
+func baseResponseSize(requestID graphsync.RequestID, extensions []graphsync.ExtensionData) uint64 {
+	extensions = append(extensions[:len(extensions):len(extensions)], graphsync.ExtensionData{
+		Name: graphsync.ExtensionMetadata,
+	})
+	return responseSize(gsmsg.NewResponse(requestID, graphsync.PartialResponse, extensions...)) + metadataSlack
+}
+
+func metadataItemSize(item metadata.Item) uint64 {
+	data, err := metadata.EncodeMetadata(metadata.Metadata{item})
+	if err != nil {
+		return 0
+	}
+	return uint64(len(data))
+}
+
+func varintSize(n uint64) uint64 {
+	var buf [binary.MaxVarintLen64]byte
+	return uint64(binary.PutUvarint(buf[:], n))
+}
@@ -0,0 +1,176 @@
+package messagequeue
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestSplitMessage(t *testing.T) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	selector := ssb.Matcher().Node()
+
+	t.Run("small messages are not split", func(t *testing.T) {
+		message := gsmsg.New()
+		message.AddRequest(gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), testutil.GenerateCids(1)[0], selector, graphsync.Priority(rand.Int31())))
+		message.AddBlock(testutil.GenerateBlocksOfSize(1, 100)[0])
+		parts := splitMessage(message, DefaultMaxMessageSize)
+		require.Len(t, parts, 1)
+		require.Equal(t, message, parts[0])
+	})
+
+	t.Run("requests are spread across messages", func(t *testing.T) {
+		message := gsmsg.New()
+		roots := testutil.GenerateCids(50)
+		for i, root := range roots {
+			message.AddRequest(gsmsg.NewRequest(graphsync.RequestID(i), root, selector, graphsync.Priority(rand.Int31())))
+		}
+		maxSize := uint64(500)
+		parts := splitMessage(message, maxSize)
+		require.Greater(t, len(parts), 1)
+		seen := make(map[graphsync.RequestID]struct{})
+		for _, part := range parts {
+			require.LessOrEqual(t, messageSize(part), maxSize)
+			requireEncodesWithin(t, part, maxSize)
+			for _, request := range part.Requests() {
+				require.Equal(t, roots[request.ID()], request.Root())
+				seen[request.ID()] = struct{}{}
+			}
+		}
+		require.Len(t, seen, len(roots))
+	})
+
+	t.Run("responses are split with their blocks and keep their order", func(t *testing.T) {
+		requestID := graphsync.RequestID(rand.Int31())
+		blks := testutil.GenerateBlocksOfSize(20, 100)
+		var md metadata.Metadata
+		for i, block := range blks {
+			md = append(md, metadata.Item{Link: cidlink.Link{Cid: block.Cid()}, BlockPresent: true})
+			if i%5 == 0 {
+				md = append(md, metadata.Item{Link: cidlink.Link{Cid: testutil.GenerateCids(1)[0]}, BlockPresent: false})
+			}
+		}
+		encodedMetadata, err := metadata.EncodeMetadata(md)
+		require.NoError(t, err)
+		otherExtension := graphsync.ExtensionData{
+			Name: graphsync.ExtensionName("graphsync/awesome"),
+			Data: testutil.RandomBytes(50),
+		}
+		otherRequestID := requestID + 1
+		message := gsmsg.New()
+		message.AddResponse(gsmsg.NewResponse(requestID, graphsync.RequestCompletedFull,
+			graphsync.ExtensionData{Name: graphsync.ExtensionMetadata, Data: encodedMetadata}, otherExtension))
+		message.AddResponse(gsmsg.NewResponse(otherRequestID, graphsync.RequestFailedUnknown))
+		for _, block := range blks {
+			message.AddBlock(block)
+		}
+		unreferenced := testutil.GenerateBlocksOfSize(1, 100)[0]
+		message.AddBlock(unreferenced)
+
+		maxSize := uint64(800)
+		parts := splitMessage(message, maxSize)
+		require.Greater(t, len(parts), 2)
+
+		var receivedMetadata metadata.Metadata
+		var statuses []graphsync.ResponseStatusCode
+		otherResponses := 0
+		received := make(map[cid.Cid]struct{})
+		for i, part := range parts {
+			require.LessOrEqual(t, messageSize(part), maxSize)
+			requireEncodesWithin(t, part, maxSize)
+			partBlocks := make(map[cid.Cid]blocks.Block)
+			for _, block := range part.Blocks() {
+				partBlocks[block.Cid()] = block
+				received[block.Cid()] = struct{}{}
+			}
+			for _, response := range part.Responses() {
+				if response.RequestID() == otherRequestID {
+					otherResponses++
+					require.Equal(t, graphsync.RequestFailedUnknown, response.Status())
+					continue
+				}
+				data, ok := response.Extension(otherExtension.Name)
+				if len(statuses) == 0 {
+					require.True(t, ok, "first response should carry other extensions")
+					require.Equal(t, otherExtension.Data, data)
+				} else {
+					require.False(t, ok, "only the first response should carry other extensions")
+				}
+				statuses = append(statuses, response.Status())
+				data, ok = response.Extension(graphsync.ExtensionMetadata)
+				require.True(t, ok)
+				partMetadata, err := metadata.DecodeMetadata(data)
+				require.NoError(t, err)
+				for _, item := range partMetadata {
+					if item.BlockPresent {
+						_, ok := partBlocks[item.Link.(cidlink.Link).Cid]
+						require.True(t, ok, "block should travel with its metadata in part %d", i)
+					}
+				}
+				receivedMetadata = append(receivedMetadata, partMetadata...)
+			}
+		}
+		require.Equal(t, md, receivedMetadata)
+		require.Equal(t, 1, otherResponses)
+		require.Greater(t, len(statuses), 1)
+		for _, status := range statuses[:len(statuses)-1] {
+			require.Equal(t, graphsync.PartialResponse, status)
+		}
+		require.Equal(t, graphsync.RequestCompletedFull, statuses[len(statuses)-1])
+		require.Len(t, received, len(blks)+1)
+		_, ok := received[unreferenced.Cid()]
+		require.True(t, ok)
+	})
+
+	t.Run("size estimates cover both wire formats", func(t *testing.T) {
+		message := gsmsg.New()
+		extension := graphsync.ExtensionData{
+			Name: graphsync.ExtensionName("graphsync/awesome"),
+			Data: testutil.RandomBytes(50),
+		}
+		message.AddRequest(gsmsg.NewRequest(graphsync.RequestID(-1), testutil.GenerateCids(1)[0], selector, graphsync.Priority(-1), extension))
+		message.AddRequest(gsmsg.CancelRequest(graphsync.RequestID(rand.Int31())))
+		message.AddResponse(gsmsg.NewResponse(graphsync.RequestID(-1), graphsync.RequestFailedUnknown, extension))
+		for _, block := range testutil.GenerateBlocksOfSize(3, 100) {
+			message.AddBlock(block)
+		}
+		requireEncodesWithin(t, message, messageSize(message))
+		requireEncodesWithin(t, gsmsg.New(), messageSize(gsmsg.New()))
+	})
+
+	t.Run("oversized blocks are sent on their own", func(t *testing.T) {
+		blks := testutil.GenerateBlocksOfSize(3, 1000)
+		message := gsmsg.New()
+		for _, block := range blks {
+			message.AddBlock(block)
+		}
+		parts := splitMessage(message, 500)
+		require.Len(t, parts, len(blks))
+		for _, part := range parts {
+			require.Len(t, part.Blocks(), 1)
+		}
+	})
+}
+
+// requireEncodesWithin checks a message is no larger than size in either wire
+// format
+func requireEncodesWithin(t *testing.T, message gsmsg.GraphSyncMessage, size uint64) {
+	pbm, err := message.ToProto()
+	require.NoError(t, err)
+	require.LessOrEqual(t, uint64(pbm.Size())+varintSize(uint64(pbm.Size())), size)
+	buf := new(bytes.Buffer)
+	require.NoError(t, message.ToNetV2(buf))
+	require.LessOrEqual(t, uint64(buf.Len()), size)
+}
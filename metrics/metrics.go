@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// Metrics receives measurements from the graphsync subsystems. It is called
+// from many go routines, so implementations must be safe for concurrent use
+// and should not block.
+type Metrics interface {
+	// RequestStarted is called when a new outgoing request is sent
+	RequestStarted()
+	// RequestCompleted is called when an outgoing request ends, with the final
+	// status from the responder, or RequestCancelled if it ended locally
+	RequestCompleted(status graphsync.ResponseStatusCode)
+	// ResponseStarted is called when a new incoming request is accepted for
+	// processing
+	ResponseStarted()
+	// ResponseCompleted is called when a response ends, with its final status
+	ResponseCompleted(status graphsync.ResponseStatusCode)
+	// BlockReceived is called for each block loaded by an outgoing request. A
+	// sizeOnWire of zero means the block was loaded from the local store.
+	BlockReceived(size uint64, sizeOnWire uint64)
+	// BlockSent is called for each block loaded by a response. A sizeOnWire
+	// of zero means the block was not sent because the requestor already has it.
+	BlockSent(size uint64, sizeOnWire uint64)
+	// ResponsesWaiting is called when the number of accepted responses that
+	// have not started processing yet changes. This counts responses, not
+	// tasks in the peer task queue.
+	ResponsesWaiting(count int)
+	// MessageSent is called after a message is written to a peer, with the time
+	// it took to send
+	MessageSent(latency time.Duration)
+	// MessageSendFailed is called when writing a message to a peer fails
+	MessageSendFailed()
+}
+
+type noop struct{}
+
+// NewNoop returns metrics that discard every measurement
+func NewNoop() Metrics {
+	return noop{}
+}
+
+func (noop) RequestStarted()                                       {}
+func (noop) RequestCompleted(status graphsync.ResponseStatusCode)  {}
+func (noop) ResponseStarted()                                      {}
+func (noop) ResponseCompleted(status graphsync.ResponseStatusCode) {}
+func (noop) BlockReceived(size uint64, sizeOnWire uint64)          {}
+func (noop) BlockSent(size uint64, sizeOnWire uint64)              {}
+func (noop) ResponsesWaiting(count int)                            {}
+func (noop) MessageSent(latency time.Duration)                     {}
+func (noop) MessageSendFailed()                                    {}
+
+// Snapshot is the state of in memory metrics at a point in time
+type Snapshot struct {
+	RequestsStarted    uint64
+	RequestsCompleted  map[graphsync.ResponseStatusCode]uint64
+	ResponsesStarted   uint64
+	ResponsesCompleted map[graphsync.ResponseStatusCode]uint64
+
+	BlocksReceived      uint64
+	BlocksLoadedLocally uint64
+	BytesReceived       uint64
+	BlocksSent          uint64
+	BlocksNotSent       uint64
+	BytesSent           uint64
+	ResponsesWaiting    int
+	MaxResponsesWaiting int
+
+	MessagesSent        uint64
+	MessageSendFailures uint64
+	TotalSendLatency    time.Duration
+	MaxSendLatency      time.Duration
+}
+
+// InMemory is a Metrics implementation that keeps running totals in memory,
+// which can be read with Snapshot and exported by the host application
+type InMemory struct {
+	lk       sync.Mutex
+	snapshot Snapshot
+}
+
+// NewInMemory returns new, empty in memory metrics
+func NewInMemory() *InMemory {
+	return &InMemory{
+		snapshot: Snapshot{
+			RequestsCompleted:  make(map[graphsync.ResponseStatusCode]uint64),
+			ResponsesCompleted: make(map[graphsync.ResponseStatusCode]uint64),
+		},
+	}
+}
+
+// Snapshot returns a copy of the current totals
+func (im *InMemory) Snapshot() Snapshot {
+	im.lk.Lock()
+	defer im.lk.Unlock()
+	snapshot := im.snapshot
+	snapshot.RequestsCompleted = copyStatusCounts(im.snapshot.RequestsCompleted)
+	snapshot.ResponsesCompleted = copyStatusCounts(im.snapshot.ResponsesCompleted)
+	return snapshot
+}
+
+// RequestStarted counts a new outgoing request
+func (im *InMemory) RequestStarted() {
+	im.lk.Lock()
+	im.snapshot.RequestsStarted++
+	im.lk.Unlock()
+}
+
+// RequestCompleted counts an outgoing request that ended with the given status
+func (im *InMemory) RequestCompleted(status graphsync.ResponseStatusCode) {
+	im.lk.Lock()
+	im.snapshot.RequestsCompleted[status]++
+	im.lk.Unlock()
+}
+
+// ResponseStarted counts a new response
+func (im *InMemory) ResponseStarted() {
+	im.lk.Lock()
+	im.snapshot.ResponsesStarted++
+	im.lk.Unlock()
+}
+
+// ResponseCompleted counts a response that ended with the given status
+func (im *InMemory) ResponseCompleted(status graphsync.ResponseStatusCode) {
+	im.lk.Lock()
+	im.snapshot.ResponsesCompleted[status]++
+	im.lk.Unlock()
+}
+
+// BlockReceived counts a block loaded by an outgoing request
+func (im *InMemory) BlockReceived(size uint64, sizeOnWire uint64) {
+	im.lk.Lock()
+	if sizeOnWire > 0 {
+		im.snapshot.BlocksReceived++
+		im.snapshot.BytesReceived += sizeOnWire
+	} else {
+		im.snapshot.BlocksLoadedLocally++
+	}
+	im.lk.Unlock()
+}
+
+// BlockSent counts a block loaded by a response
+func (im *InMemory) BlockSent(size uint64, sizeOnWire uint64) {
+	im.lk.Lock()
+	if sizeOnWire > 0 {
+		im.snapshot.BlocksSent++
+		im.snapshot.BytesSent += sizeOnWire
+	} else {
+		im.snapshot.BlocksNotSent++
+	}
+	im.lk.Unlock()
+}
+
+// ResponsesWaiting records the number of responses waiting to start
+func (im *InMemory) ResponsesWaiting(count int) {
+	im.lk.Lock()
+	im.snapshot.ResponsesWaiting = count
+	if count > im.snapshot.MaxResponsesWaiting {
+		im.snapshot.MaxResponsesWaiting = count
+	}
+	im.lk.Unlock()
+}
+
+// MessageSent counts a message sent to a peer and how long it took
+func (im *InMemory) MessageSent(latency time.Duration) {
+	im.lk.Lock()
+	im.snapshot.MessagesSent++
+	im.snapshot.TotalSendLatency += latency
+	if latency > im.snapshot.MaxSendLatency {
+		im.snapshot.MaxSendLatency = latency
+	}
+	im.lk.Unlock()
+}
+
+// MessageSendFailed counts a message that could not be sent
+func (im *InMemory) MessageSendFailed() {
+	im.lk.Lock()
+	im.snapshot.MessageSendFailures++
+	im.lk.Unlock()
+}
+
+func copyStatusCounts(counts map[graphsync.ResponseStatusCode]uint64) map[graphsync.ResponseStatusCode]uint64 {
+	copied := make(map[graphsync.ResponseStatusCode]uint64, len(counts))
+	for status, count := range counts {
+		copied[status] = count
+	}
+	return copied
+}
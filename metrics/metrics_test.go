@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryMetrics(t *testing.T) {
+	im := NewInMemory()
+	im.RequestStarted()
+	im.RequestStarted()
+	im.RequestCompleted(graphsync.RequestCompletedFull)
+	im.RequestCompleted(graphsync.RequestFailedContentNotFound)
+	im.ResponseStarted()
+	im.ResponseCompleted(graphsync.RequestCompletedPartial)
+	im.BlockReceived(100, 100)
+	im.BlockReceived(50, 0)
+	im.BlockSent(100, 100)
+	im.BlockSent(100, 100)
+	im.BlockSent(20, 0)
+	im.ResponsesWaiting(3)
+	im.ResponsesWaiting(1)
+	im.MessageSent(10 * time.Millisecond)
+	im.MessageSent(30 * time.Millisecond)
+	im.MessageSendFailed()
+
+	snapshot := im.Snapshot()
+	require.Equal(t, uint64(2), snapshot.RequestsStarted)
+	require.Equal(t, map[graphsync.ResponseStatusCode]uint64{
+		graphsync.RequestCompletedFull:         1,
+		graphsync.RequestFailedContentNotFound: 1,
+	}, snapshot.RequestsCompleted)
+	require.Equal(t, uint64(1), snapshot.ResponsesStarted)
+	require.Equal(t, map[graphsync.ResponseStatusCode]uint64{
+		graphsync.RequestCompletedPartial: 1,
+	}, snapshot.ResponsesCompleted)
+	require.Equal(t, uint64(1), snapshot.BlocksReceived)
+	require.Equal(t, uint64(1), snapshot.BlocksLoadedLocally)
+	require.Equal(t, uint64(100), snapshot.BytesReceived)
+	require.Equal(t, uint64(2), snapshot.BlocksSent)
+	require.Equal(t, uint64(1), snapshot.BlocksNotSent)
+	require.Equal(t, uint64(200), snapshot.BytesSent)
+	require.Equal(t, 1, snapshot.ResponsesWaiting)
+	require.Equal(t, 3, snapshot.MaxResponsesWaiting)
+	require.Equal(t, uint64(2), snapshot.MessagesSent)
+	require.Equal(t, uint64(1), snapshot.MessageSendFailures)
+	require.Equal(t, 40*time.Millisecond, snapshot.TotalSendLatency)
+	require.Equal(t, 30*time.Millisecond, snapshot.MaxSendLatency)
+
+	// snapshots are copies
+	snapshot.RequestsCompleted[graphsync.RequestCompletedFull] = 10
+	require.Equal(t, uint64(1), im.Snapshot().RequestsCompleted[graphsync.RequestCompletedFull])
+}
@@ -7,11 +7,17 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var (
 	// ProtocolGraphsync is the protocol identifier for graphsync messages
+	// encoded as protobufs
 	ProtocolGraphsync protocol.ID = "/ipfs/graphsync/1.0.0"
+
+	// ProtocolGraphsyncV2 is the protocol identifier for graphsync messages
+	// encoded as DAG-CBOR
+	ProtocolGraphsyncV2 protocol.ID = "/ipfs/graphsync/2.0.0"
 )
 
 // GraphSyncNetwork provides network connectivity for GraphSync.
@@ -33,6 +39,32 @@ type GraphSyncNetwork interface {
 	NewMessageSender(context.Context, peer.ID) (MessageSender, error)
 }
 
+// AddrAdder is implemented by networks that can record addresses for peers.
+// GraphSync uses it, when a network has it, to make peers suggested by
+// responders dialable.
+type AddrAdder interface {
+	// AddAddrs records addresses the given peer can be reached at, so later
+	// connections to it can be dialed
+	AddAddrs(peer.ID, []ma.Multiaddr)
+}
+
+// ConnManagerProvider is implemented by networks whose connections to peers
+// can be trimmed. GraphSync uses it, when a network has it, to keep
+// connections open while transfers are in progress.
+type ConnManagerProvider interface {
+	// ConnectionManager returns the manager used to keep connections to peers
+	// open while transfers with them are in progress
+	ConnectionManager() ConnManager
+}
+
+// ConnManager protects connections to peers from being closed by connection
+// trimming. Protections are keyed by tag, so several transfers with a peer can
+// each hold one
+type ConnManager interface {
+	Protect(peer.ID, string)
+	Unprotect(peer.ID, string) bool
+}
+
 // MessageSender is an interface to send messages to a peer
 type MessageSender interface {
 	SendMsg(context.Context, gsmsg.GraphSyncMessage) error
@@ -7,23 +7,79 @@ import (
 	"time"
 
 	ggio "github.com/gogo/protobuf/io"
+	"github.com/ipfs/go-graphsync/compression"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
 var log = logging.Logger("graphsync_network")
 
-var sendMessageTimeout = time.Minute * 10
+// DefaultSendMessageTimeout is how long writing a message to a stream may take
+// when the context passed to SendMsg has no deadline
+const DefaultSendMessageTimeout = time.Minute * 10
+
+// Option is an option for configuring the libp2p network. An option given an
+// invalid value logs a warning and leaves the setting at its default.
+type Option func(*libp2pGraphSyncNetwork)
+
+// GraphsyncProtocols sets the protocols this network speaks, in order of
+// preference. Outgoing streams negotiate the first protocol the remote peer
+// also supports. Defaults to version 2, falling back to version 1. An empty
+// list is logged and falls back to the default.
+func GraphsyncProtocols(protocols []protocol.ID) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		if len(protocols) == 0 {
+			log.Warn("at least one protocol must be supported; keeping the default")
+			return
+		}
+		gsnet.protocols = append([]protocol.ID(nil), protocols...)
+	}
+}
+
+// CompressBlocks compresses the data of outgoing blocks with the given
+// algorithm, on streams that negotiated version 2 of the protocol. Blocks with
+// any of the skipped codecs, or that do not shrink, are sent as they are;
+// compression.DefaultSkipCodecs lists codecs that are usually already
+// compressed. An unknown algorithm is logged and blocks are sent uncompressed.
+func CompressBlocks(algorithm string, skipCodecs []uint64) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		compressor, err := compression.NewCompressor(algorithm, skipCodecs)
+		if err != nil {
+			log.Warnf("%s; sending blocks uncompressed", err)
+			return
+		}
+		gsnet.compressor = compressor
+	}
+}
+
+// ProtectActiveTransfers tags and protects connections in the host's
+// connection manager while requests or responses with a peer are in progress,
+// so long transfers are not cut off when the connection manager trims
+// connections. Tags carry the given value.
+func ProtectActiveTransfers(tagValue int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.connManager = &libp2pConnManager{gsnet.host.ConnManager(), tagValue}
+	}
+}
 
 // NewFromLibp2pHost returns a GraphSyncNetwork supported by underlying Libp2p host.
-func NewFromLibp2pHost(host host.Host) GraphSyncNetwork {
+func NewFromLibp2pHost(host host.Host, options ...Option) GraphSyncNetwork {
 	graphSyncNetwork := libp2pGraphSyncNetwork{
-		host: host,
+		host:        host,
+		protocols:   []protocol.ID{ProtocolGraphsyncV2, ProtocolGraphsync},
+		connManager: connmgr.NullConnMgr{},
+	}
+
+	for _, option := range options {
+		option(&graphSyncNetwork)
 	}
 
 	return &graphSyncNetwork
@@ -32,13 +88,34 @@ func NewFromLibp2pHost(host host.Host) GraphSyncNetwork {
 // libp2pGraphSyncNetwork transforms the libp2p host interface, which sends and receives
 // NetMessage objects, into the graphsync network interface.
 type libp2pGraphSyncNetwork struct {
-	host host.Host
+	host        host.Host
+	protocols   []protocol.ID
+	compressor  *compression.Compressor
+	connManager ConnManager
 	// inbound messages from the network are forwarded to the receiver
 	receiver Receiver
 }
 
+// libp2pConnManager tags peers as well as protecting them, so connection
+// managers that only look at tag values also keep the connections
+type libp2pConnManager struct {
+	cm       connmgr.ConnManager
+	tagValue int
+}
+
+func (cm *libp2pConnManager) Protect(p peer.ID, tag string) {
+	cm.cm.TagPeer(p, tag, cm.tagValue)
+	cm.cm.Protect(p, tag)
+}
+
+func (cm *libp2pConnManager) Unprotect(p peer.ID, tag string) bool {
+	cm.cm.UntagPeer(p, tag)
+	return cm.cm.Unprotect(p, tag)
+}
+
 type streamMessageSender struct {
-	s network.Stream
+	s          network.Stream
+	compressor *compression.Compressor
 }
 
 func (s *streamMessageSender) Close() error {
@@ -50,14 +127,14 @@ func (s *streamMessageSender) Reset() error {
 }
 
 func (s *streamMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
-	return msgToStream(ctx, s.s, msg)
+	return msgToStream(ctx, s.s, msg, s.compressor)
 }
 
-func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessage) error {
+func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessage, compressor *compression.Compressor) error {
 	log.Debugf("Outgoing message with %d requests, %d responses, and %d blocks",
 		len(msg.Requests()), len(msg.Responses()), len(msg.Blocks()))
 
-	deadline := time.Now().Add(sendMessageTimeout)
+	deadline := time.Now().Add(DefaultSendMessageTimeout)
 	if dl, ok := ctx.Deadline(); ok {
 		deadline = dl
 	}
@@ -66,6 +143,11 @@ func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessa
 	}
 
 	switch s.Protocol() {
+	case ProtocolGraphsyncV2:
+		if err := msg.ToNetV2Compressed(s, compressor); err != nil {
+			log.Debugf("error: %s", err)
+			return err
+		}
 	case ProtocolGraphsync:
 		if err := msg.ToNet(s); err != nil {
 			log.Debugf("error: %s", err)
@@ -87,11 +169,11 @@ func (gsnet *libp2pGraphSyncNetwork) NewMessageSender(ctx context.Context, p pee
 		return nil, err
 	}
 
-	return &streamMessageSender{s: s}, nil
+	return &streamMessageSender{s: s, compressor: gsnet.compressor}, nil
 }
 
 func (gsnet *libp2pGraphSyncNetwork) newStreamToPeer(ctx context.Context, p peer.ID) (network.Stream, error) {
-	return gsnet.host.NewStream(ctx, p, ProtocolGraphsync)
+	return gsnet.host.NewStream(ctx, p, gsnet.protocols...)
 }
 
 func (gsnet *libp2pGraphSyncNetwork) SendMessage(
@@ -104,7 +186,7 @@ func (gsnet *libp2pGraphSyncNetwork) SendMessage(
 		return err
 	}
 
-	if err = msgToStream(ctx, s, outgoing); err != nil {
+	if err = msgToStream(ctx, s, outgoing, gsnet.compressor); err != nil {
 		_ = s.Reset()
 		return err
 	}
@@ -118,7 +200,9 @@ func (gsnet *libp2pGraphSyncNetwork) SendMessage(
 
 func (gsnet *libp2pGraphSyncNetwork) SetDelegate(r Receiver) {
 	gsnet.receiver = r
-	gsnet.host.SetStreamHandler(ProtocolGraphsync, gsnet.handleNewStream)
+	for _, proto := range gsnet.protocols {
+		gsnet.host.SetStreamHandler(proto, gsnet.handleNewStream)
+	}
 	gsnet.host.Network().Notify((*libp2pGraphSyncNotifee)(gsnet))
 }
 
@@ -126,6 +210,17 @@ func (gsnet *libp2pGraphSyncNetwork) ConnectTo(ctx context.Context, p peer.ID) e
 	return gsnet.host.Connect(ctx, peer.AddrInfo{ID: p})
 }
 
+var _ AddrAdder = (*libp2pGraphSyncNetwork)(nil)
+var _ ConnManagerProvider = (*libp2pGraphSyncNetwork)(nil)
+
+func (gsnet *libp2pGraphSyncNetwork) AddAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	gsnet.host.Peerstore().AddAddrs(p, addrs, peerstore.TempAddrTTL)
+}
+
+func (gsnet *libp2pGraphSyncNetwork) ConnectionManager() ConnManager {
+	return gsnet.connManager
+}
+
 // handleNewStream receives a new stream from the network.
 func (gsnet *libp2pGraphSyncNetwork) handleNewStream(s network.Stream) {
 	defer s.Close()
@@ -135,9 +230,21 @@ func (gsnet *libp2pGraphSyncNetwork) handleNewStream(s network.Stream) {
 		return
 	}
 
-	reader := ggio.NewDelimitedReader(s, network.MessageSizeMax)
+	var readMessage func() (gsmsg.GraphSyncMessage, error)
+	switch s.Protocol() {
+	case ProtocolGraphsyncV2:
+		readMessage = func() (gsmsg.GraphSyncMessage, error) {
+			return gsmsg.FromNetV2(s)
+		}
+	default:
+		reader := ggio.NewDelimitedReader(s, network.MessageSizeMax)
+		readMessage = func() (gsmsg.GraphSyncMessage, error) {
+			return gsmsg.FromPBReader(reader)
+		}
+	}
+
 	for {
-		received, err := gsmsg.FromPBReader(reader)
+		received, err := readMessage()
 		if err != nil {
 			if err != io.EOF {
 				_ = s.Reset()
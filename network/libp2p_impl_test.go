@@ -1,17 +1,21 @@
 package network
 
 import (
+	"bytes"
 	"context"
 	"math/rand"
 	"testing"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/testutil"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -125,3 +129,127 @@ func TestMessageSendAndReceive(t *testing.T) {
 	}
 
 }
+
+func TestProtocolNegotiation(t *testing.T) {
+	testCases := map[string]struct {
+		senderOptions   []Option
+		receiverOptions []Option
+		expected        protocol.ID
+	}{
+		"both support v2": {
+			expected: ProtocolGraphsyncV2,
+		},
+		"receiver only supports v1": {
+			receiverOptions: []Option{GraphsyncProtocols([]protocol.ID{ProtocolGraphsync})},
+			expected:        ProtocolGraphsync,
+		},
+		"sender only supports v1": {
+			senderOptions: []Option{GraphsyncProtocols([]protocol.ID{ProtocolGraphsync})},
+			expected:      ProtocolGraphsync,
+		},
+		"compressed blocks on v2": {
+			senderOptions: []Option{CompressBlocks(compression.Gzip, compression.DefaultSkipCodecs)},
+			expected:      ProtocolGraphsyncV2,
+		},
+		"compression is not used on v1": {
+			senderOptions:   []Option{CompressBlocks(compression.Gzip, compression.DefaultSkipCodecs)},
+			receiverOptions: []Option{GraphsyncProtocols([]protocol.ID{ProtocolGraphsync})},
+			expected:        ProtocolGraphsync,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			mn := mocknet.New(ctx)
+
+			host1, err := mn.GenPeer()
+			require.NoError(t, err)
+			host2, err := mn.GenPeer()
+			require.NoError(t, err)
+			err = mn.LinkAll()
+			require.NoError(t, err)
+			gsnet1 := NewFromLibp2pHost(host1, data.senderOptions...)
+			gsnet2 := NewFromLibp2pHost(host2, data.receiverOptions...)
+			r := &receiver{
+				messageReceived: make(chan struct{}),
+				connectedPeers:  make(chan peer.ID, 2),
+			}
+			gsnet1.SetDelegate(r)
+			gsnet2.SetDelegate(r)
+
+			err = gsnet1.ConnectTo(ctx, host2.ID())
+			require.NoError(t, err, "did not connect peers")
+
+			sender, err := gsnet1.NewMessageSender(ctx, host2.ID())
+			require.NoError(t, err)
+			require.Equal(t, data.expected, sender.(*streamMessageSender).s.Protocol())
+
+			extension := graphsync.ExtensionData{
+				Name: graphsync.ExtensionName("graphsync/awesome"),
+				Data: testutil.RandomBytes(100),
+			}
+			block := blocks.NewBlock(bytes.Repeat([]byte("compressible "), 100))
+			id := graphsync.RequestID(rand.Int31())
+			// several messages on one stream are read back in order
+			for i := 0; i < 3; i++ {
+				sent := gsmsg.New()
+				sent.AddResponse(gsmsg.NewResponse(id+graphsync.RequestID(i), graphsync.PartialResponse, extension))
+				sent.AddBlock(block)
+				err = sender.SendMsg(ctx, sent)
+				require.NoError(t, err)
+
+				testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+				require.Equal(t, host1.ID(), r.lastSender, "incorrect host sent message")
+				receivedResponses := r.lastMessage.Responses()
+				require.Len(t, receivedResponses, 1, "did not add response to received message")
+				require.Equal(t, id+graphsync.RequestID(i), receivedResponses[0].RequestID())
+				extensionData, found := receivedResponses[0].Extension(extension.Name)
+				require.True(t, found)
+				require.Equal(t, extension.Data, extensionData)
+				require.Equal(t, []blocks.Block{block}, r.lastMessage.Blocks())
+			}
+			require.NoError(t, sender.Close())
+		})
+	}
+}
+
+func TestInvalidOptionsKeepDefaults(t *testing.T) {
+	gsnet := &libp2pGraphSyncNetwork{protocols: []protocol.ID{ProtocolGraphsyncV2, ProtocolGraphsync}}
+	GraphsyncProtocols(nil)(gsnet)
+	require.Equal(t, []protocol.ID{ProtocolGraphsyncV2, ProtocolGraphsync}, gsnet.protocols)
+	CompressBlocks("zip-zap", nil)(gsnet)
+	require.Nil(t, gsnet.compressor)
+}
+
+func TestProtectActiveTransfers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+	host, err := mn.GenPeer()
+	require.NoError(t, err)
+	p := testutil.GeneratePeers(1)[0]
+	cm := testutil.NewTestConnManager()
+
+	// without the option, connections are left alone
+	gsnet := NewFromLibp2pHost(testutil.HostWithConnManager(host, cm)).(ConnManagerProvider)
+	gsnet.ConnectionManager().Protect(p, "transfer")
+	require.False(t, cm.IsProtected(p, ""))
+
+	// with it, connections are tagged and protected until unprotected
+	gsnet = NewFromLibp2pHost(testutil.HostWithConnManager(host, cm), ProtectActiveTransfers(10)).(ConnManagerProvider)
+	gsnet.ConnectionManager().Protect(p, "transfer")
+	gsnet.ConnectionManager().Protect(p, "other-transfer")
+	require.True(t, cm.IsProtected(p, "transfer"))
+	value, tagged := cm.TagValue(p, "transfer")
+	require.True(t, tagged)
+	require.Equal(t, 10, value)
+	require.True(t, gsnet.ConnectionManager().Unprotect(p, "transfer"))
+	require.False(t, cm.IsProtected(p, "transfer"))
+	_, tagged = cm.TagValue(p, "transfer")
+	require.False(t, tagged)
+	require.False(t, gsnet.ConnectionManager().Unprotect(p, "other-transfer"))
+	require.False(t, cm.IsProtected(p, ""))
+}
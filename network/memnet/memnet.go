@@ -0,0 +1,389 @@
+package memnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsnet "github.com/ipfs/go-graphsync/network"
+)
+
+// ErrConnectionClosed is returned when sending on a connection that was
+// disconnected
+var ErrConnectionClosed = errors.New("connection closed")
+
+// LinkOptions describe how messages travel between two peers
+type LinkOptions struct {
+	// Latency is how long a message takes to arrive once it is transmitted
+	Latency time.Duration
+	// Bandwidth is how many encoded message bytes are transmitted per second
+	// in each direction. Zero means unlimited.
+	Bandwidth uint64
+	// MessageLoss is the probability, from 0 to 1, that a message is dropped
+	MessageLoss float64
+}
+
+func (lo LinkOptions) validate() error {
+	if lo.Latency < 0 {
+		return fmt.Errorf("latency must not be negative, got %s", lo.Latency)
+	}
+	if lo.MessageLoss < 0 || lo.MessageLoss > 1 {
+		return fmt.Errorf("message loss must be between 0 and 1, got %f", lo.MessageLoss)
+	}
+	return nil
+}
+
+// Hub connects in-memory networks, so that graphsync instances in one process
+// can exchange messages without libp2p. Messages are encoded as they would be
+// on the wire and delivered in order on each connection.
+type Hub struct {
+	ctx context.Context
+
+	lk          sync.Mutex
+	rand        *rand.Rand
+	defaults    LinkOptions
+	linkOptions map[peerPair]LinkOptions
+	unlinked    map[peerPair]struct{}
+	networks    map[peer.ID]*memNetwork
+	connections map[peerPair]*connection
+}
+
+// NewHub returns a hub whose links all use the given options until they are
+// changed with SetLinkOptions. Message loss is decided by a random source
+// seeded with seed, so runs with the same seed drop the same messages. It
+// errors if the options are invalid.
+func NewHub(ctx context.Context, seed int64, defaults LinkOptions) (*Hub, error) {
+	if err := defaults.validate(); err != nil {
+		return nil, err
+	}
+	return &Hub{
+		ctx:         ctx,
+		rand:        rand.New(rand.NewSource(seed)),
+		defaults:    defaults,
+		linkOptions: make(map[peerPair]LinkOptions),
+		unlinked:    make(map[peerPair]struct{}),
+		networks:    make(map[peer.ID]*memNetwork),
+		connections: make(map[peerPair]*connection),
+	}, nil
+}
+
+// NewNetwork adds a peer to the hub and returns its network
+func (h *Hub) NewNetwork(p peer.ID) (gsnet.GraphSyncNetwork, error) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if _, ok := h.networks[p]; ok {
+		return nil, fmt.Errorf("peer %s is already on the hub", p)
+	}
+	network := &memNetwork{hub: h, p: p}
+	h.networks[p] = network
+	return network, nil
+}
+
+// SetLinkOptions changes how messages travel between two peers, in both
+// directions. Messages already sent are not affected. It errors if the
+// options are invalid.
+func (h *Hub) SetLinkOptions(a peer.ID, b peer.ID, options LinkOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	h.lk.Lock()
+	h.linkOptions[pairOf(a, b)] = options
+	h.lk.Unlock()
+	return nil
+}
+
+// Disconnect closes the connection between two peers, dropping any messages
+// still in flight. The peers may connect again later.
+func (h *Hub) Disconnect(a peer.ID, b peer.ID) {
+	h.lk.Lock()
+	conn, ok := h.connections[pairOf(a, b)]
+	delete(h.connections, pairOf(a, b))
+	networkA, networkB := h.networks[a], h.networks[b]
+	h.lk.Unlock()
+	if !ok {
+		return
+	}
+	conn.cancel()
+	networkA.notifyDisconnected(b)
+	networkB.notifyDisconnected(a)
+}
+
+// Unlink disconnects two peers and stops them connecting again until Link is
+// called
+func (h *Hub) Unlink(a peer.ID, b peer.ID) {
+	h.lk.Lock()
+	h.unlinked[pairOf(a, b)] = struct{}{}
+	h.lk.Unlock()
+	h.Disconnect(a, b)
+}
+
+// Link lets two peers that were unlinked connect again
+func (h *Hub) Link(a peer.ID, b peer.ID) {
+	h.lk.Lock()
+	delete(h.unlinked, pairOf(a, b))
+	h.lk.Unlock()
+}
+
+func (h *Hub) connect(from peer.ID, to peer.ID) (*connection, error) {
+	if from == to {
+		return nil, errors.New("cannot connect a peer to itself")
+	}
+	h.lk.Lock()
+	pair := pairOf(from, to)
+	if conn, ok := h.connections[pair]; ok {
+		h.lk.Unlock()
+		return conn, nil
+	}
+	fromNetwork := h.networks[from]
+	toNetwork, ok := h.networks[to]
+	if !ok {
+		h.lk.Unlock()
+		return nil, fmt.Errorf("peer %s is not on the hub", to)
+	}
+	if _, ok := h.unlinked[pair]; ok {
+		h.lk.Unlock()
+		return nil, fmt.Errorf("peers %s and %s are not linked", from, to)
+	}
+	ctx, cancel := context.WithCancel(h.ctx)
+	conn := &connection{
+		ctx:    ctx,
+		cancel: cancel,
+		links: map[peer.ID]*link{
+			from: newLink(ctx, fromNetwork, toNetwork),
+			to:   newLink(ctx, toNetwork, fromNetwork),
+		},
+	}
+	h.connections[pair] = conn
+	h.lk.Unlock()
+
+	for _, l := range conn.links {
+		go l.run()
+	}
+	fromNetwork.notifyConnected(to)
+	toNetwork.notifyConnected(from)
+	return conn, nil
+}
+
+func (h *Hub) send(ctx context.Context, conn *connection, from peer.ID, to peer.ID, message gsmsg.GraphSyncMessage) error {
+	buf := new(bytes.Buffer)
+	if err := message.ToNet(buf); err != nil {
+		return err
+	}
+
+	h.lk.Lock()
+	options, ok := h.linkOptions[pairOf(from, to)]
+	if !ok {
+		options = h.defaults
+	}
+	drop := options.MessageLoss > 0 && h.rand.Float64() < options.MessageLoss
+	h.lk.Unlock()
+
+	transmitted := conn.links[from].enqueue(buf.Bytes(), options, drop)
+	// like a stream write, sending returns once the message is transmitted
+	timer := time.NewTimer(time.Until(transmitted))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-conn.ctx.Done():
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type peerPair struct {
+	a peer.ID
+	b peer.ID
+}
+
+func pairOf(a peer.ID, b peer.ID) peerPair {
+	if b < a {
+		a, b = b, a
+	}
+	return peerPair{a, b}
+}
+
+type connection struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// links are keyed by the peer sending on them
+	links map[peer.ID]*link
+}
+
+type pendingMessage struct {
+	deliverAt time.Time
+	data      []byte
+}
+
+// link carries messages in one direction of a connection
+type link struct {
+	ctx  context.Context
+	from *memNetwork
+	to   *memNetwork
+	work chan struct{}
+
+	lk     sync.Mutex
+	queue  []pendingMessage
+	freeAt time.Time
+}
+
+func newLink(ctx context.Context, from *memNetwork, to *memNetwork) *link {
+	return &link{
+		ctx:  ctx,
+		from: from,
+		to:   to,
+		work: make(chan struct{}, 1),
+	}
+}
+
+// enqueue schedules a message behind those already transmitting, and returns
+// when it finishes transmitting
+func (l *link) enqueue(data []byte, options LinkOptions, drop bool) time.Time {
+	l.lk.Lock()
+	start := time.Now()
+	if l.freeAt.After(start) {
+		start = l.freeAt
+	}
+	l.freeAt = start
+	if options.Bandwidth > 0 {
+		l.freeAt = start.Add(time.Duration(uint64(len(data)) * uint64(time.Second) / options.Bandwidth))
+	}
+	transmitted := l.freeAt
+	if !drop {
+		l.queue = append(l.queue, pendingMessage{transmitted.Add(options.Latency), data})
+	}
+	l.lk.Unlock()
+
+	select {
+	case l.work <- struct{}{}:
+	default:
+	}
+	return transmitted
+}
+
+func (l *link) next() (pendingMessage, bool) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if len(l.queue) == 0 {
+		return pendingMessage{}, false
+	}
+	message := l.queue[0]
+	l.queue = l.queue[1:]
+	return message, true
+}
+
+func (l *link) run() {
+	for {
+		select {
+		case <-l.work:
+		case <-l.ctx.Done():
+			return
+		}
+		for {
+			message, ok := l.next()
+			if !ok {
+				break
+			}
+			timer := time.NewTimer(time.Until(message.deliverAt))
+			select {
+			case <-timer.C:
+			case <-l.ctx.Done():
+				timer.Stop()
+				return
+			}
+			l.to.deliver(l.from.p, message.data)
+		}
+	}
+}
+
+type memNetwork struct {
+	hub *Hub
+	p   peer.ID
+
+	receiverLk sync.RWMutex
+	receiver   gsnet.Receiver
+}
+
+func (n *memNetwork) SendMessage(ctx context.Context, p peer.ID, outgoing gsmsg.GraphSyncMessage) error {
+	conn, err := n.hub.connect(n.p, p)
+	if err != nil {
+		return err
+	}
+	return n.hub.send(ctx, conn, n.p, p, outgoing)
+}
+
+func (n *memNetwork) SetDelegate(r gsnet.Receiver) {
+	n.receiverLk.Lock()
+	n.receiver = r
+	n.receiverLk.Unlock()
+}
+
+func (n *memNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	_, err := n.hub.connect(n.p, p)
+	return err
+}
+
+func (n *memNetwork) NewMessageSender(ctx context.Context, p peer.ID) (gsnet.MessageSender, error) {
+	conn, err := n.hub.connect(n.p, p)
+	if err != nil {
+		return nil, err
+	}
+	return &messageSender{n.hub, conn, n.p, p}, nil
+}
+
+func (n *memNetwork) getReceiver() gsnet.Receiver {
+	n.receiverLk.RLock()
+	defer n.receiverLk.RUnlock()
+	return n.receiver
+}
+
+func (n *memNetwork) deliver(from peer.ID, data []byte) {
+	receiver := n.getReceiver()
+	if receiver == nil {
+		return
+	}
+	message, err := gsmsg.FromNet(bytes.NewReader(data))
+	if err != nil {
+		receiver.ReceiveError(err)
+		return
+	}
+	receiver.ReceiveMessage(context.Background(), from, message)
+}
+
+func (n *memNetwork) notifyConnected(p peer.ID) {
+	if receiver := n.getReceiver(); receiver != nil {
+		receiver.Connected(p)
+	}
+}
+
+func (n *memNetwork) notifyDisconnected(p peer.ID) {
+	if receiver := n.getReceiver(); receiver != nil {
+		receiver.Disconnected(p)
+	}
+}
+
+type messageSender struct {
+	hub  *Hub
+	conn *connection
+	from peer.ID
+	to   peer.ID
+}
+
+func (ms *messageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	if ms.conn.ctx.Err() != nil {
+		return ErrConnectionClosed
+	}
+	return ms.hub.send(ctx, ms.conn, ms.from, ms.to, msg)
+}
+
+func (ms *messageSender) Close() error { return nil }
+
+func (ms *messageSender) Reset() error { return nil }
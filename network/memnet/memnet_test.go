@@ -0,0 +1,192 @@
+package memnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type receivedMessage struct {
+	sender  peer.ID
+	message gsmsg.GraphSyncMessage
+}
+
+type receiver struct {
+	messagesReceived chan receivedMessage
+	connectedPeers   chan peer.ID
+	disconnectPeers  chan peer.ID
+}
+
+func newReceiver() *receiver {
+	return &receiver{
+		messagesReceived: make(chan receivedMessage, 16),
+		connectedPeers:   make(chan peer.ID, 16),
+		disconnectPeers:  make(chan peer.ID, 16),
+	}
+}
+
+func (r *receiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	r.messagesReceived <- receivedMessage{sender, incoming}
+}
+
+func (r *receiver) ReceiveError(err error) {}
+
+func (r *receiver) Connected(p peer.ID) {
+	r.connectedPeers <- p
+}
+
+func (r *receiver) Disconnected(p peer.ID) {
+	r.disconnectPeers <- p
+}
+
+func responseMessage(id graphsync.RequestID, size int64) gsmsg.GraphSyncMessage {
+	message := gsmsg.New()
+	message.AddResponse(gsmsg.NewResponse(id, graphsync.PartialResponse))
+	if size > 0 {
+		message.AddBlock(testutil.GenerateBlocksOfSize(1, size)[0])
+	}
+	return message
+}
+
+func setupPeers(ctx context.Context, t *testing.T, hub *Hub) (peer.ID, *receiver, peer.ID, *receiver) {
+	peers := testutil.GeneratePeers(2)
+	receivers := []*receiver{newReceiver(), newReceiver()}
+	for i, p := range peers {
+		network, err := hub.NewNetwork(p)
+		require.NoError(t, err)
+		network.SetDelegate(receivers[i])
+	}
+	_, err := hub.NewNetwork(peers[0])
+	require.Error(t, err, "should not add a peer twice")
+	return peers[0], receivers[0], peers[1], receivers[1]
+}
+
+func TestMessagesArriveInOrderAfterLatency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	latency := 50 * time.Millisecond
+	hub, err := NewHub(ctx, 1, LinkOptions{Latency: latency})
+	require.NoError(t, err)
+	peer1, receiver1, peer2, receiver2 := setupPeers(ctx, t, hub)
+	network1 := hub.networks[peer1]
+
+	start := time.Now()
+	sender, err := network1.NewMessageSender(ctx, peer2)
+	require.NoError(t, err)
+	var connected peer.ID
+	testutil.AssertReceive(ctx, t, receiver1.connectedPeers, &connected, "peer should connect")
+	require.Equal(t, peer2, connected)
+	testutil.AssertReceive(ctx, t, receiver2.connectedPeers, &connected, "peer should connect")
+	require.Equal(t, peer1, connected)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sender.SendMsg(ctx, responseMessage(graphsync.RequestID(i), 100)))
+	}
+	for i := 0; i < 5; i++ {
+		var received receivedMessage
+		testutil.AssertReceive(ctx, t, receiver2.messagesReceived, &received, "message should arrive")
+		require.Equal(t, peer1, received.sender)
+		require.Len(t, received.message.Responses(), 1)
+		require.Equal(t, graphsync.RequestID(i), received.message.Responses()[0].RequestID())
+		require.Len(t, received.message.Blocks(), 1)
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(latency))
+	testutil.AssertChannelEmpty(t, receiver1.messagesReceived, "sender should receive nothing")
+}
+
+func TestBandwidthLimitsSending(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	hub, err := NewHub(ctx, 1, LinkOptions{})
+	require.NoError(t, err)
+	peer1, _, peer2, receiver2 := setupPeers(ctx, t, hub)
+	// about 1000 bytes per message, so four messages take about 200ms
+	require.NoError(t, hub.SetLinkOptions(peer1, peer2, LinkOptions{Bandwidth: 20000}))
+	network1 := hub.networks[peer1]
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, network1.SendMessage(ctx, peer2, responseMessage(graphsync.RequestID(i), 1000)))
+	}
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, int64(elapsed), int64(150*time.Millisecond))
+	for i := 0; i < 4; i++ {
+		testutil.AssertDoesReceive(ctx, t, receiver2.messagesReceived, "message should arrive")
+	}
+}
+
+func TestMessageLoss(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	deliveredWithSeed := func(seed int64) []graphsync.RequestID {
+		hub, err := NewHub(ctx, seed, LinkOptions{MessageLoss: 0.5})
+		require.NoError(t, err)
+		peer1, _, peer2, receiver2 := setupPeers(ctx, t, hub)
+		network1 := hub.networks[peer1]
+		for i := 0; i < 20; i++ {
+			require.NoError(t, network1.SendMessage(ctx, peer2, responseMessage(graphsync.RequestID(i), 0)))
+		}
+		// a message on a lossless link marks the end of the lost ones
+		require.NoError(t, hub.SetLinkOptions(peer1, peer2, LinkOptions{}))
+		require.NoError(t, network1.SendMessage(ctx, peer2, responseMessage(graphsync.RequestID(20), 0)))
+		var delivered []graphsync.RequestID
+		for {
+			var received receivedMessage
+			testutil.AssertReceive(ctx, t, receiver2.messagesReceived, &received, "message should arrive")
+			id := received.message.Responses()[0].RequestID()
+			if id == 20 {
+				return delivered
+			}
+			delivered = append(delivered, id)
+		}
+	}
+
+	delivered := deliveredWithSeed(7)
+	require.NotEmpty(t, delivered)
+	require.Less(t, len(delivered), 20)
+	require.Equal(t, delivered, deliveredWithSeed(7), "the same seed should lose the same messages")
+	_, err := NewHub(ctx, 1, LinkOptions{MessageLoss: 2})
+	require.Error(t, err)
+}
+
+func TestDisconnectAndUnlink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	hub, err := NewHub(ctx, 1, LinkOptions{Latency: time.Second})
+	require.NoError(t, err)
+	peer1, receiver1, peer2, receiver2 := setupPeers(ctx, t, hub)
+	network1 := hub.networks[peer1]
+
+	sender, err := network1.NewMessageSender(ctx, peer2)
+	require.NoError(t, err)
+	require.NoError(t, sender.SendMsg(ctx, responseMessage(0, 0)))
+
+	// messages in flight are dropped, and the old sender stops working
+	hub.Disconnect(peer1, peer2)
+	var disconnected peer.ID
+	testutil.AssertReceive(ctx, t, receiver1.disconnectPeers, &disconnected, "peer should disconnect")
+	require.Equal(t, peer2, disconnected)
+	testutil.AssertReceive(ctx, t, receiver2.disconnectPeers, &disconnected, "peer should disconnect")
+	require.Equal(t, peer1, disconnected)
+	require.Equal(t, ErrConnectionClosed, sender.SendMsg(ctx, responseMessage(1, 0)))
+	testutil.AssertChannelEmpty(t, receiver2.messagesReceived, "message in flight should be dropped")
+
+	// disconnected peers can connect again, but unlinked peers cannot
+	require.NoError(t, network1.ConnectTo(ctx, peer2))
+	hub.Unlink(peer1, peer2)
+	require.Error(t, network1.ConnectTo(ctx, peer2))
+	_, err = network1.NewMessageSender(ctx, peer2)
+	require.Error(t, err)
+	hub.Link(peer1, peer2)
+	require.NoError(t, network1.ConnectTo(ctx, peer2))
+
+	require.Error(t, network1.ConnectTo(ctx, testutil.GeneratePeers(1)[0]), "should not connect to unknown peers")
+}
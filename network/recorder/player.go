@@ -0,0 +1,123 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsnet "github.com/ipfs/go-graphsync/network"
+)
+
+// Player is a network that replays a recording into the receiver registered
+// with it, so a node sees exactly the messages it received when the recording
+// was made. Messages the node sends in response are kept rather than
+// delivered, and can be compared with the messages it sent originally.
+type Player struct {
+	lk       sync.Mutex
+	receiver gsnet.Receiver
+	sent     []Record
+}
+
+// NewPlayer returns a network to replay recordings into
+func NewPlayer() *Player {
+	return &Player{}
+}
+
+// Play feeds the messages received in a recording to the receiver in order.
+// Messages that were sent in the recording are skipped. If paced is true,
+// messages are spaced out by the same gaps as when they were recorded,
+// otherwise they are fed in as fast as the receiver accepts them.
+func (pl *Player) Play(ctx context.Context, r io.Reader, paced bool) error {
+	pl.lk.Lock()
+	receiver := pl.receiver
+	pl.lk.Unlock()
+	if receiver == nil {
+		return errors.New("no receiver to play recording into")
+	}
+	reader := NewReader(r)
+	var last time.Time
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Direction != Received {
+			continue
+		}
+		if paced && !last.IsZero() && record.Time.After(last) {
+			timer := time.NewTimer(record.Time.Sub(last))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		last = record.Time
+		receiver.ReceiveMessage(ctx, record.Peer, record.Message)
+	}
+}
+
+// Sent returns the messages sent through the player so far
+func (pl *Player) Sent() []Record {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	return append([]Record(nil), pl.sent...)
+}
+
+func (pl *Player) record(p peer.ID, message gsmsg.GraphSyncMessage) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	pl.sent = append(pl.sent, Record{Time: time.Now(), Direction: Sent, Peer: p, Message: message})
+}
+
+// SendMessage keeps the message as sent
+func (pl *Player) SendMessage(ctx context.Context, p peer.ID, outgoing gsmsg.GraphSyncMessage) error {
+	pl.record(p, outgoing)
+	return nil
+}
+
+// SetDelegate sets the receiver recordings are played into
+func (pl *Player) SetDelegate(r gsnet.Receiver) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	pl.receiver = r
+}
+
+// ConnectTo succeeds for any peer
+func (pl *Player) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+// NewMessageSender returns a sender that keeps messages as sent
+func (pl *Player) NewMessageSender(ctx context.Context, p peer.ID) (gsnet.MessageSender, error) {
+	return &playerMessageSender{pl, p}, nil
+}
+
+type playerMessageSender struct {
+	pl *Player
+	p  peer.ID
+}
+
+func (pms *playerMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	pms.pl.record(pms.p, msg)
+	return nil
+}
+
+func (pms *playerMessageSender) Close() error {
+	return nil
+}
+
+func (pms *playerMessageSender) Reset() error {
+	return nil
+}
+
+var _ gsnet.GraphSyncNetwork = (*Player)(nil)
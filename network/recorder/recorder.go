@@ -0,0 +1,290 @@
+// Package recorder records the graphsync messages a node sends and receives,
+// and plays recordings back into a node to reproduce what happened.
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	pb "github.com/ipfs/go-graphsync/message/pb"
+	gsnet "github.com/ipfs/go-graphsync/network"
+)
+
+var log = logging.Logger("graphsync_recorder")
+
+// ErrWriterClosed is returned when writing a record after the writer is closed
+var ErrWriterClosed = errors.New("recording writer is closed")
+
+// maxRecordSize is the largest record read back, a message of the largest
+// size plus room for the record header
+const maxRecordSize = network.MessageSizeMax + 1024
+
+// Direction says whether a recorded message was sent or received
+type Direction byte
+
+const (
+	// Sent is a message the recording node sent to the peer
+	Sent = Direction(1)
+	// Received is a message the recording node received from the peer
+	Received = Direction(2)
+	// SendFailed is a message the recording node could not send to the peer.
+	// Messages are recorded as sent before they go out, so a failed send
+	// follows its Sent record.
+	SendFailed = Direction(3)
+)
+
+// Record is a single message in a recording
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	// Peer is the peer the message was sent to or received from
+	Peer    peer.ID
+	Message gsmsg.GraphSyncMessage
+}
+
+// Writer writes records to a stream. Each record is framed by its length, and
+// holds the time, direction and peer, followed by the message in the protobuf
+// encoding of protocol version 1.
+type Writer struct {
+	lk     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+// NewWriter returns a writer that writes records to the given stream
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write appends a record to the stream. It is safe to call concurrently.
+func (w *Writer) Write(record Record) error {
+	pbm, err := record.Message.ToProto()
+	if err != nil {
+		return err
+	}
+	messageData, err := pbm.Marshal()
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 0, 2*binary.MaxVarintLen64+1+len(record.Peer)+len(messageData))
+	frame = appendVarint(frame, record.Time.UnixNano())
+	frame = append(frame, byte(record.Direction))
+	frame = appendUvarint(frame, uint64(len(record.Peer)))
+	frame = append(frame, record.Peer...)
+	frame = append(frame, messageData...)
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if _, err := w.w.Write(appendUvarint(nil, uint64(len(frame)))); err != nil {
+		return err
+	}
+	_, err = w.w.Write(frame)
+	return err
+}
+
+// Close stops the writer from writing any more records. It waits for a record
+// being written to finish, so the stream can be read safely once it returns.
+func (w *Writer) Close() error {
+	w.lk.Lock()
+	w.closed = true
+	w.lk.Unlock()
+	return nil
+}
+
+// Reader reads records from a stream written by a Writer
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a reader that reads records from the given stream
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next record, or io.EOF once the stream ends
+func (r *Reader) Read() (Record, error) {
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, err
+	}
+	if length > maxRecordSize {
+		return Record{}, fmt.Errorf("record of %d bytes is larger than the maximum of %d bytes", length, maxRecordSize)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		return Record{}, unexpectedEOF(err)
+	}
+	return decodeFrame(frame)
+}
+
+func decodeFrame(frame []byte) (Record, error) {
+	errMalformed := errors.New("malformed record")
+	unixNano, n := binary.Varint(frame)
+	if n <= 0 {
+		return Record{}, errMalformed
+	}
+	frame = frame[n:]
+	if len(frame) == 0 {
+		return Record{}, errMalformed
+	}
+	direction := Direction(frame[0])
+	if direction != Sent && direction != Received && direction != SendFailed {
+		return Record{}, fmt.Errorf("unknown direction %d in record", direction)
+	}
+	frame = frame[1:]
+	peerLength, n := binary.Uvarint(frame)
+	if n <= 0 || uint64(len(frame)-n) < peerLength {
+		return Record{}, errMalformed
+	}
+	p := peer.ID(frame[n : n+int(peerLength)])
+	frame = frame[n+int(peerLength):]
+	pbm := new(pb.Message)
+	if err := pbm.Unmarshal(frame); err != nil {
+		return Record{}, err
+	}
+	message, err := gsmsg.FromProto(pbm)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Time:      time.Unix(0, unixNano),
+		Direction: direction,
+		Peer:      p,
+		Message:   message,
+	}, nil
+}
+
+func appendVarint(data []byte, value int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, value)
+	return append(data, buf[:n]...)
+}
+
+func appendUvarint(data []byte, value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, value)
+	return append(data, buf[:n]...)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Network is a network that records every message sent or received through it
+type Network struct {
+	network gsnet.GraphSyncNetwork
+	w       *Writer
+}
+
+var _ gsnet.GraphSyncNetwork = (*Network)(nil)
+var _ gsnet.AddrAdder = (*Network)(nil)
+var _ gsnet.ConnManagerProvider = (*Network)(nil)
+
+// New wraps a network so that every message sent or received through it is
+// recorded to w. Messages still go through if they cannot be recorded.
+// Messages are recorded as sent before they are handed to the network, so a
+// response to a message is never recorded ahead of it.
+func New(network gsnet.GraphSyncNetwork, w io.Writer) *Network {
+	return &Network{network: network, w: NewWriter(w)}
+}
+
+// Close stops recording. Messages still go through the network afterwards.
+// Once Close returns, nothing more is written to the recording.
+func (rn *Network) Close() error {
+	return rn.w.Close()
+}
+
+func (rn *Network) record(direction Direction, p peer.ID, message gsmsg.GraphSyncMessage) {
+	err := rn.w.Write(Record{Time: time.Now(), Direction: direction, Peer: p, Message: message})
+	if err != nil && err != ErrWriterClosed {
+		log.Warnf("unable to record message with peer %s: %s", p, err)
+	}
+}
+
+func (rn *Network) recordSend(p peer.ID, message gsmsg.GraphSyncMessage, send func() error) error {
+	rn.record(Sent, p, message)
+	err := send()
+	if err != nil {
+		rn.record(SendFailed, p, message)
+	}
+	return err
+}
+
+func (rn *Network) SendMessage(ctx context.Context, p peer.ID, outgoing gsmsg.GraphSyncMessage) error {
+	return rn.recordSend(p, outgoing, func() error {
+		return rn.network.SendMessage(ctx, p, outgoing)
+	})
+}
+
+func (rn *Network) SetDelegate(r gsnet.Receiver) {
+	rn.network.SetDelegate(&recordingReceiver{r, rn})
+}
+
+func (rn *Network) ConnectTo(ctx context.Context, p peer.ID) error {
+	return rn.network.ConnectTo(ctx, p)
+}
+
+// AddAddrs passes addresses on to the wrapped network, if it records them
+func (rn *Network) AddAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	if addrAdder, ok := rn.network.(gsnet.AddrAdder); ok {
+		addrAdder.AddAddrs(p, addrs)
+	}
+}
+
+// ConnectionManager returns the wrapped network's connection manager, or one
+// that does nothing if it has none
+func (rn *Network) ConnectionManager() gsnet.ConnManager {
+	if provider, ok := rn.network.(gsnet.ConnManagerProvider); ok {
+		return provider.ConnectionManager()
+	}
+	return connmgr.NullConnMgr{}
+}
+
+func (rn *Network) NewMessageSender(ctx context.Context, p peer.ID) (gsnet.MessageSender, error) {
+	sender, err := rn.network.NewMessageSender(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingMessageSender{sender, rn, p}, nil
+}
+
+type recordingMessageSender struct {
+	gsnet.MessageSender
+	rn *Network
+	p  peer.ID
+}
+
+func (rms *recordingMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	return rms.rn.recordSend(rms.p, msg, func() error {
+		return rms.MessageSender.SendMsg(ctx, msg)
+	})
+}
+
+type recordingReceiver struct {
+	gsnet.Receiver
+	rn *Network
+}
+
+func (rr *recordingReceiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	rr.rn.record(Received, sender, incoming)
+	rr.Receiver.ReceiveMessage(ctx, sender, incoming)
+}
@@ -0,0 +1,256 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/network/memnet"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type receiver struct {
+	messagesReceived chan gsmsg.GraphSyncMessage
+}
+
+func (r *receiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	r.messagesReceived <- incoming
+}
+
+func (r *receiver) ReceiveError(err error) {}
+
+func (r *receiver) Connected(p peer.ID) {}
+
+func (r *receiver) Disconnected(p peer.ID) {}
+
+func TestWriteAndReadRecords(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	request := gsmsg.New()
+	request.AddRequest(gsmsg.CancelRequest(graphsync.RequestID(4)))
+	response := gsmsg.New()
+	response.AddResponse(gsmsg.NewResponse(graphsync.RequestID(4), graphsync.PartialResponse))
+	response.AddBlock(testutil.GenerateBlocksOfSize(1, 100)[0])
+	records := []Record{
+		{Time: time.Unix(0, 1000), Direction: Sent, Peer: p, Message: request},
+		{Time: time.Unix(0, 5000), Direction: Received, Peer: p, Message: response},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, record := range records {
+		require.NoError(t, w.Write(record))
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	for _, expected := range records {
+		record, err := r.Read()
+		require.NoError(t, err)
+		require.True(t, expected.Time.Equal(record.Time))
+		require.Equal(t, expected.Direction, record.Direction)
+		require.Equal(t, expected.Peer, record.Peer)
+		require.Equal(t, expected.Message.Requests(), record.Message.Requests())
+		require.Equal(t, expected.Message.Responses(), record.Message.Responses())
+		require.Equal(t, expected.Message.Blocks(), record.Message.Blocks())
+	}
+	_, err := r.Read()
+	require.Equal(t, io.EOF, err)
+
+	// a recording cut off part way through a record is an error
+	r = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	_, err = r.Read()
+	require.NoError(t, err)
+	_, err = r.Read()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// nothing is written once the writer is closed
+	length := buf.Len()
+	require.NoError(t, w.Close())
+	require.Equal(t, ErrWriterClosed, w.Write(records[0]))
+	require.Equal(t, length, buf.Len())
+}
+
+func TestRecordsSentAndReceivedMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	hub, err := memnet.NewHub(ctx, 1, memnet.LinkOptions{})
+	require.NoError(t, err)
+	peers := testutil.GeneratePeers(2)
+	network1, err := hub.NewNetwork(peers[0])
+	require.NoError(t, err)
+	network2, err := hub.NewNetwork(peers[1])
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	recorded := New(network1, &buf)
+	r1 := &receiver{make(chan gsmsg.GraphSyncMessage, 1)}
+	r2 := &receiver{make(chan gsmsg.GraphSyncMessage, 1)}
+	recorded.SetDelegate(r1)
+	network2.SetDelegate(r2)
+
+	request := gsmsg.New()
+	request.AddRequest(gsmsg.CancelRequest(graphsync.RequestID(1)))
+	require.NoError(t, recorded.SendMessage(ctx, peers[1], request))
+	var received gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, r2.messagesReceived, &received, "should receive request")
+
+	response := gsmsg.New()
+	response.AddResponse(gsmsg.NewResponse(graphsync.RequestID(1), graphsync.RequestCancelled))
+	sender, err := network2.NewMessageSender(ctx, peers[0])
+	require.NoError(t, err)
+	require.NoError(t, sender.SendMsg(ctx, response))
+	testutil.AssertReceive(ctx, t, r1.messagesReceived, &received, "should receive response")
+
+	reader := NewReader(&buf)
+	record, err := reader.Read()
+	require.NoError(t, err)
+	require.Equal(t, Sent, record.Direction)
+	require.Equal(t, peers[1], record.Peer)
+	require.Equal(t, request.Requests(), record.Message.Requests())
+	record, err = reader.Read()
+	require.NoError(t, err)
+	require.Equal(t, Received, record.Direction)
+	require.Equal(t, peers[1], record.Peer)
+	require.Equal(t, response.Responses(), record.Message.Responses())
+	_, err = reader.Read()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestReplayRecordingIntoResponder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	hub, err := memnet.NewHub(ctx, 1, memnet.LinkOptions{})
+	require.NoError(t, err)
+	peers := testutil.GeneratePeers(2)
+	network1, err := hub.NewNetwork(peers[0])
+	require.NoError(t, err)
+	network2, err := hub.NewNetwork(peers[1])
+	require.NoError(t, err)
+
+	blockStore1 := make(map[ipld.Link][]byte)
+	loader1, storer1 := testutil.NewTestStore(blockStore1)
+	blockStore2 := make(map[ipld.Link][]byte)
+	loader2, storer2 := testutil.NewTestStore(blockStore2)
+	blockChainLength := 20
+	blockChain := testutil.SetupBlockChain(ctx, t, loader2, storer2, 100, blockChainLength)
+
+	// record the responder side of a transfer
+	var recording bytes.Buffer
+	requestor := gsimpl.New(ctx, network1, loader1, storer1)
+	recorded := New(network2, &recording)
+	gsimpl.New(ctx, recorded, loader2, storer2)
+	progressChan, errChan := requestor.Request(ctx, peers[1], blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	// the responder may still be sending, so stop recording before reading
+	require.NoError(t, recorded.Close())
+
+	var originalBlocks []string
+	reader := NewReader(bytes.NewReader(recording.Bytes()))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if record.Direction == Sent {
+			for _, block := range record.Message.Blocks() {
+				originalBlocks = append(originalBlocks, block.Cid().String())
+			}
+		}
+	}
+	require.Len(t, originalBlocks, blockChainLength)
+
+	// replaying the recording into a fresh responder produces the same blocks
+	// and finishes the same way
+	player := NewPlayer()
+	gsimpl.New(ctx, player, loader2, storer2)
+	require.NoError(t, player.Play(ctx, bytes.NewReader(recording.Bytes()), false))
+	require.Eventually(t, func() bool {
+		for _, record := range player.Sent() {
+			for _, response := range record.Message.Responses() {
+				if response.Status() == graphsync.RequestCompletedFull {
+					return true
+				}
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	var replayedBlocks []string
+	for _, record := range player.Sent() {
+		require.Equal(t, peers[0], record.Peer)
+		for _, block := range record.Message.Blocks() {
+			replayedBlocks = append(replayedBlocks, block.Cid().String())
+		}
+	}
+	require.ElementsMatch(t, originalBlocks, replayedBlocks)
+}
+
+func TestPacedReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	start := time.Now()
+	gap := 100 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		message := gsmsg.New()
+		message.AddRequest(gsmsg.CancelRequest(graphsync.RequestID(i)))
+		require.NoError(t, w.Write(Record{Time: start.Add(time.Duration(i) * gap), Direction: Received, Peer: p, Message: message}))
+		// sent records are skipped
+		require.NoError(t, w.Write(Record{Time: start.Add(time.Duration(i) * gap), Direction: Sent, Peer: p, Message: message}))
+	}
+
+	player := NewPlayer()
+	r := &receiver{make(chan gsmsg.GraphSyncMessage, 3)}
+	player.SetDelegate(r)
+	playStart := time.Now()
+	require.NoError(t, player.Play(ctx, &buf, true))
+	require.GreaterOrEqual(t, int64(time.Since(playStart)), int64(2*gap))
+	require.Len(t, r.messagesReceived, 3)
+	for i := 0; i < 3; i++ {
+		message := <-r.messagesReceived
+		require.Equal(t, graphsync.RequestID(i), message.Requests()[0].ID())
+	}
+}
+
+type failingNetwork struct {
+	gsnet.GraphSyncNetwork
+}
+
+func (fn failingNetwork) SendMessage(ctx context.Context, p peer.ID, outgoing gsmsg.GraphSyncMessage) error {
+	return errors.New("unable to send")
+}
+
+func TestRecordsFailedSends(t *testing.T) {
+	ctx := context.Background()
+	p := testutil.GeneratePeers(1)[0]
+	var buf bytes.Buffer
+	recorded := New(failingNetwork{}, &buf)
+
+	request := gsmsg.New()
+	request.AddRequest(gsmsg.CancelRequest(graphsync.RequestID(1)))
+	require.Error(t, recorded.SendMessage(ctx, p, request))
+
+	reader := NewReader(&buf)
+	for _, direction := range []Direction{Sent, SendFailed} {
+		record, err := reader.Read()
+		require.NoError(t, err)
+		require.Equal(t, direction, record.Direction)
+		require.Equal(t, p, record.Peer)
+		require.Equal(t, request.Requests(), record.Message.Requests())
+	}
+	_, err := reader.Read()
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,109 @@
+package partition
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// Partition describes the subset of blocks a responder should send for a
+// request that is split across several peers. Links are divided into Count
+// buckets by hash, and the responder only sends blocks that fall into one of
+// the listed Buckets.
+type Partition struct {
+	Count   int
+	Buckets []int
+}
+
+// Includes returns true if the block for the given link falls into one of the
+// buckets of this partition
+func (p Partition) Includes(link ipld.Link) bool {
+	if p.Count <= 1 {
+		return true
+	}
+	asCidLink, ok := link.(cidlink.Link)
+	if !ok {
+		return true
+	}
+	bucket := Bucket(asCidLink.Cid, p.Count)
+	for _, b := range p.Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// Bucket returns the bucket the given cid is assigned to when blocks are
+// split across count partitions
+func Bucket(c cid.Cid, count int) int {
+	hash := c.Hash()
+	if len(hash) < 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(hash[len(hash)-4:]) % uint32(count))
+}
+
+// EncodePartition encodes a partition into bytes for the partition extension
+func EncodePartition(p Partition) ([]byte, error) {
+	node, err := fluent.Build(basicnode.Style.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(2, func(na fluent.MapAssembler) {
+			na.AssembleEntry("count").AssignInt(p.Count)
+			na.AssembleEntry("buckets").CreateList(len(p.Buckets), func(na fluent.ListAssembler) {
+				for _, bucket := range p.Buckets {
+					na.AssembleValue().AssignInt(bucket)
+				}
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(node)
+}
+
+// DecodePartition decodes a partition from data for the partition extension
+func DecodePartition(data []byte) (Partition, error) {
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return Partition{}, err
+	}
+	countNode, err := node.LookupString("count")
+	if err != nil {
+		return Partition{}, err
+	}
+	count, err := countNode.AsInt()
+	if err != nil {
+		return Partition{}, err
+	}
+	if count <= 0 {
+		return Partition{}, errors.New("partition count must be positive")
+	}
+	bucketsNode, err := node.LookupString("buckets")
+	if err != nil {
+		return Partition{}, err
+	}
+	buckets := make([]int, 0, bucketsNode.Length())
+	iter := bucketsNode.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return Partition{}, err
+		}
+		bucket, err := next.AsInt()
+		if err != nil {
+			return Partition{}, err
+		}
+		if bucket < 0 || bucket >= count {
+			return Partition{}, errors.New("partition bucket out of range")
+		}
+		buckets = append(buckets, bucket)
+	}
+	return Partition{Count: count, Buckets: buckets}, nil
+}
@@ -0,0 +1,44 @@
+package partition
+
+import (
+	"testing"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestDecodeEncodePartition(t *testing.T) {
+	p := Partition{Count: 3, Buckets: []int{0, 2}}
+	encoded, err := EncodePartition(p)
+	require.NoError(t, err, "encode errored")
+	decoded, err := DecodePartition(encoded)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, p, decoded, "partition changed during encoding and decoding")
+
+	_, err = DecodePartition([]byte("not a partition"))
+	require.Error(t, err)
+}
+
+func TestPartitionsCoverAllLinks(t *testing.T) {
+	cids := testutil.GenerateCids(100)
+	partitions := []Partition{
+		{Count: 3, Buckets: []int{0}},
+		{Count: 3, Buckets: []int{1}},
+		{Count: 3, Buckets: []int{2}},
+	}
+	for _, c := range cids {
+		included := 0
+		for _, p := range partitions {
+			if p.Includes(cidlink.Link{Cid: c}) {
+				included++
+			}
+		}
+		require.Equal(t, 1, included, "each link should belong to exactly one partition")
+	}
+	whole := Partition{Count: 1}
+	for _, c := range cids {
+		require.True(t, whole.Includes(cidlink.Link{Cid: c}))
+	}
+}
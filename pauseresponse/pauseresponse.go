@@ -0,0 +1,22 @@
+package pauseresponse
+
+import (
+	"github.com/ipfs/go-graphsync/ipldutil"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// EncodePauseResponse encodes whether the response should pause into bytes
+// for the pause response extension
+func EncodePauseResponse(pause bool) ([]byte, error) {
+	return ipldutil.EncodeNode(basicnode.NewBool(pause))
+}
+
+// DecodePauseResponse decodes whether the response should pause from data
+// for the pause response extension
+func DecodePauseResponse(data []byte) (bool, error) {
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return false, err
+	}
+	return node.AsBool()
+}
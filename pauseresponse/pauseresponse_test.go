@@ -0,0 +1,20 @@
+package pauseresponse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEncodePauseResponse(t *testing.T) {
+	for _, pause := range []bool{true, false} {
+		encoded, err := EncodePauseResponse(pause)
+		require.NoError(t, err, "encode errored")
+		decoded, err := DecodePauseResponse(encoded)
+		require.NoError(t, err, "decode errored")
+		require.Equal(t, pause, decoded, "value changed during encoding and decoding")
+	}
+
+	_, err := DecodePauseResponse([]byte("not a bool"))
+	require.Error(t, err)
+}
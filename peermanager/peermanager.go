@@ -13,6 +13,12 @@ type PeerProcess interface {
 	Shutdown()
 }
 
+// Flusher is a peer process that can finish its outstanding work before it
+// shuts down
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
 // PeerProcessFactory provides a function that will create a PeerQueue.
 type PeerProcessFactory func(ctx context.Context, p peer.ID) PeerProcess
 
@@ -80,6 +86,36 @@ func (pm *PeerManager) Disconnected(p peer.ID) {
 
 }
 
+// FlushAndShutdown shuts down the processes for all peers. Processes that are
+// Flushers are first given until the context ends to finish their work.
+func (pm *PeerManager) FlushAndShutdown(ctx context.Context) error {
+	pm.peerProcessesLk.Lock()
+	peerProcesses := pm.peerProcesses
+	pm.peerProcesses = make(map[peer.ID]*peerProcessInstance)
+	pm.peerProcessesLk.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(peerProcesses))
+	for _, pqi := range peerProcesses {
+		wg.Add(1)
+		go func(process PeerProcess) {
+			defer wg.Done()
+			if flusher, ok := process.(Flusher); ok {
+				errs <- flusher.Flush(ctx)
+			}
+			process.Shutdown()
+		}(pqi.process)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetProcess returns the process for the given peer
 func (pm *PeerManager) GetProcess(
 	p peer.ID) PeerProcess {
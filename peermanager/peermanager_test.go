@@ -6,6 +6,7 @@ import (
 
 	"github.com/ipfs/go-graphsync/testutil"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
 )
 
 type fakePeerProcess struct {
@@ -50,3 +51,41 @@ func TestAddingAndRemovingPeers(t *testing.T) {
 
 	testutil.AssertContainsPeer(t, connectedPeers, peer2)
 }
+
+type fakeFlushingPeerProcess struct {
+	flushed  bool
+	shutdown bool
+}
+
+func (fp *fakeFlushingPeerProcess) Startup() {}
+func (fp *fakeFlushingPeerProcess) Shutdown() {
+	fp.shutdown = true
+}
+func (fp *fakeFlushingPeerProcess) Flush(ctx context.Context) error {
+	fp.flushed = true
+	return nil
+}
+
+func TestFlushAndShutdown(t *testing.T) {
+	ctx := context.Background()
+	var processes []*fakeFlushingPeerProcess
+	peerProcessFatory := func(ctx context.Context, p peer.ID) PeerProcess {
+		process := &fakeFlushingPeerProcess{}
+		processes = append(processes, process)
+		return process
+	}
+
+	tp := testutil.GeneratePeers(2)
+	peerManager := New(ctx, peerProcessFatory)
+	peerManager.Connected(tp[0])
+	peerManager.Connected(tp[1])
+
+	err := peerManager.FlushAndShutdown(ctx)
+	require.NoError(t, err)
+	require.Len(t, processes, 2)
+	for _, process := range processes {
+		require.True(t, process.flushed)
+		require.True(t, process.shutdown)
+	}
+	require.Empty(t, peerManager.ConnectedPeers())
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Limiter is a token bucket limiting how many bytes are sent per second. The
+// bucket holds up to one second of bytes. Sending more than the bucket holds
+// puts it into debt, which later sends wait out.
+type Limiter struct {
+	lk      sync.Mutex
+	rate    uint64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+// NewLimiter returns a limiter allowing rate bytes per second. A rate of zero
+// means no limit.
+func NewLimiter(rate uint64) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		tokens:  float64(rate),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate == 0 {
+		l.tokens = 0
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// Rate returns how many bytes per second the limiter allows
+func (l *Limiter) Rate() uint64 {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.rate
+}
+
+// SetRate changes how many bytes per second the limiter allows, and wakes
+// anyone waiting on Changed
+func (l *Limiter) SetRate(rate uint64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	l.refill(l.last)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Take records that n bytes were sent
+func (l *Limiter) Take(n uint64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.refill(time.Now())
+	if l.rate > 0 {
+		l.tokens -= float64(n)
+	}
+}
+
+// Delay returns how long to wait before sending more, at the current rate
+func (l *Limiter) Delay() time.Duration {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.refill(time.Now())
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Changed returns a channel that is closed the next time the rate changes
+func (l *Limiter) Changed() <-chan struct{} {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.changed
+}
+
+// Limits holds a limiter shared by all peers, and a limiter for each peer
+type Limits struct {
+	global *Limiter
+
+	lk       sync.Mutex
+	peerRate uint64
+	peers    map[peer.ID]*Limiter
+}
+
+// NewLimits returns limits allowing globalRate bytes per second across all
+// peers, and peerRate bytes per second to each peer. A rate of zero means no
+// limit.
+func NewLimits(globalRate uint64, peerRate uint64) *Limits {
+	return &Limits{
+		global:   NewLimiter(globalRate),
+		peerRate: peerRate,
+		peers:    make(map[peer.ID]*Limiter),
+	}
+}
+
+// SetGlobalRate changes how many bytes per second are allowed across all peers
+func (l *Limits) SetGlobalRate(rate uint64) {
+	l.global.SetRate(rate)
+}
+
+// SetPeerRate changes how many bytes per second are allowed to one peer, until
+// the peer is forgotten
+func (l *Limits) SetPeerRate(p peer.ID, rate uint64) {
+	l.peerLimiter(p).SetRate(rate)
+}
+
+// Limiters returns the global limiter and the limiter for the given peer
+func (l *Limits) Limiters(p peer.ID) (*Limiter, *Limiter) {
+	return l.global, l.peerLimiter(p)
+}
+
+// ForgetPeer drops the limiter for a peer, along with any rate set for it
+func (l *Limits) ForgetPeer(p peer.ID) {
+	l.lk.Lock()
+	delete(l.peers, p)
+	l.lk.Unlock()
+}
+
+func (l *Limits) peerLimiter(p peer.ID) *Limiter {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	limiter, ok := l.peers[p]
+	if !ok {
+		limiter = NewLimiter(l.peerRate)
+		l.peers[p] = limiter
+	}
+	return limiter
+}
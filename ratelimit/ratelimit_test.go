@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(1000)
+	require.Equal(t, uint64(1000), limiter.Rate())
+
+	// a full bucket lets a second of bytes through at once
+	limiter.Take(1000)
+	require.Less(t, int64(limiter.Delay()), int64(10*time.Millisecond))
+
+	// sending past the bucket goes into debt
+	limiter.Take(500)
+	delay := limiter.Delay()
+	require.Greater(t, int64(delay), int64(400*time.Millisecond))
+	require.LessOrEqual(t, int64(delay), int64(500*time.Millisecond))
+
+	// raising the rate shortens the wait, and wakes waiters
+	changed := limiter.Changed()
+	limiter.SetRate(10000)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("change should be signalled")
+	}
+	require.LessOrEqual(t, int64(limiter.Delay()), int64(50*time.Millisecond))
+
+	// no rate means no limit, and clears any debt
+	limiter.Take(100000)
+	limiter.SetRate(0)
+	require.Zero(t, limiter.Delay())
+	limiter.Take(100000)
+	require.Zero(t, limiter.Delay())
+}
+
+func TestLimits(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	limits := NewLimits(0, 100)
+
+	global, peer0 := limits.Limiters(peers[0])
+	require.Zero(t, global.Rate())
+	require.Equal(t, uint64(100), peer0.Rate())
+	_, samePeer0 := limits.Limiters(peers[0])
+	require.Equal(t, peer0, samePeer0)
+
+	// rates can be changed for one peer and for all peers
+	limits.SetPeerRate(peers[1], 1000)
+	_, peer1 := limits.Limiters(peers[1])
+	require.Equal(t, uint64(1000), peer1.Rate())
+	require.Equal(t, uint64(100), peer0.Rate())
+	limits.SetGlobalRate(5000)
+	require.Equal(t, uint64(5000), global.Rate())
+
+	// forgotten peers go back to the default rate
+	limits.ForgetPeer(peers[1])
+	_, peer1 = limits.Limiters(peers[1])
+	require.Equal(t, uint64(100), peer1.Rate())
+}
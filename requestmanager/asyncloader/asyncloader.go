@@ -13,9 +13,12 @@ import (
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/responsecache"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/unverifiedblockstore"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
+	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
 )
 
+var log = logging.Logger("graphsync")
+
 type loaderMessage interface {
 	handle(al *AsyncLoader)
 }
@@ -40,12 +43,16 @@ type AsyncLoader struct {
 	alternateQueues  map[string]alternateQueue
 	responseCache    *responsecache.ResponseCache
 	loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
+	memoryLimit      *unverifiedblockstore.MemoryLimit
+	// pausedRequests ignore responses until they are unpaused
+	pausedRequests map[graphsync.RequestID]struct{}
 }
 
 // New initializes a new link loading manager for asynchronous loads from the given context
 // and local store loading and storing function
 func New(ctx context.Context, loader ipld.Loader, storer ipld.Storer) *AsyncLoader {
-	responseCache, loadAttemptQueue := setupAttemptQueue(loader, storer)
+	memoryLimit := unverifiedblockstore.NewMemoryLimit()
+	responseCache, loadAttemptQueue := setupAttemptQueue(loader, storer, memoryLimit)
 	ctx, cancel := context.WithCancel(ctx)
 	return &AsyncLoader{
 		ctx:              ctx,
@@ -59,9 +66,25 @@ func New(ctx context.Context, loader ipld.Loader, storer ipld.Storer) *AsyncLoad
 		alternateQueues:  make(map[string]alternateQueue),
 		responseCache:    responseCache,
 		loadAttemptQueue: loadAttemptQueue,
+		memoryLimit:      memoryLimit,
+		pausedRequests:   make(map[graphsync.RequestID]struct{}),
 	}
 }
 
+// SetMemoryLimit limits how many bytes of received blocks that are not yet
+// verified are held in memory, across all requests. Blocks past the limit are
+// written to a temporary directory inside spillDir, or kept in memory if
+// spillDir is "". It must be called before the async loader starts.
+func (al *AsyncLoader) SetMemoryLimit(maxMemory uint64, spillDir string) {
+	al.memoryLimit.SetLimit(maxMemory, spillDir)
+}
+
+// AtMemoryLimit returns true if received blocks that are not yet verified
+// have reached the memory limit
+func (al *AsyncLoader) AtMemoryLimit() bool {
+	return al.memoryLimit.Full()
+}
+
 // Startup starts processing of messages
 func (al *AsyncLoader) Startup() {
 	go al.messageQueueWorker()
@@ -113,6 +136,9 @@ func (al *AsyncLoader) StartRequest(requestID graphsync.RequestID, persistenceOp
 // neccesary
 func (al *AsyncLoader) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
 	blks []blocks.Block) {
+	// count the blocks against the memory limit straight away, so callers see
+	// the limit reached before they are processed
+	al.memoryLimit.Receiving(blocksSize(blks))
 	select {
 	case <-al.ctx.Done():
 	case al.incomingMessages <- &newResponsesAvailableMessage{responses, blks}:
@@ -158,6 +184,36 @@ func (al *AsyncLoader) CleanupRequest(requestID graphsync.RequestID) {
 	}
 }
 
+// ClearMissingLinks indicates the given request is moving to a different peer,
+// so links the previous peer reported missing may still arrive
+func (al *AsyncLoader) ClearMissingLinks(requestID graphsync.RequestID) {
+	select {
+	case <-al.ctx.Done():
+	case al.incomingMessages <- &clearMissingLinksMessage{requestID}:
+	}
+}
+
+// PauseRequest indicates the given request is paused, and will be sent again
+// before it loads any more links. Blocks received for it that no other request
+// references are released, and further responses to it are ignored until
+// UnpauseRequest is called, so a paused request holds on to no memory.
+func (al *AsyncLoader) PauseRequest(requestID graphsync.RequestID) {
+	select {
+	case <-al.ctx.Done():
+	case al.incomingMessages <- &pauseRequestMessage{requestID}:
+	}
+}
+
+// UnpauseRequest indicates the given request is about to be sent again, so
+// responses to it are processed once more, and loads wait for them even if the
+// response before the pause had completed
+func (al *AsyncLoader) UnpauseRequest(requestID graphsync.RequestID) {
+	select {
+	case <-al.ctx.Done():
+	case al.incomingMessages <- &unpauseRequestMessage{requestID}:
+	}
+}
+
 type loadRequestMessage struct {
 	response    chan struct{}
 	requestID   graphsync.RequestID
@@ -190,10 +246,25 @@ type cleanupRequestMessage struct {
 	requestID graphsync.RequestID
 }
 
+type clearMissingLinksMessage struct {
+	requestID graphsync.RequestID
+}
+
+type pauseRequestMessage struct {
+	requestID graphsync.RequestID
+}
+
+type unpauseRequestMessage struct {
+	requestID graphsync.RequestID
+}
+
 func (al *AsyncLoader) run() {
 	for {
 		select {
 		case <-al.ctx.Done():
+			if err := al.memoryLimit.Close(); err != nil {
+				log.Warnf("Unable to remove unverified blocks from disk: %s", err)
+			}
 			return
 		case message := <-al.outgoingMessages:
 			message.handle(al)
@@ -256,7 +327,7 @@ func (rpom *registerPersistenceOptionMessage) register(al *AsyncLoader) error {
 	if existing {
 		return errors.New("already registerd a persistence option with this name")
 	}
-	responseCache, loadAttemptQueue := setupAttemptQueue(rpom.loader, rpom.storer)
+	responseCache, loadAttemptQueue := setupAttemptQueue(rpom.loader, rpom.storer, al.memoryLimit)
 	al.alternateQueues[rpom.name] = alternateQueue{responseCache, loadAttemptQueue}
 	return nil
 }
@@ -298,6 +369,9 @@ func (frm *finishRequestMessage) handle(al *AsyncLoader) {
 func (nram *newResponsesAvailableMessage) handle(al *AsyncLoader) {
 	byQueue := make(map[string][]graphsync.RequestID)
 	for requestID := range nram.responses {
+		if _, paused := al.pausedRequests[requestID]; paused {
+			continue
+		}
 		queue := al.requestQueues[requestID]
 		byQueue[queue] = append(byQueue[queue], requestID)
 	}
@@ -310,10 +384,15 @@ func (nram *newResponsesAvailableMessage) handle(al *AsyncLoader) {
 		}
 		responseCache.ProcessResponse(responses, nram.blks)
 		loadAttemptQueue.RetryLoads()
+		// blocks no request references are only pruned once waiting loads
+		// have had a chance to use them
+		responseCache.PruneUnreferencedBlocks()
 	}
+	al.memoryLimit.Received(blocksSize(nram.blks))
 }
 
 func (crm *cleanupRequestMessage) handle(al *AsyncLoader) {
+	delete(al.pausedRequests, crm.requestID)
 	aq, ok := al.requestQueues[crm.requestID]
 	if ok {
 		al.alternateQueues[aq].responseCache.FinishRequest(crm.requestID)
@@ -323,15 +402,41 @@ func (crm *cleanupRequestMessage) handle(al *AsyncLoader) {
 	al.responseCache.FinishRequest(crm.requestID)
 }
 
-func setupAttemptQueue(loader ipld.Loader, storer ipld.Storer) (*responsecache.ResponseCache, *loadattemptqueue.LoadAttemptQueue) {
+func (cmlm *clearMissingLinksMessage) handle(al *AsyncLoader) {
+	al.getResponseCache(al.requestQueues[cmlm.requestID]).ClearMissingLinks(cmlm.requestID)
+}
+
+func (prm *pauseRequestMessage) handle(al *AsyncLoader) {
+	al.pausedRequests[prm.requestID] = struct{}{}
+	al.getResponseCache(al.requestQueues[prm.requestID]).FinishRequest(prm.requestID)
+}
+
+func (urm *unpauseRequestMessage) handle(al *AsyncLoader) {
+	if _, ok := al.pausedRequests[urm.requestID]; !ok {
+		return
+	}
+	delete(al.pausedRequests, urm.requestID)
+	al.activeRequests[urm.requestID] = struct{}{}
+}
+
+func blocksSize(blks []blocks.Block) uint64 {
+	var size uint64
+	for _, block := range blks {
+		size += uint64(len(block.RawData()))
+	}
+	return size
+}
+
+func setupAttemptQueue(loader ipld.Loader, storer ipld.Storer, memoryLimit *unverifiedblockstore.MemoryLimit) (*responsecache.ResponseCache, *loadattemptqueue.LoadAttemptQueue) {
 
-	unverifiedBlockStore := unverifiedblockstore.New(storer)
+	unverifiedBlockStore := unverifiedblockstore.New(storer, memoryLimit)
 	responseCache := responsecache.New(unverifiedBlockStore)
 	loadAttemptQueue := loadattemptqueue.New(func(requestID graphsync.RequestID, link ipld.Link) types.AsyncLoadResult {
 		// load from response cache
 		data, err := responseCache.AttemptLoad(requestID, link)
-		if data == nil && err == nil {
-			// fall back to local store
+		if data == nil {
+			// fall back to local store, which also holds blocks other requests
+			// have already verified, even if this request's peer is missing them
 			stream, loadErr := loader(link, ipld.LinkContext{})
 			if stream != nil && loadErr == nil {
 				localData, loadErr := ioutil.ReadAll(stream)
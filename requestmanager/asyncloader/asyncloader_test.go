@@ -73,7 +73,8 @@ func TestAsyncLoadInitialLoadFails(t *testing.T) {
 
 		resultChan := asyncLoader.AsyncLoad(requestID, link)
 		assertFailResponse(ctx, t, resultChan)
-		st.AssertLocalLoads(t, 0)
+		// another request may have stored the block locally
+		st.AssertLocalLoads(t, 1)
 	})
 }
 
@@ -140,7 +141,7 @@ func TestAsyncLoadInitialLoadIndeterminateThenFails(t *testing.T) {
 		}
 		asyncLoader.ProcessResponse(responses, nil)
 		assertFailResponse(ctx, t, resultChan)
-		st.AssertLocalLoads(t, 1)
+		st.AssertLocalLoads(t, 2)
 	})
 }
 
@@ -283,6 +284,177 @@ func TestRequestSplittingSameBlockOnlyOneResponse(t *testing.T) {
 	})
 }
 
+func TestAsyncLoadMissingThenClearedThenSucceeds(t *testing.T) {
+	blocks := testutil.GenerateBlocksOfSize(1, 100)
+	block := blocks[0]
+	link := cidlink.Link{Cid: block.Cid()}
+	st := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID, "")
+		require.NoError(t, err)
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: link, BlockPresent: false},
+			},
+		}
+		asyncLoader.ProcessResponse(responses, nil)
+
+		// the request moves to a peer that has the block
+		asyncLoader.ClearMissingLinks(requestID)
+		resultChan := asyncLoader.AsyncLoad(requestID, link)
+		st.AssertAttemptLoadWithoutResult(ctx, t, resultChan)
+
+		responses = map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: link, BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(responses, blocks)
+		assertSuccessResponse(ctx, t, resultChan)
+		st.AssertBlockStored(t, block)
+	})
+}
+
+func TestSharedBlockMissingForOneRequest(t *testing.T) {
+	blocks := testutil.GenerateBlocksOfSize(2, 100)
+	link1 := cidlink.Link{Cid: blocks[0].Cid()}
+	link2 := cidlink.Link{Cid: blocks[1].Cid()}
+	st := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID1 := graphsync.RequestID(rand.Int31())
+		requestID2 := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID1, "")
+		require.NoError(t, err)
+		err = asyncLoader.StartRequest(requestID2, "")
+		require.NoError(t, err)
+
+		// the first request's peer sends both blocks, while the second
+		// request's peer is missing them
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID1: metadata.Metadata{
+				metadata.Item{Link: link1, BlockPresent: true},
+				metadata.Item{Link: link2, BlockPresent: true},
+			},
+			requestID2: metadata.Metadata{
+				metadata.Item{Link: link1, BlockPresent: false},
+				metadata.Item{Link: link2, BlockPresent: false},
+			},
+		}
+		asyncLoader.ProcessResponse(responses, blocks)
+
+		// an unverified block is loaded from the response cache
+		resultChan := asyncLoader.AsyncLoad(requestID2, link1)
+		assertSuccessResponse(ctx, t, resultChan)
+		st.AssertLocalLoads(t, 0)
+		st.AssertBlockStored(t, blocks[0])
+
+		// a block verified by the other request is loaded from the local store
+		resultChan = asyncLoader.AsyncLoad(requestID1, link2)
+		assertSuccessResponse(ctx, t, resultChan)
+		resultChan = asyncLoader.AsyncLoad(requestID2, link2)
+		assertSuccessResponse(ctx, t, resultChan)
+		st.AssertLocalLoads(t, 1)
+	})
+}
+
+func TestUnreferencedBlockSatisfiesWaitingLoad(t *testing.T) {
+	blocks := testutil.GenerateBlocksOfSize(2, 100)
+	link := cidlink.Link{Cid: blocks[1].Cid()}
+	st := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID1 := graphsync.RequestID(rand.Int31())
+		requestID2 := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID1, "")
+		require.NoError(t, err)
+		err = asyncLoader.StartRequest(requestID2, "")
+		require.NoError(t, err)
+		resultChan := asyncLoader.AsyncLoad(requestID2, link)
+		st.AssertAttemptLoadWithoutResult(ctx, t, resultChan)
+
+		// the block arrives with a response that does not reference it
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID1: metadata.Metadata{
+				metadata.Item{Link: cidlink.Link{Cid: blocks[0].Cid()}, BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(responses, blocks)
+		assertSuccessResponse(ctx, t, resultChan)
+		st.AssertBlockStored(t, blocks[1])
+	})
+}
+
+func TestMemoryLimit(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	st := newStore()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetMemoryLimit(150, "")
+	asyncLoader.Startup()
+
+	blocks := testutil.GenerateBlocksOfSize(2, 100)
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	md := make(metadata.Metadata, 0, len(blocks))
+	for _, block := range blocks {
+		md = append(md, metadata.Item{Link: cidlink.Link{Cid: block.Cid()}, BlockPresent: true})
+	}
+	asyncLoader.ProcessResponse(map[graphsync.RequestID]metadata.Metadata{requestID: md}, blocks)
+	require.Eventually(t, asyncLoader.AtMemoryLimit, time.Second, 10*time.Millisecond)
+
+	// verifying blocks frees memory
+	for _, block := range blocks {
+		resultChan := asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: block.Cid()})
+		assertSuccessResponse(ctx, t, resultChan)
+	}
+	require.False(t, asyncLoader.AtMemoryLimit())
+}
+
+func TestPauseRequestReleasesBlocks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	st := newStore()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetMemoryLimit(150, "")
+	asyncLoader.Startup()
+
+	blocks := testutil.GenerateBlocksOfSize(2, 100)
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	md := make(metadata.Metadata, 0, len(blocks))
+	for _, block := range blocks {
+		md = append(md, metadata.Item{Link: cidlink.Link{Cid: block.Cid()}, BlockPresent: true})
+	}
+	responses := map[graphsync.RequestID]metadata.Metadata{requestID: md}
+	asyncLoader.ProcessResponse(responses, blocks)
+	require.Eventually(t, asyncLoader.AtMemoryLimit, time.Second, 10*time.Millisecond)
+
+	// pausing the request lets go of the blocks it holds
+	asyncLoader.PauseRequest(requestID)
+	require.Eventually(t, func() bool { return !asyncLoader.AtMemoryLimit() }, time.Second, 10*time.Millisecond)
+
+	// responses that arrive while it is paused are dropped
+	asyncLoader.ProcessResponse(responses, blocks)
+	require.Eventually(t, func() bool { return !asyncLoader.AtMemoryLimit() }, time.Second, 10*time.Millisecond)
+
+	// once it is unpaused, loads wait for it to be sent again, even though the
+	// response before the pause completed
+	asyncLoader.CompleteResponsesFor(requestID)
+	asyncLoader.UnpauseRequest(requestID)
+	resultChans := make([]<-chan types.AsyncLoadResult, 0, len(blocks))
+	for _, block := range blocks {
+		resultChans = append(resultChans, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: block.Cid()}))
+	}
+	asyncLoader.ProcessResponse(responses, blocks)
+	for _, resultChan := range resultChans {
+		assertSuccessResponse(ctx, t, resultChan)
+	}
+}
+
 type store struct {
 	internalLoader ipld.Loader
 	storer         ipld.Storer
@@ -25,7 +25,10 @@ type UnverifiedBlockStore interface {
 }
 
 // ResponseCache maintains a store of unverified blocks and response
-// data about links for loading, and prunes blocks as needed.
+// data about links for loading, and prunes blocks as needed. Blocks are shared
+// by all requests using the cache, so a block received for one request can
+// satisfy another request that traverses the same link, even if the other
+// request's peer does not have it.
 type ResponseCache struct {
 	responseCacheLk sync.RWMutex
 
@@ -53,19 +56,34 @@ func (rc *ResponseCache) FinishRequest(requestID graphsync.RequestID) {
 	rc.responseCacheLk.Unlock()
 }
 
-// AttemptLoad attempts to laod the given block from the cache
+// ClearMissingLinks forgets the links the given request's peer reported
+// missing, so they can be loaded from a different peer
+func (rc *ResponseCache) ClearMissingLinks(requestID graphsync.RequestID) {
+	rc.responseCacheLk.Lock()
+	rc.linkTracker.ClearMissingLinks(requestID)
+	rc.responseCacheLk.Unlock()
+}
+
+// AttemptLoad attempts to laod the given block from the cache, which may have
+// been received for any request. It only returns an error if the block is not
+// in the cache and the request's peer is known to be missing it.
 func (rc *ResponseCache) AttemptLoad(requestID graphsync.RequestID, link ipld.Link) ([]byte, error) {
 	rc.responseCacheLk.Lock()
 	defer rc.responseCacheLk.Unlock()
+	data, _ := rc.unverifiedBlockStore.VerifyBlock(link)
+	if data != nil {
+		return data, nil
+	}
 	if rc.linkTracker.IsKnownMissingLink(requestID, link) {
 		return nil, fmt.Errorf("Remote Peer Is Missing Block: %s", link.String())
 	}
-	data, _ := rc.unverifiedBlockStore.VerifyBlock(link)
-	return data, nil
+	return nil, nil
 }
 
 // ProcessResponse processes incoming response data, adding unverified blocks,
-// and tracking link metadata from a remote peer
+// and tracking link metadata from a remote peer. Blocks that no request
+// references are kept until PruneUnreferencedBlocks is called, so loads
+// already waiting in any request can use them first.
 func (rc *ResponseCache) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
 	blks []blocks.Block) {
 	rc.responseCacheLk.Lock()
@@ -82,10 +100,15 @@ func (rc *ResponseCache) ProcessResponse(responses map[graphsync.RequestID]metad
 		}
 	}
 
-	// prune unused blocks right away
+	rc.responseCacheLk.Unlock()
+}
+
+// PruneUnreferencedBlocks removes blocks that no in progress request has
+// traversed
+func (rc *ResponseCache) PruneUnreferencedBlocks() {
+	rc.responseCacheLk.Lock()
 	rc.unverifiedBlockStore.PruneBlocks(func(link ipld.Link) bool {
 		return rc.linkTracker.BlockRefCount(link) == 0
 	})
-
 	rc.responseCacheLk.Unlock()
 }
@@ -99,6 +99,8 @@ func TestResponseCacheManagingLinks(t *testing.T) {
 
 	responseCache.ProcessResponse(responses, blks)
 
+	require.Len(t, fubs.blocks(), len(blks), "should keep block with no references until pruned")
+	responseCache.PruneUnreferencedBlocks()
 	require.Len(t, fubs.blocks(), len(blks)-1, "should prune block with no references")
 	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[2])
 
@@ -111,13 +113,9 @@ func TestResponseCacheManagingLinks(t *testing.T) {
 	require.Len(t, fubs.blocks(), len(blks)-2, "should prune block once verified")
 	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[4])
 
-	// fails as it is a known missing block
+	// should succeed for request 1, even though its peer is missing the block,
+	// as request 2 received it
 	data, err = responseCache.AttemptLoad(requestID1, cidlink.Link{Cid: blks[1].Cid()})
-	require.Error(t, err)
-	require.Nil(t, data, "no data should be returned for missing block")
-
-	// should succeed for request 2 where it's not a missing block
-	data, err = responseCache.AttemptLoad(requestID2, cidlink.Link{Cid: blks[1].Cid()})
 	require.NoError(t, err)
 	require.Equal(t, blks[1].RawData(), data)
 
@@ -125,6 +123,16 @@ func TestResponseCacheManagingLinks(t *testing.T) {
 	require.Len(t, fubs.blocks(), len(blks)-3, "should prune block once verified")
 	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[1])
 
+	// fails as it is a known missing block no longer in the cache
+	data, err = responseCache.AttemptLoad(requestID1, cidlink.Link{Cid: blks[1].Cid()})
+	require.Error(t, err)
+	require.Nil(t, data, "no data should be returned for missing block")
+
+	// should be unknown result for request 2 where it's not a missing block
+	data, err = responseCache.AttemptLoad(requestID2, cidlink.Link{Cid: blks[1].Cid()})
+	require.NoError(t, err)
+	require.Nil(t, data)
+
 	// should be unknown result as block is not known missing or present in block store
 	data, err = responseCache.AttemptLoad(requestID1, cidlink.Link{Cid: blks[2].Cid()})
 	require.NoError(t, err)
@@ -2,37 +2,58 @@ package unverifiedblockstore
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
 
+	logging "github.com/ipfs/go-log"
 	ipld "github.com/ipld/go-ipld-prime"
 )
 
+var log = logging.Logger("graphsync")
+
+type unverifiedBlock struct {
+	data []byte
+	// path is set instead of data for blocks spilled to disk
+	path string
+	size uint64
+}
+
 // UnverifiedBlockStore holds an in memory cache of receied blocks from the network
 // that have not been verified to be part of a traversal
 type UnverifiedBlockStore struct {
-	inMemoryBlocks map[ipld.Link][]byte
+	inMemoryBlocks map[ipld.Link]unverifiedBlock
 	storer         ipld.Storer
+	memoryLimit    *MemoryLimit
 }
 
 // New initializes a new unverified store with the given storer function for writing
-// to permaneant storage if the block is verified
-func New(storer ipld.Storer) *UnverifiedBlockStore {
+// to permaneant storage if the block is verified. The memory used by blocks is
+// counted against the given memory limit, which may be shared by several stores
+func New(storer ipld.Storer, memoryLimit *MemoryLimit) *UnverifiedBlockStore {
 	return &UnverifiedBlockStore{
-		inMemoryBlocks: make(map[ipld.Link][]byte),
+		inMemoryBlocks: make(map[ipld.Link]unverifiedBlock),
 		storer:         storer,
+		memoryLimit:    memoryLimit,
 	}
 }
 
 // AddUnverifiedBlock adds a new unverified block to the in memory cache as it
-// comes in as part of a traversal.
+// comes in as part of a traversal. Once the memory limit is reached, blocks
+// are written to the spill directory if there is one.
 func (ubs *UnverifiedBlockStore) AddUnverifiedBlock(lnk ipld.Link, data []byte) {
-	ubs.inMemoryBlocks[lnk] = data
+	if existing, ok := ubs.inMemoryBlocks[lnk]; ok {
+		ubs.memoryLimit.release(existing)
+	}
+	ubs.inMemoryBlocks[lnk] = ubs.memoryLimit.allocate(data)
 }
 
 // PruneBlocks removes blocks from the unverified store without committing them,
 // if the passed in function returns true for the given link
 func (ubs *UnverifiedBlockStore) PruneBlocks(shouldPrune func(ipld.Link) bool) {
-	for link := range ubs.inMemoryBlocks {
+	for link, block := range ubs.inMemoryBlocks {
 		if shouldPrune(link) {
+			ubs.memoryLimit.release(block)
 			delete(ubs.inMemoryBlocks, link)
 		}
 	}
@@ -41,11 +62,16 @@ func (ubs *UnverifiedBlockStore) PruneBlocks(shouldPrune func(ipld.Link) bool) {
 // VerifyBlock verifies the data for the given link as being part of a traversal,
 // removes it from the unverified store, and writes it to permaneant storage.
 func (ubs *UnverifiedBlockStore) VerifyBlock(lnk ipld.Link) ([]byte, error) {
-	data, ok := ubs.inMemoryBlocks[lnk]
+	block, ok := ubs.inMemoryBlocks[lnk]
 	if !ok {
 		return nil, fmt.Errorf("Block not found")
 	}
 	delete(ubs.inMemoryBlocks, lnk)
+	data, err := ubs.memoryLimit.read(block)
+	ubs.memoryLimit.release(block)
+	if err != nil {
+		return nil, err
+	}
 	buffer, committer, err := ubs.storer(ipld.LinkContext{})
 	if err != nil {
 		return nil, err
@@ -60,3 +86,124 @@ func (ubs *UnverifiedBlockStore) VerifyBlock(lnk ipld.Link) ([]byte, error) {
 	}
 	return data, nil
 }
+
+// MemoryLimit tracks the memory used by unverified blocks across all of the
+// stores that share it. A limit of zero means memory is not limited.
+//
+// Blocks past the limit are written to a temporary directory inside the spill
+// directory, if one is set. Otherwise they are kept in memory. Either way, the
+// limit reports itself as full until the blocks are verified or pruned, so the
+// requestor can slow down the responders sending them.
+//
+// MemoryLimit is not safe for concurrent use, except for Full, Receiving
+// and Received.
+type MemoryLimit struct {
+	maxMemory uint64
+	spillDir  string
+	tempDir   string
+	inMemory  uint64
+	// used counts blocks in memory and on disk, and pending counts blocks on
+	// their way to a store. Both are accessed atomically.
+	used    uint64
+	pending uint64
+}
+
+// NewMemoryLimit returns a memory limit that does not limit memory until
+// SetLimit is called
+func NewMemoryLimit() *MemoryLimit {
+	return &MemoryLimit{}
+}
+
+// SetLimit sets how many bytes of unverified blocks are held in memory, and
+// the directory blocks past the limit are written to, or "" to keep them in
+// memory
+func (ml *MemoryLimit) SetLimit(maxMemory uint64, spillDir string) {
+	ml.maxMemory = maxMemory
+	ml.spillDir = spillDir
+}
+
+// Full returns true if unverified blocks, in memory, on disk, or on their way
+// to a store, have reached the memory limit
+func (ml *MemoryLimit) Full() bool {
+	return ml.maxMemory != 0 && atomic.LoadUint64(&ml.used)+atomic.LoadUint64(&ml.pending) >= ml.maxMemory
+}
+
+// Receiving counts blocks of the given size that will be added to a store
+// shortly against the limit
+func (ml *MemoryLimit) Receiving(size uint64) {
+	atomic.AddUint64(&ml.pending, size)
+}
+
+// Received stops counting blocks passed to Receiving, once they are added
+// to a store or dropped
+func (ml *MemoryLimit) Received(size uint64) {
+	atomic.AddUint64(&ml.pending, ^(size - 1))
+}
+
+// Close removes any blocks still on disk
+func (ml *MemoryLimit) Close() error {
+	if ml.tempDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(ml.tempDir)
+	ml.tempDir = ""
+	return err
+}
+
+func (ml *MemoryLimit) allocate(data []byte) unverifiedBlock {
+	size := uint64(len(data))
+	block := unverifiedBlock{data: data, size: size}
+	if ml.spillDir != "" && ml.maxMemory != 0 && ml.inMemory+size > ml.maxMemory {
+		path, err := ml.spill(data)
+		if err != nil {
+			log.Warnf("Unable to write unverified block to disk, keeping it in memory: %s", err)
+		} else {
+			block = unverifiedBlock{path: path, size: size}
+		}
+	}
+	if block.path == "" {
+		ml.inMemory += size
+	}
+	atomic.AddUint64(&ml.used, size)
+	return block
+}
+
+func (ml *MemoryLimit) spill(data []byte) (string, error) {
+	if ml.tempDir == "" {
+		tempDir, err := ioutil.TempDir(ml.spillDir, "graphsync-unverified-")
+		if err != nil {
+			return "", err
+		}
+		ml.tempDir = tempDir
+	}
+	file, err := ioutil.TempFile(ml.tempDir, "block-")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (ml *MemoryLimit) read(block unverifiedBlock) ([]byte, error) {
+	if block.path == "" {
+		return block.data, nil
+	}
+	return ioutil.ReadFile(block.path)
+}
+
+func (ml *MemoryLimit) release(block unverifiedBlock) {
+	atomic.AddUint64(&ml.used, ^(block.size - 1))
+	if block.path == "" {
+		ml.inMemory -= block.size
+	} else if err := os.Remove(block.path); err != nil {
+		log.Warnf("Unable to remove unverified block from disk: %s", err)
+	}
+}
@@ -3,6 +3,9 @@ package unverifiedblockstore
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ipld/go-ipld-prime"
@@ -16,7 +19,7 @@ import (
 func TestVerifyBlockPresent(t *testing.T) {
 	blocksWritten := make(map[ipld.Link][]byte)
 	loader, storer := testutil.NewTestStore(blocksWritten)
-	unverifiedBlockStore := New(storer)
+	unverifiedBlockStore := New(storer, NewMemoryLimit())
 	block := testutil.GenerateBlocksOfSize(1, 100)[0]
 	reader, err := loader(cidlink.Link{Cid: block.Cid()}, ipld.LinkContext{})
 	require.Nil(t, reader)
@@ -45,3 +48,85 @@ func TestVerifyBlockPresent(t *testing.T) {
 	require.Nil(t, data)
 	require.Error(t, err, "block cannot be verified twice")
 }
+
+func TestMemoryLimit(t *testing.T) {
+	blocksWritten := make(map[ipld.Link][]byte)
+	_, storer := testutil.NewTestStore(blocksWritten)
+	memoryLimit := NewMemoryLimit()
+	memoryLimit.SetLimit(250, "")
+	unverifiedBlockStore := New(storer, memoryLimit)
+	otherStore := New(storer, memoryLimit)
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+
+	unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+	unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData())
+	require.False(t, memoryLimit.Full())
+
+	// the limit is shared between stores
+	otherStore.AddUnverifiedBlock(cidlink.Link{Cid: blks[2].Cid()}, blks[2].RawData())
+	require.True(t, memoryLimit.Full())
+
+	// blocks past the limit are still kept without a spill directory
+	data, err := otherStore.VerifyBlock(cidlink.Link{Cid: blks[2].Cid()})
+	require.NoError(t, err)
+	require.Equal(t, blks[2].RawData(), data)
+	require.False(t, memoryLimit.Full())
+
+	unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: blks[2].Cid()}, blks[2].RawData())
+	require.True(t, memoryLimit.Full())
+	unverifiedBlockStore.PruneBlocks(func(link ipld.Link) bool {
+		return link.(cidlink.Link).Cid != blks[0].Cid()
+	})
+	require.False(t, memoryLimit.Full())
+}
+
+func TestSpillToDisk(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "graphsync-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	blocksWritten := make(map[ipld.Link][]byte)
+	_, storer := testutil.NewTestStore(blocksWritten)
+	memoryLimit := NewMemoryLimit()
+	memoryLimit.SetLimit(250, spillDir)
+	unverifiedBlockStore := New(storer, memoryLimit)
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	for _, blk := range blks {
+		unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: blk.Cid()}, blk.RawData())
+	}
+	require.True(t, memoryLimit.Full())
+
+	// blocks past the memory limit are on disk
+	tempDirs, err := ioutil.ReadDir(spillDir)
+	require.NoError(t, err)
+	require.Len(t, tempDirs, 1)
+	tempDir := filepath.Join(spillDir, tempDirs[0].Name())
+	spilled, err := ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, spilled, 2)
+
+	for _, blk := range blks {
+		data, err := unverifiedBlockStore.VerifyBlock(cidlink.Link{Cid: blk.Cid()})
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), data)
+		require.Equal(t, blk.RawData(), blocksWritten[cidlink.Link{Cid: blk.Cid()}])
+	}
+	require.False(t, memoryLimit.Full())
+	spilled, err = ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, spilled)
+
+	// pruned blocks are removed from disk, and closing removes the rest
+	for _, blk := range blks {
+		unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: blk.Cid()}, blk.RawData())
+	}
+	unverifiedBlockStore.PruneBlocks(func(link ipld.Link) bool {
+		return link.(cidlink.Link).Cid == blks[3].Cid()
+	})
+	spilled, err = ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, spilled, 1)
+	require.NoError(t, memoryLimit.Close())
+	_, err = os.Stat(tempDir)
+	require.True(t, os.IsNotExist(err))
+}
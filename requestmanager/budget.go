@@ -0,0 +1,32 @@
+package requestmanager
+
+import (
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/budget"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// applyBudget combines the budget extension on a request with a budget set by
+// request hooks, keeping the stricter limits. If hooks set a budget, the
+// request is updated so the responder enforces the combined budget as well.
+func applyBudget(request gsmsg.GraphSyncRequest, hooksBudget graphsync.Budget) (gsmsg.GraphSyncRequest, graphsync.Budget, error) {
+	var requestBudget graphsync.Budget
+	budgetData, has := request.Extension(graphsync.ExtensionBudget)
+	if has {
+		var err error
+		requestBudget, err = budget.DecodeBudget(budgetData)
+		if err != nil {
+			return request, graphsync.Budget{}, err
+		}
+	}
+	if hooksBudget == (graphsync.Budget{}) {
+		return request, requestBudget, nil
+	}
+	requestBudget = budget.Min(requestBudget, hooksBudget)
+	budgetData, err := budget.EncodeBudget(requestBudget)
+	if err != nil {
+		return request, graphsync.Budget{}, err
+	}
+	request = request.ReplaceExtensions([]graphsync.ExtensionData{{Name: graphsync.ExtensionBudget, Data: budgetData}})
+	return request, requestBudget, nil
+}
@@ -0,0 +1,473 @@
+package requestmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// defaultCoalesceBufferSize is how many responses and errors are buffered for
+// each subscriber of a shared request, and how many a shared request keeps to
+// replay to subscribers that join late
+const defaultCoalesceBufferSize = 64
+
+// DefaultCoalesceDetachAfter is how long a shared request waits for room in a
+// subscriber's buffer before detaching it, unless set otherwise
+const DefaultCoalesceDetachAfter = time.Second
+
+type startRequestFn func(ctx context.Context) (<-chan graphsync.ResponseProgress, <-chan error)
+
+// coalescedRequests tracks requests that are shared by every caller making an
+// identical request while it is in progress, so the peer only sends the data
+// once. A shared request is only cancelled once all of its subscribers have
+// cancelled.
+//
+// Each subscriber reads from its own bounded buffer. A subscriber whose buffer
+// stays full for detachAfter is detached, and gets the rest of the response
+// from a request of its own. If detachAfter is zero, subscribers are never
+// detached, and a full buffer holds up the shared request until there is
+// room. A shared request only takes new subscribers until it has
+// returned more than fits in a buffer; after that, an identical request starts
+// a new shared request.
+type coalescedRequests struct {
+	ctx         context.Context
+	bufferSize  int
+	detachAfter time.Duration
+	lk          sync.Mutex
+	requests    map[string]*coalescedRequest
+}
+
+// coalescedRequest is a request in progress and its subscribers
+type coalescedRequest struct {
+	cancel context.CancelFunc
+
+	lk          sync.Mutex
+	subscribers map[*coalescedSubscriber]struct{}
+	// open is set while late subscribers can still join, and replayResponses
+	// and replayErrors hold what the request has returned so far for them
+	open            bool
+	replayResponses []graphsync.ResponseProgress
+	replayErrors    []error
+}
+
+// coalescedSubscriber is a caller subscribed to a shared request
+type coalescedSubscriber struct {
+	ctx   context.Context
+	start startRequestFn
+	// responses and errors buffer what the shared request returns until the
+	// subscriber reads it. Only the shared request fills and closes them, until
+	// the subscriber is detached.
+	responses chan graphsync.ResponseProgress
+	errors    chan error
+	// deliveredResponses counts the responses put in the buffer by path, and
+	// deliveredErrors counts the errors by message, so a detached subscriber is
+	// not sent them again by its own request
+	deliveredResponses map[string]int
+	deliveredErrors    map[string]int
+}
+
+func newCoalescedRequests(ctx context.Context) *coalescedRequests {
+	return &coalescedRequests{
+		ctx:         ctx,
+		bufferSize:  defaultCoalesceBufferSize,
+		detachAfter: DefaultCoalesceDetachAfter,
+		requests:    make(map[string]*coalescedRequest),
+	}
+}
+
+// coalesceKey identifies requests that return the same data. Requests with
+// different retry policies are kept apart, since a shared request retries as
+// the policy of the caller that started it says.
+func coalesceKey(peers []peer.ID, root ipld.Link, selector ipld.Node, extensions []graphsync.ExtensionData, retryPolicy *graphsync.RetryPolicy) (string, error) {
+	encodedSelector, err := ipldutil.EncodeNode(selector)
+	if err != nil {
+		return "", err
+	}
+	sortedPeers := make([]peer.ID, len(peers))
+	copy(sortedPeers, peers)
+	sort.Slice(sortedPeers, func(i, j int) bool { return sortedPeers[i] < sortedPeers[j] })
+	sorted := make([]graphsync.ExtensionData, len(extensions))
+	copy(sorted, extensions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	var key bytes.Buffer
+	writeKeyPart := func(part []byte) {
+		var length [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(length[:], uint64(len(part)))
+		key.Write(length[:n])
+		key.Write(part)
+	}
+	writeKeyPart([]byte{byte(len(sortedPeers))})
+	for _, p := range sortedPeers {
+		writeKeyPart([]byte(p))
+	}
+	writeKeyPart([]byte(root.String()))
+	writeKeyPart(encodedSelector)
+	for _, extension := range sorted {
+		writeKeyPart([]byte(extension.Name))
+		writeKeyPart(extension.Data)
+	}
+	if retryPolicy == nil {
+		writeKeyPart(nil)
+		return key.String(), nil
+	}
+	writeKeyPart(uvarintBytes(uint64(retryPolicy.MaxAttempts)))
+	writeKeyPart(uvarintBytes(uint64(len(retryPolicy.Backoff))))
+	for _, backoff := range retryPolicy.Backoff {
+		writeKeyPart(uvarintBytes(uint64(backoff)))
+	}
+	for _, p := range retryPolicy.FallbackPeers {
+		writeKeyPart([]byte(p))
+	}
+	return key.String(), nil
+}
+
+func uvarintBytes(value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, value)
+	return buf[:n]
+}
+
+// subscribe returns the responses of the request in progress with the given
+// key, starting it first if there is none. start sends the request for this
+// caller alone, and is also used if the caller is detached.
+func (crs *coalescedRequests) subscribe(ctx context.Context, key string, start startRequestFn) (<-chan graphsync.ResponseProgress, <-chan error) {
+	sub := &coalescedSubscriber{
+		ctx:                ctx,
+		start:              start,
+		responses:          make(chan graphsync.ResponseProgress, crs.bufferSize),
+		errors:             make(chan error, crs.bufferSize),
+		deliveredResponses: make(map[string]int),
+		deliveredErrors:    make(map[string]int),
+	}
+	crs.lk.Lock()
+	cr, ok := crs.requests[key]
+	var requestCtx context.Context
+	if !ok {
+		requestCtx, cr = crs.newCoalescedRequest()
+		crs.requests[key] = cr
+	}
+	cr.lk.Lock()
+	cr.subscribers[sub] = struct{}{}
+	// the replay always fits, since the request closes to new subscribers
+	// before it has returned more than a buffer holds
+	for _, response := range cr.replayResponses {
+		sub.responses <- response
+		sub.deliveredResponses[response.Path.String()]++
+	}
+	for _, err := range cr.replayErrors {
+		sub.errors <- err
+		sub.deliveredErrors[err.Error()]++
+	}
+	cr.lk.Unlock()
+	crs.lk.Unlock()
+
+	if !ok {
+		incomingResponses, incomingErrors := start(requestCtx)
+		go crs.collect(key, cr, incomingResponses, incomingErrors)
+	}
+	return crs.deliver(key, cr, sub)
+}
+
+func (crs *coalescedRequests) newCoalescedRequest() (context.Context, *coalescedRequest) {
+	requestCtx, cancel := context.WithCancel(crs.ctx)
+	return requestCtx, &coalescedRequest{
+		cancel:      cancel,
+		subscribers: make(map[*coalescedSubscriber]struct{}),
+		open:        true,
+	}
+}
+
+// collect passes the responses of a shared request to its subscribers until it
+// finishes, then stops new callers from subscribing to it
+func (crs *coalescedRequests) collect(key string, cr *coalescedRequest,
+	incomingResponses <-chan graphsync.ResponseProgress,
+	incomingErrors <-chan error) {
+	for incomingResponses != nil || incomingErrors != nil {
+		select {
+		case response, ok := <-incomingResponses:
+			if !ok {
+				incomingResponses = nil
+				continue
+			}
+			crs.publish(key, cr, func() {
+				cr.replayResponses = append(cr.replayResponses, response)
+			}, func(sub *coalescedSubscriber, wait <-chan struct{}) bool {
+				return sub.bufferResponse(response, wait)
+			})
+		case err, ok := <-incomingErrors:
+			if !ok {
+				incomingErrors = nil
+				continue
+			}
+			crs.publish(key, cr, func() {
+				cr.replayErrors = append(cr.replayErrors, err)
+			}, func(sub *coalescedSubscriber, wait <-chan struct{}) bool {
+				return sub.bufferError(err, wait)
+			})
+		}
+	}
+	crs.remove(key, cr)
+	cr.lk.Lock()
+	for sub := range cr.subscribers {
+		close(sub.responses)
+		close(sub.errors)
+	}
+	cr.subscribers = nil
+	cr.lk.Unlock()
+	cr.cancel()
+}
+
+// publish records a response or error for late subscribers while the request
+// is still open to them, and buffers it for every subscriber. Subscribers whose
+// buffers stay full for too long are detached.
+func (crs *coalescedRequests) publish(key string, cr *coalescedRequest, record func(), buffer func(sub *coalescedSubscriber, wait <-chan struct{}) bool) {
+	crs.lk.Lock()
+	cr.lk.Lock()
+	if cr.open {
+		record()
+		if len(cr.replayResponses)+len(cr.replayErrors) > crs.bufferSize {
+			cr.open = false
+			cr.replayResponses = nil
+			cr.replayErrors = nil
+			if crs.requests[key] == cr {
+				delete(crs.requests, key)
+			}
+		}
+	}
+	subscribers := make([]*coalescedSubscriber, 0, len(cr.subscribers))
+	for sub := range cr.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	cr.lk.Unlock()
+	crs.lk.Unlock()
+
+	var full []*coalescedSubscriber
+	for _, sub := range subscribers {
+		if !buffer(sub, nil) {
+			full = append(full, sub)
+		}
+	}
+	if len(full) == 0 {
+		return
+	}
+	waitCtx := crs.ctx
+	if crs.detachAfter > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(crs.ctx, crs.detachAfter)
+		defer cancel()
+	}
+	var behind []*coalescedSubscriber
+	for _, sub := range full {
+		if !buffer(sub, waitCtx.Done()) {
+			behind = append(behind, sub)
+		}
+	}
+	if len(behind) == 0 || crs.ctx.Err() != nil {
+		return
+	}
+
+	crs.lk.Lock()
+	defer crs.lk.Unlock()
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+	for _, sub := range behind {
+		if _, ok := cr.subscribers[sub]; !ok {
+			continue
+		}
+		delete(cr.subscribers, sub)
+		go crs.detach(sub)
+	}
+	if len(cr.subscribers) == 0 {
+		if crs.requests[key] == cr {
+			delete(crs.requests, key)
+		}
+		cr.cancel()
+	}
+}
+
+// bufferResponse puts a response in the subscriber's buffer. If the buffer is
+// full, it waits for room until wait is closed, or not at all if wait is nil,
+// and returns false if there is still none. A subscriber that has gone away
+// always has room.
+func (sub *coalescedSubscriber) bufferResponse(response graphsync.ResponseProgress, wait <-chan struct{}) bool {
+	select {
+	case sub.responses <- response:
+		sub.deliveredResponses[response.Path.String()]++
+		return true
+	default:
+	}
+	if wait == nil {
+		return false
+	}
+	select {
+	case sub.responses <- response:
+		sub.deliveredResponses[response.Path.String()]++
+		return true
+	case <-sub.ctx.Done():
+		return true
+	case <-wait:
+		return false
+	}
+}
+
+// bufferError puts an error in the subscriber's buffer, waiting for room like
+// bufferResponse
+func (sub *coalescedSubscriber) bufferError(err error, wait <-chan struct{}) bool {
+	select {
+	case sub.errors <- err:
+		sub.deliveredErrors[err.Error()]++
+		return true
+	default:
+	}
+	if wait == nil {
+		return false
+	}
+	select {
+	case sub.errors <- err:
+		sub.deliveredErrors[err.Error()]++
+		return true
+	case <-sub.ctx.Done():
+		return true
+	case <-wait:
+		return false
+	}
+}
+
+// detach sends a request for a subscriber that fell behind its shared request,
+// and passes on the responses and errors it has not already buffered. Its own
+// request may not return the same responses in the same order -- blocks it
+// finds locally, for instance, are not sent again -- so responses are matched
+// by path rather than counted.
+func (crs *coalescedRequests) detach(sub *coalescedSubscriber) {
+	incomingResponses, incomingErrors := sub.start(sub.ctx)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(sub.responses)
+		for response := range incomingResponses {
+			path := response.Path.String()
+			if sub.deliveredResponses[path] > 0 {
+				sub.deliveredResponses[path]--
+				continue
+			}
+			select {
+			case <-sub.ctx.Done():
+				return
+			case <-crs.ctx.Done():
+				return
+			case sub.responses <- response:
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(sub.errors)
+		for err := range incomingErrors {
+			if sub.deliveredErrors[err.Error()] > 0 {
+				sub.deliveredErrors[err.Error()]--
+				continue
+			}
+			select {
+			case <-sub.ctx.Done():
+				return
+			case <-crs.ctx.Done():
+				return
+			case sub.errors <- err:
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// deliver sends what is buffered for a single subscriber to the caller
+func (crs *coalescedRequests) deliver(key string, cr *coalescedRequest, sub *coalescedSubscriber) (<-chan graphsync.ResponseProgress, <-chan error) {
+	returnedResponses := make(chan graphsync.ResponseProgress)
+	returnedErrors := make(chan error)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(returnedResponses)
+		for {
+			select {
+			case <-sub.ctx.Done():
+				return
+			case <-crs.ctx.Done():
+				return
+			case response, ok := <-sub.responses:
+				if !ok {
+					return
+				}
+				select {
+				case <-sub.ctx.Done():
+					return
+				case <-crs.ctx.Done():
+					return
+				case returnedResponses <- response:
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(returnedErrors)
+		for {
+			select {
+			case <-sub.ctx.Done():
+				return
+			case <-crs.ctx.Done():
+				return
+			case err, ok := <-sub.errors:
+				if !ok {
+					return
+				}
+				select {
+				case <-sub.ctx.Done():
+					return
+				case <-crs.ctx.Done():
+					return
+				case returnedErrors <- err:
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		crs.unsubscribe(key, cr, sub)
+	}()
+	return returnedResponses, returnedErrors
+}
+
+// unsubscribe cancels a shared request once its last subscriber is gone
+func (crs *coalescedRequests) unsubscribe(key string, cr *coalescedRequest, sub *coalescedSubscriber) {
+	crs.lk.Lock()
+	defer crs.lk.Unlock()
+	cr.lk.Lock()
+	_, subscribed := cr.subscribers[sub]
+	delete(cr.subscribers, sub)
+	last := subscribed && len(cr.subscribers) == 0
+	cr.lk.Unlock()
+	if last {
+		if crs.requests[key] == cr {
+			delete(crs.requests, key)
+		}
+		cr.cancel()
+	}
+}
+
+func (crs *coalescedRequests) remove(key string, cr *coalescedRequest) {
+	crs.lk.Lock()
+	if crs.requests[key] == cr {
+		delete(crs.requests, key)
+	}
+	crs.lk.Unlock()
+}
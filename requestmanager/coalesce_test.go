@@ -0,0 +1,186 @@
+package requestmanager
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCoalescedRequest struct {
+	name      string
+	responses chan graphsync.ResponseProgress
+	errors    chan error
+}
+
+func TestCoalescedRequestsBuffers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	crs := newCoalescedRequests(ctx)
+	crs.bufferSize = 2
+	crs.detachAfter = 10 * time.Millisecond
+
+	started := make(chan fakeCoalescedRequest, 3)
+	startAs := func(name string) startRequestFn {
+		return func(requestCtx context.Context) (<-chan graphsync.ResponseProgress, <-chan error) {
+			fr := fakeCoalescedRequest{name, make(chan graphsync.ResponseProgress), make(chan error)}
+			started <- fr
+			return fr.responses, fr.errors
+		}
+	}
+	nextStarted := func() fakeCoalescedRequest {
+		select {
+		case <-ctx.Done():
+			t.Fatal("request should start")
+		case fr := <-started:
+			return fr
+		}
+		return fakeCoalescedRequest{}
+	}
+	progressAt := func(i int) graphsync.ResponseProgress {
+		return graphsync.ResponseProgress{Path: ipld.ParsePath(strconv.Itoa(i))}
+	}
+	verifyProgress := func(responses []graphsync.ResponseProgress, from int, to int) {
+		require.Len(t, responses, to-from)
+		for i, response := range responses {
+			require.Equal(t, strconv.Itoa(from+i), response.Path.String())
+		}
+	}
+
+	fast, fastErrs := crs.subscribe(ctx, "key", startAs("fast"))
+	slow, slowErrs := crs.subscribe(ctx, "key", startAs("slow"))
+	shared := nextStarted()
+	require.Equal(t, "fast", shared.name)
+	sharedErr := errors.New("shared error")
+	shared.errors <- sharedErr
+
+	// the fast subscriber keeps up, while the slow subscriber's buffer fills.
+	// It can also hold one response on its way out of the buffer.
+	for i := 0; i < 4; i++ {
+		shared.responses <- progressAt(i)
+		verifyProgress(testutil.ReadNResponses(ctx, t, fast, 1), i, i+1)
+	}
+
+	// once the shared request has returned more than a buffer holds, a caller
+	// making an identical request starts a new shared request instead
+	late, lateErrs := crs.subscribe(ctx, "key", startAs("late"))
+
+	// the slow subscriber leaves its buffer full, and gets a request of its own
+	startedRequests := map[string]fakeCoalescedRequest{}
+	for i := 0; i < 2; i++ {
+		fr := nextStarted()
+		startedRequests[fr.name] = fr
+	}
+	own, lateShared := startedRequests["slow"], startedRequests["late"]
+	require.NotNil(t, own.responses)
+	require.NotNil(t, lateShared.responses)
+
+	// the slow subscriber's own request skips the responses and errors it
+	// already has, even when it does not return the same responses -- here the
+	// first is found locally, so it is not returned again
+	ownErr := errors.New("own error")
+	go func() {
+		for i := 1; i < 5; i++ {
+			own.responses <- progressAt(i)
+		}
+		close(own.responses)
+	}()
+	go func() {
+		own.errors <- sharedErr
+		own.errors <- ownErr
+		close(own.errors)
+	}()
+	verifyProgress(testutil.CollectResponses(ctx, t, slow), 0, 5)
+	require.Equal(t, []error{sharedErr, ownErr}, testutil.CollectErrors(ctx, t, slowErrs))
+
+	close(shared.responses)
+	close(shared.errors)
+	testutil.VerifyEmptyResponse(ctx, t, fast)
+	require.Equal(t, []error{sharedErr}, testutil.CollectErrors(ctx, t, fastErrs))
+
+	close(lateShared.responses)
+	close(lateShared.errors)
+	testutil.VerifyEmptyResponse(ctx, t, late)
+	testutil.VerifyEmptyErrors(ctx, t, lateErrs)
+	require.Empty(t, started)
+}
+
+func TestCoalescedRequestsWithoutDetaching(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	crs := newCoalescedRequests(ctx)
+	crs.bufferSize = 2
+	crs.detachAfter = 0
+
+	started := make(chan fakeCoalescedRequest, 2)
+	start := func(requestCtx context.Context) (<-chan graphsync.ResponseProgress, <-chan error) {
+		fr := fakeCoalescedRequest{"shared", make(chan graphsync.ResponseProgress), make(chan error)}
+		started <- fr
+		return fr.responses, fr.errors
+	}
+	fast, _ := crs.subscribe(ctx, "key", start)
+	slow, _ := crs.subscribe(ctx, "key", start)
+	var shared fakeCoalescedRequest
+	testutil.AssertReceive(ctx, t, started, &shared, "request should start")
+
+	// the slow subscriber's full buffer holds up the shared request, rather
+	// than getting a request of its own
+	responsesSent := make(chan struct{})
+	go func() {
+		for i := 0; i < 6; i++ {
+			shared.responses <- graphsync.ResponseProgress{Path: ipld.ParsePath(strconv.Itoa(i))}
+		}
+		close(shared.responses)
+		close(shared.errors)
+		close(responsesSent)
+	}()
+	require.Len(t, testutil.ReadNResponses(ctx, t, fast, 3), 3)
+	select {
+	case <-responsesSent:
+		t.Fatal("shared request should wait for the slow subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Len(t, testutil.CollectResponses(ctx, t, slow), 6)
+	require.Len(t, testutil.CollectResponses(ctx, t, fast), 3)
+	require.Empty(t, started)
+}
+
+func TestCoalesceKey(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	root := testutil.GenerateBlocksOfSize(1, 100)[0]
+	link := cidlink.Link{Cid: root.Cid()}
+	selector := builder.NewSelectorSpecBuilder(basicnode.Style.Any).Matcher().Node()
+	keyFor := func(peers []peer.ID, retryPolicy *graphsync.RetryPolicy) string {
+		key, err := coalesceKey(peers, link, selector, nil, retryPolicy)
+		require.NoError(t, err)
+		return key
+	}
+
+	// peers in any order make the same key
+	require.Equal(t, keyFor(peers, nil), keyFor([]peer.ID{peers[1], peers[0]}, nil))
+
+	// requests with different retry policies are kept apart
+	policy := graphsync.RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{time.Second}}
+	samePolicy := graphsync.RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{time.Second}}
+	require.Equal(t, keyFor(peers, &policy), keyFor(peers, &samePolicy))
+	require.NotEqual(t, keyFor(peers, nil), keyFor(peers, &policy))
+	require.NotEqual(t, keyFor(peers, &policy), keyFor(peers, &graphsync.RetryPolicy{MaxAttempts: 2}))
+	require.NotEqual(t, keyFor(peers, &policy), keyFor(peers, &graphsync.RetryPolicy{
+		MaxAttempts:   2,
+		Backoff:       []time.Duration{time.Second},
+		FallbackPeers: peers[:1],
+	}))
+}
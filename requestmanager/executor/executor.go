@@ -5,12 +5,14 @@ import (
 	"context"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/pauseresponse"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
 	ipld "github.com/ipld/go-ipld-prime"
@@ -31,6 +33,11 @@ type ExecutionEnv struct {
 	TerminateRequest func(graphsync.RequestID)
 	WaitForMessages  func(ctx context.Context, resumeMessages chan graphsync.ExtensionData) ([]graphsync.ExtensionData, error)
 	Loader           AsyncLoadFn
+	// PauseLoader lets go of the blocks received for a request once it has
+	// paused, and UnpauseLoader is called when it resumes, before it loads
+	// more links or is sent again
+	PauseLoader   func(graphsync.RequestID)
+	UnpauseLoader func(graphsync.RequestID)
 }
 
 // RequestExecution are parameters for a single request execution
@@ -44,6 +51,31 @@ type RequestExecution struct {
 	NodeStyleChooser traversal.LinkTargetNodeStyleChooser
 	ResumeMessages   chan []graphsync.ExtensionData
 	PauseMessages    chan struct{}
+	RetryMessages    chan Retry
+	// ThrottleMessages ask the request to pause the response while the
+	// traversal catches up with the blocks already received. The response is
+	// resumed once the traversal has to wait on the network. A message carrying
+	// false means the responders cannot pause the response, so the request is
+	// cancelled instead, and sent again once the traversal has to wait.
+	ThrottleMessages chan bool
+	Budget           graphsync.Budget
+	// LocalFirst defers sending the request until the traversal reaches a link
+	// that is not available locally. The request is then sent with the blocks
+	// already traversed as do-not-send-cids.
+	LocalFirst bool
+	// ResolvedLocally is called if a LocalFirst request completes without
+	// being sent
+	ResolvedLocally func()
+	// RawBlocks, if set, receives each block in traversal order, and no
+	// progress is sent for the nodes visited
+	RawBlocks chan<- graphsync.RawBlock
+}
+
+// Retry tells an executing request to resend itself to the given peer after
+// the given delay, once the previous attempt has failed
+type Retry struct {
+	P     peer.ID
+	Delay time.Duration
 }
 
 // Start begins execution of a request in a go routine
@@ -60,9 +92,19 @@ func (ee ExecutionEnv) Start(re RequestExecution) (chan graphsync.ResponseProgre
 		nodeStyleChooser: re.NodeStyleChooser,
 		resumeMessages:   re.ResumeMessages,
 		pauseMessages:    re.PauseMessages,
+		retryMessages:    re.RetryMessages,
+		throttleMessages: re.ThrottleMessages,
+		budget:           re.Budget,
+		resolvedLocally:  re.ResolvedLocally,
+		rawBlocks:        re.RawBlocks,
 		env:              ee,
 	}
-	executor.sendRequest(executor.request)
+	if re.LocalFirst {
+		executor.restartNeeded = true
+		executor.pendingExtensions = extensionsExcept(executor.request, graphsync.ExtensionDoNotSendCIDs)
+	} else {
+		executor.sendRequest(executor.request)
+	}
 	go executor.run()
 	return executor.inProgressChan, executor.inProgressErr
 }
@@ -78,10 +120,20 @@ type requestExecutor struct {
 	nodeStyleChooser  traversal.LinkTargetNodeStyleChooser
 	resumeMessages    chan []graphsync.ExtensionData
 	pauseMessages     chan struct{}
+	retryMessages     chan Retry
+	throttleMessages  chan bool
 	doNotSendCids     *cid.Set
+	budget            graphsync.Budget
+	blocksReceived    uint64
+	bytesReceived     uint64
 	env               ExecutionEnv
 	restartNeeded     bool
 	pendingExtensions []graphsync.ExtensionData
+	requestSent       bool
+	// throttled is set while the responder is asked to pause the response
+	throttled       bool
+	resolvedLocally func()
+	rawBlocks       chan<- graphsync.RawBlock
 }
 
 func (re *requestExecutor) visitor(tp traversal.Progress, node ipld.Node, tr traversal.VisitReason) error {
@@ -97,10 +149,14 @@ func (re *requestExecutor) visitor(tp traversal.Progress, node ipld.Node, tr tra
 }
 
 func (re *requestExecutor) traverse() error {
+	var visitor traversal.AdvVisitFn
+	if re.rawBlocks == nil {
+		visitor = re.visitor
+	}
 	traverser := ipldutil.TraversalBuilder{
 		Root:     cidlink.Link{Cid: re.request.Root()},
 		Selector: re.request.Selector(),
-		Visitor:  re.visitor,
+		Visitor:  visitor,
 		Chooser:  re.nodeStyleChooser,
 	}.Start(re.ctx)
 	defer traverser.Shutdown(context.Background())
@@ -114,23 +170,34 @@ func (re *requestExecutor) traverse() error {
 		var result types.AsyncLoadResult
 		select {
 		case result = <-resultChan:
+			err := re.throttleAsNeeded()
+			if err != nil {
+				return err
+			}
 		default:
-			err := re.sendRestartAsNeeded()
+			err := re.resumeThrottledAsNeeded()
 			if err != nil {
 				return err
 			}
-			select {
-			case <-re.ctx.Done():
-				return ipldutil.ContextCancelError{}
-			case result = <-resultChan:
+			err = re.sendRestartAsNeeded()
+			if err != nil {
+				return err
+			}
+			result, err = re.waitForResult(resultChan)
+			if err != nil {
+				return err
 			}
 		}
 		err = re.processResult(traverser, lnk, result)
 		if _, ok := err.(hooks.ErrPaused); ok {
+			// the paused request holds no blocks, until it is resumed and
+			// about to be sent again
+			re.env.PauseLoader(re.request.ID())
 			err = re.waitForResume()
 			if err != nil {
 				return err
 			}
+			re.env.UnpauseLoader(re.request.ID())
 			err = traverser.Advance(bytes.NewReader(result.Data))
 			if err != nil {
 				return err
@@ -143,6 +210,9 @@ func (re *requestExecutor) traverse() error {
 
 func (re *requestExecutor) run() {
 	err := re.traverse()
+	if err == nil && !re.requestSent && re.resolvedLocally != nil {
+		re.resolvedLocally()
+	}
 	if err != nil {
 		if !isContextErr(err) {
 			select {
@@ -165,6 +235,9 @@ func (re *requestExecutor) run() {
 }
 
 func (re *requestExecutor) sendRequest(request gsmsg.GraphSyncRequest) {
+	if !request.IsCancel() && !request.IsUpdate() {
+		re.requestSent = true
+	}
 	re.env.SendRequest(re.p, request)
 }
 
@@ -177,11 +250,46 @@ func (re *requestExecutor) runBlockHooks(blk graphsync.BlockData) error {
 	return re.env.RunBlockHooks(re.p, response, blk)
 }
 
+func (re *requestExecutor) waitForResult(resultChan <-chan types.AsyncLoadResult) (types.AsyncLoadResult, error) {
+	for {
+		select {
+		case <-re.ctx.Done():
+			return types.AsyncLoadResult{}, ipldutil.ContextCancelError{}
+		case result := <-resultChan:
+			return result, nil
+		case retry := <-re.retryMessages:
+			err := re.retry(retry)
+			if err != nil {
+				return types.AsyncLoadResult{}, err
+			}
+		}
+	}
+}
+
+func (re *requestExecutor) retry(retry Retry) error {
+	timer := time.NewTimer(retry.Delay)
+	defer timer.Stop()
+	select {
+	case <-re.ctx.Done():
+		return ipldutil.ContextCancelError{}
+	case <-timer.C:
+	}
+	re.p = retry.P
+	re.restartNeeded = true
+	return re.sendRestartAsNeeded()
+}
+
 func (re *requestExecutor) waitForResume() error {
 	select {
 	case <-re.ctx.Done():
 		return ipldutil.ContextCancelError{}
-	case re.pendingExtensions = <-re.resumeMessages:
+	case extensions := <-re.resumeMessages:
+		// a request that was never sent keeps its own extensions as well
+		if re.requestSent {
+			re.pendingExtensions = extensions
+		} else {
+			re.pendingExtensions = append(re.pendingExtensions, extensions...)
+		}
 		re.restartNeeded = true
 		return nil
 	}
@@ -201,6 +309,14 @@ func (re *requestExecutor) onNewBlockWithPause(block graphsync.BlockData) error
 }
 
 func (re *requestExecutor) onNewBlock(block graphsync.BlockData) error {
+	if block.BlockSizeOnWire() > 0 {
+		if !re.budget.Allows(re.blocksReceived+1, re.bytesReceived+block.BlockSizeOnWire()) {
+			re.sendRequest(gsmsg.CancelRequest(re.request.ID()))
+			return graphsync.RequestBudgetExceededErr{}
+		}
+		re.blocksReceived++
+		re.bytesReceived += block.BlockSizeOnWire()
+	}
 	re.doNotSendCids.Add(block.Link().(cidlink.Link).Cid)
 	return re.runBlockHooks(block)
 }
@@ -216,6 +332,12 @@ func (re *requestExecutor) processResult(traverser ipldutil.Traverser, link ipld
 		}
 	}
 	err := re.onNewBlockWithPause(&blockData{link, result.Local, uint64(len(result.Data))})
+	if _, paused := err.(hooks.ErrPaused); err != nil && !paused {
+		return err
+	}
+	if rawErr := re.sendRawBlock(link, result); rawErr != nil {
+		return rawErr
+	}
 	if err != nil {
 		return err
 	}
@@ -226,6 +348,65 @@ func (re *requestExecutor) processResult(traverser ipldutil.Traverser, link ipld
 	return nil
 }
 
+func (re *requestExecutor) sendRawBlock(link ipld.Link, result types.AsyncLoadResult) error {
+	if re.rawBlocks == nil {
+		return nil
+	}
+	select {
+	case <-re.ctx.Done():
+		return ipldutil.ContextCancelError{}
+	case re.rawBlocks <- graphsync.RawBlock{Cid: link.(cidlink.Link).Cid, Data: result.Data, Local: result.Local}:
+		return nil
+	}
+}
+
+// throttleAsNeeded asks the responder to pause the response when asked to, so
+// the traversal can work through the blocks it has already received. If the
+// responder cannot pause the response, the request is cancelled and sent
+// again later with the blocks traversed by then as do-not-send-cids.
+func (re *requestExecutor) throttleAsNeeded() error {
+	var canPause bool
+	select {
+	case canPause = <-re.throttleMessages:
+	default:
+		return nil
+	}
+	if re.throttled || re.restartNeeded || !re.requestSent {
+		return nil
+	}
+	if !canPause {
+		re.sendRequest(gsmsg.CancelRequest(re.request.ID()))
+		re.restartNeeded = true
+		re.pendingExtensions = extensionsExcept(re.request, graphsync.ExtensionDoNotSendCIDs)
+		return nil
+	}
+	re.throttled = true
+	return re.sendPauseResponse(true)
+}
+
+// resumeThrottledAsNeeded asks the responder to resume a response paused by
+// throttleAsNeeded, once the traversal has caught up with it
+func (re *requestExecutor) resumeThrottledAsNeeded() error {
+	if !re.throttled {
+		return nil
+	}
+	re.throttled = false
+	// a request sent again starts a new response, which is not paused
+	if re.restartNeeded {
+		return nil
+	}
+	return re.sendPauseResponse(false)
+}
+
+func (re *requestExecutor) sendPauseResponse(pause bool) error {
+	data, err := pauseresponse.EncodePauseResponse(pause)
+	if err != nil {
+		return err
+	}
+	re.sendRequest(gsmsg.UpdateRequest(re.request.ID(), graphsync.ExtensionData{Name: graphsync.ExtensionPauseResponse, Data: data}))
+	return nil
+}
+
 func (re *requestExecutor) sendRestartAsNeeded() error {
 	if !re.restartNeeded {
 		return nil
@@ -243,6 +424,20 @@ func (re *requestExecutor) sendRestartAsNeeded() error {
 	return nil
 }
 
+// extensionsExcept returns the extensions on a request, leaving out the one
+// with the given name
+func extensionsExcept(request gsmsg.GraphSyncRequest, name graphsync.ExtensionName) []graphsync.ExtensionData {
+	var extensions []graphsync.ExtensionData
+	for _, extensionName := range request.ExtensionNames() {
+		if extensionName == name {
+			continue
+		}
+		data, _ := request.Extension(extensionName)
+		extensions = append(extensions, graphsync.ExtensionData{Name: extensionName, Data: data})
+	}
+	return extensions
+}
+
 func isContextErr(err error) bool {
 	// TODO: Match with errors.Is when https://github.com/ipld/go-ipld-prime/issues/58 is resolved
 	return strings.Contains(err.Error(), ipldutil.ContextCancelError{}.Error())
@@ -13,6 +13,7 @@ import (
 	"github.com/ipfs/go-graphsync/cidset"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/pauseresponse"
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/testloader"
@@ -59,6 +60,20 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.True(t, ree.nodeStyleChooserCalled)
 			},
 		},
+		"budget exceeded": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.budget = graphsync.Budget{MaxBlocks: 5}
+			},
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				tbc.VerifyResponseRangeSync(responses, 0, 5)
+				require.Equal(t, []error{graphsync.RequestBudgetExceededErr{}}, receivedErrors)
+				require.Len(t, ree.requestsSent, 2)
+				require.Equal(t, ree.request, ree.requestsSent[0].request)
+				require.True(t, ree.requestsSent[1].request.IsCancel())
+				require.Len(t, ree.blookHooksCalled, 5)
+				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+			},
+		},
 		"context cancelled": {
 			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
 				ree.blockHookResults[blockHookKey{p, requestID, tbc.LinkTipIndex(5)}] = ipldutil.ContextCancelError{}
@@ -92,6 +107,8 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.Len(t, ree.blookHooksCalled, 10)
 				require.Equal(t, ree.request.ID(), ree.terminateRequested)
 				require.True(t, ree.nodeStyleChooserCalled)
+				// the paused request lets go of its blocks until it is sent again
+				require.Equal(t, []bool{true, false}, ree.loaderPauses)
 			},
 		},
 		"multiple pause": {
@@ -119,6 +136,7 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.Len(t, ree.blookHooksCalled, 10)
 				require.Equal(t, ree.request.ID(), ree.terminateRequested)
 				require.True(t, ree.nodeStyleChooserCalled)
+				require.Equal(t, []bool{true, false, true, false}, ree.loaderPauses)
 			},
 		},
 		"multiple pause with extensions": {
@@ -213,6 +231,7 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.Equal(t, 1, ree.currentWaitForResumeResult)
 				require.Equal(t, ree.request, ree.requestsSent[0].request)
 				require.True(t, ree.requestsSent[1].request.IsCancel())
+				require.Equal(t, []bool{true, false}, ree.loaderPauses)
 				doNotSendCidsExt, has := ree.requestsSent[2].request.Extension(graphsync.ExtensionDoNotSendCIDs)
 				require.True(t, has)
 				cidSet, err := cidset.DecodeCidSet(doNotSendCidsExt)
@@ -252,6 +271,172 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.True(t, ree.nodeStyleChooserCalled)
 			},
 		},
+		"local first resolves locally": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.localFirst = true
+				ree.localBlocks = 10
+			},
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				tbc.VerifyWholeChainSync(responses)
+				require.Empty(t, receivedErrors)
+				require.Empty(t, ree.requestsSent)
+				require.True(t, ree.resolvedLocally)
+				require.Len(t, ree.blookHooksCalled, 10)
+				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+			},
+		},
+		"local first sends at first missing link": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.localFirst = true
+				ree.localBlocks = 6
+				ree.loaderRanges = [][2]int{{6, 10}}
+			},
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				tbc.VerifyWholeChainSync(responses)
+				require.Empty(t, receivedErrors)
+				require.Len(t, ree.requestsSent, 1)
+				sent := ree.requestsSent[0].request
+				require.Equal(t, ree.request.ID(), sent.ID())
+				require.Equal(t, ree.request.Root(), sent.Root())
+				testExtData, has := sent.Extension(graphsync.ExtensionName("applesauce"))
+				require.True(t, has)
+				require.Equal(t, "cheese", string(testExtData))
+				doNotSendCidsExt, has := sent.Extension(graphsync.ExtensionDoNotSendCIDs)
+				require.True(t, has)
+				cidSet, err := cidset.DecodeCidSet(doNotSendCidsExt)
+				require.NoError(t, err)
+				require.Equal(t, 6, cidSet.Len())
+				require.False(t, ree.resolvedLocally)
+				require.Len(t, ree.blookHooksCalled, 10)
+				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+			},
+		},
+		"local first pause before sending": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.localFirst = true
+				ree.localBlocks = 6
+				ree.blockHookResults[blockHookKey{p, requestID, tbc.LinkTipIndex(3)}] = hooks.ErrPaused{}
+				ree.waitForResumeResults = append(ree.waitForResumeResults, []graphsync.ExtensionData{
+					{
+						Name: graphsync.ExtensionName("resumed"),
+						Data: []byte("cheese 1"),
+					},
+				})
+				ree.loaderRanges = [][2]int{{6, 10}, {6, 10}}
+			},
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				tbc.VerifyWholeChainSync(responses)
+				require.Empty(t, receivedErrors)
+				require.Equal(t, 1, ree.currentWaitForResumeResult)
+				// the pause sends nothing, and the request goes out once with its
+				// own extensions and those from the resume
+				require.Len(t, ree.requestsSent, 1)
+				sent := ree.requestsSent[0].request
+				require.False(t, sent.IsCancel())
+				testExtData, has := sent.Extension(graphsync.ExtensionName("applesauce"))
+				require.True(t, has)
+				require.Equal(t, "cheese", string(testExtData))
+				testExtData, has = sent.Extension(graphsync.ExtensionName("resumed"))
+				require.True(t, has)
+				require.Equal(t, "cheese 1", string(testExtData))
+				doNotSendCidsExt, has := sent.Extension(graphsync.ExtensionDoNotSendCIDs)
+				require.True(t, has)
+				cidSet, err := cidset.DecodeCidSet(doNotSendCidsExt)
+				require.NoError(t, err)
+				require.Equal(t, 6, cidSet.Len())
+				require.Len(t, ree.blookHooksCalled, 10)
+			},
+		},
+		"throttle while catching up": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.throttleAt = tbc.LinkTipIndex(2)
+			},
+			configureLoader: func() configureLoaderFn {
+				// the responder gets as far as block 6 before it pauses, and sends
+				// the rest once it is resumed
+				ranges := [][2]int{{0, 6}, {6, 6}, {6, 10}}
+				return func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, fal *testloader.FakeAsyncLoader, startStop [2]int) {
+					fal.SuccessResponseOn(requestID, tbc.Blocks(ranges[0][0], ranges[0][1]))
+					ranges = ranges[1:]
+				}
+			}(),
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				tbc.VerifyWholeChainSync(responses)
+				require.Empty(t, receivedErrors)
+				// the response is paused and resumed with updates, not restarted
+				require.Len(t, ree.requestsSent, 3)
+				for i, pause := range []bool{true, false} {
+					sent := ree.requestsSent[i+1].request
+					require.True(t, sent.IsUpdate())
+					require.Equal(t, ree.request.ID(), sent.ID())
+					pauseData, has := sent.Extension(graphsync.ExtensionPauseResponse)
+					require.True(t, has)
+					decoded, err := pauseresponse.DecodePauseResponse(pauseData)
+					require.NoError(t, err)
+					require.Equal(t, pause, decoded)
+				}
+				require.Len(t, ree.blookHooksCalled, 10)
+				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+			},
+		},
+		"throttle a response that cannot pause": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.throttleAt = tbc.LinkTipIndex(2)
+				ree.throttleCannotPause = true
+			},
+			configureLoader: func() configureLoaderFn {
+				// the responder gets as far as block 6 before it is cancelled, and
+				// sends the rest once the request is sent again
+				ranges := [][2]int{{0, 6}, {6, 10}}
+				return func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, fal *testloader.FakeAsyncLoader, startStop [2]int) {
+					fal.SuccessResponseOn(requestID, tbc.Blocks(ranges[0][0], ranges[0][1]))
+					ranges = ranges[1:]
+				}
+			}(),
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				tbc.VerifyWholeChainSync(responses)
+				require.Empty(t, receivedErrors)
+				// the request is cancelled, and sent again once the traversal
+				// catches up, without the blocks it already has
+				require.Len(t, ree.requestsSent, 3)
+				require.True(t, ree.requestsSent[1].request.IsCancel())
+				sent := ree.requestsSent[2].request
+				require.False(t, sent.IsCancel())
+				require.False(t, sent.IsUpdate())
+				testExtData, has := sent.Extension(graphsync.ExtensionName("applesauce"))
+				require.True(t, has)
+				require.Equal(t, "cheese", string(testExtData))
+				doNotSendCidsExt, has := sent.Extension(graphsync.ExtensionDoNotSendCIDs)
+				require.True(t, has)
+				cidSet, err := cidset.DecodeCidSet(doNotSendCidsExt)
+				require.NoError(t, err)
+				require.Equal(t, 6, cidSet.Len())
+				require.Len(t, ree.blookHooksCalled, 10)
+				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+			},
+		},
+		"raw blocks": {
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.rawBlocks = make(chan graphsync.RawBlock)
+			},
+			configureLoader: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, fal *testloader.FakeAsyncLoader, startStop [2]int) {
+				// the first blocks are in the local store
+				for i, blk := range tbc.Blocks(startStop[0], startStop[1]) {
+					fal.ResponseOn(requestID, cidlink.Link{Cid: blk.Cid()}, types.AsyncLoadResult{Data: blk.RawData(), Local: i < 4})
+				}
+			},
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				require.Empty(t, responses)
+				require.Empty(t, receivedErrors)
+				require.Len(t, ree.rawBlocksReceived, 10)
+				for i, blk := range tbc.AllBlocks() {
+					require.Equal(t, blk.Cid(), ree.rawBlocksReceived[i].Cid)
+					require.Equal(t, blk.RawData(), ree.rawBlocksReceived[i].Data)
+					require.Equal(t, i < 4, ree.rawBlocksReceived[i].Local)
+				}
+				require.Len(t, ree.blookHooksCalled, 10)
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -276,26 +461,35 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				p:                p,
 				resumeMessages:   make(chan []graphsync.ExtensionData, 1),
 				pauseMessages:    make(chan struct{}, 1),
+				throttleMessages: make(chan bool, 1),
 				blockHookResults: make(map[blockHookKey]error),
 				doNotSendCids:    cid.NewSet(),
-				request:          gsmsg.NewRequest(requestID, tbc.TipLink.(cidlink.Link).Cid, tbc.Selector(), graphsync.Priority(rand.Int31())),
+				request:          gsmsg.NewRequest(requestID, tbc.TipLink.(cidlink.Link).Cid, tbc.Selector(), graphsync.Priority(rand.Int31()), graphsync.ExtensionData{Name: graphsync.ExtensionName("applesauce"), Data: []byte("cheese")}),
 				fal:              fal,
 				tbc:              tbc,
 				configureLoader:  configureLoader,
 			}
-			fal.OnAsyncLoad(ree.checkPause)
+			fal.OnAsyncLoad(func(requestID graphsync.RequestID, link ipld.Link, result <-chan types.AsyncLoadResult) {
+				ree.checkThrottle(link)
+				ree.checkPause(requestID, link, result)
+			})
 			if data.configureRequestExecution != nil {
 				data.configureRequestExecution(p, requestID, tbc, ree)
 			}
 			if len(ree.loaderRanges) == 0 {
 				ree.loaderRanges = [][2]int{{0, 10}}
 			}
+			if ree.localBlocks > 0 {
+				fal.SuccessResponseOn(requestID, tbc.Blocks(0, ree.localBlocks))
+			}
 			inProgress, inProgressErr := ree.requestExecution()
 			var responsesReceived []graphsync.ResponseProgress
 			var errorsReceived []error
 			var inProgressDone, inProgressErrDone bool
 			for !inProgressDone || !inProgressErrDone {
 				select {
+				case block := <-ree.rawBlocks:
+					ree.rawBlocksReceived = append(ree.rawBlocksReceived, block)
 				case response, ok := <-inProgress:
 					if !ok {
 						inProgress = nil
@@ -346,8 +540,15 @@ type requestExecutionEnv struct {
 	waitForResumeResults [][]graphsync.ExtensionData
 	resumeMessages       chan []graphsync.ExtensionData
 	pauseMessages        chan struct{}
+	throttleMessages     chan bool
+	throttleAt           ipld.Link
+	throttleCannotPause  bool
 	externalPauses       []pauseKey
 	loaderRanges         [][2]int
+	budget               graphsync.Budget
+	localFirst           bool
+	localBlocks          int
+	rawBlocks            chan graphsync.RawBlock
 
 	// results
 	currentPauseResult         int
@@ -356,6 +557,9 @@ type requestExecutionEnv struct {
 	blookHooksCalled           []blockHookKey
 	terminateRequested         graphsync.RequestID
 	nodeStyleChooserCalled     bool
+	resolvedLocally            bool
+	rawBlocksReceived          []graphsync.RawBlock
+	loaderPauses               []bool
 
 	// deps
 	configureLoader configureLoaderFn
@@ -383,6 +587,14 @@ func (ree *requestExecutionEnv) sendRequest(p peer.ID, request gsmsg.GraphSyncRe
 	}
 }
 
+func (ree *requestExecutionEnv) pauseLoader(requestID graphsync.RequestID) {
+	ree.loaderPauses = append(ree.loaderPauses, true)
+}
+
+func (ree *requestExecutionEnv) unpauseLoader(requestID graphsync.RequestID) {
+	ree.loaderPauses = append(ree.loaderPauses, false)
+}
+
 func (ree *requestExecutionEnv) nodeStyleChooser(ipld.Link, ipld.LinkContext) (ipld.NodeStyle, error) {
 	ree.nodeStyleChooserCalled = true
 	return basicnode.Style.Any, nil
@@ -405,6 +617,12 @@ func (ree *requestExecutionEnv) checkPause(requestID graphsync.RequestID, link i
 	}
 }
 
+func (ree *requestExecutionEnv) checkThrottle(link ipld.Link) {
+	if ree.throttleAt != nil && ree.throttleAt == link {
+		ree.throttleMessages <- !ree.throttleCannotPause
+	}
+}
+
 func (ree *requestExecutionEnv) runBlockHooks(p peer.ID, response graphsync.ResponseData, blk graphsync.BlockData) error {
 	bhk := blockHookKey{p, response.RequestID(), blk.Link()}
 	ree.blookHooksCalled = append(ree.blookHooksCalled, bhk)
@@ -428,6 +646,8 @@ func (ree *requestExecutionEnv) requestExecution() (chan graphsync.ResponseProgr
 		RunBlockHooks:    ree.runBlockHooks,
 		TerminateRequest: ree.terminateRequest,
 		Loader:           ree.fal.AsyncLoad,
+		PauseLoader:      ree.pauseLoader,
+		UnpauseLoader:    ree.unpauseLoader,
 	}.Start(executor.RequestExecution{
 		Ctx:              ree.ctx,
 		P:                ree.p,
@@ -437,5 +657,10 @@ func (ree *requestExecutionEnv) requestExecution() (chan graphsync.ResponseProgr
 		NodeStyleChooser: ree.nodeStyleChooser,
 		ResumeMessages:   ree.resumeMessages,
 		PauseMessages:    ree.pauseMessages,
+		ThrottleMessages: ree.throttleMessages,
+		Budget:           ree.budget,
+		LocalFirst:       ree.localFirst,
+		ResolvedLocally:  func() { ree.resolvedLocally = true },
+		RawBlocks:        ree.rawBlocks,
 	})
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
@@ -32,6 +33,11 @@ func TestRequestHookProcessing(t *testing.T) {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
 	request := gsmsg.NewRequest(requestID, root, ssb.Matcher().Node(), graphsync.Priority(0), extension)
 	p := testutil.GeneratePeers(1)[0]
+	retryPolicy := graphsync.RetryPolicy{
+		MaxAttempts:   3,
+		Backoff:       []time.Duration{time.Millisecond},
+		FallbackPeers: testutil.GeneratePeers(1),
+	}
 	testCases := map[string]struct {
 		configure func(t *testing.T, hooks *hooks.OutgoingRequestHooks)
 		assert    func(t *testing.T, result hooks.RequestResult)
@@ -40,6 +46,7 @@ func TestRequestHookProcessing(t *testing.T) {
 			assert: func(t *testing.T, result hooks.RequestResult) {
 				require.Nil(t, result.CustomChooser)
 				require.Empty(t, result.PersistenceOption)
+				require.False(t, result.FollowPeers)
 			},
 		},
 		"hooks alter chooser": {
@@ -68,6 +75,50 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Equal(t, "chainstore", result.PersistenceOption)
 			},
 		},
+		"hooks alter retry policy": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					if _, found := requestData.Extension(extensionName); found {
+						hookActions.UseRetryPolicy(retryPolicy)
+					}
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Nil(t, result.CustomChooser)
+				require.Empty(t, result.PersistenceOption)
+				require.Equal(t, retryPolicy, result.RetryPolicy)
+			},
+		},
+		"hooks follow additional peers": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.FollowAdditionalPeers()
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.FollowPeers)
+			},
+		},
+		"hooks set inactivity timeout": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.UseInactivityTimeout(30 * time.Second)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Equal(t, 30*time.Second, result.InactivityTimeout)
+			},
+		},
+		"hooks resolve locally first": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.ResolveLocallyFirst()
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.LocalFirst)
+			},
+		},
 		"hooks unregistered": {
 			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
 				unregister := hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
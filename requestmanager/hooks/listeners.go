@@ -0,0 +1,41 @@
+package hooks
+
+import (
+	"github.com/hannahhoward/go-pubsub"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// AdditionalPeersListeners is a set of listeners for peers suggested by responders
+type AdditionalPeersListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalAdditionalPeersEvent struct {
+	p        peer.ID
+	response graphsync.ResponseData
+	peers    []peer.AddrInfo
+}
+
+func additionalPeersDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalAdditionalPeersEvent)
+	listener := subscriberFn.(graphsync.OnAdditionalPeersListener)
+	listener(ie.p, ie.response, ie.peers)
+	return nil
+}
+
+// NewAdditionalPeersListeners returns a new list of additional peers listeners
+func NewAdditionalPeersListeners() *AdditionalPeersListeners {
+	return &AdditionalPeersListeners{pubSub: pubsub.New(additionalPeersDispatcher)}
+}
+
+// Register registers a listener for peers suggested by responders
+func (apl *AdditionalPeersListeners) Register(listener graphsync.OnAdditionalPeersListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(apl.pubSub.Subscribe(listener))
+}
+
+// NotifyAdditionalPeersListeners notifies all listeners that a responder suggested other peers
+func (apl *AdditionalPeersListeners) NotifyAdditionalPeersListeners(p peer.ID, response graphsync.ResponseData, peers []peer.AddrInfo) {
+	_ = apl.pubSub.Publish(internalAdditionalPeersEvent{p, response, peers})
+}
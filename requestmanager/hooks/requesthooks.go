@@ -1,6 +1,8 @@
 package hooks
 
 import (
+	"time"
+
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipld/go-ipld-prime/traversal"
@@ -41,6 +43,11 @@ func (orh *OutgoingRequestHooks) Register(hook graphsync.OnOutgoingRequestHook)
 type RequestResult struct {
 	PersistenceOption string
 	CustomChooser     traversal.LinkTargetNodeStyleChooser
+	RetryPolicy       graphsync.RetryPolicy
+	Budget            graphsync.Budget
+	FollowPeers       bool
+	InactivityTimeout time.Duration
+	LocalFirst        bool
 }
 
 // ProcessRequestHooks runs request hooks against an outgoing request
@@ -53,12 +60,22 @@ func (orh *OutgoingRequestHooks) ProcessRequestHooks(p peer.ID, request graphsyn
 type requestHookActions struct {
 	persistenceOption  string
 	nodeBuilderChooser traversal.LinkTargetNodeStyleChooser
+	retryPolicy        graphsync.RetryPolicy
+	budget             graphsync.Budget
+	followPeers        bool
+	inactivityTimeout  time.Duration
+	localFirst         bool
 }
 
 func (rha *requestHookActions) result() RequestResult {
 	return RequestResult{
 		PersistenceOption: rha.persistenceOption,
 		CustomChooser:     rha.nodeBuilderChooser,
+		RetryPolicy:       rha.retryPolicy,
+		Budget:            rha.budget,
+		FollowPeers:       rha.followPeers,
+		InactivityTimeout: rha.inactivityTimeout,
+		LocalFirst:        rha.localFirst,
 	}
 }
 
@@ -69,3 +86,23 @@ func (rha *requestHookActions) UsePersistenceOption(name string) {
 func (rha *requestHookActions) UseLinkTargetNodeStyleChooser(nodeBuilderChooser traversal.LinkTargetNodeStyleChooser) {
 	rha.nodeBuilderChooser = nodeBuilderChooser
 }
+
+func (rha *requestHookActions) UseRetryPolicy(retryPolicy graphsync.RetryPolicy) {
+	rha.retryPolicy = retryPolicy
+}
+
+func (rha *requestHookActions) UseBudget(budget graphsync.Budget) {
+	rha.budget = budget
+}
+
+func (rha *requestHookActions) FollowAdditionalPeers() {
+	rha.followPeers = true
+}
+
+func (rha *requestHookActions) UseInactivityTimeout(timeout time.Duration) {
+	rha.inactivityTimeout = timeout
+}
+
+func (rha *requestHookActions) ResolveLocallyFirst() {
+	rha.localFirst = true
+}
@@ -0,0 +1,311 @@
+package requestmanager
+
+import (
+	"sync"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/partition"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type peerAssignment struct {
+	p         peer.ID
+	requestID graphsync.RequestID
+	buckets   []int
+	complete  bool
+}
+
+// multiPeerRequest tracks a single request whose blocks are split across
+// several peers. Each peer gets its own sub request on the wire, carrying a
+// partition extension for the buckets assigned to it, while all responses are
+// processed locally under the ID of the main request.
+type multiPeerRequest struct {
+	requestID graphsync.RequestID
+	count     int
+	// peers in the order they were given for the request
+	peers []peer.ID
+
+	lk          sync.Mutex
+	assignments map[graphsync.RequestID]*peerAssignment
+	failedPeers map[peer.ID]struct{}
+	lastRequest gsmsg.GraphSyncRequest
+	hasRequest  bool
+}
+
+func newMultiPeerRequest(requestID graphsync.RequestID, peers []peer.ID) *multiPeerRequest {
+	return &multiPeerRequest{
+		requestID:   requestID,
+		count:       len(peers),
+		peers:       peers,
+		assignments: make(map[graphsync.RequestID]*peerAssignment),
+		failedPeers: make(map[peer.ID]struct{}),
+	}
+}
+
+func (mpr *multiPeerRequest) assign(p peer.ID, requestID graphsync.RequestID, buckets []int) {
+	mpr.lk.Lock()
+	mpr.assignments[requestID] = &peerAssignment{p: p, requestID: requestID, buckets: buckets}
+	mpr.lk.Unlock()
+}
+
+func (mpr *multiPeerRequest) subRequestIDs() []graphsync.RequestID {
+	mpr.lk.Lock()
+	defer mpr.lk.Unlock()
+	requestIDs := make([]graphsync.RequestID, 0, len(mpr.assignments))
+	for requestID := range mpr.assignments {
+		requestIDs = append(requestIDs, requestID)
+	}
+	return requestIDs
+}
+
+// subRequestIDsForPeer returns the incomplete sub requests assigned to a peer
+func (mpr *multiPeerRequest) subRequestIDsForPeer(p peer.ID) []graphsync.RequestID {
+	mpr.lk.Lock()
+	defer mpr.lk.Unlock()
+	var requestIDs []graphsync.RequestID
+	for requestID, assignment := range mpr.assignments {
+		if assignment.p == p && !assignment.complete {
+			requestIDs = append(requestIDs, requestID)
+		}
+	}
+	return requestIDs
+}
+
+func (mpr *multiPeerRequest) peerForSubRequest(requestID graphsync.RequestID) (peer.ID, bool) {
+	mpr.lk.Lock()
+	defer mpr.lk.Unlock()
+	assignment, ok := mpr.assignments[requestID]
+	if !ok {
+		return "", false
+	}
+	return assignment.p, true
+}
+
+// sendRequest fans out a request for the main request ID to every peer with
+// an incomplete assignment, rewriting it for that peer's sub request
+func (mpr *multiPeerRequest) sendRequest(peerHandler PeerHandler, request gsmsg.GraphSyncRequest) {
+	mpr.lk.Lock()
+	if !request.IsCancel() && !request.IsUpdate() {
+		mpr.lastRequest = request
+		mpr.hasRequest = true
+	}
+	outgoing := make([]*peerAssignment, 0, len(mpr.assignments))
+	for _, assignment := range mpr.assignments {
+		if !assignment.complete {
+			outgoing = append(outgoing, assignment)
+		}
+	}
+	mpr.lk.Unlock()
+	for _, assignment := range outgoing {
+		subRequest, err := mpr.subRequest(assignment, request)
+		if err != nil {
+			log.Errorf("Unable to build request for peer %s: %s", assignment.p, err)
+			continue
+		}
+		peerHandler.SendRequest(assignment.p, subRequest)
+	}
+}
+
+// sendRequestToPeer sends a request for the main request ID to the given peer
+// only, on each of its incomplete sub requests
+func (mpr *multiPeerRequest) sendRequestToPeer(peerHandler PeerHandler, p peer.ID, request gsmsg.GraphSyncRequest) {
+	mpr.lk.Lock()
+	outgoing := make([]*peerAssignment, 0, 1)
+	for _, assignment := range mpr.assignments {
+		if assignment.p == p && !assignment.complete {
+			outgoing = append(outgoing, assignment)
+		}
+	}
+	mpr.lk.Unlock()
+	for _, assignment := range outgoing {
+		subRequest, err := mpr.subRequest(assignment, request)
+		if err != nil {
+			log.Errorf("Unable to build request for peer %s: %s", assignment.p, err)
+			continue
+		}
+		peerHandler.SendRequest(assignment.p, subRequest)
+	}
+}
+
+func (mpr *multiPeerRequest) subRequest(assignment *peerAssignment, request gsmsg.GraphSyncRequest) (gsmsg.GraphSyncRequest, error) {
+	if request.IsCancel() {
+		return gsmsg.CancelRequest(assignment.requestID), nil
+	}
+	if request.IsUpdate() {
+		return gsmsg.UpdateRequest(assignment.requestID, extensionsForRequest(request)...), nil
+	}
+	partitionData, err := partition.EncodePartition(partition.Partition{Count: mpr.count, Buckets: assignment.buckets})
+	if err != nil {
+		return gsmsg.GraphSyncRequest{}, err
+	}
+	extensions := append(extensionsForRequest(request), graphsync.ExtensionData{Name: graphsync.ExtensionPartition, Data: partitionData})
+	return gsmsg.NewRequest(assignment.requestID, request.Root(), request.Selector(), request.Priority(), extensions...), nil
+}
+
+// completeSubRequest marks a sub request as finished and returns true if every
+// sub request for the main request is now complete
+func (mpr *multiPeerRequest) completeSubRequest(requestID graphsync.RequestID) bool {
+	mpr.lk.Lock()
+	defer mpr.lk.Unlock()
+	assignment, ok := mpr.assignments[requestID]
+	if ok {
+		assignment.complete = true
+	}
+	for _, assignment := range mpr.assignments {
+		if !assignment.complete {
+			return false
+		}
+	}
+	return true
+}
+
+// failSubRequest removes the assignment for a failed sub request and moves
+// its buckets to the peer that has not failed with the fewest buckets, under
+// the new sub request ID. Ties go to the peer given first for the request. It
+// returns false if no such peer remains.
+func (mpr *multiPeerRequest) failSubRequest(requestID graphsync.RequestID, newRequestID graphsync.RequestID) (*peerAssignment, bool) {
+	mpr.lk.Lock()
+	defer mpr.lk.Unlock()
+	failed, ok := mpr.assignments[requestID]
+	if !ok {
+		return nil, false
+	}
+	delete(mpr.assignments, requestID)
+	mpr.failedPeers[failed.p] = struct{}{}
+	bucketCounts := make(map[peer.ID]int)
+	for _, assignment := range mpr.assignments {
+		bucketCounts[assignment.p] += len(assignment.buckets)
+	}
+	var target peer.ID
+	found := false
+	for _, p := range mpr.peers {
+		if _, isFailed := mpr.failedPeers[p]; isFailed {
+			continue
+		}
+		if !found || bucketCounts[p] < bucketCounts[target] {
+			target = p
+			found = true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	reassigned := &peerAssignment{p: target, requestID: newRequestID, buckets: failed.buckets}
+	mpr.assignments[newRequestID] = reassigned
+	return reassigned, true
+}
+
+// resendAssignment sends the most recent full request to a newly created
+// assignment
+func (mpr *multiPeerRequest) resendAssignment(peerHandler PeerHandler, assignment *peerAssignment) {
+	mpr.lk.Lock()
+	request, hasRequest := mpr.lastRequest, mpr.hasRequest
+	mpr.lk.Unlock()
+	if !hasRequest {
+		return
+	}
+	subRequest, err := mpr.subRequest(assignment, request)
+	if err != nil {
+		log.Errorf("Unable to build request for peer %s: %s", assignment.p, err)
+		return
+	}
+	peerHandler.SendRequest(assignment.p, subRequest)
+}
+
+func extensionsForRequest(request gsmsg.GraphSyncRequest) []graphsync.ExtensionData {
+	names := request.ExtensionNames()
+	extensions := make([]graphsync.ExtensionData, 0, len(names))
+	for _, name := range names {
+		if name == graphsync.ExtensionPartition {
+			continue
+		}
+		data, _ := request.Extension(name)
+		extensions = append(extensions, graphsync.ExtensionData{Name: name, Data: data})
+	}
+	return extensions
+}
+
+// setupMultiPeerRequest splits a request across its peers, giving each peer a
+// sub request of its own
+func (rm *RequestManager) setupMultiPeerRequest(requestID graphsync.RequestID, peers []peer.ID) *multiPeerRequest {
+	mpr := newMultiPeerRequest(requestID, peers)
+	for i, p := range peers {
+		subRequestID := rm.nextRequestID
+		rm.nextRequestID++
+		mpr.assign(p, subRequestID, []int{i})
+		rm.subRequests[subRequestID] = requestID
+	}
+	return mpr
+}
+
+// processSubRequestResponses rewrites responses for the sub requests of a
+// multi-peer request so they are processed under the main request ID. Terminal
+// statuses from a single peer are only passed on once the whole request
+// finishes: a failed peer's share is moved to another peer, and the request
+// completes only when every share has completed.
+func (rm *RequestManager) processSubRequestResponses(responses []gsmsg.GraphSyncResponse, p peer.ID) []gsmsg.GraphSyncResponse {
+	translated := make([]gsmsg.GraphSyncResponse, 0, len(responses))
+	for _, response := range responses {
+		requestID, isSubRequest := rm.subRequests[response.RequestID()]
+		if !isSubRequest {
+			// peers only know the sub request IDs of a multi-peer request
+			if requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]; !ok || requestStatus.multiPeer == nil {
+				translated = append(translated, response)
+			}
+			continue
+		}
+		requestStatus, ok := rm.inProgressRequestStatuses[requestID]
+		if !ok {
+			continue
+		}
+		mpr := requestStatus.multiPeer
+		assignedPeer, ok := mpr.peerForSubRequest(response.RequestID())
+		if !ok || assignedPeer != p {
+			continue
+		}
+		status := response.Status()
+		if gsmsg.IsTerminalSuccessCode(status) {
+			if !mpr.completeSubRequest(response.RequestID()) {
+				status = graphsync.PartialResponse
+			}
+		} else if gsmsg.IsTerminalFailureCode(status) {
+			if rm.reassignSubRequest(requestID, requestStatus, response.RequestID()) {
+				status = graphsync.PartialResponse
+			}
+		}
+		var extensions []graphsync.ExtensionData
+		for _, name := range response.ExtensionNames() {
+			data, _ := response.Extension(name)
+			extensions = append(extensions, graphsync.ExtensionData{Name: name, Data: data})
+		}
+		translated = append(translated, gsmsg.NewResponse(requestID, status, extensions...))
+	}
+	return translated
+}
+
+// reassignSubRequest moves the share of a failed sub request to another peer,
+// returning false if no peer is left to take it
+func (rm *RequestManager) reassignSubRequest(requestID graphsync.RequestID, requestStatus *inProgressRequestStatus, subRequestID graphsync.RequestID) bool {
+	mpr := requestStatus.multiPeer
+	newRequestID := rm.nextRequestID
+	reassigned, ok := mpr.failSubRequest(subRequestID, newRequestID)
+	delete(rm.subRequests, subRequestID)
+	if !ok {
+		return false
+	}
+	rm.nextRequestID++
+	rm.subRequests[newRequestID] = requestID
+	if !requestStatus.paused {
+		mpr.resendAssignment(rm.peerHandler, reassigned)
+	}
+	return true
+}
+
+// removeSubRequests forgets the sub requests of a multi-peer request once it
+// finishes
+func (rm *RequestManager) removeSubRequests(mpr *multiPeerRequest) {
+	for _, subRequestID := range mpr.subRequestIDs() {
+		delete(rm.subRequests, subRequestID)
+	}
+}
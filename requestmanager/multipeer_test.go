@@ -0,0 +1,36 @@
+package requestmanager
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailSubRequestReassignment(t *testing.T) {
+	peers := testutil.GeneratePeers(4)
+	mpr := newMultiPeerRequest(graphsync.RequestID(0), peers)
+	for i, p := range peers {
+		mpr.assign(p, graphsync.RequestID(i+1), []int{i})
+	}
+
+	// all remaining peers have one bucket, so the first one given is chosen
+	reassigned, ok := mpr.failSubRequest(graphsync.RequestID(2), graphsync.RequestID(5))
+	require.True(t, ok)
+	require.Equal(t, peers[0], reassigned.p)
+	require.Equal(t, graphsync.RequestID(5), reassigned.requestID)
+	require.Equal(t, []int{1}, reassigned.buckets)
+
+	// the peer with the fewest buckets is chosen
+	reassigned, ok = mpr.failSubRequest(graphsync.RequestID(4), graphsync.RequestID(6))
+	require.True(t, ok)
+	require.Equal(t, peers[2], reassigned.p)
+	require.Equal(t, []int{3}, reassigned.buckets)
+
+	// no peers remain once every peer has failed
+	_, ok = mpr.failSubRequest(graphsync.RequestID(1), graphsync.RequestID(7))
+	require.True(t, ok)
+	_, ok = mpr.failSubRequest(graphsync.RequestID(3), graphsync.RequestID(8))
+	require.False(t, ok)
+}
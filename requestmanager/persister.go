@@ -0,0 +1,104 @@
+package requestmanager
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/requestmanager/requeststore"
+)
+
+// requestPersister writes received CIDs and removals to the request store in
+// the background, in batches, so requests never wait on the datastore
+type requestPersister struct {
+	requestStore *requeststore.RequestStore
+	signal       chan struct{}
+
+	pendingLk       sync.Mutex
+	pendingCids     map[string][]cid.Cid
+	pendingRemovals map[string]struct{}
+
+	// writeLk is held while writing, so a removal never races with a batch of
+	// CIDs for the same request
+	writeLk sync.Mutex
+}
+
+func newRequestPersister(requestStore *requeststore.RequestStore) *requestPersister {
+	return &requestPersister{
+		requestStore:    requestStore,
+		signal:          make(chan struct{}, 1),
+		pendingCids:     make(map[string][]cid.Cid),
+		pendingRemovals: make(map[string]struct{}),
+	}
+}
+
+// addCid queues a received CID for the persisted request with the given ID
+func (rp *requestPersister) addCid(id string, c cid.Cid) {
+	rp.pendingLk.Lock()
+	rp.pendingCids[id] = append(rp.pendingCids[id], c)
+	rp.pendingLk.Unlock()
+	rp.notify()
+}
+
+// removeLater queues the removal of the persisted request with the given ID
+func (rp *requestPersister) removeLater(id string) {
+	rp.pendingLk.Lock()
+	rp.pendingRemovals[id] = struct{}{}
+	rp.pendingLk.Unlock()
+	rp.notify()
+}
+
+// remove removes the persisted request with the given ID right away, along
+// with anything queued for it
+func (rp *requestPersister) remove(id string) error {
+	rp.writeLk.Lock()
+	defer rp.writeLk.Unlock()
+	rp.pendingLk.Lock()
+	delete(rp.pendingCids, id)
+	delete(rp.pendingRemovals, id)
+	rp.pendingLk.Unlock()
+	return rp.requestStore.Remove(id)
+}
+
+// flush writes everything queued so far
+func (rp *requestPersister) flush() {
+	rp.writeLk.Lock()
+	defer rp.writeLk.Unlock()
+	rp.pendingLk.Lock()
+	pendingCids, pendingRemovals := rp.pendingCids, rp.pendingRemovals
+	rp.pendingCids = make(map[string][]cid.Cid)
+	rp.pendingRemovals = make(map[string]struct{})
+	rp.pendingLk.Unlock()
+	for id, cids := range pendingCids {
+		if _, removed := pendingRemovals[id]; removed {
+			continue
+		}
+		if err := rp.requestStore.AddCids(id, cids); err != nil {
+			log.Warnf("Unable to persist blocks for request %s: %s", id, err)
+		}
+	}
+	for id := range pendingRemovals {
+		if err := rp.requestStore.Remove(id); err != nil {
+			log.Warnf("Unable to remove persisted request %s: %s", id, err)
+		}
+	}
+}
+
+func (rp *requestPersister) notify() {
+	select {
+	case rp.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (rp *requestPersister) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			rp.flush()
+			return
+		case <-rp.signal:
+			rp.flush()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package requestmanager
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-graphsync/requestmanager/requeststore"
+	"github.com/ipfs/go-graphsync/testutil"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestPersister(t *testing.T) {
+	rs := requeststore.New(dss.MutexWrap(datastore.NewMapDatastore()))
+	rp := newRequestPersister(rs)
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	record := requeststore.Record{
+		P:        testutil.GeneratePeers(1)[0],
+		Root:     testutil.GenerateCids(1)[0],
+		Selector: ssb.ExploreAll(ssb.Matcher()).Node(),
+	}
+	id1, err := rs.NewID()
+	require.NoError(t, err)
+	id2, err := rs.NewID()
+	require.NoError(t, err)
+	require.NoError(t, rs.Put(id1, record))
+	require.NoError(t, rs.Put(id2, record))
+
+	cids := testutil.GenerateCids(3)
+	for _, c := range cids {
+		rp.addCid(id1, c)
+		rp.addCid(id2, c)
+	}
+
+	// nothing is written until the persister flushes
+	_, receivedCids, err := rs.Get(id1)
+	require.NoError(t, err)
+	require.Equal(t, 0, receivedCids.Len())
+
+	rp.flush()
+	_, receivedCids, err = rs.Get(id1)
+	require.NoError(t, err)
+	require.Equal(t, len(cids), receivedCids.Len())
+
+	// a queued removal drops any queued cids for the same request
+	rp.addCid(id2, testutil.GenerateCids(1)[0])
+	rp.removeLater(id2)
+	_, _, err = rs.Get(id2)
+	require.NoError(t, err)
+	rp.flush()
+	_, _, err = rs.Get(id2)
+	require.Equal(t, requeststore.ErrNotFound, err)
+
+	// a direct removal discards whatever is queued
+	rp.addCid(id1, testutil.GenerateCids(1)[0])
+	require.NoError(t, rp.remove(id1))
+	rp.flush()
+	ids, err := rs.List()
+	require.NoError(t, err)
+	require.Empty(t, ids)
+}
@@ -0,0 +1,33 @@
+package requestmanager
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// peerProtection keeps the connections to the peers a request is sent to open
+// until the request finishes
+type peerProtection struct {
+	tag   string
+	peers map[peer.ID]struct{}
+}
+
+func newPeerProtection(tag string) peerProtection {
+	return peerProtection{tag: tag, peers: make(map[peer.ID]struct{})}
+}
+
+// protectPeer keeps the connection to a peer open until the request finishes
+func (rm *RequestManager) protectPeer(requestStatus *inProgressRequestStatus, p peer.ID) {
+	pp := &requestStatus.protection
+	if _, ok := pp.peers[p]; ok {
+		return
+	}
+	pp.peers[p] = struct{}{}
+	rm.connManager.Protect(p, pp.tag)
+}
+
+func (rm *RequestManager) unprotectPeers(requestStatus *inProgressRequestStatus) {
+	pp := &requestStatus.protection
+	for p := range pp.peers {
+		rm.connManager.Unprotect(p, pp.tag)
+	}
+}
@@ -0,0 +1,72 @@
+package requestmanager
+
+import (
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/additionalpeers"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/requestmanager/executor"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// redirectState tracks the peers responders suggested for a request that
+// follows them
+type redirectState struct {
+	follow bool
+	// peers are the suggested peers not tried yet, in the order they were
+	// suggested
+	peers []peer.ID
+	// seen are the peers the request has been sent to or has queued, so no
+	// peer is tried twice
+	seen map[peer.ID]struct{}
+}
+
+func newRedirectState(follow bool, p peer.ID) redirectState {
+	return redirectState{
+		follow: follow,
+		seen:   map[peer.ID]struct{}{p: {}},
+	}
+}
+
+// processAdditionalPeers notifies listeners of peers suggested by responders,
+// and queues them as redirect targets for requests that follow them
+func (rm *RequestManager) processAdditionalPeers(responses []gsmsg.GraphSyncResponse, p peer.ID) {
+	for _, response := range responses {
+		additionalPeersData, has := response.Extension(graphsync.ExtensionAdditionalPeers)
+		if !has {
+			continue
+		}
+		peers, err := additionalpeers.DecodeAdditionalPeers(additionalPeersData)
+		if err != nil {
+			log.Warnf("Unable to decode additional peers for request %d: %s", response.RequestID(), err)
+			continue
+		}
+		rm.additionalPeersListeners.NotifyAdditionalPeersListeners(p, response, peers)
+		requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+		rs := &requestStatus.redirect
+		if !rs.follow || requestStatus.multiPeer != nil {
+			continue
+		}
+		for _, ai := range peers {
+			if _, seen := rs.seen[ai.ID]; seen {
+				continue
+			}
+			rs.seen[ai.ID] = struct{}{}
+			rs.peers = append(rs.peers, ai.ID)
+		}
+	}
+}
+
+// redirectRequest resends a failed request to the next peer a responder
+// suggested, if the request follows additional peers. Each suggested peer is
+// tried at most once.
+func (rm *RequestManager) redirectRequest(requestID graphsync.RequestID, requestStatus *inProgressRequestStatus) bool {
+	rs := &requestStatus.redirect
+	if len(rs.peers) == 0 {
+		return false
+	}
+	if !rm.sendRetry(requestID, requestStatus, executor.Retry{P: rs.peers[0]}) {
+		return false
+	}
+	rs.peers = rs.peers[1:]
+	return true
+}
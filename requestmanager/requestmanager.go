@@ -4,41 +4,88 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync/cidset"
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
+	"github.com/ipfs/go-graphsync/requestmanager/requeststore"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync"
 	ipldutil "github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/metrics"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 var log = logging.Logger("graphsync")
 
+var errPersistenceDisabled = errors.New("request persistence is not enabled")
+
+var errShuttingDown = errors.New("graphsync is shutting down")
+
 const (
 	// defaultPriority is the default priority for requests sent by graphsync
 	defaultPriority = graphsync.Priority(0)
 )
 
+// send states of a request. Requests that resolve locally first start unsent,
+// and are only sent once the traversal reaches a link that is not available
+// locally.
+const (
+	requestSent int32 = iota
+	requestUnsent
+	// requestAbandoned is a request cancelled before it was sent, which must
+	// not be sent afterwards
+	requestAbandoned
+	// requestResolvedLocally is a request that completed without being sent
+	requestResolvedLocally
+)
+
+type transferStats struct {
+	blocks uint64
+	bytes  uint64
+}
+
 type inProgressRequestStatus struct {
 	ctx            context.Context
 	cancelFn       func()
 	p              peer.ID
+	root           ipld.Link
+	startTime      time.Time
+	stats          *transferStats
 	networkError   chan error
 	resumeMessages chan []graphsync.ExtensionData
 	pauseMessages  chan struct{}
 	paused         bool
 	lastResponse   atomic.Value
+	persistedID    string
+	terminalStatus graphsync.ResponseStatusCode
+	// rejected is set when the responder fails the request in a way that
+	// resuming it will not fix
+	rejected bool
+	// sendState is accessed atomically, as the executor sends the request
+	// outside the run loop
+	sendState int32
+
+	// the state of each feature a request can use lives in the feature's own
+	// file
+	multiPeer  *multiPeerRequest
+	retry      retryState
+	redirect   redirectState
+	stall      stallState
+	throttle   throttleState
+	protection peerProtection
 }
 
 // PeerHandler is an interface that can send requests to peers
@@ -46,6 +93,13 @@ type PeerHandler interface {
 	SendRequest(p peer.ID, graphSyncRequest gsmsg.GraphSyncRequest)
 }
 
+// ConnManager protects connections to peers while requests to them are in
+// progress
+type ConnManager interface {
+	Protect(peer.ID, string)
+	Unprotect(peer.ID, string) bool
+}
+
 // AsyncLoader is an interface for loading links asynchronously, returning
 // results as new responses are processed
 type AsyncLoader interface {
@@ -55,6 +109,10 @@ type AsyncLoader interface {
 	AsyncLoad(requestID graphsync.RequestID, link ipld.Link) <-chan types.AsyncLoadResult
 	CompleteResponsesFor(requestID graphsync.RequestID)
 	CleanupRequest(requestID graphsync.RequestID)
+	ClearMissingLinks(requestID graphsync.RequestID)
+	PauseRequest(requestID graphsync.RequestID)
+	UnpauseRequest(requestID graphsync.RequestID)
+	AtMemoryLimit() bool
 }
 
 // RequestManager tracks outgoing requests and processes incoming reponses
@@ -65,13 +123,25 @@ type RequestManager struct {
 	messages    chan requestManagerMessage
 	peerHandler PeerHandler
 	rc          *responseCollector
+	coalesced   *coalescedRequests
 	asyncLoader AsyncLoader
 	// dont touch out side of run loop
 	nextRequestID             graphsync.RequestID
 	inProgressRequestStatuses map[graphsync.RequestID]*inProgressRequestStatus
+	subRequests               map[graphsync.RequestID]graphsync.RequestID
 	requestHooks              RequestHooks
 	responseHooks             ResponseHooks
 	blockHooks                BlockHooks
+	additionalPeersListeners  AdditionalPeersListeners
+	requestStore              *requeststore.RequestStore
+	persister                 *requestPersister
+	metrics                   metrics.Metrics
+	connManager               ConnManager
+	inactivityTimeout         time.Duration
+	localFirst                bool
+	coalesceRequests          bool
+	throttleResponses         bool
+	stopped                   int32
 }
 
 type requestManagerMessage interface {
@@ -88,6 +158,11 @@ type ResponseHooks interface {
 	ProcessResponseHooks(p peer.ID, response graphsync.ResponseData) hooks.UpdateResult
 }
 
+// AdditionalPeersListeners are notified of peers that responders suggest
+type AdditionalPeersListeners interface {
+	NotifyAdditionalPeersListeners(p peer.ID, response graphsync.ResponseData, peers []peer.AddrInfo)
+}
+
 // BlockHooks run for each block loaded
 type BlockHooks interface {
 	ProcessBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) hooks.UpdateResult
@@ -98,18 +173,24 @@ func New(ctx context.Context,
 	asyncLoader AsyncLoader,
 	requestHooks RequestHooks,
 	responseHooks ResponseHooks,
-	blockHooks BlockHooks) *RequestManager {
+	blockHooks BlockHooks,
+	additionalPeersListeners AdditionalPeersListeners) *RequestManager {
 	ctx, cancel := context.WithCancel(ctx)
 	return &RequestManager{
 		ctx:                       ctx,
 		cancel:                    cancel,
 		asyncLoader:               asyncLoader,
 		rc:                        newResponseCollector(ctx),
+		coalesced:                 newCoalescedRequests(ctx),
 		messages:                  make(chan requestManagerMessage, 16),
 		inProgressRequestStatuses: make(map[graphsync.RequestID]*inProgressRequestStatus),
+		subRequests:               make(map[graphsync.RequestID]graphsync.RequestID),
 		requestHooks:              requestHooks,
 		responseHooks:             responseHooks,
 		blockHooks:                blockHooks,
+		additionalPeersListeners:  additionalPeersListeners,
+		metrics:                   metrics.NewNoop(),
+		connManager:               connmgr.NullConnMgr{},
 	}
 }
 
@@ -118,6 +199,63 @@ func (rm *RequestManager) SetDelegate(peerHandler PeerHandler) {
 	rm.peerHandler = peerHandler
 }
 
+// SetMetrics specifies where measurements for outgoing requests are reported.
+// It must be called before the request manager starts.
+func (rm *RequestManager) SetMetrics(metrics metrics.Metrics) {
+	rm.metrics = metrics
+}
+
+// SetRequestStore specifies where in progress requests are persisted so they
+// can be resumed later. It must be called before the request manager starts.
+func (rm *RequestManager) SetRequestStore(requestStore *requeststore.RequestStore) {
+	rm.requestStore = requestStore
+	rm.persister = newRequestPersister(requestStore)
+}
+
+// SetConnManager specifies what protects connections to peers while requests
+// to them are in progress. It must be called before the request manager
+// starts.
+func (rm *RequestManager) SetConnManager(connManager ConnManager) {
+	rm.connManager = connManager
+}
+
+// SetInactivityTimeout specifies how long requests wait for a response or
+// block from the peer before they are cancelled, unless a request hook sets a
+// different timeout. Zero disables the timeout. It must be called before the
+// request manager starts.
+func (rm *RequestManager) SetInactivityTimeout(timeout time.Duration) {
+	rm.inactivityTimeout = timeout
+}
+
+// SetLocalFirst specifies whether requests first traverse as much of the
+// selector as they can locally, and are only sent to the peer once they reach
+// a link that is not available locally. Request hooks can turn this on for a
+// single request. It must be called before the request manager starts.
+func (rm *RequestManager) SetLocalFirst(localFirst bool) {
+	rm.localFirst = localFirst
+}
+
+// SetCoalesceRequests specifies whether a request that is identical to one
+// already in progress -- same peers, root, selector, extensions and retry
+// policy -- shares the request in progress instead of sending a new one. The
+// shared request is only cancelled once every caller has cancelled. A caller
+// that leaves its buffer full for detachAfter gets a request of its own; zero
+// never detaches callers. Raw block requests and resumed requests are not
+// coalesced. It must be called before the request manager starts.
+func (rm *RequestManager) SetCoalesceRequests(coalesceRequests bool, detachAfter time.Duration) {
+	rm.coalesceRequests = coalesceRequests
+	rm.coalesced.detachAfter = detachAfter
+}
+
+// SetThrottleResponses specifies whether requests offer to pause their
+// responses while they catch up with the blocks they have received, so the
+// blocks that are not yet verified stay under the memory limit. Responders
+// that do not answer the offer have the request cancelled, and sent again
+// later, instead. It must be called before the request manager starts.
+func (rm *RequestManager) SetThrottleResponses(throttleResponses bool) {
+	rm.throttleResponses = throttleResponses
+}
+
 type inProgressRequest struct {
 	requestID     graphsync.RequestID
 	incoming      chan graphsync.ResponseProgress
@@ -125,10 +263,13 @@ type inProgressRequest struct {
 }
 
 type newRequestMessage struct {
-	p                     peer.ID
+	peers                 []peer.ID
 	root                  ipld.Link
 	selector              ipld.Node
 	extensions            []graphsync.ExtensionData
+	persistedID           string
+	rawBlocks             chan<- graphsync.RawBlock
+	retryPolicy           *graphsync.RetryPolicy
 	inProgressRequestChan chan<- inProgressRequest
 }
 
@@ -138,14 +279,197 @@ func (rm *RequestManager) SendRequest(ctx context.Context,
 	root ipld.Link,
 	selector ipld.Node,
 	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	return rm.SendRequestToPeers(ctx, []peer.ID{p}, root, selector, extensions...)
+}
+
+// SendRequestToPeers initiates a new GraphSync request whose blocks are split
+// across the given peers.
+func (rm *RequestManager) SendRequestToPeers(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if rm.coalesceRequests {
+		var retryPolicy *graphsync.RetryPolicy
+		if contextRetryPolicy, ok := graphsync.RetryPolicyFromContext(ctx); ok {
+			retryPolicy = &contextRetryPolicy
+		}
+		if key, err := coalesceKey(peers, root, selector, extensions, retryPolicy); err == nil {
+			return rm.coalesced.subscribe(ctx, key, func(requestCtx context.Context) (<-chan graphsync.ResponseProgress, <-chan error) {
+				if retryPolicy != nil {
+					requestCtx = graphsync.WithRetryPolicy(requestCtx, *retryPolicy)
+				}
+				return rm.sendRequestToPeers(requestCtx, peers, root, selector, extensions, nil)
+			})
+		}
+	}
+	return rm.sendRequestToPeers(ctx, peers, root, selector, extensions, nil)
+}
+
+// RequestBlocks initiates a new GraphSync request to the given peer that
+// returns the raw blocks of the traversal in order, instead of the nodes it
+// visits. Raw block requests are never coalesced, since sharing them would
+// mean buffering block data for every caller.
+func (rm *RequestManager) RequestBlocks(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.RawBlock, <-chan error) {
+	rawBlocks := make(chan graphsync.RawBlock)
+	returnedBlocks := make(chan graphsync.RawBlock)
+	// no progress is sent for a raw block request, and the progress channel
+	// closes once the request finishes, after its last block is sent
+	progress, errs := rm.sendRequestToPeers(ctx, []peer.ID{p}, root, selector, extensions, rawBlocks)
+	go func() {
+		defer close(returnedBlocks)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-rm.ctx.Done():
+				return
+			case _, ok := <-progress:
+				if !ok {
+					return
+				}
+			case block := <-rawBlocks:
+				select {
+				case <-ctx.Done():
+					return
+				case <-rm.ctx.Done():
+					return
+				case returnedBlocks <- block:
+				}
+			}
+		}
+	}()
+	return returnedBlocks, errs
+}
+
+func (rm *RequestManager) sendRequestToPeers(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	rawBlocks chan<- graphsync.RawBlock) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if atomic.LoadInt32(&rm.stopped) != 0 {
+		return rm.singleErrorResponse(errShuttingDown)
+	}
+	if len(peers) == 0 {
+		return rm.singleErrorResponse(fmt.Errorf("No peers to send request to"))
+	}
 	if _, err := ipldutil.ParseSelector(selector); err != nil {
 		return rm.singleErrorResponse(fmt.Errorf("Invalid Selector Spec"))
 	}
+	var persistedID string
+	if rm.requestStore != nil {
+		var err error
+		persistedID, err = rm.persistRequest(peers, root, selector, extensions)
+		if err != nil {
+			return rm.singleErrorResponse(err)
+		}
+	}
+	return rm.startRequest(ctx, peers, root, selector, extensions, persistedID, rawBlocks)
+}
+
+// ResumeRequest sends a persisted request again, asking the peer not to send
+// the blocks that were received before.
+func (rm *RequestManager) ResumeRequest(ctx context.Context, id string) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if atomic.LoadInt32(&rm.stopped) != 0 {
+		return rm.singleErrorResponse(errShuttingDown)
+	}
+	if rm.requestStore == nil {
+		return rm.singleErrorResponse(errPersistenceDisabled)
+	}
+	rm.persister.flush()
+	record, receivedCids, err := rm.requestStore.Get(id)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	extensions, err := resumeExtensions(record.Extensions, receivedCids)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	peers := record.Peers
+	if len(peers) == 0 {
+		peers = []peer.ID{record.P}
+	}
+	return rm.startRequest(ctx, peers, cidlink.Link{Cid: record.Root}, record.Selector, extensions, id, nil)
+}
 
+// PersistedRequests lists the requests in the request store that have not
+// completed yet.
+func (rm *RequestManager) PersistedRequests() ([]graphsync.PersistedRequest, error) {
+	if rm.requestStore == nil {
+		return nil, errPersistenceDisabled
+	}
+	rm.persister.flush()
+	ids, err := rm.requestStore.List()
+	if err != nil {
+		return nil, err
+	}
+	persistedRequests := make([]graphsync.PersistedRequest, 0, len(ids))
+	for _, id := range ids {
+		record, receivedCids, err := rm.requestStore.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		persistedRequests = append(persistedRequests, graphsync.PersistedRequest{
+			ID:             id,
+			Peer:           record.P,
+			Peers:          record.Peers,
+			Root:           cidlink.Link{Cid: record.Root},
+			Selector:       record.Selector,
+			Extensions:     record.Extensions,
+			BlocksReceived: receivedCids.Len(),
+		})
+	}
+	return persistedRequests, nil
+}
+
+// RemovePersistedRequest deletes a request from the request store.
+func (rm *RequestManager) RemovePersistedRequest(id string) error {
+	if rm.requestStore == nil {
+		return errPersistenceDisabled
+	}
+	return rm.persister.remove(id)
+}
+
+func (rm *RequestManager) persistRequest(peers []peer.ID, root ipld.Link, selector ipld.Node, extensions []graphsync.ExtensionData) (string, error) {
+	asCidLink, ok := root.(cidlink.Link)
+	if !ok {
+		return "", fmt.Errorf("request failed: link has no cid")
+	}
+	id, err := rm.requestStore.NewID()
+	if err != nil {
+		return "", err
+	}
+	record := requeststore.Record{P: peers[0], Root: asCidLink.Cid, Selector: selector, Extensions: extensions}
+	if len(peers) > 1 {
+		record.Peers = peers
+	}
+	err = rm.requestStore.Put(id, record)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (rm *RequestManager) startRequest(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	persistedID string,
+	rawBlocks chan<- graphsync.RawBlock) (<-chan graphsync.ResponseProgress, <-chan error) {
 	inProgressRequestChan := make(chan inProgressRequest)
+	var retryPolicy *graphsync.RetryPolicy
+	if contextRetryPolicy, ok := graphsync.RetryPolicyFromContext(ctx); ok {
+		retryPolicy = &contextRetryPolicy
+	}
 
 	select {
-	case rm.messages <- &newRequestMessage{p, root, selector, extensions, inProgressRequestChan}:
+	case rm.messages <- &newRequestMessage{peers, root, selector, extensions, persistedID, rawBlocks, retryPolicy, inProgressRequestChan}:
 	case <-rm.ctx.Done():
 		return rm.emptyResponse()
 	case <-ctx.Done():
@@ -230,6 +554,33 @@ func (rm *RequestManager) ProcessResponses(p peer.ID, responses []gsmsg.GraphSyn
 	}
 }
 
+type networkErrorMessage struct {
+	p          peer.ID
+	requestIDs []graphsync.RequestID
+	err        error
+}
+
+// ProcessNetworkError fails requests to a peer after messages for them could
+// not be sent to the peer. If no request IDs are given, every
+// request in progress with the peer fails. Requests with a retry policy, or
+// that follow additional peers, are sent again instead.
+func (rm *RequestManager) ProcessNetworkError(p peer.ID, requestIDs []graphsync.RequestID, err error) {
+	rm.sendNetworkErrorMessage(&networkErrorMessage{p, requestIDs, graphsync.RequestFailedNetworkErr{Peer: p, Err: err}})
+}
+
+// Disconnected fails every request in progress with a peer that disconnected,
+// except paused requests, which reconnect when they are unpaused
+func (rm *RequestManager) Disconnected(p peer.ID) {
+	rm.sendNetworkErrorMessage(&networkErrorMessage{p, nil, graphsync.RequestFailedPeerDisconnectedErr{Peer: p}})
+}
+
+func (rm *RequestManager) sendNetworkErrorMessage(message *networkErrorMessage) {
+	select {
+	case rm.messages <- message:
+	case <-rm.ctx.Done():
+	}
+}
+
 type unpauseRequestMessage struct {
 	id         graphsync.RequestID
 	extensions []graphsync.ExtensionData
@@ -254,6 +605,27 @@ func (rm *RequestManager) PauseRequest(requestID graphsync.RequestID) error {
 	return rm.sendSyncMessage(&pauseRequestMessage{requestID, response}, response)
 }
 
+type requestStatesMessage struct {
+	response chan []graphsync.RequestState
+}
+
+// InProgressRequests returns a snapshot of the state of all in progress
+// requests, ordered by request ID
+func (rm *RequestManager) InProgressRequests() []graphsync.RequestState {
+	response := make(chan []graphsync.RequestState, 1)
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case rm.messages <- &requestStatesMessage{response}:
+	}
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case requestStates := <-response:
+		return requestStates
+	}
+}
+
 func (rm *RequestManager) sendSyncMessage(message requestManagerMessage, response chan error) error {
 	select {
 	case <-rm.ctx.Done():
@@ -268,8 +640,28 @@ func (rm *RequestManager) sendSyncMessage(message requestManagerMessage, respons
 	}
 }
 
+// StopAcceptingRequests makes all new requests fail, while requests already
+// in progress continue
+func (rm *RequestManager) StopAcceptingRequests() {
+	atomic.StoreInt32(&rm.stopped, 1)
+}
+
+type cancelAllMessage struct {
+	response chan error
+}
+
+// CancelAll cancels all in progress requests, and tells the responders to
+// stop sending them
+func (rm *RequestManager) CancelAll() {
+	response := make(chan error, 1)
+	_ = rm.sendSyncMessage(&cancelAllMessage{response}, response)
+}
+
 // Startup starts processing for the WantManager.
 func (rm *RequestManager) Startup() {
+	if rm.persister != nil {
+		go rm.persister.run(rm.ctx)
+	}
 	go rm.run()
 }
 
@@ -296,6 +688,7 @@ func (rm *RequestManager) run() {
 func (rm *RequestManager) cleanupInProcessRequests() {
 	for _, requestStatus := range rm.inProgressRequestStatuses {
 		requestStatus.cancelFn()
+		rm.unprotectPeers(requestStatus)
 	}
 }
 
@@ -304,7 +697,8 @@ type terminateRequestMessage struct {
 }
 
 func (nrm *newRequestMessage) setupRequest(requestID graphsync.RequestID, rm *RequestManager) (chan graphsync.ResponseProgress, chan error) {
-	request, hooksResult, err := rm.validateRequest(requestID, nrm.p, nrm.root, nrm.selector, nrm.extensions)
+	p := nrm.peers[0]
+	request, hooksResult, err := rm.validateRequest(requestID, nrm.peers, nrm.root, nrm.selector, nrm.extensions)
 	if err != nil {
 		return rm.singleErrorResponse(err)
 	}
@@ -318,23 +712,85 @@ func (nrm *newRequestMessage) setupRequest(requestID graphsync.RequestID, rm *Re
 	} else {
 		doNotSendCids = cid.NewSet()
 	}
+	request, requestBudget, err := applyBudget(request, hooksResult.Budget)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	if rm.throttleResponses {
+		request, err = offerPauseResponse(request)
+		if err != nil {
+			return rm.singleErrorResponse(err)
+		}
+	}
+	// a retry policy set on the request itself wins over the hooks
+	if nrm.retryPolicy != nil {
+		hooksResult.RetryPolicy = *nrm.retryPolicy
+	}
 	ctx, cancel := context.WithCancel(rm.ctx)
-	p := nrm.p
 	resumeMessages := make(chan []graphsync.ExtensionData, 1)
 	pauseMessages := make(chan struct{}, 1)
 	networkError := make(chan error, 1)
 	requestStatus := &inProgressRequestStatus{
-		ctx: ctx, cancelFn: cancel, p: p, resumeMessages: resumeMessages, pauseMessages: pauseMessages, networkError: networkError,
+		ctx: ctx, cancelFn: cancel, p: p, root: nrm.root, startTime: time.Now(), stats: &transferStats{},
+		resumeMessages: resumeMessages, pauseMessages: pauseMessages, networkError: networkError,
+		persistedID: nrm.persistedID,
+		retry:       newRetryState(hooksResult.RetryPolicy, p),
+		redirect:    newRedirectState(hooksResult.FollowPeers, p),
+		stall:       stallState{timeout: rm.inactivityTimeout},
+		throttle:    newThrottleState(),
+		protection:  newPeerProtection(fmt.Sprintf("graphsync-request-%d", request.ID())),
+	}
+	if hooksResult.InactivityTimeout > 0 {
+		requestStatus.stall.timeout = hooksResult.InactivityTimeout
+	}
+	for _, requestPeer := range nrm.peers {
+		rm.protectPeer(requestStatus, requestPeer)
+	}
+	localFirst := rm.localFirst || hooksResult.LocalFirst
+	if localFirst {
+		requestStatus.sendState = requestUnsent
 	}
 	lastResponse := &requestStatus.lastResponse
 	lastResponse.Store(gsmsg.NewResponse(request.ID(), graphsync.RequestAcknowledged))
 	rm.inProgressRequestStatuses[request.ID()] = requestStatus
+	rm.metrics.RequestStarted()
+	rm.startStallTimer(request.ID(), &requestStatus.stall)
+	peerSendRequest := rm.peerHandler.SendRequest
+	if len(nrm.peers) > 1 {
+		requestStatus.multiPeer = rm.setupMultiPeerRequest(request.ID(), nrm.peers)
+		peerSendRequest = func(_ peer.ID, request gsmsg.GraphSyncRequest) {
+			requestStatus.multiPeer.sendRequest(rm.peerHandler, request)
+		}
+	}
+	sendRequest := func(p peer.ID, request gsmsg.GraphSyncRequest) {
+		if !request.IsCancel() && !request.IsUpdate() {
+			atomic.CompareAndSwapInt32(&requestStatus.sendState, requestUnsent, requestSent)
+		}
+		// there is nothing to cancel or update until the request is sent
+		if atomic.LoadInt32(&requestStatus.sendState) != requestSent {
+			return
+		}
+		peerSendRequest(p, request)
+	}
 	incoming, incomingError := executor.ExecutionEnv{
 		Ctx:              rm.ctx,
-		SendRequest:      rm.peerHandler.SendRequest,
+		SendRequest:      sendRequest,
 		TerminateRequest: rm.terminateRequest,
-		RunBlockHooks:    rm.processBlockHooks,
-		Loader:           rm.asyncLoader.AsyncLoad,
+		RunBlockHooks: func(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) error {
+			rm.metrics.BlockReceived(block.BlockSize(), block.BlockSizeOnWire())
+			if block.BlockSizeOnWire() > 0 {
+				atomic.AddUint64(&requestStatus.stats.blocks, 1)
+				atomic.AddUint64(&requestStatus.stats.bytes, block.BlockSizeOnWire())
+			}
+			err := rm.processBlockHooks(sendRequest, p, response, block)
+			if err == nil && requestStatus.persistedID != "" {
+				rm.persistBlock(requestStatus.persistedID, block)
+			}
+			return err
+		},
+		Loader:        rm.asyncLoader.AsyncLoad,
+		PauseLoader:   rm.asyncLoader.PauseRequest,
+		UnpauseLoader: rm.asyncLoader.UnpauseRequest,
 	}.Start(
 		executor.RequestExecution{
 			Ctx:              ctx,
@@ -346,6 +802,14 @@ func (nrm *newRequestMessage) setupRequest(requestID graphsync.RequestID, rm *Re
 			NodeStyleChooser: hooksResult.CustomChooser,
 			ResumeMessages:   resumeMessages,
 			PauseMessages:    pauseMessages,
+			RetryMessages:    requestStatus.retry.messages,
+			ThrottleMessages: requestStatus.throttle.messages,
+			Budget:           requestBudget,
+			LocalFirst:       localFirst,
+			RawBlocks:        nrm.rawBlocks,
+			ResolvedLocally: func() {
+				atomic.CompareAndSwapInt32(&requestStatus.sendState, requestUnsent, requestResolvedLocally)
+			},
 		})
 	return incoming, incomingError
 }
@@ -363,17 +827,84 @@ func (nrm *newRequestMessage) handle(rm *RequestManager) {
 }
 
 func (trm *terminateRequestMessage) handle(rm *RequestManager) {
+	if requestStatus, ok := rm.inProgressRequestStatuses[trm.requestID]; ok {
+		rm.releaseRequest(requestStatus)
+		terminalStatus := requestStatus.finalStatus()
+		// cancelled requests, and requests that failed on the network, stay
+		// persisted so they can be resumed
+		if requestStatus.persistedID != "" && (terminalStatus == graphsync.RequestCompletedFull || requestStatus.rejected) {
+			rm.persister.removeLater(requestStatus.persistedID)
+		}
+		rm.metrics.RequestCompleted(terminalStatus)
+	}
 	delete(rm.inProgressRequestStatuses, trm.requestID)
 	rm.asyncLoader.CleanupRequest(trm.requestID)
 }
 
+// releaseRequest lets go of what the features of a request hold once it ends
+func (rm *RequestManager) releaseRequest(requestStatus *inProgressRequestStatus) {
+	if requestStatus.multiPeer != nil {
+		rm.removeSubRequests(requestStatus.multiPeer)
+	}
+	requestStatus.stall.stop()
+	rm.unprotectPeers(requestStatus)
+}
+
+// finalStatus returns the status a request ended with. A request that
+// completed without being sent completed in full, and a request that ended
+// without a status was cancelled.
+func (requestStatus *inProgressRequestStatus) finalStatus() graphsync.ResponseStatusCode {
+	if atomic.LoadInt32(&requestStatus.sendState) == requestResolvedLocally {
+		return graphsync.RequestCompletedFull
+	}
+	if requestStatus.terminalStatus == 0 {
+		return graphsync.RequestCancelled
+	}
+	return requestStatus.terminalStatus
+}
+
+func (rsm *requestStatesMessage) handle(rm *RequestManager) {
+	requestStates := make([]graphsync.RequestState, 0, len(rm.inProgressRequestStatuses))
+	for requestID, requestStatus := range rm.inProgressRequestStatuses {
+		requestStates = append(requestStates, graphsync.RequestState{
+			Peer:      requestStatus.p,
+			RequestID: requestID,
+			Root:      requestStatus.root,
+			Paused:    requestStatus.paused,
+			Blocks:    atomic.LoadUint64(&requestStatus.stats.blocks),
+			Bytes:     atomic.LoadUint64(&requestStatus.stats.bytes),
+			StartTime: requestStatus.startTime,
+		})
+	}
+	sort.Slice(requestStates, func(i, j int) bool {
+		return requestStates[i].RequestID < requestStates[j].RequestID
+	})
+	select {
+	case <-rm.ctx.Done():
+	case rsm.response <- requestStates:
+	}
+}
+
+func (cam *cancelAllMessage) handle(rm *RequestManager) {
+	for requestID := range rm.inProgressRequestStatuses {
+		(&cancelRequestMessage{requestID, false}).handle(rm)
+	}
+	select {
+	case <-rm.ctx.Done():
+	case cam.response <- nil:
+	}
+}
+
 func (crm *cancelRequestMessage) handle(rm *RequestManager) {
 	inProgressRequestStatus, ok := rm.inProgressRequestStatuses[crm.requestID]
 	if !ok {
 		return
 	}
 
-	rm.peerHandler.SendRequest(inProgressRequestStatus.p, gsmsg.CancelRequest(crm.requestID))
+	if !crm.isPause {
+		atomic.CompareAndSwapInt32(&inProgressRequestStatus.sendState, requestUnsent, requestAbandoned)
+	}
+	rm.sendRequest(inProgressRequestStatus, gsmsg.CancelRequest(crm.requestID))
 	if crm.isPause {
 		inProgressRequestStatus.paused = true
 	} else {
@@ -382,11 +913,17 @@ func (crm *cancelRequestMessage) handle(rm *RequestManager) {
 }
 
 func (prm *processResponseMessage) handle(rm *RequestManager) {
-	filteredResponses := rm.processExtensions(prm.responses, prm.p)
-	filteredResponses = rm.filterResponsesForPeer(filteredResponses, prm.p)
+	responses := rm.processSubRequestResponses(prm.responses, prm.p)
+	// hooks and extensions only see responses from the peers a request was sent to
+	filteredResponses := rm.filterResponsesForPeer(responses, prm.p)
+	filteredResponses = rm.processExtensions(filteredResponses, prm.p)
 	rm.updateLastResponses(filteredResponses)
+	rm.updateLastActivity(filteredResponses)
+	rm.processAdditionalPeers(filteredResponses, prm.p)
+	rm.processPauseResponseOffers(filteredResponses, prm.p)
 	responseMetadata := metadataForResponses(filteredResponses)
 	rm.asyncLoader.ProcessResponse(responseMetadata, prm.blks)
+	rm.throttleRequests(filteredResponses, prm.blks)
 	rm.processTerminations(filteredResponses)
 }
 
@@ -394,7 +931,7 @@ func (rm *RequestManager) filterResponsesForPeer(responses []gsmsg.GraphSyncResp
 	responsesForPeer := make([]gsmsg.GraphSyncResponse, 0, len(responses))
 	for _, response := range responses {
 		requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]
-		if !ok || requestStatus.p != p {
+		if !ok || (requestStatus.multiPeer == nil && requestStatus.p != p) {
 			continue
 		}
 		responsesForPeer = append(responsesForPeer, response)
@@ -423,7 +960,7 @@ func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg
 	result := rm.responseHooks.ProcessResponseHooks(p, response)
 	if len(result.Extensions) > 0 {
 		updateRequest := gsmsg.UpdateRequest(response.RequestID(), result.Extensions...)
-		rm.peerHandler.SendRequest(p, updateRequest)
+		rm.sendRequestToPeer(p, updateRequest)
 	}
 	if result.Err != nil {
 		requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]
@@ -435,7 +972,7 @@ func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg
 		case requestStatus.networkError <- responseError:
 		case <-requestStatus.ctx.Done():
 		}
-		rm.peerHandler.SendRequest(p, gsmsg.CancelRequest(response.RequestID()))
+		rm.sendRequest(requestStatus, gsmsg.CancelRequest(response.RequestID()))
 		requestStatus.cancelFn()
 		return false
 	}
@@ -447,18 +984,68 @@ func (rm *RequestManager) processTerminations(responses []gsmsg.GraphSyncRespons
 		if gsmsg.IsTerminalResponseCode(response.Status()) {
 			if gsmsg.IsTerminalFailureCode(response.Status()) {
 				requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+				retryAfter := retryAfterForResponse(response)
+				if rm.redirectRequest(response.RequestID(), requestStatus) {
+					continue
+				}
+				if rm.retryRequest(response.RequestID(), requestStatus, response.Status(), retryAfter) {
+					continue
+				}
 				responseError := rm.generateResponseErrorFromStatus(response.Status())
+				if response.Status() == graphsync.RequestFailedBusy {
+					responseError = graphsync.RequestFailedBusyErr{RetryAfter: retryAfter}
+				}
 				select {
 				case requestStatus.networkError <- responseError:
 				case <-requestStatus.ctx.Done():
 				}
 				requestStatus.cancelFn()
 			}
+			if requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]; ok {
+				requestStatus.terminalStatus = response.Status()
+				requestStatus.rejected = gsmsg.IsTerminalFailureCode(response.Status()) && response.Status() != graphsync.RequestFailedBusy
+			}
 			rm.asyncLoader.CompleteResponsesFor(response.RequestID())
 		}
 	}
 }
 
+func (rm *RequestManager) persistBlock(persistedID string, block graphsync.BlockData) {
+	asCidLink, ok := block.Link().(cidlink.Link)
+	if !ok {
+		return
+	}
+	rm.persister.addCid(persistedID, asCidLink.Cid)
+}
+
+// resumeExtensions adds the received cids to the do not send cids extension
+// of a persisted request, keeping any cids the original request excluded.
+func resumeExtensions(extensions []graphsync.ExtensionData, receivedCids *cid.Set) ([]graphsync.ExtensionData, error) {
+	resumed := make([]graphsync.ExtensionData, 0, len(extensions)+1)
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionDoNotSendCIDs {
+			resumed = append(resumed, extension)
+			continue
+		}
+		doNotSendCids, err := cidset.DecodeCidSet(extension.Data)
+		if err != nil {
+			return nil, err
+		}
+		_ = doNotSendCids.ForEach(func(c cid.Cid) error {
+			receivedCids.Add(c)
+			return nil
+		})
+	}
+	if receivedCids.Len() == 0 {
+		return resumed, nil
+	}
+	cidsData, err := cidset.EncodeCidSet(receivedCids)
+	if err != nil {
+		return nil, err
+	}
+	return append(resumed, graphsync.ExtensionData{Name: graphsync.ExtensionDoNotSendCIDs, Data: cidsData}), nil
+}
+
 func (rm *RequestManager) generateResponseErrorFromStatus(status graphsync.ResponseStatusCode) error {
 	switch status {
 	case graphsync.RequestFailedBusy:
@@ -476,11 +1063,11 @@ func (rm *RequestManager) generateResponseErrorFromStatus(status graphsync.Respo
 	}
 }
 
-func (rm *RequestManager) processBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) error {
+func (rm *RequestManager) processBlockHooks(sendRequest func(peer.ID, gsmsg.GraphSyncRequest), p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) error {
 	result := rm.blockHooks.ProcessBlockHooks(p, response, block)
 	if len(result.Extensions) > 0 {
 		updateRequest := gsmsg.UpdateRequest(response.RequestID(), result.Extensions...)
-		rm.peerHandler.SendRequest(p, updateRequest)
+		sendRequest(p, updateRequest)
 	}
 	if result.Err != nil {
 		_, isPause := result.Err.(hooks.ErrPaused)
@@ -492,6 +1079,95 @@ func (rm *RequestManager) processBlockHooks(p peer.ID, response graphsync.Respon
 	return result.Err
 }
 
+// sendRequest sends a request to the peer for an in progress request, or to all
+// of its peers if the request is split across several
+func (rm *RequestManager) sendRequest(requestStatus *inProgressRequestStatus, request gsmsg.GraphSyncRequest) {
+	if atomic.LoadInt32(&requestStatus.sendState) != requestSent {
+		return
+	}
+	if requestStatus.multiPeer != nil {
+		requestStatus.multiPeer.sendRequest(rm.peerHandler, request)
+		return
+	}
+	rm.peerHandler.SendRequest(requestStatus.p, request)
+}
+
+// sendRequestToPeer sends a request to a single peer, targeting that peer's
+// sub requests if the request is split across several peers
+func (rm *RequestManager) sendRequestToPeer(p peer.ID, request gsmsg.GraphSyncRequest) {
+	requestStatus, ok := rm.inProgressRequestStatuses[request.ID()]
+	if ok && requestStatus.multiPeer != nil {
+		requestStatus.multiPeer.sendRequestToPeer(rm.peerHandler, p, request)
+		return
+	}
+	rm.peerHandler.SendRequest(p, request)
+}
+
+func (nem *networkErrorMessage) handle(rm *RequestManager) {
+	requestIDs := nem.requestIDs
+	if requestIDs == nil {
+		requestIDs = rm.requestIDsForPeer(nem.p)
+	}
+	for _, requestID := range requestIDs {
+		rm.failRequestOnPeer(nem.p, requestID, nem.err)
+	}
+}
+
+// requestIDsForPeer returns the IDs used on the wire for requests in progress
+// with a peer
+func (rm *RequestManager) requestIDsForPeer(p peer.ID) []graphsync.RequestID {
+	var requestIDs []graphsync.RequestID
+	for requestID, requestStatus := range rm.inProgressRequestStatuses {
+		if requestStatus.multiPeer != nil {
+			requestIDs = append(requestIDs, requestStatus.multiPeer.subRequestIDsForPeer(p)...)
+		} else if requestStatus.p == p {
+			requestIDs = append(requestIDs, requestID)
+		}
+	}
+	return requestIDs
+}
+
+// failRequestOnPeer handles a network error for a request sent to a peer the
+// same way as a failed response from it: the request moves to another peer if
+// it can, and otherwise ends with the given error. Requests that are paused,
+// have finished, or have moved on from the peer are left alone.
+func (rm *RequestManager) failRequestOnPeer(p peer.ID, requestID graphsync.RequestID, err error) {
+	if mainRequestID, isSubRequest := rm.subRequests[requestID]; isSubRequest {
+		requestStatus, ok := rm.inProgressRequestStatuses[mainRequestID]
+		if !ok {
+			return
+		}
+		assignedPeer, ok := requestStatus.multiPeer.peerForSubRequest(requestID)
+		if !ok || assignedPeer != p {
+			return
+		}
+		if !rm.reassignSubRequest(mainRequestID, requestStatus, requestID) {
+			rm.failRequest(requestStatus, err)
+		}
+		return
+	}
+	requestStatus, ok := rm.inProgressRequestStatuses[requestID]
+	if !ok || requestStatus.multiPeer != nil || requestStatus.p != p || requestStatus.paused || requestStatus.terminalStatus != 0 {
+		return
+	}
+	if rm.redirectRequest(requestID, requestStatus) {
+		return
+	}
+	if rm.retryRequest(requestID, requestStatus, graphsync.RequestFailedUnknown, 0) {
+		return
+	}
+	rm.failRequest(requestStatus, err)
+}
+
+func (rm *RequestManager) failRequest(requestStatus *inProgressRequestStatus, err error) {
+	select {
+	case requestStatus.networkError <- err:
+	case <-requestStatus.ctx.Done():
+	}
+	requestStatus.terminalStatus = graphsync.RequestFailedUnknown
+	requestStatus.cancelFn()
+}
+
 func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID) {
 	select {
 	case <-rm.ctx.Done():
@@ -499,7 +1175,10 @@ func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID) {
 	}
 }
 
-func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.ID, root ipld.Link, selectorSpec ipld.Node, extensions []graphsync.ExtensionData) (gsmsg.GraphSyncRequest, hooks.RequestResult, error) {
+// validateRequest builds the request and runs the outgoing request hooks for
+// every peer it goes to. All peers must store blocks in the same place, and
+// every other setting comes from the hooks for the first peer.
+func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, peers []peer.ID, root ipld.Link, selectorSpec ipld.Node, extensions []graphsync.ExtensionData) (gsmsg.GraphSyncRequest, hooks.RequestResult, error) {
 	_, err := ipldutil.EncodeNode(selectorSpec)
 	if err != nil {
 		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
@@ -513,7 +1192,13 @@ func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.
 		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, fmt.Errorf("request failed: link has no cid")
 	}
 	request := gsmsg.NewRequest(requestID, asCidLink.Cid, selectorSpec, defaultPriority, extensions...)
-	hooksResult := rm.requestHooks.ProcessRequestHooks(p, request)
+	hooksResult := rm.requestHooks.ProcessRequestHooks(peers[0], request)
+	for _, p := range peers[1:] {
+		peerResult := rm.requestHooks.ProcessRequestHooks(p, request)
+		if peerResult.PersistenceOption != hooksResult.PersistenceOption {
+			return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, fmt.Errorf("request hooks chose different persistence options for peers %s and %s", peers[0], p)
+		}
+	}
 	err = rm.asyncLoader.StartRequest(requestID, hooksResult.PersistenceOption)
 	if err != nil {
 		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
@@ -530,9 +1215,10 @@ func (urm *unpauseRequestMessage) unpause(rm *RequestManager) error {
 		return errors.New("request is not paused")
 	}
 	inProgressRequestStatus.paused = false
+	inProgressRequestStatus.stall.touch()
 	select {
 	case <-inProgressRequestStatus.pauseMessages:
-		rm.peerHandler.SendRequest(inProgressRequestStatus.p, gsmsg.UpdateRequest(urm.id, urm.extensions...))
+		rm.sendRequest(inProgressRequestStatus, gsmsg.UpdateRequest(urm.id, urm.extensions...))
 		return nil
 	case <-rm.ctx.Done():
 		return errors.New("context cancelled")
@@ -11,9 +11,14 @@ import (
 	"github.com/ipfs/go-graphsync/requestmanager/testloader"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/additionalpeers"
+	"github.com/ipfs/go-graphsync/budget"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
+	"github.com/ipfs/go-graphsync/retryafter"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync/metadata"
@@ -24,6 +29,8 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/partition"
+	"github.com/ipfs/go-graphsync/pauseresponse"
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
@@ -78,6 +85,12 @@ func encodedMetadataForBlocks(t *testing.T, blks []blocks.Block, present bool) g
 	}
 }
 
+func pauseResponseAnswer(t *testing.T) graphsync.ExtensionData {
+	data, err := pauseresponse.EncodePauseResponse(false)
+	require.NoError(t, err)
+	return graphsync.ExtensionData{Name: graphsync.ExtensionPauseResponse, Data: data}
+}
+
 func TestNormalSimultaneousFetch(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -239,6 +252,31 @@ func TestCancelManagerExitsGracefully(t *testing.T) {
 	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
 }
 
+func TestStopAcceptingAndCancelAllRequests(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedResponseChan1, returnedErrorChan1 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	// new requests fail, while the existing request continues
+	td.requestManager.StopAcceptingRequests()
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	testutil.VerifySingleTerminalError(requestCtx, t, returnedErrorChan2)
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan2)
+
+	// cancelling sends a cancel for the in progress request
+	td.requestManager.CancelAll()
+	cancelRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.True(t, cancelRecord.gsr.IsCancel())
+	require.Equal(t, rr.gsr.ID(), cancelRecord.gsr.ID())
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan1)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan1)
+}
+
 func TestFailedRequest(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -258,6 +296,540 @@ func TestFailedRequest(t *testing.T) {
 	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
 }
 
+func TestMultiPeerRequest(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequestToPeers(requestCtx, peers, td.blockChain.TipLink, td.blockChain.Selector())
+	// the main request takes the first request ID, each peer gets its own after that
+	requestID := graphsync.RequestID(0)
+
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	if requestRecords[0].p != peers[0] {
+		requestRecords[0], requestRecords[1] = requestRecords[1], requestRecords[0]
+	}
+	for i, rr := range requestRecords {
+		require.Equal(t, peers[i], rr.p)
+		require.NotEqual(t, requestID, rr.gsr.ID())
+		partitionData, has := rr.gsr.Extension(graphsync.ExtensionPartition)
+		require.True(t, has)
+		part, err := partition.DecodePartition(partitionData)
+		require.NoError(t, err)
+		require.Equal(t, partition.Partition{Count: 2, Buckets: []int{i}}, part)
+	}
+
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstMetadata := metadataForBlocks(firstBlocks, true)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecords[0].gsr.ID(), graphsync.PartialResponse, encodedMetadataForBlocks(t, firstBlocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, firstBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		requestID: firstMetadata,
+	})
+	td.fal.SuccessResponseOn(requestID, firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+
+	failedResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecords[1].gsr.ID(), graphsync.RequestFailedContentNotFound),
+	}
+	td.requestManager.ProcessResponses(peers[1], failedResponses, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[0], rr.p)
+	require.NotEqual(t, requestRecords[0].gsr.ID(), rr.gsr.ID())
+	require.NotEqual(t, requestRecords[1].gsr.ID(), rr.gsr.ID())
+	partitionData, has := rr.gsr.Extension(graphsync.ExtensionPartition)
+	require.True(t, has)
+	part, err := partition.DecodePartition(partitionData)
+	require.NoError(t, err)
+	require.Equal(t, partition.Partition{Count: 2, Buckets: []int{1}}, part)
+
+	moreBlocks := td.blockChain.RemainderBlocks(3)
+	moreMetadata := encodedMetadataForBlocks(t, moreBlocks, true)
+	moreResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecords[0].gsr.ID(), graphsync.RequestCompletedFull, moreMetadata),
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, moreMetadata),
+	}
+	td.requestManager.ProcessResponses(peers[0], moreResponses, moreBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, moreBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		requestID: append(metadataForBlocks(moreBlocks, true), metadataForBlocks(moreBlocks, true)...),
+	})
+	td.fal.SuccessResponseOn(requestID, moreBlocks)
+
+	td.blockChain.VerifyRemainder(requestCtx, returnedResponseChan, 3)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
+func TestMultiPeerRequestHooks(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	var hookedPeers []peer.ID
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		hookedPeers = append(hookedPeers, p)
+		if p == peers[1] {
+			ha.UsePersistenceOption("other")
+		}
+	})
+
+	// the hooks run for every peer, and must agree on where blocks are stored
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequestToPeers(requestCtx, peers, td.blockChain.TipLink, td.blockChain.Selector())
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 1)
+	require.Equal(t, peers, hookedPeers)
+	require.Empty(t, td.requestRecordChan)
+}
+
+func TestRetryRequest(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseRetryPolicy(graphsync.RetryPolicy{
+			MaxAttempts:   3,
+			Backoff:       []time.Duration{10 * time.Millisecond},
+			FallbackPeers: []peer.ID{peers[1]},
+		})
+	})
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[0], rr.p)
+
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, encodedMetadataForBlocks(t, firstBlocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, firstBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(firstBlocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+
+	failedResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy),
+	}
+	td.requestManager.ProcessResponses(peers[0], failedResponses, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+
+	// first retry goes to the fallback peer, skipping blocks already received
+	retryRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[1], retryRecord.p)
+	require.Equal(t, rr.gsr.ID(), retryRecord.gsr.ID())
+	require.False(t, retryRecord.gsr.IsCancel())
+	doNotSendCidsExt, has := retryRecord.gsr.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.True(t, has)
+	cidSet, err := cidset.DecodeCidSet(doNotSendCidsExt)
+	require.NoError(t, err)
+	require.Equal(t, 3, cidSet.Len())
+
+	// responses from the failed peer are now ignored
+	moreBlocks := td.blockChain.RemainderBlocks(3)
+	moreResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, moreBlocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], moreResponses, moreBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, moreBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+	td.requestManager.ProcessResponses(peers[1], moreResponses, moreBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, moreBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(moreBlocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), moreBlocks)
+
+	td.blockChain.VerifyRemainder(requestCtx, returnedResponseChan, 3)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
+func TestRetryPolicyOnRequest(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	// the policy set on the request wins over the policy chosen by hooks
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseRetryPolicy(graphsync.RetryPolicy{MaxAttempts: 1})
+	})
+	retryCtx := graphsync.WithRetryPolicy(requestCtx, graphsync.RetryPolicy{
+		MaxAttempts:   2,
+		FallbackPeers: []peer.ID{peers[1]},
+	})
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(retryCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[0], rr.p)
+
+	// a network error is retried on the fallback peer, forgetting the links
+	// the failed peer was missing
+	td.requestManager.ProcessNetworkError(peers[0], []graphsync.RequestID{rr.gsr.ID()}, errors.New("stream reset"))
+	retryRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[1], retryRecord.p)
+	require.Equal(t, rr.gsr.ID(), retryRecord.gsr.ID())
+	td.fal.VerifyMissingLinksCleared(t, rr.gsr.ID(), 1)
+
+	blocks := td.blockChain.AllBlocks()
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, blocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[1], responses, blocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, blocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(blocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), blocks)
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
+func TestRetryRequestAttemptsExhausted(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseRetryPolicy(graphsync.RetryPolicy{MaxAttempts: 2})
+	})
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	failedResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedUnknown),
+	}
+	td.requestManager.ProcessResponses(peers[0], failedResponses, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+
+	retryRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[0], retryRecord.p)
+	require.Equal(t, rr.gsr.ID(), retryRecord.gsr.ID())
+
+	td.requestManager.ProcessResponses(peers[0], failedResponses, nil)
+
+	testutil.VerifySingleTerminalError(requestCtx, t, returnedErrorChan)
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+}
+
+func TestBusyRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseRetryPolicy(graphsync.RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{time.Millisecond}})
+	})
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	busyResponse := func(retryAfter time.Duration) []gsmsg.GraphSyncResponse {
+		retryAfterData, err := retryafter.EncodeRetryAfter(retryAfter)
+		require.NoError(t, err)
+		return []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy, graphsync.ExtensionData{Name: graphsync.ExtensionRetryAfter, Data: retryAfterData}),
+		}
+	}
+
+	// the retry waits for the responder's delay instead of the shorter backoff
+	busyAt := time.Now()
+	td.requestManager.ProcessResponses(peers[0], busyResponse(100*time.Millisecond), nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+	readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)
+	require.True(t, time.Since(busyAt) >= 100*time.Millisecond, "should not retry before retry after")
+
+	// once attempts run out, the delay is returned with the error
+	td.requestManager.ProcessResponses(peers[0], busyResponse(2*time.Second), nil)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Equal(t, []error{graphsync.RequestFailedBusyErr{RetryAfter: 2 * time.Second}}, errs)
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+}
+
+func TestNetworkErrors(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	sendRequest := func(p peer.ID) (graphsync.RequestID, <-chan graphsync.ResponseProgress, <-chan error) {
+		returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, p, td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+		return rr.gsr.ID(), returnedResponseChan, returnedErrorChan
+	}
+
+	// a request that could not be sent fails with the send error
+	sendErr := errors.New("stream reset")
+	failedID, failedResponseChan, failedErrorChan := sendRequest(peers[0])
+	td.requestManager.ProcessNetworkError(peers[0], []graphsync.RequestID{failedID}, sendErr)
+	testutil.VerifyEmptyResponse(requestCtx, t, failedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, failedErrorChan)
+	require.Equal(t, []error{graphsync.RequestFailedNetworkErr{Peer: peers[0], Err: sendErr}}, errs)
+
+	// a disconnect fails requests in progress with the peer, except paused ones
+	_, disconnectedResponseChan, disconnectedErrorChan := sendRequest(peers[0])
+	pausedID, _, pausedErrorChan := sendRequest(peers[0])
+	_, _, otherErrorChan := sendRequest(peers[1])
+	require.NoError(t, td.requestManager.PauseRequest(pausedID))
+	td.requestManager.Disconnected(peers[0])
+	testutil.VerifyEmptyResponse(requestCtx, t, disconnectedResponseChan)
+	errs = testutil.CollectErrors(requestCtx, t, disconnectedErrorChan)
+	require.Equal(t, []error{graphsync.RequestFailedPeerDisconnectedErr{Peer: peers[0]}}, errs)
+	testutil.AssertChannelEmpty(t, pausedErrorChan, "paused request should not fail")
+	testutil.AssertChannelEmpty(t, otherErrorChan, "request to another peer should not fail")
+
+	// requests with a retry policy are sent again instead
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseRetryPolicy(graphsync.RetryPolicy{MaxAttempts: 2})
+	})
+	retriedID, _, retriedErrorChan := sendRequest(peers[1])
+	td.requestManager.ProcessNetworkError(peers[1], []graphsync.RequestID{retriedID}, sendErr)
+	retryRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[1], retryRecord.p)
+	require.Equal(t, retriedID, retryRecord.gsr.ID())
+	testutil.AssertChannelEmpty(t, retriedErrorChan, "retried request should not fail")
+}
+
+func TestInactivityTimeout(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseInactivityTimeout(100 * time.Millisecond)
+	})
+	stallErr := graphsync.RequestStalledErr{Peer: peers[0], Timeout: 100 * time.Millisecond}
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestID := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0].gsr.ID()
+
+	// responses keep the request alive past its timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(requestID, graphsync.PartialResponse),
+		}, nil)
+		td.fal.VerifyLastProcessedResponses(requestCtx, t, map[graphsync.RequestID]metadata.Metadata{})
+		td.fal.VerifyLastProcessedBlocks(requestCtx, t, nil)
+	}
+	testutil.AssertChannelEmpty(t, returnedErrorChan, "request with recent responses should not stall")
+
+	// once the peer goes silent, the request is cancelled with a stall error
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, requestID, rr.gsr.ID())
+	require.True(t, rr.gsr.IsCancel())
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Equal(t, []error{stallErr}, errs)
+
+	// time spent paused does not count
+	pausedResponseChan, pausedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	pausedID := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0].gsr.ID()
+	require.NoError(t, td.requestManager.PauseRequest(pausedID))
+	time.Sleep(200 * time.Millisecond)
+	testutil.AssertChannelEmpty(t, pausedErrorChan, "paused request should not stall")
+	require.NoError(t, td.requestManager.UnpauseRequest(pausedID))
+	testutil.VerifyEmptyResponse(requestCtx, t, pausedResponseChan)
+	errs = testutil.CollectErrors(requestCtx, t, pausedErrorChan)
+	require.Equal(t, []error{stallErr}, errs)
+}
+
+func TestProtectsPeersWithActiveRequests(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	requestCtx1, cancel1 := context.WithCancel(requestCtx)
+	peers := testutil.GeneratePeers(2)
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseRetryPolicy(graphsync.RetryPolicy{MaxAttempts: 2, FallbackPeers: peers[1:]})
+	})
+
+	_, returnedErrorChan := td.requestManager.SendRequest(requestCtx1, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	tag := fmt.Sprintf("graphsync-request-%d", rr.gsr.ID())
+	require.True(t, td.connManager.IsProtected(peers[0], tag))
+	require.False(t, td.connManager.IsProtected(peers[1], ""))
+
+	// peers a request moves to are protected as well
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy),
+	}, nil)
+	td.fal.VerifyLastProcessedResponses(requestCtx, t, map[graphsync.RequestID]metadata.Metadata{})
+	td.fal.VerifyLastProcessedBlocks(requestCtx, t, nil)
+	rr = readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[1], rr.p)
+	require.True(t, td.connManager.IsProtected(peers[0], tag))
+	require.True(t, td.connManager.IsProtected(peers[1], tag))
+
+	// once the request ends, nothing is left protected
+	cancel1()
+	testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Eventually(t, func() bool {
+		return !td.connManager.IsProtected(peers[0], "") && !td.connManager.IsProtected(peers[1], "")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMultiPeerRequestDisconnect(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	_, returnedErrorChan := td.requestManager.SendRequestToPeers(requestCtx, peers, td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	if requestRecords[0].p != peers[0] {
+		requestRecords[0], requestRecords[1] = requestRecords[1], requestRecords[0]
+	}
+
+	// the share of a disconnected peer moves to the remaining peer
+	td.requestManager.Disconnected(peers[1])
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[0], rr.p)
+	require.NotEqual(t, requestRecords[0].gsr.ID(), rr.gsr.ID())
+	require.NotEqual(t, requestRecords[1].gsr.ID(), rr.gsr.ID())
+	partitionData, has := rr.gsr.Extension(graphsync.ExtensionPartition)
+	require.True(t, has)
+	part, err := partition.DecodePartition(partitionData)
+	require.NoError(t, err)
+	require.Equal(t, partition.Partition{Count: 2, Buckets: []int{1}}, part)
+	testutil.AssertChannelEmpty(t, returnedErrorChan, "request should not fail while a peer remains")
+
+	// once no peer remains, the request fails
+	td.requestManager.Disconnected(peers[0])
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Equal(t, []error{graphsync.RequestFailedPeerDisconnectedErr{Peer: peers[0]}}, errs)
+}
+
+func TestAdditionalPeers(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := []peer.ID{test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)}
+	suggested := []peer.AddrInfo{{ID: peers[1], Addrs: []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/4001")}}, {ID: peers[0]}}
+	additionalPeersData, err := additionalpeers.EncodeAdditionalPeers(suggested)
+	require.NoError(t, err)
+	additionalPeersExtension := graphsync.ExtensionData{Name: graphsync.ExtensionAdditionalPeers, Data: additionalPeersData}
+
+	notified := make(chan []peer.AddrInfo, 2)
+	td.additionalPeersListeners.Register(func(p peer.ID, response graphsync.ResponseData, peers []peer.AddrInfo) {
+		notified <- peers
+	})
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		if _, has := requestData.Extension(td.extensionName1); has {
+			hookActions.FollowAdditionalPeers()
+		}
+	})
+
+	// a request that does not follow suggestions fails, but listeners still hear of them
+	_, returnedErrorChan1 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy, additionalPeersExtension),
+	}, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+	var notifiedPeers []peer.AddrInfo
+	testutil.AssertReceive(requestCtx, t, notified, &notifiedPeers, "should notify listeners")
+	require.Equal(t, suggested, notifiedPeers)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan1)
+	require.Equal(t, []error{graphsync.RequestFailedBusyErr{}}, errs)
+
+	// a request that follows suggestions is sent to the suggested peer it has not tried yet
+	_, returnedErrorChan2 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+	rr = readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.AdditionalPeers, additionalPeersExtension),
+	}, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+	testutil.AssertReceive(requestCtx, t, notified, &notifiedPeers, "should notify listeners")
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy),
+	}, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+	redirected := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[1], redirected.p)
+	require.Equal(t, rr.gsr.ID(), redirected.gsr.ID())
+
+	// once suggestions run out, the failure is returned
+	td.requestManager.ProcessResponses(peers[1], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedUnknown),
+	}, nil)
+	errs = testutil.CollectErrors(requestCtx, t, returnedErrorChan2)
+	require.Equal(t, []error{graphsync.RequestFailedUnknownErr{}}, errs)
+}
+
+func TestRequestBudget(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseBudget(graphsync.Budget{MaxBlocks: 3})
+	})
+	budgetData, err := budget.EncodeBudget(graphsync.Budget{MaxBlocks: 4, MaxBytes: 1 << 20})
+	require.NoError(t, err)
+	budgetExtension := graphsync.ExtensionData{Name: graphsync.ExtensionBudget, Data: budgetData}
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), budgetExtension)
+
+	// the responder is asked for the stricter of the two budgets
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	sentBudgetData, has := rr.gsr.Extension(graphsync.ExtensionBudget)
+	require.True(t, has)
+	sentBudget, err := budget.DecodeBudget(sentBudgetData)
+	require.NoError(t, err)
+	require.Equal(t, graphsync.Budget{MaxBlocks: 3, MaxBytes: 1 << 20}, sentBudget)
+
+	// a responder that ignores the budget is cut off
+	blocks := td.blockChain.AllBlocks()
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, blocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, blocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, blocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(blocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), blocks)
+
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Equal(t, []error{graphsync.RequestBudgetExceededErr{}}, errs)
+	cancelRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.True(t, cancelRecord.gsr.IsCancel())
+}
+
 func TestLocallyFulfilledFirstRequestFailsLater(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -317,6 +889,423 @@ func TestLocallyFulfilledFirstRequestSucceedsLater(t *testing.T) {
 	testutil.AssertDoesReceive(requestCtx, t, called, "response hooks called for response")
 }
 
+func TestLocalFirst(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		ha.ResolveLocallyFirst()
+	})
+	localBlocks := td.blockChain.AllBlocks()
+	td.fal.OnAsyncLoad(func(requestID graphsync.RequestID, link ipld.Link, res <-chan types.AsyncLoadResult) {
+		for _, block := range localBlocks {
+			if link.(cidlink.Link).Cid == block.Cid() {
+				td.fal.ResponseOn(requestID, link, types.AsyncLoadResult{Data: block.RawData(), Local: true})
+				return
+			}
+		}
+	})
+
+	// a request that resolves entirely locally is never sent
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+	require.Empty(t, td.requestRecordChan)
+
+	// a request is sent once it reaches a missing block, with the blocks it
+	// already has as do-not-send-cids
+	localBlocks = td.blockChain.Blocks(0, 3)
+	returnedResponseChan, returnedErrorChan = td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.False(t, rr.gsr.IsCancel())
+	require.False(t, rr.gsr.IsUpdate())
+	doNotSendCidsData, has := rr.gsr.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.True(t, has)
+	doNotSendCids, err := cidset.DecodeCidSet(doNotSendCidsData)
+	require.NoError(t, err)
+	require.Equal(t, 3, doNotSendCids.Len())
+	for _, block := range localBlocks {
+		require.True(t, doNotSendCids.Has(block.Cid()))
+	}
+
+	md := encodedMetadataForBlocks(t, td.blockChain.RemainderBlocks(3), true)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.RemainderBlocks(3))
+	td.fal.VerifyLastProcessedBlocks(ctx, t, td.blockChain.RemainderBlocks(3))
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(td.blockChain.RemainderBlocks(3), true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.RemainderBlocks(3))
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+}
+
+func TestMemoryBackPressure(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+	td.requestManager.SetThrottleResponses(true)
+
+	td.fal.SetAtMemoryLimit(true)
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	_, has := rr.gsr.Extension(graphsync.ExtensionPauseResponse)
+	require.True(t, has)
+
+	// the responder answers the offer to pause the response
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	md := encodedMetadataForBlocks(t, firstBlocks, true)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md, pauseResponseAnswer(t)),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, firstBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(firstBlocks, true),
+	})
+	// wait for the response to be handled
+	require.Len(t, td.requestManager.InProgressRequests(), 1)
+	td.fal.SuccessResponseOn(rr.gsr.ID(), firstBlocks)
+
+	// the responder is paused while the request works through the blocks it
+	// has, then resumed once it catches up
+	rrs := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	for i, pause := range []bool{true, false} {
+		require.True(t, rrs[i].gsr.IsUpdate())
+		require.Equal(t, rr.gsr.ID(), rrs[i].gsr.ID())
+		pauseData, has := rrs[i].gsr.Extension(graphsync.ExtensionPauseResponse)
+		require.True(t, has)
+		decoded, err := pauseresponse.DecodePauseResponse(pauseData)
+		require.NoError(t, err)
+		require.Equal(t, pause, decoded)
+	}
+
+	td.fal.SetAtMemoryLimit(false)
+	remainingBlocks := td.blockChain.RemainderBlocks(3)
+	md = encodedMetadataForBlocks(t, remainingBlocks, true)
+	secondResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], secondResponses, remainingBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, remainingBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(remainingBlocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), remainingBlocks)
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+	require.Empty(t, td.requestRecordChan)
+}
+
+func TestMemoryBackPressureWithoutPauseResponse(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+	td.requestManager.SetThrottleResponses(true)
+
+	td.fal.SetAtMemoryLimit(true)
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	// the responder does not answer the offer to pause the response
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	md := encodedMetadataForBlocks(t, firstBlocks, true)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, firstBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(firstBlocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), firstBlocks)
+
+	// so the request is cancelled, and sent again once it catches up, without
+	// the blocks it already has
+	rrs := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	require.True(t, rrs[0].gsr.IsCancel())
+	require.Equal(t, rr.gsr.ID(), rrs[0].gsr.ID())
+	require.False(t, rrs[1].gsr.IsCancel())
+	require.False(t, rrs[1].gsr.IsUpdate())
+	require.Equal(t, rr.gsr.ID(), rrs[1].gsr.ID())
+	_, has := rrs[1].gsr.Extension(graphsync.ExtensionPauseResponse)
+	require.True(t, has)
+	doNotSendCidsData, has := rrs[1].gsr.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.True(t, has)
+	doNotSendCids, err := cidset.DecodeCidSet(doNotSendCidsData)
+	require.NoError(t, err)
+	require.Equal(t, 3, doNotSendCids.Len())
+
+	td.fal.SetAtMemoryLimit(false)
+	remainingBlocks := td.blockChain.RemainderBlocks(3)
+	md = encodedMetadataForBlocks(t, remainingBlocks, true)
+	secondResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], secondResponses, remainingBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, remainingBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(remainingBlocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), remainingBlocks)
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+	require.Empty(t, td.requestRecordChan)
+}
+
+func TestMemoryBackPressureMultiplePeers(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+	td.requestManager.SetThrottleResponses(true)
+
+	td.fal.SetAtMemoryLimit(true)
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequestToPeers(requestCtx, peers, td.blockChain.TipLink, td.blockChain.Selector())
+	requestID := graphsync.RequestID(0)
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	subRequests := make(map[peer.ID]graphsync.RequestID, len(requestRecords))
+	for _, rr := range requestRecords {
+		subRequests[rr.p] = rr.gsr.ID()
+	}
+	require.Len(t, subRequests, 2)
+
+	// both responders answer the offer to pause the response
+	td.requestManager.ProcessResponses(peers[1], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(subRequests[peers[1]], graphsync.PartialResponse, pauseResponseAnswer(t)),
+	}, nil)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, nil)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{})
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(subRequests[peers[0]], graphsync.PartialResponse, encodedMetadataForBlocks(t, firstBlocks, true), pauseResponseAnswer(t)),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, firstBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadataForBlocks(firstBlocks, true),
+	})
+	// wait for the response to be handled
+	require.Len(t, td.requestManager.InProgressRequests(), 1)
+	td.fal.SuccessResponseOn(requestID, firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+
+	// every peer is paused, then resumed once the request catches up
+	rrs := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 4)
+	for i, pause := range []bool{true, true, false, false} {
+		require.True(t, rrs[i].gsr.IsUpdate())
+		require.Equal(t, subRequests[rrs[i].p], rrs[i].gsr.ID())
+		pauseData, has := rrs[i].gsr.Extension(graphsync.ExtensionPauseResponse)
+		require.True(t, has)
+		decoded, err := pauseresponse.DecodePauseResponse(pauseData)
+		require.NoError(t, err)
+		require.Equal(t, pause, decoded)
+	}
+	require.NotEqual(t, rrs[0].p, rrs[1].p)
+	require.NotEqual(t, rrs[2].p, rrs[3].p)
+
+	td.fal.SetAtMemoryLimit(false)
+	remainingBlocks := td.blockChain.RemainderBlocks(3)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(subRequests[peers[0]], graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, remainingBlocks, true)),
+	}, remainingBlocks)
+	td.requestManager.ProcessResponses(peers[1], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(subRequests[peers[1]], graphsync.RequestCompletedFull),
+	}, nil)
+	td.fal.SuccessResponseOn(requestID, remainingBlocks)
+
+	td.blockChain.VerifyRemainder(requestCtx, returnedResponseChan, 3)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	require.Empty(t, td.requestRecordChan)
+}
+
+func TestRequestBlocks(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedBlocksChan, returnedErrorChan := td.requestManager.RequestBlocks(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	md := encodedMetadataForBlocks(t, td.blockChain.AllBlocks(), true)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+	td.fal.VerifyLastProcessedBlocks(ctx, t, td.blockChain.AllBlocks())
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(td.blockChain.AllBlocks(), true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.AllBlocks())
+
+	// blocks are returned in traversal order, then the channel closes
+	for _, blk := range td.blockChain.AllBlocks() {
+		var rawBlock graphsync.RawBlock
+		testutil.AssertReceive(requestCtx, t, returnedBlocksChan, &rawBlock, "should receive block")
+		require.Equal(t, blk.Cid(), rawBlock.Cid)
+		require.Equal(t, blk.RawData(), rawBlock.Data)
+		require.False(t, rawBlock.Local)
+	}
+	select {
+	case _, ok := <-returnedBlocksChan:
+		require.False(t, ok, "should not receive more blocks")
+	case <-requestCtx.Done():
+		t.Fatal("blocks channel should close")
+	}
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	td.requestManager.SetCoalesceRequests(true, DefaultCoalesceDetachAfter)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	requestCtx1, cancel1 := context.WithCancel(requestCtx)
+	peers := testutil.GeneratePeers(1)
+
+	// identical requests share one network request, while a request with
+	// different extensions gets its own
+	returnedResponseChan1, returnedErrorChan1 := td.requestManager.SendRequest(requestCtx1, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan3, returnedErrorChan3 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	sharedRequest, otherRequest := requestRecords[0].gsr, requestRecords[1].gsr
+	if _, has := sharedRequest.Extension(td.extensionName1); has {
+		sharedRequest, otherRequest = otherRequest, sharedRequest
+	}
+	_, has := otherRequest.Extension(td.extensionName1)
+	require.True(t, has)
+
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(sharedRequest.ID(), graphsync.PartialResponse, encodedMetadataForBlocks(t, firstBlocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, firstBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		sharedRequest.ID(): metadataForBlocks(firstBlocks, true),
+	})
+	td.fal.SuccessResponseOn(sharedRequest.ID(), firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan1, 0, 3)
+
+	// cancelling one subscriber does not cancel the shared request
+	cancel1()
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan1)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan1)
+
+	// a subscriber that joins late still gets the whole response
+	returnedResponseChan4, returnedErrorChan4 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	moreBlocks := td.blockChain.RemainderBlocks(3)
+	moreResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(sharedRequest.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, moreBlocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], moreResponses, moreBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, moreBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		sharedRequest.ID(): metadataForBlocks(moreBlocks, true),
+	})
+	td.fal.SuccessResponseOn(sharedRequest.ID(), moreBlocks)
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan2)
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan4)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan4)
+	require.Empty(t, td.requestRecordChan)
+
+	// once the shared request finishes, an identical request is sent again
+	requestCtx5, cancel5 := context.WithCancel(requestCtx)
+	returnedResponseChan5, _ := td.requestManager.SendRequest(requestCtx5, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan6, returnedErrorChan6 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.NotEqual(t, sharedRequest.ID(), rr.gsr.ID())
+	require.NotEqual(t, otherRequest.ID(), rr.gsr.ID())
+	cancel5()
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan5)
+
+	allBlocks := td.blockChain.AllBlocks()
+	allResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, allBlocks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], allResponses, allBlocks)
+	td.fal.VerifyLastProcessedBlocks(ctx, t, allBlocks)
+	td.fal.VerifyLastProcessedResponses(ctx, t, map[graphsync.RequestID]metadata.Metadata{
+		rr.gsr.ID(): metadataForBlocks(allBlocks, true),
+	})
+	td.fal.SuccessResponseOn(rr.gsr.ID(), allBlocks)
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan6)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan6)
+
+	// the shared request is cancelled once all of its subscribers cancel
+	requestCtx7, cancel7 := context.WithCancel(requestCtx)
+	requestCtx8, cancel8 := context.WithCancel(requestCtx)
+	returnedResponseChan7, _ := td.requestManager.SendRequest(requestCtx7, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan8, _ := td.requestManager.SendRequest(requestCtx8, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr = readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	cancel7()
+	cancel8()
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan7)
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan8)
+	cancelRecord := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.True(t, cancelRecord.gsr.IsCancel())
+	require.Equal(t, rr.gsr.ID(), cancelRecord.gsr.ID())
+
+	require.Empty(t, returnedResponseChan3)
+	require.Empty(t, returnedErrorChan3)
+}
+
+func TestCoalesceRequestsFromPeers(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	td.requestManager.SetCoalesceRequests(true, DefaultCoalesceDetachAfter)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	requestCtx1, cancel1 := context.WithCancel(requestCtx)
+	requestCtx2, cancel2 := context.WithCancel(requestCtx)
+	peers := testutil.GeneratePeers(2)
+
+	// the same peers in any order make an identical request, sent once to each peer
+	returnedResponseChan1, _ := td.requestManager.SendRequestToPeers(requestCtx1, peers, td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan2, _ := td.requestManager.SendRequestToPeers(requestCtx2, []peer.ID{peers[1], peers[0]}, td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	require.NotEqual(t, requestRecords[0].p, requestRecords[1].p)
+
+	// the shared request is cancelled once both callers cancel
+	cancel1()
+	cancel2()
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan1)
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan2)
+	cancelRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+	for _, cancelRecord := range cancelRecords {
+		require.True(t, cancelRecord.gsr.IsCancel())
+	}
+	require.Empty(t, td.requestRecordChan)
+}
+
 func TestRequestReturnsMissingBlocks(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -342,6 +1331,38 @@ func TestRequestReturnsMissingBlocks(t *testing.T) {
 	require.NotEqual(t, len(errs), 0, "did not send errors")
 }
 
+func TestIgnoresResponsesFromOtherPeers(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	hookedPeers := make(chan peer.ID, 2)
+	td.responseHooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		hookedPeers <- p
+	})
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	// a peer the request was not sent to cannot run hooks or end the request
+	td.requestManager.ProcessResponses(peers[1], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedUnknown),
+	}, nil)
+	require.Len(t, td.requestManager.InProgressRequests(), 1)
+	require.Empty(t, hookedPeers)
+
+	allBlocks := td.blockChain.AllBlocks()
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, allBlocks, true)),
+	}, allBlocks)
+	td.fal.SuccessResponseOn(rr.gsr.ID(), allBlocks)
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	require.Equal(t, peers[0], <-hookedPeers)
+}
+
 func TestEncodingExtensions(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -849,23 +1870,25 @@ func TestPauseResumeExternal(t *testing.T) {
 }
 
 type testData struct {
-	requestRecordChan chan requestRecord
-	fph               *fakePeerHandler
-	fal               *testloader.FakeAsyncLoader
-	requestHooks      *hooks.OutgoingRequestHooks
-	responseHooks     *hooks.IncomingResponseHooks
-	blockHooks        *hooks.IncomingBlockHooks
-	requestManager    *RequestManager
-	blockStore        map[ipld.Link][]byte
-	loader            ipld.Loader
-	storer            ipld.Storer
-	blockChain        *testutil.TestBlockChain
-	extensionName1    graphsync.ExtensionName
-	extensionData1    []byte
-	extension1        graphsync.ExtensionData
-	extensionName2    graphsync.ExtensionName
-	extensionData2    []byte
-	extension2        graphsync.ExtensionData
+	requestRecordChan        chan requestRecord
+	fph                      *fakePeerHandler
+	fal                      *testloader.FakeAsyncLoader
+	requestHooks             *hooks.OutgoingRequestHooks
+	responseHooks            *hooks.IncomingResponseHooks
+	blockHooks               *hooks.IncomingBlockHooks
+	additionalPeersListeners *hooks.AdditionalPeersListeners
+	connManager              *testutil.TestConnManager
+	requestManager           *RequestManager
+	blockStore               map[ipld.Link][]byte
+	loader                   ipld.Loader
+	storer                   ipld.Storer
+	blockChain               *testutil.TestBlockChain
+	extensionName1           graphsync.ExtensionName
+	extensionData1           []byte
+	extension1               graphsync.ExtensionData
+	extensionName2           graphsync.ExtensionName
+	extensionData2           []byte
+	extension2               graphsync.ExtensionData
 }
 
 func newTestData(ctx context.Context, t *testing.T) *testData {
@@ -876,8 +1899,11 @@ func newTestData(ctx context.Context, t *testing.T) *testData {
 	td.requestHooks = hooks.NewRequestHooks()
 	td.responseHooks = hooks.NewResponseHooks()
 	td.blockHooks = hooks.NewBlockHooks()
-	td.requestManager = New(ctx, td.fal, td.requestHooks, td.responseHooks, td.blockHooks)
+	td.additionalPeersListeners = hooks.NewAdditionalPeersListeners()
+	td.requestManager = New(ctx, td.fal, td.requestHooks, td.responseHooks, td.blockHooks, td.additionalPeersListeners)
+	td.connManager = testutil.NewTestConnManager()
 	td.requestManager.SetDelegate(td.fph)
+	td.requestManager.SetConnManager(td.connManager)
 	td.requestManager.Startup()
 	td.blockStore = make(map[ipld.Link][]byte)
 	td.loader, td.storer = testutil.NewTestStore(td.blockStore)
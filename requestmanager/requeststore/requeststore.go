@@ -0,0 +1,291 @@
+package requeststore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	requestKey = "request"
+	cidsKey    = "cids"
+)
+
+// ErrNotFound means there is no persisted request with the given ID
+var ErrNotFound = errors.New("persisted request not found")
+
+// Record is the information needed to send a persisted request again
+type Record struct {
+	P peer.ID
+	// Peers lists every peer for a request split across several peers, with P
+	// first, and is empty otherwise
+	Peers      []peer.ID
+	Root       cid.Cid
+	Selector   ipld.Node
+	Extensions []graphsync.ExtensionData
+}
+
+// RequestStore checkpoints in progress requests to a datastore, along with the
+// CIDs received so far, so they can be resumed after a restart
+type RequestStore struct {
+	ds datastore.Datastore
+}
+
+// New returns a request store that keeps requests under a graphsync namespace
+// in the given datastore
+func New(ds datastore.Datastore) *RequestStore {
+	return &RequestStore{
+		ds: namespace.Wrap(ds, datastore.NewKey("/graphsync/requests")),
+	}
+}
+
+// NewID generates a new identifier for a persisted request
+func (rs *RequestStore) NewID() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Put saves the record for the request with the given ID
+func (rs *RequestStore) Put(id string, record Record) error {
+	data, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	return rs.ds.Put(datastore.KeyWithNamespaces([]string{id, requestKey}), data)
+}
+
+// AddCid records that a block was received for the request with the given ID
+func (rs *RequestStore) AddCid(id string, c cid.Cid) error {
+	return rs.ds.Put(cidKey(id, c), []byte{})
+}
+
+// AddCids records that blocks were received for the request with the given
+// ID, in a single batch if the datastore supports it
+func (rs *RequestStore) AddCids(id string, cids []cid.Cid) error {
+	batching, ok := rs.ds.(datastore.Batching)
+	if !ok {
+		return rs.addCidsUnbatched(id, cids)
+	}
+	batch, err := batching.Batch()
+	if err == datastore.ErrBatchUnsupported {
+		return rs.addCidsUnbatched(id, cids)
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range cids {
+		if err := batch.Put(cidKey(id, c), []byte{}); err != nil {
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
+func (rs *RequestStore) addCidsUnbatched(id string, cids []cid.Cid) error {
+	for _, c := range cids {
+		if err := rs.AddCid(id, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cidKey(id string, c cid.Cid) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{id, cidsKey, c.String()})
+}
+
+// Get returns the record and the received CIDs for the request with the given
+// ID
+func (rs *RequestStore) Get(id string) (Record, *cid.Set, error) {
+	data, err := rs.ds.Get(datastore.KeyWithNamespaces([]string{id, requestKey}))
+	if err == datastore.ErrNotFound {
+		return Record{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return Record{}, nil, err
+	}
+	record, err := decodeRecord(data)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	cidsPrefix := datastore.KeyWithNamespaces([]string{id, cidsKey})
+	results, err := rs.ds.Query(query.Query{Prefix: cidsPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return Record{}, nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return Record{}, nil, err
+	}
+	cids := cid.NewSet()
+	for _, entry := range entries {
+		c, err := cid.Decode(datastore.RawKey(entry.Key).Name())
+		if err != nil {
+			return Record{}, nil, err
+		}
+		cids.Add(c)
+	}
+	return record, cids, nil
+}
+
+// List returns the IDs of all persisted requests
+func (rs *RequestStore) List() ([]string, error) {
+	results, err := rs.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if key.Name() != requestKey {
+			continue
+		}
+		ids = append(ids, strings.TrimPrefix(key.Parent().String(), "/"))
+	}
+	return ids, nil
+}
+
+// Remove deletes the request with the given ID and all of its received CIDs
+func (rs *RequestStore) Remove(id string) error {
+	results, err := rs.ds.Query(query.Query{Prefix: datastore.NewKey(id).String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := rs.ds.Delete(datastore.RawKey(entry.Key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeRecord(record Record) ([]byte, error) {
+	entries := 4
+	if len(record.Peers) > 0 {
+		entries++
+	}
+	node, err := fluent.Build(basicnode.Style.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(entries, func(na fluent.MapAssembler) {
+			na.AssembleEntry("peer").AssignBytes([]byte(record.P))
+			if len(record.Peers) > 0 {
+				na.AssembleEntry("peers").CreateList(len(record.Peers), func(na fluent.ListAssembler) {
+					for _, p := range record.Peers {
+						na.AssembleValue().AssignBytes([]byte(p))
+					}
+				})
+			}
+			na.AssembleEntry("root").AssignLink(cidlink.Link{Cid: record.Root})
+			na.AssembleEntry("selector").AssignNode(record.Selector)
+			na.AssembleEntry("extensions").CreateMap(len(record.Extensions), func(na fluent.MapAssembler) {
+				for _, extension := range record.Extensions {
+					na.AssembleEntry(string(extension.Name)).AssignBytes(extension.Data)
+				}
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(node)
+}
+
+func decodeRecord(data []byte) (Record, error) {
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return Record{}, err
+	}
+	peerNode, err := node.LookupString("peer")
+	if err != nil {
+		return Record{}, err
+	}
+	peerBytes, err := peerNode.AsBytes()
+	if err != nil {
+		return Record{}, err
+	}
+	var peers []peer.ID
+	// records for requests to a single peer have no peers list
+	if peersNode, err := node.LookupString("peers"); err == nil {
+		peerIter := peersNode.ListIterator()
+		for !peerIter.Done() {
+			_, v, err := peerIter.Next()
+			if err != nil {
+				return Record{}, err
+			}
+			p, err := v.AsBytes()
+			if err != nil {
+				return Record{}, err
+			}
+			peers = append(peers, peer.ID(p))
+		}
+	}
+	rootNode, err := node.LookupString("root")
+	if err != nil {
+		return Record{}, err
+	}
+	root, err := rootNode.AsLink()
+	if err != nil {
+		return Record{}, err
+	}
+	asCidLink, ok := root.(cidlink.Link)
+	if !ok {
+		return Record{}, errors.New("root is not a CID link")
+	}
+	selector, err := node.LookupString("selector")
+	if err != nil {
+		return Record{}, err
+	}
+	extensionsNode, err := node.LookupString("extensions")
+	if err != nil {
+		return Record{}, err
+	}
+	var extensions []graphsync.ExtensionData
+	iter := extensionsNode.MapIterator()
+	for !iter.Done() {
+		k, v, err := iter.Next()
+		if err != nil {
+			return Record{}, err
+		}
+		name, err := k.AsString()
+		if err != nil {
+			return Record{}, err
+		}
+		extensionData, err := v.AsBytes()
+		if err != nil {
+			return Record{}, err
+		}
+		extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionName(name), Data: extensionData})
+	}
+	return Record{
+		P:          peer.ID(peerBytes),
+		Peers:      peers,
+		Root:       asCidLink.Cid,
+		Selector:   selector,
+		Extensions: extensions,
+	}, nil
+}
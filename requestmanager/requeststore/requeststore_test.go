@@ -0,0 +1,104 @@
+package requeststore
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistAndRemoveRequests(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	rs := New(ds)
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	record := Record{
+		P:        testutil.GeneratePeers(1)[0],
+		Root:     testutil.GenerateCids(1)[0],
+		Selector: ssb.ExploreAll(ssb.Matcher()).Node(),
+		Extensions: []graphsync.ExtensionData{
+			{Name: graphsync.ExtensionName("AppleSauce/McGee"), Data: testutil.RandomBytes(100)},
+		},
+	}
+	id1, err := rs.NewID()
+	require.NoError(t, err)
+	id2, err := rs.NewID()
+	require.NoError(t, err)
+	require.NotEqual(t, id1, id2)
+
+	require.NoError(t, rs.Put(id1, record))
+	require.NoError(t, rs.Put(id2, record))
+	cids := testutil.GenerateCids(5)
+	for _, c := range cids {
+		require.NoError(t, rs.AddCid(id1, c))
+	}
+
+	ids, err := rs.List()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{id1, id2}, ids)
+
+	receivedRecord, receivedCids, err := rs.Get(id1)
+	require.NoError(t, err)
+	require.Equal(t, record.P, receivedRecord.P)
+	require.Equal(t, record.Root, receivedRecord.Root)
+	require.Equal(t, record.Extensions, receivedRecord.Extensions)
+	selectorData, err := encodeRecord(record)
+	require.NoError(t, err)
+	receivedSelectorData, err := encodeRecord(receivedRecord)
+	require.NoError(t, err)
+	require.Equal(t, selectorData, receivedSelectorData)
+	require.Equal(t, len(cids), receivedCids.Len())
+	for _, c := range cids {
+		require.True(t, receivedCids.Has(c))
+	}
+
+	require.NoError(t, rs.Remove(id1))
+	ids, err = rs.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{id2}, ids)
+	_, _, err = rs.Get(id1)
+	require.Equal(t, ErrNotFound, err)
+
+	// cids for other requests are untouched
+	_, receivedCids, err = rs.Get(id2)
+	require.NoError(t, err)
+	require.Equal(t, 0, receivedCids.Len())
+}
+
+func TestPersistMultiPeerRequestWithBatchedCids(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	rs := New(ds)
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
+	peers := testutil.GeneratePeers(3)
+	record := Record{
+		P:        peers[0],
+		Peers:    peers,
+		Root:     testutil.GenerateCids(1)[0],
+		Selector: ssb.ExploreAll(ssb.Matcher()).Node(),
+	}
+	id, err := rs.NewID()
+	require.NoError(t, err)
+	require.NoError(t, rs.Put(id, record))
+	cids := testutil.GenerateCids(5)
+	require.NoError(t, rs.AddCids(id, cids[:3]))
+	require.NoError(t, rs.AddCids(id, cids[3:]))
+
+	receivedRecord, receivedCids, err := rs.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, peers[0], receivedRecord.P)
+	require.Equal(t, peers, receivedRecord.Peers)
+	require.Equal(t, len(cids), receivedCids.Len())
+	for _, c := range cids {
+		require.True(t, receivedCids.Has(c))
+	}
+
+	require.NoError(t, rs.Remove(id))
+	_, _, err = rs.Get(id)
+	require.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,102 @@
+package requestmanager
+
+import (
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/requestmanager/executor"
+	"github.com/ipfs/go-graphsync/retryafter"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// retryState tracks the attempts made for a request under its retry policy
+type retryState struct {
+	// messages tell the executor to send the request again, to the same peer
+	// or another one. Redirects use them as well.
+	messages chan executor.Retry
+	policy   graphsync.RetryPolicy
+	// peers are tried in turn, the fallback peers first and the original peer
+	// last
+	peers    []peer.ID
+	attempts int
+}
+
+func newRetryState(policy graphsync.RetryPolicy, p peer.ID) retryState {
+	return retryState{
+		messages: make(chan executor.Retry, 1),
+		policy:   policy,
+		peers:    append(append([]peer.ID{}, policy.FallbackPeers...), p),
+		attempts: 1,
+	}
+}
+
+// retryAfterForResponse returns how long a busy responder asked to wait before
+// retrying, or zero if it did not say
+func retryAfterForResponse(response gsmsg.GraphSyncResponse) time.Duration {
+	retryAfterData, has := response.Extension(graphsync.ExtensionRetryAfter)
+	if !has {
+		return 0
+	}
+	retryAfter, err := retryafter.DecodeRetryAfter(retryAfterData)
+	if err != nil {
+		log.Warnf("Unable to decode retry after for request %d: %s", response.RequestID(), err)
+		return 0
+	}
+	return retryAfter
+}
+
+// retryRequest schedules another attempt for a request that failed with the
+// given status, if its retry policy allows it. The executor resends the request
+// once the backoff delay has passed.
+func (rm *RequestManager) retryRequest(requestID graphsync.RequestID, requestStatus *inProgressRequestStatus, status graphsync.ResponseStatusCode, retryAfter time.Duration) bool {
+	if requestStatus.multiPeer != nil {
+		return false
+	}
+	if status != graphsync.RequestFailedBusy && status != graphsync.RequestFailedUnknown {
+		return false
+	}
+	rs := &requestStatus.retry
+	if rs.attempts >= rs.policy.MaxAttempts {
+		return false
+	}
+	retryIndex := rs.attempts - 1
+	var delay time.Duration
+	if len(rs.policy.Backoff) > 0 {
+		if retryIndex < len(rs.policy.Backoff) {
+			delay = rs.policy.Backoff[retryIndex]
+		} else {
+			delay = rs.policy.Backoff[len(rs.policy.Backoff)-1]
+		}
+	}
+	// never retry sooner than a busy responder asked
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	retry := executor.Retry{
+		P:     rs.peers[retryIndex%len(rs.peers)],
+		Delay: delay,
+	}
+	if !rm.sendRetry(requestID, requestStatus, retry) {
+		return false
+	}
+	rs.attempts++
+	return true
+}
+
+// sendRetry tells the executor to send a request again, and moves the request
+// to the peer it is sent to. It returns false if a retry is already pending.
+func (rm *RequestManager) sendRetry(requestID graphsync.RequestID, requestStatus *inProgressRequestStatus, retry executor.Retry) bool {
+	select {
+	case requestStatus.retry.messages <- retry:
+	default:
+		return false
+	}
+	requestStatus.p = retry.P
+	// the next peer may have blocks the failed peer was missing
+	rm.asyncLoader.ClearMissingLinks(requestID)
+	rm.protectPeer(requestStatus, retry.P)
+	// the delay before the request is sent again does not count as inactivity
+	requestStatus.stall.touchAt(time.Now().Add(retry.Delay))
+	return true
+}
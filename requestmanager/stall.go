@@ -0,0 +1,88 @@
+package requestmanager
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// stallState cancels a request that goes too long without a response or block
+// from its peer
+type stallState struct {
+	// timeout is how long the request waits for a response or block from the
+	// peer before it is cancelled, or zero to wait forever
+	timeout      time.Duration
+	lastActivity time.Time
+	timer        *time.Timer
+}
+
+// startStallTimer starts checking a request for inactivity, if it has a timeout
+func (rm *RequestManager) startStallTimer(requestID graphsync.RequestID, ss *stallState) {
+	if ss.timeout <= 0 {
+		return
+	}
+	ss.lastActivity = time.Now()
+	ss.timer = time.AfterFunc(ss.timeout, func() {
+		select {
+		case rm.messages <- &stallCheckMessage{requestID}:
+		case <-rm.ctx.Done():
+		}
+	})
+}
+
+// touch counts the request as active now
+func (ss *stallState) touch() {
+	ss.touchAt(time.Now())
+}
+
+// touchAt counts the request as active until the given time
+func (ss *stallState) touchAt(t time.Time) {
+	ss.lastActivity = t
+}
+
+func (ss *stallState) stop() {
+	if ss.timer != nil {
+		ss.timer.Stop()
+	}
+}
+
+func (rm *RequestManager) updateLastActivity(responses []gsmsg.GraphSyncResponse) {
+	now := time.Now()
+	for _, response := range responses {
+		rm.inProgressRequestStatuses[response.RequestID()].stall.touchAt(now)
+	}
+}
+
+type stallCheckMessage struct {
+	requestID graphsync.RequestID
+}
+
+// handle cancels a request if its inactivity timeout has passed since the
+// last response or block from the peer, and otherwise checks again when it
+// next could. Time spent paused does not count.
+func (scm *stallCheckMessage) handle(rm *RequestManager) {
+	requestStatus, ok := rm.inProgressRequestStatuses[scm.requestID]
+	if !ok || requestStatus.terminalStatus != 0 {
+		return
+	}
+	ss := &requestStatus.stall
+	// paused requests and requests still resolving locally are not waiting on
+	// the peer
+	if requestStatus.paused || atomic.LoadInt32(&requestStatus.sendState) == requestUnsent {
+		ss.touch()
+	}
+	remaining := ss.timeout - time.Since(ss.lastActivity)
+	if remaining > 0 {
+		ss.timer.Reset(remaining)
+		return
+	}
+	stallError := graphsync.RequestStalledErr{Peer: requestStatus.p, Timeout: ss.timeout}
+	select {
+	case requestStatus.networkError <- stallError:
+	case <-requestStatus.ctx.Done():
+	}
+	rm.sendRequest(requestStatus, gsmsg.CancelRequest(scm.requestID))
+	requestStatus.cancelFn()
+}
@@ -37,6 +37,12 @@ type FakeAsyncLoader struct {
 	storesRequestedLk  sync.RWMutex
 	storesRequested    map[storeKey]struct{}
 	cb                 func(graphsync.RequestID, ipld.Link, <-chan types.AsyncLoadResult)
+	atMemoryLimitLk    sync.RWMutex
+	atMemoryLimit      bool
+	clearedLk          sync.RWMutex
+	cleared            map[graphsync.RequestID]int
+	pausedLk           sync.RWMutex
+	paused             map[graphsync.RequestID]bool
 }
 
 // NewFakeAsyncLoader returns a new FakeAsyncLoader instance
@@ -46,6 +52,8 @@ func NewFakeAsyncLoader() *FakeAsyncLoader {
 		responses:        make(chan map[graphsync.RequestID]metadata.Metadata, 1),
 		blks:             make(chan []blocks.Block, 1),
 		storesRequested:  make(map[storeKey]struct{}),
+		cleared:          make(map[graphsync.RequestID]int),
+		paused:           make(map[graphsync.RequestID]bool),
 	}
 }
 
@@ -127,6 +135,58 @@ func (fal *FakeAsyncLoader) AsyncLoad(requestID graphsync.RequestID, link ipld.L
 // CompleteResponsesFor in the case of the test loader does nothing
 func (fal *FakeAsyncLoader) CompleteResponsesFor(requestID graphsync.RequestID) {}
 
+// ClearMissingLinks counts how many times missing links were cleared for a
+// given requestID
+func (fal *FakeAsyncLoader) ClearMissingLinks(requestID graphsync.RequestID) {
+	fal.clearedLk.Lock()
+	fal.cleared[requestID]++
+	fal.clearedLk.Unlock()
+}
+
+// VerifyMissingLinksCleared verifies missing links were cleared the given
+// number of times for a given requestID
+func (fal *FakeAsyncLoader) VerifyMissingLinksCleared(t *testing.T, requestID graphsync.RequestID, times int) {
+	fal.clearedLk.RLock()
+	defer fal.clearedLk.RUnlock()
+	require.Equal(t, times, fal.cleared[requestID], "did not clear missing links the expected number of times")
+}
+
+// SetAtMemoryLimit sets the value returned by AtMemoryLimit
+func (fal *FakeAsyncLoader) SetAtMemoryLimit(atMemoryLimit bool) {
+	fal.atMemoryLimitLk.Lock()
+	fal.atMemoryLimit = atMemoryLimit
+	fal.atMemoryLimitLk.Unlock()
+}
+
+// AtMemoryLimit returns the value set with SetAtMemoryLimit
+func (fal *FakeAsyncLoader) AtMemoryLimit() bool {
+	fal.atMemoryLimitLk.RLock()
+	defer fal.atMemoryLimitLk.RUnlock()
+	return fal.atMemoryLimit
+}
+
+// PauseRequest records that the given request is paused
+func (fal *FakeAsyncLoader) PauseRequest(requestID graphsync.RequestID) {
+	fal.pausedLk.Lock()
+	fal.paused[requestID] = true
+	fal.pausedLk.Unlock()
+}
+
+// UnpauseRequest records that the given request is no longer paused
+func (fal *FakeAsyncLoader) UnpauseRequest(requestID graphsync.RequestID) {
+	fal.pausedLk.Lock()
+	fal.paused[requestID] = false
+	fal.pausedLk.Unlock()
+}
+
+// VerifyRequestPaused verifies whether the given request was last paused or
+// unpaused
+func (fal *FakeAsyncLoader) VerifyRequestPaused(t *testing.T, requestID graphsync.RequestID, paused bool) {
+	fal.pausedLk.RLock()
+	defer fal.pausedLk.RUnlock()
+	require.Equal(t, paused, fal.paused[requestID], "request was not paused as expected")
+}
+
 // CleanupRequest simulates the effect of cleaning up the request by removing any response channels
 // for the request
 func (fal *FakeAsyncLoader) CleanupRequest(requestID graphsync.RequestID) {
@@ -0,0 +1,88 @@
+package requestmanager
+
+import (
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/pauseresponse"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// throttleState pauses the responders of a request while it catches up with
+// the blocks already received
+type throttleState struct {
+	// messages carry whether the responders can pause the response, or the
+	// request has to be cancelled and sent again instead
+	messages chan bool
+	// pausablePeers are the peers that have said they can pause the response
+	pausablePeers map[peer.ID]struct{}
+}
+
+func newThrottleState() throttleState {
+	return throttleState{
+		messages:      make(chan bool, 1),
+		pausablePeers: make(map[peer.ID]struct{}),
+	}
+}
+
+// throttleRequests applies back pressure while received blocks that are not
+// yet verified are over the memory limit. Only the requests that just received
+// blocks pause their responders, until they catch up with the blocks they
+// have, so other requests carry on. Requests split across several peers pause
+// every peer they are waiting on. Requests whose responders have not said they
+// can pause are cancelled instead, and sent again once they catch up.
+func (rm *RequestManager) throttleRequests(responses []gsmsg.GraphSyncResponse, blks []blocks.Block) {
+	if len(blks) == 0 || !rm.asyncLoader.AtMemoryLimit() {
+		return
+	}
+	for _, response := range responses {
+		if gsmsg.IsTerminalResponseCode(response.Status()) {
+			continue
+		}
+		requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]
+		if !ok || requestStatus.paused {
+			continue
+		}
+		select {
+		case requestStatus.throttle.messages <- canPauseResponse(requestStatus):
+		default:
+		}
+	}
+}
+
+// offerPauseResponse adds the pause response extension to a request, offering
+// to pause its response. A responder that supports it answers in its first
+// response, and only then is sent pause updates.
+func offerPauseResponse(request gsmsg.GraphSyncRequest) (gsmsg.GraphSyncRequest, error) {
+	data, err := pauseresponse.EncodePauseResponse(false)
+	if err != nil {
+		return request, err
+	}
+	return request.ReplaceExtensions([]graphsync.ExtensionData{{Name: graphsync.ExtensionPauseResponse, Data: data}}), nil
+}
+
+// processPauseResponseOffers notes the peers that answered the offer to pause
+// their responses
+func (rm *RequestManager) processPauseResponseOffers(responses []gsmsg.GraphSyncResponse, p peer.ID) {
+	for _, response := range responses {
+		if _, has := response.Extension(graphsync.ExtensionPauseResponse); !has {
+			continue
+		}
+		rm.inProgressRequestStatuses[response.RequestID()].throttle.pausablePeers[p] = struct{}{}
+	}
+}
+
+// canPauseResponse returns whether every peer a request is waiting on has said
+// it can pause the response
+func canPauseResponse(requestStatus *inProgressRequestStatus) bool {
+	peers := []peer.ID{requestStatus.p}
+	if requestStatus.multiPeer != nil {
+		peers = requestStatus.multiPeer.peers
+	}
+	for _, p := range peers {
+		if _, ok := requestStatus.throttle.pausablePeers[p]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -19,7 +19,8 @@ func metadataForResponses(responses []gsmsg.GraphSyncResponse) map[graphsync.Req
 			log.Warnf("Unable to decode metadata in response for request id: %d", response.RequestID())
 			continue
 		}
-		responseMetadata[response.RequestID()] = md
+		// a multi-peer request can receive several responses in one message
+		responseMetadata[response.RequestID()] = append(responseMetadata[response.RequestID()], md...)
 	}
 	return responseMetadata
 }
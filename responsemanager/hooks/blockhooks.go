@@ -44,6 +44,9 @@ func (obh *OutgoingBlockHooks) Register(hook graphsync.OnOutgoingBlockHook) grap
 type BlockResult struct {
 	Err        error
 	Extensions []graphsync.ExtensionData
+	// PeerBandwidthLimit is the new bandwidth limit for the peer, if a hook
+	// changed it
+	PeerBandwidthLimit *uint64
 }
 
 // ProcessBlockHooks runs block hooks against a request and block data
@@ -54,12 +57,13 @@ func (obh *OutgoingBlockHooks) ProcessBlockHooks(p peer.ID, request graphsync.Re
 }
 
 type blockHookActions struct {
-	err        error
-	extensions []graphsync.ExtensionData
+	err                error
+	extensions         []graphsync.ExtensionData
+	peerBandwidthLimit *uint64
 }
 
 func (bha *blockHookActions) result() BlockResult {
-	return BlockResult{bha.err, bha.extensions}
+	return BlockResult{bha.err, bha.extensions, bha.peerBandwidthLimit}
 }
 
 func (bha *blockHookActions) SendExtensionData(data graphsync.ExtensionData) {
@@ -73,3 +77,7 @@ func (bha *blockHookActions) TerminateWithError(err error) {
 func (bha *blockHookActions) PauseResponse() {
 	bha.err = ErrPaused{}
 }
+
+func (bha *blockHookActions) SetPeerBandwidthLimit(bytesPerSecond uint64) {
+	bha.peerBandwidthLimit = &bytesPerSecond
+}
@@ -14,6 +14,7 @@ import (
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,6 +56,10 @@ func TestRequestHookProcessing(t *testing.T) {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Style.Any)
 	request := gsmsg.NewRequest(requestID, root, ssb.Matcher().Node(), graphsync.Priority(0), extension)
 	p := testutil.GeneratePeers(1)[0]
+	additionalPeers := []peer.AddrInfo{
+		{ID: testutil.GeneratePeers(1)[0], Addrs: []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/4001")}},
+		{ID: testutil.GeneratePeers(1)[0]},
+	}
 	testCases := map[string]struct {
 		configure func(t *testing.T, requestHooks *hooks.IncomingRequestHooks)
 		assert    func(t *testing.T, result hooks.RequestResult)
@@ -200,6 +205,31 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"hooks send additional peers": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.SendAdditionalPeers(additionalPeers[0])
+					hookActions.SendAdditionalPeers(additionalPeers[1:]...)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.False(t, result.IsValidated)
+				require.Equal(t, additionalPeers, result.AdditionalPeers)
+				require.NoError(t, result.Err)
+			},
+		},
+		"hooks set peer bandwidth limit": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.SetPeerBandwidthLimit(1 << 20)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.NotNil(t, result.PeerBandwidthLimit)
+				require.Equal(t, uint64(1<<20), *result.PeerBandwidthLimit)
+				require.NoError(t, result.Err)
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -278,6 +308,18 @@ func TestBlockHookProcessing(t *testing.T) {
 				require.EqualError(t, result.Err, hooks.ErrPaused{}.Error())
 			},
 		},
+		"set peer bandwidth limit": {
+			configure: func(t *testing.T, blockHooks *hooks.OutgoingBlockHooks) {
+				blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+					hookActions.SetPeerBandwidthLimit(0)
+				})
+			},
+			assert: func(t *testing.T, result hooks.BlockResult) {
+				require.NotNil(t, result.PeerBandwidthLimit)
+				require.Zero(t, *result.PeerBandwidthLimit)
+				require.NoError(t, result.Err)
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -70,3 +70,38 @@ func (rcl *RequestorCancelledListeners) Register(listener graphsync.OnRequestorC
 func (rcl *RequestorCancelledListeners) NotifyCancelledListeners(p peer.ID, request graphsync.RequestData) {
 	_ = rcl.pubSub.Publish(internalRequestorCancelledEvent{p, request})
 }
+
+// NetworkErrorListeners is a set of listeners for responses that end because
+// of network errors
+type NetworkErrorListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalNetworkErrorEvent struct {
+	p       peer.ID
+	request graphsync.RequestData
+	err     error
+}
+
+func networkErrorDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalNetworkErrorEvent)
+	listener := subscriberFn.(graphsync.OnNetworkErrorListener)
+	listener(ie.p, ie.request, ie.err)
+	return nil
+}
+
+// NewNetworkErrorListeners returns a new list of network error listeners
+func NewNetworkErrorListeners() *NetworkErrorListeners {
+	return &NetworkErrorListeners{pubSub: pubsub.New(networkErrorDispatcher)}
+}
+
+// Register registers a listener for network errors
+func (nel *NetworkErrorListeners) Register(listener graphsync.OnNetworkErrorListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(nel.pubSub.Subscribe(listener))
+}
+
+// NotifyNetworkErrorListeners notifies all listeners that a response ended
+// because of a network error
+func (nel *NetworkErrorListeners) NotifyNetworkErrorListeners(p peer.ID, request graphsync.RequestData, err error) {
+	_ = nel.pubSub.Publish(internalNetworkErrorEvent{p, request, err})
+}
@@ -49,12 +49,16 @@ func (irh *IncomingRequestHooks) Register(hook graphsync.OnIncomingRequestHook)
 
 // RequestResult is the outcome of running requesthooks
 type RequestResult struct {
-	IsValidated   bool
-	IsPaused      bool
-	CustomLoader  ipld.Loader
-	CustomChooser traversal.LinkTargetNodeStyleChooser
-	Err           error
-	Extensions    []graphsync.ExtensionData
+	IsValidated     bool
+	IsPaused        bool
+	CustomLoader    ipld.Loader
+	CustomChooser   traversal.LinkTargetNodeStyleChooser
+	Err             error
+	Extensions      []graphsync.ExtensionData
+	AdditionalPeers []peer.AddrInfo
+	// PeerBandwidthLimit is the new bandwidth limit for the peer, if a hook
+	// changed it
+	PeerBandwidthLimit *uint64
 }
 
 // ProcessRequestHooks runs request hooks against an incoming request
@@ -74,16 +78,20 @@ type requestHookActions struct {
 	loader             ipld.Loader
 	chooser            traversal.LinkTargetNodeStyleChooser
 	extensions         []graphsync.ExtensionData
+	additionalPeers    []peer.AddrInfo
+	peerBandwidthLimit *uint64
 }
 
 func (ha *requestHookActions) result() RequestResult {
 	return RequestResult{
-		IsValidated:   ha.isValidated,
-		IsPaused:      ha.isPaused,
-		CustomLoader:  ha.loader,
-		CustomChooser: ha.chooser,
-		Err:           ha.err,
-		Extensions:    ha.extensions,
+		IsValidated:        ha.isValidated,
+		IsPaused:           ha.isPaused,
+		CustomLoader:       ha.loader,
+		CustomChooser:      ha.chooser,
+		Err:                ha.err,
+		Extensions:         ha.extensions,
+		AdditionalPeers:    ha.additionalPeers,
+		PeerBandwidthLimit: ha.peerBandwidthLimit,
 	}
 }
 
@@ -115,3 +123,11 @@ func (ha *requestHookActions) UseLinkTargetNodeStyleChooser(chooser traversal.Li
 func (ha *requestHookActions) PauseResponse() {
 	ha.isPaused = true
 }
+
+func (ha *requestHookActions) SendAdditionalPeers(peers ...peer.AddrInfo) {
+	ha.additionalPeers = append(ha.additionalPeers, peers...)
+}
+
+func (ha *requestHookActions) SetPeerBandwidthLimit(bytesPerSecond uint64) {
+	ha.peerBandwidthLimit = &bytesPerSecond
+}
@@ -15,13 +15,15 @@ import (
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync/linktracker"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/partition"
 	"github.com/ipfs/go-graphsync/responsemanager/responsebuilder"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 const (
-	// max block size is the maximum size for batching blocks in a single payload
-	maxBlockSize uint64 = 512 * 1024
+	// DefaultMaxBlockSize is the default maximum size for batching blocks in a
+	// single payload
+	DefaultMaxBlockSize uint64 = 512 * 1024
 )
 
 var log = logging.Logger("graphsync")
@@ -40,10 +42,13 @@ type peerResponseSender struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	peerHandler  PeerMessageHandler
+	maxBlockSize uint64
 	outgoingWork chan struct{}
+	flushes      chan chan struct{}
 
 	linkTrackerLk      sync.RWMutex
 	linkTracker        *linktracker.LinkTracker
+	partitions         map[graphsync.RequestID]partition.Partition
 	responseBuildersLk sync.RWMutex
 	responseBuilders   []*responsebuilder.ResponseBuilder
 }
@@ -53,12 +58,14 @@ type peerResponseSender struct {
 type PeerResponseSender interface {
 	peermanager.PeerProcess
 	IgnoreBlocks(requestID graphsync.RequestID, links []ipld.Link)
+	UsePartition(requestID graphsync.RequestID, p partition.Partition)
 	SendResponse(
 		requestID graphsync.RequestID,
 		link ipld.Link,
 		data []byte,
 	) graphsync.BlockData
 	SendExtensionData(graphsync.RequestID, graphsync.ExtensionData)
+	SendAdditionalPeers(graphsync.RequestID, graphsync.ExtensionData)
 	FinishWithCancel(requestID graphsync.RequestID)
 	FinishRequest(requestID graphsync.RequestID) graphsync.ResponseStatusCode
 	FinishWithError(requestID graphsync.RequestID, status graphsync.ResponseStatusCode)
@@ -75,6 +82,7 @@ type PeerResponseTransactionSender interface {
 		data []byte,
 	) graphsync.BlockData
 	SendExtensionData(graphsync.ExtensionData)
+	SendAdditionalPeers(graphsync.ExtensionData)
 	FinishWithCancel()
 	FinishRequest() graphsync.ResponseStatusCode
 	FinishWithError(status graphsync.ResponseStatusCode)
@@ -82,16 +90,20 @@ type PeerResponseTransactionSender interface {
 }
 
 // NewResponseSender generates a new PeerResponseSender for the given context, peer ID,
-// using the given peer message handler.
-func NewResponseSender(ctx context.Context, p peer.ID, peerHandler PeerMessageHandler) PeerResponseSender {
+// using the given peer message handler. Blocks are batched into payloads of at
+// most maxBlockSize bytes, unless a single block is larger.
+func NewResponseSender(ctx context.Context, p peer.ID, peerHandler PeerMessageHandler, maxBlockSize uint64) PeerResponseSender {
 	ctx, cancel := context.WithCancel(ctx)
 	return &peerResponseSender{
 		p:            p,
 		ctx:          ctx,
 		cancel:       cancel,
 		peerHandler:  peerHandler,
+		maxBlockSize: maxBlockSize,
 		outgoingWork: make(chan struct{}, 1),
+		flushes:      make(chan chan struct{}),
 		linkTracker:  linktracker.New(),
+		partitions:   make(map[graphsync.RequestID]partition.Partition),
 	}
 }
 
@@ -108,6 +120,14 @@ func (prs *peerResponseSender) IgnoreBlocks(requestID graphsync.RequestID, links
 	prs.linkTrackerLk.Unlock()
 }
 
+// UsePartition limits the blocks sent for the given request to those in the
+// given partition -- other blocks are reported as present but not sent
+func (prs *peerResponseSender) UsePartition(requestID graphsync.RequestID, p partition.Partition) {
+	prs.linkTrackerLk.Lock()
+	prs.partitions[requestID] = p
+	prs.linkTrackerLk.Unlock()
+}
+
 type responseOperation interface {
 	build(responseBuilder *responsebuilder.ResponseBuilder)
 	size() uint64
@@ -132,6 +152,25 @@ func (prs *peerResponseSender) Shutdown() {
 	prs.cancel()
 }
 
+// Flush hands any responses that are waiting to be sent to the message queue
+// for the peer, returning once they are handed off or the context ends
+func (prs *peerResponseSender) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case prs.flushes <- flushed:
+	case <-prs.ctx.Done():
+		return prs.ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type extensionOperation struct {
 	requestID graphsync.RequestID
 	extension graphsync.ExtensionData
@@ -149,6 +188,12 @@ func (prs *peerResponseSender) SendExtensionData(requestID graphsync.RequestID,
 	prs.execute([]responseOperation{extensionOperation{requestID, extension}})
 }
 
+// SendAdditionalPeers sends the given additional peers extension with the
+// AdditionalPeers status
+func (prs *peerResponseSender) SendAdditionalPeers(requestID graphsync.RequestID, extension graphsync.ExtensionData) {
+	prs.execute([]responseOperation{extensionOperation{requestID, extension}, statusOperation{requestID, graphsync.AdditionalPeers}})
+}
+
 type peerResponseTransactionSender struct {
 	requestID  graphsync.RequestID
 	operations []responseOperation
@@ -165,6 +210,10 @@ func (prts *peerResponseTransactionSender) SendExtensionData(extension graphsync
 	prts.operations = append(prts.operations, extensionOperation{prts.requestID, extension})
 }
 
+func (prts *peerResponseTransactionSender) SendAdditionalPeers(extension graphsync.ExtensionData) {
+	prts.operations = append(prts.operations, extensionOperation{prts.requestID, extension}, statusOperation{prts.requestID, graphsync.AdditionalPeers})
+}
+
 func (prts *peerResponseTransactionSender) FinishRequest() graphsync.ResponseStatusCode {
 	op := prts.prs.setupFinishOperation(prts.requestID)
 	prts.operations = append(prts.operations, op)
@@ -237,6 +286,14 @@ func (prs *peerResponseSender) setupBlockOperation(requestID graphsync.RequestID
 	link ipld.Link, data []byte) blockOperation {
 	hasBlock := data != nil
 	prs.linkTrackerLk.Lock()
+	p, hasPartition := prs.partitions[requestID]
+	if hasBlock && hasPartition && (prs.linkTracker.IsExcludedLink(requestID, link) || !p.Includes(link)) {
+		prs.linkTracker.RecordExcludedLinkTraversal(requestID, link)
+		prs.linkTrackerLk.Unlock()
+		return blockOperation{
+			data, false, link, requestID,
+		}
+	}
 	sendBlock := hasBlock && prs.linkTracker.BlockRefCount(link) == 0
 	prs.linkTracker.RecordLinkTraversal(requestID, link, hasBlock)
 	prs.linkTrackerLk.Unlock()
@@ -275,6 +332,7 @@ func (fo statusOperation) size() uint64 {
 func (prs *peerResponseSender) finishTracking(requestID graphsync.RequestID) bool {
 	prs.linkTrackerLk.Lock()
 	defer prs.linkTrackerLk.Unlock()
+	delete(prs.partitions, requestID)
 	return prs.linkTracker.FinishRequest(requestID)
 }
 
@@ -298,6 +356,7 @@ func (prs *peerResponseSender) FinishRequest(requestID graphsync.RequestID) grap
 
 func (prs *peerResponseSender) setupFinishWithErrOperation(requestID graphsync.RequestID, status graphsync.ResponseStatusCode) statusOperation {
 	prs.linkTrackerLk.Lock()
+	delete(prs.partitions, requestID)
 	prs.linkTracker.FinishRequest(requestID)
 	prs.linkTrackerLk.Unlock()
 	return statusOperation{requestID, status}
@@ -320,7 +379,7 @@ func (prs *peerResponseSender) FinishWithCancel(requestID graphsync.RequestID) {
 func (prs *peerResponseSender) buildResponse(blkSize uint64, buildResponseFn func(*responsebuilder.ResponseBuilder)) bool {
 	prs.responseBuildersLk.Lock()
 	defer prs.responseBuildersLk.Unlock()
-	if shouldBeginNewResponse(prs.responseBuilders, blkSize) {
+	if shouldBeginNewResponse(prs.responseBuilders, blkSize, prs.maxBlockSize) {
 		prs.responseBuilders = append(prs.responseBuilders, responsebuilder.New())
 	}
 	responseBuilder := prs.responseBuilders[len(prs.responseBuilders)-1]
@@ -328,7 +387,7 @@ func (prs *peerResponseSender) buildResponse(blkSize uint64, buildResponseFn fun
 	return !responseBuilder.Empty()
 }
 
-func shouldBeginNewResponse(responseBuilders []*responsebuilder.ResponseBuilder, blkSize uint64) bool {
+func shouldBeginNewResponse(responseBuilders []*responsebuilder.ResponseBuilder, blkSize uint64, maxBlockSize uint64) bool {
 	if len(responseBuilders) == 0 {
 		return true
 	}
@@ -352,6 +411,9 @@ func (prs *peerResponseSender) run() {
 			return
 		case <-prs.outgoingWork:
 			prs.sendResponseMessages()
+		case flushed := <-prs.flushes:
+			prs.sendResponseMessages()
+			close(flushed)
 		}
 	}
 }
@@ -12,6 +12,7 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/partition"
 	"github.com/ipfs/go-graphsync/testutil"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
@@ -51,7 +52,7 @@ func TestPeerResponseSenderSendsResponses(t *testing.T) {
 		done: done,
 		sent: sent,
 	}
-	peerResponseSender := NewResponseSender(ctx, p, fph)
+	peerResponseSender := NewResponseSender(ctx, p, fph, DefaultMaxBlockSize)
 	peerResponseSender.Startup()
 
 	bd := peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -153,7 +154,7 @@ func TestPeerResponseSenderSendsVeryLargeBlocksResponses(t *testing.T) {
 		done: done,
 		sent: sent,
 	}
-	peerResponseSender := NewResponseSender(ctx, p, fph)
+	peerResponseSender := NewResponseSender(ctx, p, fph, DefaultMaxBlockSize)
 	peerResponseSender.Startup()
 
 	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -222,6 +223,53 @@ func TestPeerResponseSenderSendsVeryLargeBlocksResponses(t *testing.T) {
 
 }
 
+func TestPeerResponseSenderUsesMaxBlockSize(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	done := make(chan struct{}, 1)
+	sent := make(chan struct{}, 1)
+	fph := &fakePeerHandler{
+		done: done,
+		sent: sent,
+	}
+	peerResponseSender := NewResponseSender(ctx, p, fph, 250)
+	peerResponseSender.Startup()
+
+	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
+	testutil.AssertDoesReceive(ctx, t, sent, "did not send first message")
+	require.Len(t, fph.lastBlocks, 1)
+
+	// queue the remaining blocks while the first message is sending
+	for i := 1; i < len(blks); i++ {
+		peerResponseSender.SendResponse(requestID1, links[i], blks[i].RawData())
+	}
+	peerResponseSender.FinishRequest(requestID1)
+
+	// no more than two blocks fit in each message
+	done <- struct{}{}
+	testutil.AssertDoesReceive(ctx, t, sent, "did not send second message")
+	require.Len(t, fph.lastBlocks, 2)
+	require.Equal(t, blks[1].Cid(), fph.lastBlocks[0].Cid())
+	require.Equal(t, blks[2].Cid(), fph.lastBlocks[1].Cid())
+
+	done <- struct{}{}
+	testutil.AssertDoesReceive(ctx, t, sent, "did not send third message")
+	require.Len(t, fph.lastBlocks, 2)
+	require.Equal(t, blks[3].Cid(), fph.lastBlocks[0].Cid())
+	require.Equal(t, blks[4].Cid(), fph.lastBlocks[1].Cid())
+	response, err := findResponseForRequestID(fph.lastResponses, requestID1)
+	require.NoError(t, err)
+	require.Equal(t, graphsync.RequestCompletedFull, response.Status())
+}
+
 func TestPeerResponseSenderSendsExtensionData(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -239,7 +287,7 @@ func TestPeerResponseSenderSendsExtensionData(t *testing.T) {
 		done: done,
 		sent: sent,
 	}
-	peerResponseSender := NewResponseSender(ctx, p, fph)
+	peerResponseSender := NewResponseSender(ctx, p, fph, DefaultMaxBlockSize)
 	peerResponseSender.Startup()
 
 	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -302,7 +350,7 @@ func TestPeerResponseSenderSendsResponsesInTransaction(t *testing.T) {
 		done: done,
 		sent: sent,
 	}
-	peerResponseSender := NewResponseSender(ctx, p, fph)
+	peerResponseSender := NewResponseSender(ctx, p, fph, DefaultMaxBlockSize)
 	peerResponseSender.Startup()
 
 	err := peerResponseSender.Transaction(requestID1, func(peerResponseSender PeerResponseTransactionSender) error {
@@ -352,7 +400,7 @@ func TestPeerResponseSenderIgnoreBlocks(t *testing.T) {
 		done: done,
 		sent: sent,
 	}
-	peerResponseSender := NewResponseSender(ctx, p, fph)
+	peerResponseSender := NewResponseSender(ctx, p, fph, DefaultMaxBlockSize)
 	peerResponseSender.Startup()
 
 	peerResponseSender.IgnoreBlocks(requestID1, links)
@@ -415,6 +463,54 @@ func TestPeerResponseSenderIgnoreBlocks(t *testing.T) {
 	require.Equal(t, graphsync.RequestCompletedFull, response2.Status(), "did not send correct response code in third message")
 }
 
+func TestPeerResponseSenderUsePartition(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	done := make(chan struct{}, 1)
+	sent := make(chan struct{}, 1)
+	fph := &fakePeerHandler{
+		done: done,
+		sent: sent,
+	}
+	peerResponseSender := NewResponseSender(ctx, p, fph, DefaultMaxBlockSize)
+	peerResponseSender.Startup()
+
+	part := partition.Partition{Count: 2, Buckets: []int{1}}
+	peerResponseSender.UsePartition(requestID1, part)
+
+	var expectedBlocks []blocks.Block
+	_ = peerResponseSender.Transaction(requestID1, func(prts PeerResponseTransactionSender) error {
+		for i, link := range links {
+			bd := prts.SendResponse(link, blks[i].RawData())
+			require.Equal(t, uint64(len(blks[i].RawData())), bd.BlockSize())
+			if part.Includes(link) {
+				require.Equal(t, uint64(len(blks[i].RawData())), bd.BlockSizeOnWire())
+				expectedBlocks = append(expectedBlocks, blks[i])
+			} else {
+				require.Equal(t, uint64(0), bd.BlockSizeOnWire())
+			}
+		}
+		prts.FinishRequest()
+		return nil
+	})
+	testutil.AssertDoesReceive(ctx, t, sent, "did not send message")
+
+	require.Len(t, fph.lastBlocks, len(expectedBlocks))
+	for _, blk := range expectedBlocks {
+		testutil.AssertContainsBlock(t, fph.lastBlocks, blk)
+	}
+	require.Len(t, fph.lastResponses, 1)
+	require.Equal(t, graphsync.RequestCompletedFull, fph.lastResponses[0].Status())
+}
+
 func findResponseForRequestID(responses []gsmsg.GraphSyncResponse, requestID graphsync.RequestID) (gsmsg.GraphSyncResponse, error) {
 	for _, response := range responses {
 		if response.RequestID() == requestID {
@@ -3,14 +3,22 @@ package responsemanager
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/additionalpeers"
+	"github.com/ipfs/go-graphsync/budget"
 	"github.com/ipfs/go-graphsync/cidset"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metrics"
+	"github.com/ipfs/go-graphsync/partition"
+	"github.com/ipfs/go-graphsync/pauseresponse"
+	"github.com/ipfs/go-graphsync/ratelimit"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/runtraversal"
@@ -21,20 +29,44 @@ import (
 
 var errCancelledByCommand = errors.New("response cancelled by responder")
 
+var errBudgetExceeded = errors.New("response budget exceeded")
+
+// errRequestorPaused pauses a response because the requestor asked for it. It
+// is handled like hooks.ErrPaused, except the requestor can resume it.
+type errRequestorPaused struct{}
+
+func (e errRequestorPaused) Error() string { return "request has been paused by the requestor" }
+
+// errThrottled stops a response that has sent as much as the bandwidth limits
+// allow for now. The response manager queues it again after delay, or sooner
+// if either limit's rate changes.
+type errThrottled struct {
+	delay         time.Duration
+	globalChanged <-chan struct{}
+	peerChanged   <-chan struct{}
+}
+
+func (e errThrottled) Error() string {
+	return fmt.Sprintf("response throttled for %s", e.delay)
+}
+
 // TODO: Move this into a seperate module and fully seperate from the ResponseManager
 type queryExecutor struct {
-	requestHooks       RequestHooks
-	blockHooks         BlockHooks
-	updateHooks        UpdateHooks
-	completedListeners CompletedListeners
-	cancelledListeners CancelledListeners
-	peerManager        PeerManager
-	loader             ipld.Loader
-	queryQueue         QueryQueue
-	messages           chan responseManagerMessage
-	ctx                context.Context
-	workSignal         chan struct{}
-	ticker             *time.Ticker
+	requestHooks          RequestHooks
+	blockHooks            BlockHooks
+	updateHooks           UpdateHooks
+	completedListeners    CompletedListeners
+	cancelledListeners    CancelledListeners
+	networkErrorListeners NetworkErrorListeners
+	peerManager           PeerManager
+	loader                ipld.Loader
+	queryQueue            QueryQueue
+	messages              chan responseManagerMessage
+	ctx                   context.Context
+	workSignal            chan struct{}
+	ticker                *time.Ticker
+	metrics               metrics.Metrics
+	bandwidthLimits       *ratelimit.Limits
 }
 
 func (qe *queryExecutor) processQueriesWorker() {
@@ -71,11 +103,14 @@ func (qe *queryExecutor) processQueriesWorker() {
 				continue
 			}
 			status, err := qe.executeTask(key, taskData)
-			_, isPaused := err.(hooks.ErrPaused)
+			isPaused := isPausedErr(err)
+			_, isThrottled := err.(errThrottled)
 			isCancelled := err != nil && isContextErr(err)
-			if isCancelled {
+			if isNetworkErr(err) {
+				qe.networkErrorListeners.NotifyNetworkErrorListeners(key.p, taskData.request, err)
+			} else if isCancelled {
 				qe.cancelledListeners.NotifyCancelledListeners(key.p, taskData.request)
-			} else if !isPaused {
+			} else if !isPaused && !isThrottled {
 				qe.completedListeners.NotifyCompletedListeners(key.p, taskData.request, status)
 			}
 			select {
@@ -93,28 +128,32 @@ func (qe *queryExecutor) executeTask(key responseKey, taskData responseTaskData)
 	var err error
 	loader := taskData.loader
 	traverser := taskData.traverser
+	responseBudget := taskData.budget
 	if loader == nil || traverser == nil {
 		var isPaused bool
-		loader, traverser, isPaused, err = qe.prepareQuery(taskData.ctx, key.p, taskData.request)
+		loader, traverser, responseBudget, isPaused, err = qe.prepareQuery(taskData.ctx, key.p, taskData.request)
 		if err != nil {
 			return graphsync.RequestFailedUnknown, err
 		}
 		select {
 		case <-qe.ctx.Done():
 			return graphsync.RequestFailedUnknown, errors.New("context cancelled")
-		case qe.messages <- &setResponseDataRequest{key, loader, traverser}:
+		case qe.messages <- &setResponseDataRequest{key, loader, traverser, responseBudget}:
 		}
 		if isPaused {
 			return graphsync.RequestPaused, hooks.ErrPaused{}
 		}
 	}
-	return qe.executeQuery(key.p, taskData.request, loader, traverser, taskData.signals)
+	return qe.executeQuery(key.p, taskData.request, loader, traverser, taskData.signals, taskData.stats, responseBudget)
 }
 
 func (qe *queryExecutor) prepareQuery(ctx context.Context,
 	p peer.ID,
-	request gsmsg.GraphSyncRequest) (ipld.Loader, ipldutil.Traverser, bool, error) {
+	request gsmsg.GraphSyncRequest) (ipld.Loader, ipldutil.Traverser, graphsync.Budget, bool, error) {
 	result := qe.requestHooks.ProcessRequestHooks(p, request)
+	if result.PeerBandwidthLimit != nil {
+		qe.bandwidthLimits.SetPeerRate(p, *result.PeerBandwidthLimit)
+	}
 	peerResponseSender := qe.peerManager.SenderForPeer(p)
 	var transactionError error
 	var isPaused bool
@@ -122,6 +161,24 @@ func (qe *queryExecutor) prepareQuery(ctx context.Context,
 		for _, extension := range result.Extensions {
 			transaction.SendExtensionData(extension)
 		}
+		if len(result.AdditionalPeers) > 0 {
+			additionalPeersData, err := additionalpeers.EncodeAdditionalPeers(result.AdditionalPeers)
+			if err != nil {
+				log.Warnf("Unable to encode additional peers for request %d: %s", request.ID(), err)
+			} else {
+				transaction.SendAdditionalPeers(graphsync.ExtensionData{Name: graphsync.ExtensionAdditionalPeers, Data: additionalPeersData})
+			}
+		}
+		// answering the offer to pause the response tells the requestor it can
+		// send pause updates
+		if _, has := request.Extension(graphsync.ExtensionPauseResponse); has {
+			pauseData, err := pauseresponse.EncodePauseResponse(false)
+			if err != nil {
+				log.Warnf("Unable to encode pause response for request %d: %s", request.ID(), err)
+			} else {
+				transaction.SendExtensionData(graphsync.ExtensionData{Name: graphsync.ExtensionPauseResponse, Data: pauseData})
+			}
+		}
 		if result.Err != nil || !result.IsValidated {
 			transaction.FinishWithError(graphsync.RequestFailedUnknown)
 			transactionError = errors.New("request not valid")
@@ -132,13 +189,20 @@ func (qe *queryExecutor) prepareQuery(ctx context.Context,
 		return nil
 	})
 	if err != nil {
-		return nil, nil, false, err
+		return nil, nil, graphsync.Budget{}, false, err
 	}
 	if transactionError != nil {
-		return nil, nil, false, transactionError
+		return nil, nil, graphsync.Budget{}, false, transactionError
 	}
 	if err := qe.processDoNoSendCids(request, peerResponseSender); err != nil {
-		return nil, nil, false, err
+		return nil, nil, graphsync.Budget{}, false, err
+	}
+	if err := qe.processPartition(request, peerResponseSender); err != nil {
+		return nil, nil, graphsync.Budget{}, false, err
+	}
+	responseBudget, err := qe.processBudget(request, peerResponseSender)
+	if err != nil {
+		return nil, nil, graphsync.Budget{}, false, err
 	}
 	rootLink := cidlink.Link{Cid: request.Root()}
 	traverser := ipldutil.TraversalBuilder{
@@ -150,7 +214,7 @@ func (qe *queryExecutor) prepareQuery(ctx context.Context,
 	if loader == nil {
 		loader = qe.loader
 	}
-	return loader, traverser, isPaused, nil
+	return loader, traverser, responseBudget, isPaused, nil
 }
 
 func (qe *queryExecutor) processDoNoSendCids(request gsmsg.GraphSyncRequest, peerResponseSender peerresponsemanager.PeerResponseSender) error {
@@ -175,27 +239,71 @@ func (qe *queryExecutor) processDoNoSendCids(request gsmsg.GraphSyncRequest, pee
 	return nil
 }
 
+func (qe *queryExecutor) processPartition(request gsmsg.GraphSyncRequest, peerResponseSender peerresponsemanager.PeerResponseSender) error {
+	partitionData, has := request.Extension(graphsync.ExtensionPartition)
+	if !has {
+		return nil
+	}
+	p, err := partition.DecodePartition(partitionData)
+	if err != nil {
+		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+		return err
+	}
+	peerResponseSender.UsePartition(request.ID(), p)
+	return nil
+}
+
+func (qe *queryExecutor) processBudget(request gsmsg.GraphSyncRequest, peerResponseSender peerresponsemanager.PeerResponseSender) (graphsync.Budget, error) {
+	budgetData, has := request.Extension(graphsync.ExtensionBudget)
+	if !has {
+		return graphsync.Budget{}, nil
+	}
+	b, err := budget.DecodeBudget(budgetData)
+	if err != nil {
+		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+		return graphsync.Budget{}, err
+	}
+	return b, nil
+}
+
 func (qe *queryExecutor) executeQuery(
 	p peer.ID,
 	request gsmsg.GraphSyncRequest,
 	loader ipld.Loader,
 	traverser ipldutil.Traverser,
-	signals signals) (graphsync.ResponseStatusCode, error) {
+	signals signals,
+	stats *transferStats,
+	responseBudget graphsync.Budget) (graphsync.ResponseStatusCode, error) {
 	updateChan := make(chan []gsmsg.GraphSyncRequest)
 	peerResponseSender := qe.peerManager.SenderForPeer(p)
 	err := runtraversal.RunTraversal(loader, traverser, func(link ipld.Link, data []byte) error {
+		// the block may turn out to be one the requestor has, but checking it
+		// first means the response never goes over the budget
+		if len(data) > 0 && !responseBudget.Allows(atomic.LoadUint64(&stats.blocks)+1, atomic.LoadUint64(&stats.bytes)+uint64(len(data))) {
+			return errBudgetExceeded
+		}
 		var err error
+		var sentBytes uint64
 		_ = peerResponseSender.Transaction(request.ID(), func(transaction peerresponsemanager.PeerResponseTransactionSender) error {
 			err = qe.checkForUpdates(p, request, signals, updateChan, transaction)
-			if _, ok := err.(hooks.ErrPaused); !ok && err != nil {
+			if !isPausedErr(err) && err != nil {
 				return nil
 			}
 			blockData := transaction.SendResponse(link, data)
+			sentBytes = blockData.BlockSizeOnWire()
+			if sentBytes > 0 {
+				atomic.AddUint64(&stats.blocks, 1)
+				atomic.AddUint64(&stats.bytes, sentBytes)
+			}
 			if blockData.BlockSize() > 0 {
+				qe.metrics.BlockSent(blockData.BlockSize(), blockData.BlockSizeOnWire())
 				result := qe.blockHooks.ProcessBlockHooks(p, request, blockData)
 				for _, extension := range result.Extensions {
 					transaction.SendExtensionData(extension)
 				}
+				if result.PeerBandwidthLimit != nil {
+					qe.bandwidthLimits.SetPeerRate(p, *result.PeerBandwidthLimit)
+				}
 				if _, ok := result.Err.(hooks.ErrPaused); ok {
 					transaction.PauseRequest()
 				}
@@ -205,13 +313,23 @@ func (qe *queryExecutor) executeQuery(
 			}
 			return nil
 		})
+		if err == nil && sentBytes > 0 {
+			err = qe.takeBandwidth(p, sentBytes)
+		}
 		return err
 	})
 	if err != nil {
-		_, isPaused := err.(hooks.ErrPaused)
-		if isPaused {
+		if isPausedErr(err) {
 			return graphsync.RequestPaused, err
 		}
+		if _, isThrottled := err.(errThrottled); isThrottled {
+			return graphsync.PartialResponse, err
+		}
+		// the requestor cannot be reached, so there is no point telling it
+		if isNetworkErr(err) {
+			peerResponseSender.FinishWithCancel(request.ID())
+			return graphsync.RequestFailedUnknown, err
+		}
 		if isContextErr(err) {
 			peerResponseSender.FinishWithCancel(request.ID())
 			return graphsync.RequestCancelled, err
@@ -220,12 +338,34 @@ func (qe *queryExecutor) executeQuery(
 			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestCancelled)
 			return graphsync.RequestCancelled, err
 		}
+		if err == errBudgetExceeded {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestCompletedPartial)
+			return graphsync.RequestCompletedPartial, nil
+		}
 		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
 		return graphsync.RequestFailedUnknown, err
 	}
 	return peerResponseSender.FinishRequest(request.ID()), nil
 }
 
+// takeBandwidth records bytes sent to a peer against the bandwidth limits. If
+// the limits allow nothing more to be sent for now, it returns errThrottled,
+// so the response gives up its worker rather than waiting in it.
+func (qe *queryExecutor) takeBandwidth(p peer.ID, bytes uint64) error {
+	global, peerLimiter := qe.bandwidthLimits.Limiters(p)
+	globalChanged, peerChanged := global.Changed(), peerLimiter.Changed()
+	global.Take(bytes)
+	peerLimiter.Take(bytes)
+	delay := global.Delay()
+	if peerDelay := peerLimiter.Delay(); peerDelay > delay {
+		delay = peerDelay
+	}
+	if delay <= 0 {
+		return nil
+	}
+	return errThrottled{delay, globalChanged, peerChanged}
+}
+
 func (qe *queryExecutor) checkForUpdates(
 	p peer.ID,
 	request gsmsg.GraphSyncRequest,
@@ -234,11 +374,8 @@ func (qe *queryExecutor) checkForUpdates(
 	peerResponseSender peerresponsemanager.PeerResponseTransactionSender) error {
 	for {
 		select {
-		case selfCancelled := <-signals.stopSignal:
-			if selfCancelled {
-				return errCancelledByCommand
-			}
-			return ipldutil.ContextCancelError{}
+		case err := <-signals.stopSignal:
+			return err
 		case <-signals.pauseSignal:
 			peerResponseSender.PauseRequest()
 			return hooks.ErrPaused{}
@@ -249,6 +386,7 @@ func (qe *queryExecutor) checkForUpdates(
 			}
 			select {
 			case updates := <-updateChan:
+				pause := false
 				for _, update := range updates {
 					result := qe.updateHooks.ProcessUpdateHooks(p, request, update)
 					for _, extension := range result.Extensions {
@@ -257,6 +395,13 @@ func (qe *queryExecutor) checkForUpdates(
 					if result.Err != nil {
 						return result.Err
 					}
+					if requested, ok := pauseRequested(update); ok {
+						pause = requested
+					}
+				}
+				if pause {
+					peerResponseSender.PauseRequest()
+					return errRequestorPaused{}
 				}
 			case <-qe.ctx.Done():
 			}
@@ -266,6 +411,39 @@ func (qe *queryExecutor) checkForUpdates(
 	}
 }
 
+// pauseRequested returns whether an update asks for the response to pause or
+// to resume. ok is false if it asks for neither.
+func pauseRequested(update gsmsg.GraphSyncRequest) (pause bool, ok bool) {
+	data, has := update.Extension(graphsync.ExtensionPauseResponse)
+	if !has {
+		return false, false
+	}
+	pause, err := pauseresponse.DecodePauseResponse(data)
+	if err != nil {
+		log.Warnf("Unable to decode pause response extension: %s", err)
+		return false, false
+	}
+	return pause, true
+}
+
+func isPausedErr(err error) bool {
+	switch err.(type) {
+	case hooks.ErrPaused, errRequestorPaused:
+		return true
+	default:
+		return false
+	}
+}
+
+func isNetworkErr(err error) bool {
+	switch err.(type) {
+	case graphsync.RequestFailedNetworkErr, graphsync.RequestFailedPeerDisconnectedErr:
+		return true
+	default:
+		return false
+	}
+}
+
 func isContextErr(err error) bool {
 	// TODO: Match with errors.Is when https://github.com/ipld/go-ipld-prime/issues/58 is resolved
 	return strings.Contains(err.Error(), ipldutil.ContextCancelError{}.Error())
@@ -3,7 +3,10 @@ package responsemanager
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
@@ -11,20 +14,37 @@ import (
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metrics"
+	"github.com/ipfs/go-graphsync/ratelimit"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
+	"github.com/ipfs/go-graphsync/retryafter"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 var log = logging.Logger("graphsync")
 
 const (
-	maxInProcessRequests = 6
-	thawSpeed            = time.Millisecond * 100
+	// DefaultMaxInProcessRequests is the default number of responses that are
+	// processed at the same time
+	DefaultMaxInProcessRequests = 6
+	// DefaultThawSpeed is the default interval at which workers check the
+	// queue for responses that became ready while they were idle
+	DefaultThawSpeed = time.Millisecond * 100
+	// DefaultBusyRetryAfter is the default delay a requestor is asked to wait
+	// when its request is rejected because the queue is full
+	DefaultBusyRetryAfter = time.Second
 )
 
+type transferStats struct {
+	blocks uint64
+	bytes  uint64
+}
+
 type inProgressResponseStatus struct {
 	ctx       context.Context
 	cancelFn  func()
@@ -34,6 +54,20 @@ type inProgressResponseStatus struct {
 	signals   signals
 	updates   []gsmsg.GraphSyncRequest
 	isPaused  bool
+	isQueued  bool
+	startTime time.Time
+	stats     *transferStats
+	budget    graphsync.Budget
+	pausedAt  time.Time
+	idleTimer *time.Timer
+	// isThrottled is set while the response waits out the bandwidth limits,
+	// off the workers. throttles counts how many times that happened, so a
+	// stale wake up is ignored.
+	isThrottled bool
+	throttles   uint64
+	// requestorPaused is set while the response is paused because the
+	// requestor asked for it, so only then can the requestor resume it
+	requestorPaused bool
 }
 
 type responseKey struct {
@@ -44,7 +78,7 @@ type responseKey struct {
 type signals struct {
 	pauseSignal  chan struct{}
 	updateSignal chan struct{}
-	stopSignal   chan bool
+	stopSignal   chan error
 }
 
 type responseTaskData struct {
@@ -54,6 +88,8 @@ type responseTaskData struct {
 	loader    ipld.Loader
 	traverser ipldutil.Traverser
 	signals   signals
+	stats     *transferStats
+	budget    graphsync.Budget
 }
 
 // QueryQueue is an interface that can receive new selector query tasks
@@ -91,6 +127,19 @@ type CancelledListeners interface {
 	NotifyCancelledListeners(p peer.ID, request graphsync.RequestData)
 }
 
+// NetworkErrorListeners is an interface for notifying listeners that responses
+// ended because of network errors
+type NetworkErrorListeners interface {
+	NotifyNetworkErrorListeners(p peer.ID, request graphsync.RequestData, err error)
+}
+
+// ConnManager protects connections to peers while responses to them are in
+// progress
+type ConnManager interface {
+	Protect(peer.ID, string)
+	Unprotect(peer.ID, string) bool
+}
+
 // PeerManager is an interface that returns sender interfaces for peer responses.
 type PeerManager interface {
 	SenderForPeer(p peer.ID) peerresponsemanager.PeerResponseSender
@@ -103,17 +152,29 @@ type responseManagerMessage interface {
 // ResponseManager handles incoming requests from the network, initiates selector
 // traversals, and transmits responses
 type ResponseManager struct {
-	ctx                 context.Context
-	cancelFn            context.CancelFunc
-	peerManager         PeerManager
-	queryQueue          QueryQueue
-	updateHooks         UpdateHooks
-	cancelledListeners  CancelledListeners
-	completedListeners  CompletedListeners
-	messages            chan responseManagerMessage
-	workSignal          chan struct{}
-	qe                  *queryExecutor
-	inProgressResponses map[responseKey]*inProgressResponseStatus
+	ctx                   context.Context
+	cancelFn              context.CancelFunc
+	peerManager           PeerManager
+	queryQueue            QueryQueue
+	updateHooks           UpdateHooks
+	cancelledListeners    CancelledListeners
+	networkErrorListeners NetworkErrorListeners
+	completedListeners    CompletedListeners
+	messages              chan responseManagerMessage
+	workSignal            chan struct{}
+	qe                    *queryExecutor
+	inProgressResponses   map[responseKey]*inProgressResponseStatus
+	queuedResponses       int
+	queuedByPeer          map[peer.ID]int
+	metrics               metrics.Metrics
+	connManager           ConnManager
+	maxInProcess          int
+	maxQueued             int
+	maxQueuedPerPeer      int
+	busyRetryAfter        time.Duration
+	pausedIdleTimeout     time.Duration
+	draining              bool
+	drainedWaiters        []chan struct{}
 }
 
 // New creates a new response manager from the given context, loader,
@@ -132,34 +193,105 @@ func New(ctx context.Context,
 	messages := make(chan responseManagerMessage, 16)
 	workSignal := make(chan struct{}, 1)
 	qe := &queryExecutor{
-		requestHooks:       requestHooks,
-		blockHooks:         blockHooks,
-		updateHooks:        updateHooks,
-		completedListeners: completedListeners,
-		cancelledListeners: cancelledListeners,
-		peerManager:        peerManager,
-		loader:             loader,
-		queryQueue:         queryQueue,
-		messages:           messages,
-		ctx:                ctx,
-		workSignal:         workSignal,
-		ticker:             time.NewTicker(thawSpeed),
+		requestHooks:          requestHooks,
+		blockHooks:            blockHooks,
+		updateHooks:           updateHooks,
+		completedListeners:    completedListeners,
+		cancelledListeners:    cancelledListeners,
+		networkErrorListeners: hooks.NewNetworkErrorListeners(),
+		peerManager:           peerManager,
+		loader:                loader,
+		queryQueue:            queryQueue,
+		messages:              messages,
+		ctx:                   ctx,
+		workSignal:            workSignal,
+		ticker:                time.NewTicker(DefaultThawSpeed),
+		metrics:               metrics.NewNoop(),
+		bandwidthLimits:       ratelimit.NewLimits(0, 0),
 	}
 	return &ResponseManager{
-		ctx:                 ctx,
-		cancelFn:            cancelFn,
-		peerManager:         peerManager,
-		queryQueue:          queryQueue,
-		updateHooks:         updateHooks,
-		completedListeners:  completedListeners,
-		cancelledListeners:  cancelledListeners,
-		messages:            messages,
-		workSignal:          workSignal,
-		qe:                  qe,
-		inProgressResponses: make(map[responseKey]*inProgressResponseStatus),
+		ctx:                   ctx,
+		cancelFn:              cancelFn,
+		peerManager:           peerManager,
+		queryQueue:            queryQueue,
+		updateHooks:           updateHooks,
+		completedListeners:    completedListeners,
+		cancelledListeners:    cancelledListeners,
+		networkErrorListeners: qe.networkErrorListeners,
+		messages:              messages,
+		workSignal:            workSignal,
+		qe:                    qe,
+		inProgressResponses:   make(map[responseKey]*inProgressResponseStatus),
+		queuedByPeer:          make(map[peer.ID]int),
+		metrics:               metrics.NewNoop(),
+		connManager:           connmgr.NullConnMgr{},
+		maxInProcess:          DefaultMaxInProcessRequests,
+		busyRetryAfter:        DefaultBusyRetryAfter,
 	}
 }
 
+// SetMetrics specifies where measurements for responses are reported. It must
+// be called before the response manager starts.
+func (rm *ResponseManager) SetMetrics(metrics metrics.Metrics) {
+	rm.metrics = metrics
+	rm.qe.metrics = metrics
+}
+
+// SetNetworkErrorListeners specifies what is told about responses that end
+// because the requestor cannot be reached. It must be called before the
+// response manager starts.
+func (rm *ResponseManager) SetNetworkErrorListeners(networkErrorListeners NetworkErrorListeners) {
+	rm.networkErrorListeners = networkErrorListeners
+	rm.qe.networkErrorListeners = networkErrorListeners
+}
+
+// SetConnManager specifies what protects connections to peers while responses
+// to them are in progress. It must be called before the response manager
+// starts.
+func (rm *ResponseManager) SetConnManager(connManager ConnManager) {
+	rm.connManager = connManager
+}
+
+// SetMaxInProcessRequests sets how many responses are processed at the same
+// time. It must be called before the response manager starts.
+func (rm *ResponseManager) SetMaxInProcessRequests(maxInProcess int) {
+	rm.maxInProcess = maxInProcess
+}
+
+// SetQueueLimits sets how many responses may wait in the queue in total and
+// for a single peer. New requests past either limit are rejected with
+// RequestFailedBusy, asking the requestor to retry after the given delay. A
+// limit of zero means no limit. It must be called before the response manager
+// starts.
+func (rm *ResponseManager) SetQueueLimits(maxQueued int, maxQueuedPerPeer int, retryAfter time.Duration) {
+	rm.maxQueued = maxQueued
+	rm.maxQueuedPerPeer = maxQueuedPerPeer
+	rm.busyRetryAfter = retryAfter
+}
+
+// SetBandwidthLimits sets how many block bytes per second may be sent across
+// all peers, and to each peer. A limit of zero means no limit. Hooks may later
+// change the limit for a peer. It must be called before the response manager
+// starts.
+func (rm *ResponseManager) SetBandwidthLimits(global uint64, perPeer uint64) {
+	rm.qe.bandwidthLimits = ratelimit.NewLimits(global, perPeer)
+}
+
+// SetPausedResponseIdleTimeout sets how long a paused response waits to be
+// unpaused before it is cancelled, sending RequestCancelled to the requestor.
+// Zero means paused responses wait forever. It must be called before the
+// response manager starts.
+func (rm *ResponseManager) SetPausedResponseIdleTimeout(timeout time.Duration) {
+	rm.pausedIdleTimeout = timeout
+}
+
+// SetThawSpeed sets how often idle workers check the queue for new work. It
+// must be called before the response manager starts.
+func (rm *ResponseManager) SetThawSpeed(thawSpeed time.Duration) {
+	rm.qe.ticker.Stop()
+	rm.qe.ticker = time.NewTicker(thawSpeed)
+}
+
 type processRequestMessage struct {
 	p        peer.ID
 	requests []gsmsg.GraphSyncRequest
@@ -211,6 +343,30 @@ func (rm *ResponseManager) CancelResponse(p peer.ID, requestID graphsync.Request
 	return rm.sendSyncMessage(&cancelRequestMessage{p, requestID, response}, response)
 }
 
+type networkErrorMessage struct {
+	p          peer.ID
+	requestIDs []graphsync.RequestID
+	err        error
+}
+
+// ProcessNetworkError ends responses to a peer after messages for them could
+// not be sent. If no request IDs are given, every response to the peer ends.
+func (rm *ResponseManager) ProcessNetworkError(p peer.ID, requestIDs []graphsync.RequestID, err error) {
+	rm.sendNetworkErrorMessage(&networkErrorMessage{p, requestIDs, graphsync.RequestFailedNetworkErr{Peer: p, Err: err}})
+}
+
+// Disconnected ends every response to a peer that disconnected
+func (rm *ResponseManager) Disconnected(p peer.ID) {
+	rm.sendNetworkErrorMessage(&networkErrorMessage{p, nil, graphsync.RequestFailedPeerDisconnectedErr{Peer: p}})
+}
+
+func (rm *ResponseManager) sendNetworkErrorMessage(message *networkErrorMessage) {
+	select {
+	case rm.messages <- message:
+	case <-rm.ctx.Done():
+	}
+}
+
 func (rm *ResponseManager) sendSyncMessage(message responseManagerMessage, response chan error) error {
 	select {
 	case <-rm.ctx.Done():
@@ -225,6 +381,64 @@ func (rm *ResponseManager) sendSyncMessage(message responseManagerMessage, respo
 	}
 }
 
+type responseStatesMessage struct {
+	response chan []graphsync.RequestState
+}
+
+// InProgressResponses returns a snapshot of the state of all in progress
+// responses, ordered by peer and request ID
+func (rm *ResponseManager) InProgressResponses() []graphsync.RequestState {
+	response := make(chan []graphsync.RequestState, 1)
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case rm.messages <- &responseStatesMessage{response}:
+	}
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case responseStates := <-response:
+		return responseStates
+	}
+}
+
+type drainMessage struct {
+	drained chan struct{}
+}
+
+// Drain stops accepting new requests, rejecting them with RequestFailedBusy,
+// and waits until all in progress responses finish. It returns an error if
+// the context ends first.
+func (rm *ResponseManager) Drain(ctx context.Context) error {
+	drained := make(chan struct{})
+	select {
+	case <-rm.ctx.Done():
+		return errors.New("Context Cancelled")
+	case <-ctx.Done():
+		return ctx.Err()
+	case rm.messages <- &drainMessage{drained}:
+	}
+	select {
+	case <-rm.ctx.Done():
+		return errors.New("Context Cancelled")
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-drained:
+		return nil
+	}
+}
+
+type cancelAllMessage struct{}
+
+// CancelAll cancels all in progress responses, sending RequestCancelled to
+// the requestors
+func (rm *ResponseManager) CancelAll() {
+	select {
+	case <-rm.ctx.Done():
+	case rm.messages <- &cancelAllMessage{}:
+	}
+}
+
 type synchronizeMessage struct {
 	sync chan error
 }
@@ -250,6 +464,7 @@ type setResponseDataRequest struct {
 	key       responseKey
 	loader    ipld.Loader
 	traverser ipldutil.Traverser
+	budget    graphsync.Budget
 }
 
 type responseUpdateRequest struct {
@@ -268,14 +483,15 @@ func (rm *ResponseManager) Shutdown() {
 }
 
 func (rm *ResponseManager) cleanupInProcessResponses() {
-	for _, response := range rm.inProgressResponses {
+	for key, response := range rm.inProgressResponses {
 		response.cancelFn()
+		rm.connManager.Unprotect(key.p, connTag(key.requestID))
 	}
 }
 
 func (rm *ResponseManager) run() {
 	defer rm.cleanupInProcessResponses()
-	for i := 0; i < maxInProcessRequests; i++ {
+	for i := 0; i < rm.maxInProcess; i++ {
 		go rm.qe.processQueriesWorker()
 	}
 
@@ -285,10 +501,62 @@ func (rm *ResponseManager) run() {
 			return
 		case message := <-rm.messages:
 			message.handle(rm)
+			rm.checkDrained()
 		}
 	}
 }
 
+func (rm *ResponseManager) checkDrained() {
+	if !rm.draining || len(rm.inProgressResponses) > 0 {
+		return
+	}
+	for _, drained := range rm.drainedWaiters {
+		close(drained)
+	}
+	rm.drainedWaiters = nil
+}
+
+func (rm *ResponseManager) setQueued(p peer.ID, response *inProgressResponseStatus, isQueued bool) {
+	if response.isQueued == isQueued {
+		return
+	}
+	response.isQueued = isQueued
+	if isQueued {
+		rm.queuedResponses++
+		rm.queuedByPeer[p]++
+	} else {
+		rm.queuedResponses--
+		rm.queuedByPeer[p]--
+		if rm.queuedByPeer[p] == 0 {
+			delete(rm.queuedByPeer, p)
+		}
+	}
+	rm.metrics.ResponsesWaiting(rm.queuedResponses)
+}
+
+func (rm *ResponseManager) queueIsFull(p peer.ID) bool {
+	if rm.maxQueued > 0 && rm.queuedResponses >= rm.maxQueued {
+		return true
+	}
+	return rm.maxQueuedPerPeer > 0 && rm.queuedByPeer[p] >= rm.maxQueuedPerPeer
+}
+
+func (rm *ResponseManager) rejectBusy(p peer.ID, requestID graphsync.RequestID) {
+	peerResponseSender := rm.peerManager.SenderForPeer(p)
+	_ = peerResponseSender.Transaction(requestID, func(transaction peerresponsemanager.PeerResponseTransactionSender) error {
+		if rm.busyRetryAfter > 0 {
+			retryAfterData, err := retryafter.EncodeRetryAfter(rm.busyRetryAfter)
+			if err != nil {
+				log.Warnf("Unable to encode retry after: %s", err)
+			} else {
+				transaction.SendExtensionData(graphsync.ExtensionData{Name: graphsync.ExtensionRetryAfter, Data: retryAfterData})
+			}
+		}
+		transaction.FinishWithError(graphsync.RequestFailedBusy)
+		return nil
+	})
+}
+
 func (rm *ResponseManager) processUpdate(key responseKey, update gsmsg.GraphSyncRequest) {
 	response, ok := rm.inProgressResponses[key]
 	if !ok {
@@ -318,11 +586,13 @@ func (rm *ResponseManager) processUpdate(key responseKey, update gsmsg.GraphSync
 		log.Errorf("Error processing update: %s", err)
 	}
 	if result.Err != nil {
-		delete(rm.inProgressResponses, key)
-		response.cancelFn()
+		rm.metrics.ResponseCompleted(graphsync.RequestFailedUnknown)
+		rm.removeResponse(key, response)
 		return
 	}
-	if result.Unpause {
+	pause, ok := pauseRequested(update)
+	resume := ok && !pause && response.requestorPaused
+	if result.Unpause || resume {
 		err := rm.unpauseRequest(key.p, key.requestID)
 		if err != nil {
 			log.Warnf("error unpausing request: %s", err.Error())
@@ -341,6 +611,10 @@ func (rm *ResponseManager) unpauseRequest(p peer.ID, requestID graphsync.Request
 		return errors.New("request is not paused")
 	}
 	inProgressResponse.isPaused = false
+	inProgressResponse.requestorPaused = false
+	if inProgressResponse.idleTimer != nil {
+		inProgressResponse.idleTimer.Stop()
+	}
 	if len(extensions) > 0 {
 		peerResponseSender := rm.peerManager.SenderForPeer(key.p)
 		_ = peerResponseSender.Transaction(requestID, func(transaction peerresponsemanager.PeerResponseTransactionSender) error {
@@ -351,6 +625,7 @@ func (rm *ResponseManager) unpauseRequest(p peer.ID, requestID graphsync.Request
 		})
 	}
 	rm.queryQueue.PushTasks(p, peertask.Task{Topic: key, Priority: math.MaxInt32, Work: 1})
+	rm.setQueued(p, inProgressResponse, true)
 	select {
 	case rm.workSignal <- struct{}{}:
 	default:
@@ -365,8 +640,11 @@ func (rm *ResponseManager) cancelRequest(p peer.ID, requestID graphsync.RequestI
 	if !ok {
 		return errors.New("could not find request")
 	}
+	// a response waiting in the queue is not running, so it can finish here
+	wasQueued := response.isQueued
+	rm.setQueued(key.p, response, false)
 
-	if response.isPaused {
+	if response.isPaused || response.isThrottled || wasQueued {
 		peerResponseSender := rm.peerManager.SenderForPeer(key.p)
 		if selfCancel {
 			rm.completedListeners.NotifyCompletedListeners(p, response.request, graphsync.RequestCancelled)
@@ -375,17 +653,58 @@ func (rm *ResponseManager) cancelRequest(p peer.ID, requestID graphsync.RequestI
 			rm.cancelledListeners.NotifyCancelledListeners(p, response.request)
 			peerResponseSender.FinishWithCancel(requestID)
 		}
-		delete(rm.inProgressResponses, key)
-		response.cancelFn()
+		rm.metrics.ResponseCompleted(graphsync.RequestCancelled)
+		rm.removeResponse(key, response)
 		return nil
 	}
+	var stopErr error = ipldutil.ContextCancelError{}
+	if selfCancel {
+		stopErr = errCancelledByCommand
+	}
 	select {
-	case response.signals.stopSignal <- selfCancel:
+	case response.signals.stopSignal <- stopErr:
 	default:
 	}
 	return nil
 }
 
+func (nem *networkErrorMessage) handle(rm *ResponseManager) {
+	if nem.requestIDs == nil {
+		for key, response := range rm.inProgressResponses {
+			if key.p == nem.p {
+				rm.failResponse(key, response, nem.err)
+			}
+		}
+		return
+	}
+	for _, requestID := range nem.requestIDs {
+		key := responseKey{nem.p, requestID}
+		if response, ok := rm.inProgressResponses[key]; ok {
+			rm.failResponse(key, response, nem.err)
+		}
+	}
+}
+
+// failResponse ends a response that can no longer reach its requestor, without
+// sending anything more to it
+func (rm *ResponseManager) failResponse(key responseKey, response *inProgressResponseStatus, err error) {
+	rm.queryQueue.Remove(key, key.p)
+	wasQueued := response.isQueued
+	rm.setQueued(key.p, response, false)
+
+	if response.isPaused || response.isThrottled || wasQueued {
+		rm.networkErrorListeners.NotifyNetworkErrorListeners(key.p, response.request, err)
+		rm.peerManager.SenderForPeer(key.p).FinishWithCancel(key.requestID)
+		rm.metrics.ResponseCompleted(graphsync.RequestFailedUnknown)
+		rm.removeResponse(key, response)
+		return
+	}
+	select {
+	case response.signals.stopSignal <- err:
+	default:
+	}
+}
+
 func (prm *processRequestMessage) handle(rm *ResponseManager) {
 	for _, request := range prm.requests {
 		key := responseKey{p: prm.p, requestID: request.ID()}
@@ -397,20 +716,33 @@ func (prm *processRequestMessage) handle(rm *ResponseManager) {
 			rm.processUpdate(key, request)
 			continue
 		}
+		if rm.draining {
+			rm.peerManager.SenderForPeer(prm.p).FinishWithError(request.ID(), graphsync.RequestFailedBusy)
+			continue
+		}
+		if rm.queueIsFull(prm.p) {
+			rm.rejectBusy(prm.p, request.ID())
+			continue
+		}
 		ctx, cancelFn := context.WithCancel(rm.ctx)
-		rm.inProgressResponses[key] =
-			&inProgressResponseStatus{
-				ctx:      ctx,
-				cancelFn: cancelFn,
-				request:  request,
-				signals: signals{
-					pauseSignal:  make(chan struct{}, 1),
-					updateSignal: make(chan struct{}, 1),
-					stopSignal:   make(chan bool, 1),
-				},
-			}
+		response := &inProgressResponseStatus{
+			ctx:       ctx,
+			cancelFn:  cancelFn,
+			request:   request,
+			startTime: time.Now(),
+			stats:     &transferStats{},
+			signals: signals{
+				pauseSignal:  make(chan struct{}, 1),
+				updateSignal: make(chan struct{}, 1),
+				stopSignal:   make(chan error, 1),
+			},
+		}
+		rm.inProgressResponses[key] = response
+		rm.connManager.Protect(prm.p, connTag(request.ID()))
+		rm.metrics.ResponseStarted()
 		// TODO: Use a better work estimation metric.
 		rm.queryQueue.PushTasks(prm.p, peertask.Task{Topic: key, Priority: int(request.Priority()), Work: 1})
+		rm.setQueued(prm.p, response, true)
 		select {
 		case rm.workSignal <- struct{}{}:
 		default:
@@ -422,7 +754,8 @@ func (rdr *responseDataRequest) handle(rm *ResponseManager) {
 	response, ok := rm.inProgressResponses[rdr.key]
 	var taskData responseTaskData
 	if ok {
-		taskData = responseTaskData{false, response.ctx, response.request, response.loader, response.traverser, response.signals}
+		rm.setQueued(rdr.key.p, response, false)
+		taskData = responseTaskData{false, response.ctx, response.request, response.loader, response.traverser, response.signals, response.stats, response.budget}
 	} else {
 		taskData = responseTaskData{empty: true}
 	}
@@ -437,15 +770,142 @@ func (ftr *finishTaskRequest) handle(rm *ResponseManager) {
 	if !ok {
 		return
 	}
-	if _, ok := ftr.err.(hooks.ErrPaused); ok {
+	if isPausedErr(ftr.err) {
 		response.isPaused = true
+		_, response.requestorPaused = ftr.err.(errRequestorPaused)
+		// the response may have been stopped as it paused, without seeing it
+		select {
+		case stopErr := <-response.signals.stopSignal:
+			rm.stopPausedResponse(ftr.key, response, stopErr)
+			return
+		default:
+		}
+		rm.startIdleTimer(ftr.key, response)
+		return
+	}
+	if throttled, ok := ftr.err.(errThrottled); ok {
+		rm.throttleResponse(ftr.key, response, throttled)
 		return
 	}
 	if ftr.err != nil {
 		log.Infof("response failed: %w", ftr.err)
 	}
-	delete(rm.inProgressResponses, ftr.key)
+	rm.metrics.ResponseCompleted(ftr.status)
+	rm.removeResponse(ftr.key, response)
+}
+
+// stopPausedResponse ends a paused response the way the error it was stopped
+// with would have ended it while it ran
+func (rm *ResponseManager) stopPausedResponse(key responseKey, response *inProgressResponseStatus, stopErr error) {
+	if _, ok := stopErr.(ipldutil.ContextCancelError); ok {
+		_ = rm.cancelRequest(key.p, key.requestID, false)
+		return
+	}
+	if stopErr == errCancelledByCommand {
+		_ = rm.cancelRequest(key.p, key.requestID, true)
+		return
+	}
+	rm.failResponse(key, response, stopErr)
+}
+
+// connTag is the tag protecting the connection to a peer while a response to
+// it is in progress
+func connTag(requestID graphsync.RequestID) string {
+	return fmt.Sprintf("graphsync-response-%d", requestID)
+}
+
+// startIdleTimer arranges for a paused response to be cancelled if it is
+// still paused once the idle timeout passes
+func (rm *ResponseManager) startIdleTimer(key responseKey, response *inProgressResponseStatus) {
+	if rm.pausedIdleTimeout <= 0 {
+		return
+	}
+	response.pausedAt = time.Now()
+	if response.idleTimer != nil {
+		response.idleTimer.Reset(rm.pausedIdleTimeout)
+		return
+	}
+	response.idleTimer = time.AfterFunc(rm.pausedIdleTimeout, func() {
+		select {
+		case rm.messages <- &idleTimeoutMessage{key}:
+		case <-rm.ctx.Done():
+		}
+	})
+}
+
+// removeResponse stops tracking a response, and forgets the bandwidth limit
+// for its peer once the peer has no responses left
+func (rm *ResponseManager) removeResponse(key responseKey, response *inProgressResponseStatus) {
+	delete(rm.inProgressResponses, key)
 	response.cancelFn()
+	rm.connManager.Unprotect(key.p, connTag(key.requestID))
+	if response.idleTimer != nil {
+		response.idleTimer.Stop()
+	}
+	for otherKey := range rm.inProgressResponses {
+		if otherKey.p == key.p {
+			return
+		}
+	}
+	rm.qe.bandwidthLimits.ForgetPeer(key.p)
+}
+
+// throttleResponse holds a response back until the bandwidth limits allow it
+// to send again, or their rates change, then queues it again
+func (rm *ResponseManager) throttleResponse(key responseKey, response *inProgressResponseStatus, throttled errThrottled) {
+	response.isThrottled = true
+	response.throttles++
+	throttles := response.throttles
+	ctx := response.ctx
+	go func() {
+		timer := time.NewTimer(throttled.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-throttled.globalChanged:
+		case <-throttled.peerChanged:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case rm.messages <- &throttleEndedMessage{key, throttles}:
+		case <-rm.ctx.Done():
+		}
+	}()
+}
+
+type throttleEndedMessage struct {
+	key       responseKey
+	throttles uint64
+}
+
+func (tem *throttleEndedMessage) handle(rm *ResponseManager) {
+	response, ok := rm.inProgressResponses[tem.key]
+	// the response may have been paused, or throttled again, since then
+	if !ok || !response.isThrottled || response.throttles != tem.throttles {
+		return
+	}
+	response.isThrottled = false
+	rm.queryQueue.PushTasks(tem.key.p, peertask.Task{Topic: tem.key, Priority: math.MaxInt32, Work: 1})
+	rm.setQueued(tem.key.p, response, true)
+	select {
+	case rm.workSignal <- struct{}{}:
+	default:
+	}
+}
+
+type idleTimeoutMessage struct {
+	key responseKey
+}
+
+func (itm *idleTimeoutMessage) handle(rm *ResponseManager) {
+	response, ok := rm.inProgressResponses[itm.key]
+	// the response may have been unpaused, or paused again, since the timer fired
+	if !ok || !response.isPaused || time.Since(response.pausedAt) < rm.pausedIdleTimeout {
+		return
+	}
+	log.Infof("cancelling response to peer %s, request ID %d: paused for longer than %s", itm.key.p.Pretty(), itm.key.requestID, rm.pausedIdleTimeout)
+	_ = rm.cancelRequest(itm.key.p, itm.key.requestID, true)
 }
 
 func (srdr *setResponseDataRequest) handle(rm *ResponseManager) {
@@ -455,6 +915,7 @@ func (srdr *setResponseDataRequest) handle(rm *ResponseManager) {
 	}
 	response.loader = srdr.loader
 	response.traverser = srdr.traverser
+	response.budget = srdr.budget
 }
 
 func (rur *responseUpdateRequest) handle(rm *ResponseManager) {
@@ -472,6 +933,42 @@ func (rur *responseUpdateRequest) handle(rm *ResponseManager) {
 	}
 }
 
+func (rsm *responseStatesMessage) handle(rm *ResponseManager) {
+	responseStates := make([]graphsync.RequestState, 0, len(rm.inProgressResponses))
+	for key, response := range rm.inProgressResponses {
+		responseStates = append(responseStates, graphsync.RequestState{
+			Peer:      key.p,
+			RequestID: key.requestID,
+			Root:      cidlink.Link{Cid: response.request.Root()},
+			Paused:    response.isPaused,
+			Blocks:    atomic.LoadUint64(&response.stats.blocks),
+			Bytes:     atomic.LoadUint64(&response.stats.bytes),
+			StartTime: response.startTime,
+		})
+	}
+	sort.Slice(responseStates, func(i, j int) bool {
+		if responseStates[i].Peer != responseStates[j].Peer {
+			return responseStates[i].Peer < responseStates[j].Peer
+		}
+		return responseStates[i].RequestID < responseStates[j].RequestID
+	})
+	select {
+	case <-rm.ctx.Done():
+	case rsm.response <- responseStates:
+	}
+}
+
+func (dm *drainMessage) handle(rm *ResponseManager) {
+	rm.draining = true
+	rm.drainedWaiters = append(rm.drainedWaiters, dm.drained)
+}
+
+func (cam *cancelAllMessage) handle(rm *ResponseManager) {
+	for key := range rm.inProgressResponses {
+		_ = rm.cancelRequest(key.p, key.requestID, true)
+	}
+}
+
 func (sm *synchronizeMessage) handle(rm *ResponseManager) {
 	select {
 	case <-rm.ctx.Done():
@@ -496,6 +993,14 @@ func (prm *pauseRequestMessage) pauseRequest(rm *ResponseManager) error {
 	if inProgressResponse.isPaused {
 		return errors.New("request is already paused")
 	}
+	// a throttled response is not running, so it can pause here
+	if inProgressResponse.isThrottled {
+		inProgressResponse.isThrottled = false
+		inProgressResponse.isPaused = true
+		rm.peerManager.SenderForPeer(key.p).PauseRequest(key.requestID)
+		rm.startIdleTimer(key, inProgressResponse)
+		return nil
+	}
 	select {
 	case inProgressResponse.signals.pauseSignal <- struct{}{}:
 	default:
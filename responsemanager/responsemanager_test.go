@@ -10,11 +10,16 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/additionalpeers"
+	"github.com/ipfs/go-graphsync/budget"
 	"github.com/ipfs/go-graphsync/cidset"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/partition"
+	"github.com/ipfs/go-graphsync/pauseresponse"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/persistenceoptions"
+	"github.com/ipfs/go-graphsync/retryafter"
 	"github.com/ipfs/go-graphsync/selectorvalidator"
 	"github.com/ipfs/go-graphsync/testutil"
 	"github.com/ipfs/go-peertaskqueue/peertask"
@@ -22,6 +27,8 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
 
@@ -113,6 +120,7 @@ type fakePeerResponseSender struct {
 	pausedRequests       chan pausedRequest
 	cancelledRequests    chan cancelledRequest
 	ignoredLinks         chan []ipld.Link
+	partitions           chan partition.Partition
 }
 
 func (fprs *fakePeerResponseSender) Startup()  {}
@@ -127,6 +135,10 @@ func (fprs *fakePeerResponseSender) IgnoreBlocks(requestID graphsync.RequestID,
 	fprs.ignoredLinks <- links
 }
 
+func (fprs *fakePeerResponseSender) UsePartition(requestID graphsync.RequestID, p partition.Partition) {
+	fprs.partitions <- p
+}
+
 func (fbd fakeBlkData) Link() ipld.Link {
 	return fbd.link
 }
@@ -155,6 +167,13 @@ func (fprs *fakePeerResponseSender) SendExtensionData(
 	fprs.sentExtensions <- sentExtension{requestID, extension}
 }
 
+func (fprs *fakePeerResponseSender) SendAdditionalPeers(
+	requestID graphsync.RequestID,
+	extension graphsync.ExtensionData,
+) {
+	fprs.sentExtensions <- sentExtension{requestID, extension}
+}
+
 func (fprs *fakePeerResponseSender) FinishRequest(requestID graphsync.RequestID) graphsync.ResponseStatusCode {
 	fprs.lastCompletedRequest <- completedRequest{requestID, graphsync.RequestCompletedFull}
 	return graphsync.RequestCompletedFull
@@ -190,6 +209,10 @@ func (fprts *fakePeerResponseTransactionSender) SendExtensionData(extension grap
 	fprts.prs.SendExtensionData(fprts.requestID, extension)
 }
 
+func (fprts *fakePeerResponseTransactionSender) SendAdditionalPeers(extension graphsync.ExtensionData) {
+	fprts.prs.SendAdditionalPeers(fprts.requestID, extension)
+}
+
 func (fprts *fakePeerResponseTransactionSender) FinishRequest() graphsync.ResponseStatusCode {
 	return fprts.prs.FinishRequest(fprts.requestID)
 }
@@ -348,6 +371,378 @@ func TestEarlyCancellation(t *testing.T) {
 	testutil.AssertDoesReceiveFirst(t, timer.C, "should not process more responses", td.sentResponses, td.completedRequestChan)
 }
 
+func TestDrainAndCancelAll(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	td.queryQueue.popWait.Add(1)
+	defer td.queryQueue.popWait.Done()
+	responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	responseManager.Startup()
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+
+	// the response is stuck in the queue, so draining times out
+	drainCtx, drainCancel := context.WithTimeout(td.ctx, 50*time.Millisecond)
+	defer drainCancel()
+	err := responseManager.Drain(drainCtx)
+	require.EqualError(t, err, context.DeadlineExceeded.Error())
+
+	// new requests are rejected while draining
+	newRequestID := td.requestID + 1
+	newRequests := []gsmsg.GraphSyncRequest{
+		gsmsg.NewRequest(newRequestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0)),
+	}
+	responseManager.ProcessRequests(td.ctx, td.p, newRequests)
+	var rejected completedRequest
+	testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &rejected, "should reject request")
+	require.Equal(t, completedRequest{newRequestID, graphsync.RequestFailedBusy}, rejected)
+
+	// cancelling finishes the remaining response
+	responseManager.CancelAll()
+	var cancelled completedRequest
+	testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &cancelled, "should cancel request")
+	require.Equal(t, completedRequest{td.requestID, graphsync.RequestCancelled}, cancelled)
+
+	err = responseManager.Drain(td.ctx)
+	require.NoError(t, err)
+}
+
+func TestNetworkErrors(t *testing.T) {
+	t.Run("ends a response in progress", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.SetNetworkErrorListeners(td.networkErrorListeners)
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		// hold the response after its first block until the error arrives
+		blockSent := make(chan struct{}, 1)
+		release := make(chan struct{})
+		td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+			select {
+			case blockSent <- struct{}{}:
+				<-release
+			default:
+			}
+		})
+		networkErrors := make(chan error, 1)
+		td.networkErrorListeners.Register(func(p peer.ID, request graphsync.RequestData, err error) {
+			require.Equal(t, td.p, p)
+			require.Equal(t, td.requestID, request.ID())
+			networkErrors <- err
+		})
+		cancelledListenerCalled := make(chan struct{}, 1)
+		td.cancelledListeners.Register(func(p peer.ID, request graphsync.RequestData) {
+			cancelledListenerCalled <- struct{}{}
+		})
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, blockSent, "should send a block")
+
+		sendErr := errors.New("stream reset")
+		responseManager.ProcessNetworkError(td.p, []graphsync.RequestID{td.requestID}, sendErr)
+		responseManager.synchronize()
+		close(release)
+
+		var err error
+		testutil.AssertReceive(td.ctx, t, networkErrors, &err, "should call network error listener")
+		require.Equal(t, graphsync.RequestFailedNetworkErr{Peer: td.p, Err: sendErr}, err)
+		testutil.AssertDoesReceive(td.ctx, t, td.cancelledRequests, "should stop the response without sending")
+		testutil.AssertChannelEmpty(t, td.completedRequestChan, "should not send a final status")
+		testutil.AssertChannelEmpty(t, cancelledListenerCalled, "should not call cancelled listener")
+	})
+	t.Run("ends a paused response when the peer disconnects", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.SetNetworkErrorListeners(td.networkErrorListeners)
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.PauseResponse()
+		})
+		networkErrors := make(chan error, 1)
+		td.networkErrorListeners.Register(func(p peer.ID, request graphsync.RequestData, err error) {
+			networkErrors <- err
+		})
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, td.pausedRequests, "should pause immediately")
+
+		responseManager.Disconnected(td.p)
+		var err error
+		testutil.AssertReceive(td.ctx, t, networkErrors, &err, "should call network error listener")
+		require.Equal(t, graphsync.RequestFailedPeerDisconnectedErr{Peer: td.p}, err)
+		testutil.AssertDoesReceive(td.ctx, t, td.cancelledRequests, "should stop the response without sending")
+		require.Empty(t, responseManager.InProgressResponses())
+		require.Error(t, responseManager.UnpauseResponse(td.p, td.requestID), "ended response should not unpause")
+	})
+}
+
+func TestPausedResponseIdleTimeout(t *testing.T) {
+	setup := func(t *testing.T, td testData) *ResponseManager {
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.SetPausedResponseIdleTimeout(100 * time.Millisecond)
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.PauseResponse()
+		})
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, td.pausedRequests, "should pause immediately")
+		return responseManager
+	}
+
+	t.Run("cancels a response that stays paused", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := setup(t, td)
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should cancel the paused response")
+		require.Equal(t, graphsync.RequestCancelled, lastRequest.result)
+		require.Empty(t, responseManager.InProgressResponses())
+		require.Error(t, responseManager.UnpauseResponse(td.p, td.requestID), "cancelled response should not unpause")
+	})
+
+	t.Run("a response unpaused in time finishes", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := setup(t, td)
+		require.NoError(t, responseManager.UnpauseResponse(td.p, td.requestID))
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should complete request")
+		require.True(t, gsmsg.IsTerminalSuccessCode(lastRequest.result), "request should succeed")
+		timer := time.NewTimer(200 * time.Millisecond)
+		testutil.AssertDoesReceiveFirst(t, timer.C, "should not cancel after the response finished", td.completedRequestChan)
+	})
+}
+
+func TestProtectsPeersWithActiveResponses(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+	responseManager.SetConnManager(td.connManager)
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.ValidateRequest()
+		hookActions.PauseResponse()
+	})
+	responseManager.Startup()
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+	testutil.AssertDoesReceive(td.ctx, t, td.pausedRequests, "should pause immediately")
+	require.True(t, td.connManager.IsProtected(td.p, connTag(td.requestID)))
+
+	require.NoError(t, responseManager.UnpauseResponse(td.p, td.requestID))
+	testutil.AssertDoesReceive(td.ctx, t, td.completedRequestChan, "should complete request")
+	require.Eventually(t, func() bool {
+		return !td.connManager.IsProtected(td.p, "")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueLimits(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	// keep every response waiting in the queue
+	td.queryQueue.popWait.Add(1)
+	defer td.queryQueue.popWait.Done()
+	responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+	responseManager.SetQueueLimits(3, 2, 2*time.Second)
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	responseManager.Startup()
+
+	root := td.blockChain.TipLink.(cidlink.Link).Cid
+	newRequest := func(id graphsync.RequestID) []gsmsg.GraphSyncRequest {
+		return []gsmsg.GraphSyncRequest{gsmsg.NewRequest(id, root, td.blockChain.Selector(), graphsync.Priority(0))}
+	}
+	verifyRejected := func(id graphsync.RequestID) {
+		var sentExtension sentExtension
+		testutil.AssertReceive(td.ctx, t, td.sentExtensions, &sentExtension, "should send retry after")
+		require.Equal(t, id, sentExtension.requestID)
+		require.Equal(t, graphsync.ExtensionRetryAfter, sentExtension.extension.Name)
+		retryAfter, err := retryafter.DecodeRetryAfter(sentExtension.extension.Data)
+		require.NoError(t, err)
+		require.Equal(t, 2*time.Second, retryAfter)
+		var rejected completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &rejected, "should reject request")
+		require.Equal(t, completedRequest{id, graphsync.RequestFailedBusy}, rejected)
+	}
+
+	// the per peer limit rejects a third request from the same peer
+	responseManager.ProcessRequests(td.ctx, td.p, newRequest(1))
+	responseManager.ProcessRequests(td.ctx, td.p, newRequest(2))
+	responseManager.ProcessRequests(td.ctx, td.p, newRequest(3))
+	verifyRejected(3)
+
+	// another peer can still queue until the global limit is reached
+	otherPeer := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(td.ctx, otherPeer, newRequest(4))
+	responseManager.ProcessRequests(td.ctx, otherPeer, newRequest(5))
+	verifyRejected(5)
+	require.Len(t, responseManager.InProgressResponses(), 3)
+}
+
+func TestMaxInProcessRequests(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+	responseManager.SetMaxInProcessRequests(1)
+	responseManager.SetThawSpeed(10 * time.Millisecond)
+	started := make(chan graphsync.RequestID, 2)
+	release := make(chan struct{})
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.ValidateRequest()
+		started <- requestData.ID()
+		<-release
+	})
+	responseManager.Startup()
+
+	secondRequestID := td.requestID + 1
+	requests := append(td.requests, gsmsg.NewRequest(secondRequestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0)))
+	responseManager.ProcessRequests(td.ctx, td.p, requests)
+
+	var startedID graphsync.RequestID
+	testutil.AssertReceive(td.ctx, t, started, &startedID, "first response should start")
+	require.Equal(t, td.requestID, startedID)
+
+	// the only worker is busy, so the second response waits
+	time.Sleep(50 * time.Millisecond)
+	testutil.AssertChannelEmpty(t, started, "second response should not start while the first is processing")
+
+	close(release)
+	testutil.AssertReceive(td.ctx, t, started, &startedID, "second response should start")
+	require.Equal(t, secondRequestID, startedID)
+	for i := 0; i < len(requests); i++ {
+		testutil.AssertDoesReceive(td.ctx, t, td.completedRequestChan, "should complete request")
+	}
+}
+
+func TestRequestorPause(t *testing.T) {
+	pauseUpdate := func(t *testing.T, td testData, pause bool) []gsmsg.GraphSyncRequest {
+		data, err := pauseresponse.EncodePauseResponse(pause)
+		require.NoError(t, err)
+		return []gsmsg.GraphSyncRequest{
+			gsmsg.UpdateRequest(td.requestID, graphsync.ExtensionData{Name: graphsync.ExtensionPauseResponse, Data: data}),
+		}
+	}
+
+	t.Run("answers the offer to pause the response", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		data, err := pauseresponse.EncodePauseResponse(false)
+		require.NoError(t, err)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{Name: graphsync.ExtensionPauseResponse, Data: data}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
+		var receivedExtension sentExtension
+		testutil.AssertReceive(td.ctx, t, td.sentExtensions, &receivedExtension, "should answer the offer")
+		require.Equal(t, graphsync.ExtensionPauseResponse, receivedExtension.extension.Name)
+		pause, err := pauseresponse.DecodePauseResponse(receivedExtension.extension.Data)
+		require.NoError(t, err)
+		require.False(t, pause)
+		testutil.AssertDoesReceive(td.ctx, t, td.completedRequestChan, "should complete request")
+	})
+
+	t.Run("does not answer a request without the offer", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, td.completedRequestChan, "should complete request")
+		testutil.AssertChannelEmpty(t, td.sentExtensions, "should not send extensions")
+	})
+
+	t.Run("pauses and resumes when the requestor asks", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		// the requestor asks for a pause while the first block is sent
+		blkIndex := 0
+		td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+			blkIndex++
+			if blkIndex == 1 {
+				responseManager.ProcessRequests(td.ctx, td.p, pauseUpdate(t, td, true))
+				responseManager.synchronize()
+			}
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, td.pausedRequests, "should pause request")
+		// the pause takes effect after the next block
+		for i := 0; i < 2; i++ {
+			testutil.AssertDoesReceive(td.ctx, t, td.sentResponses, "should send block")
+		}
+		testutil.AssertChannelEmpty(t, td.sentResponses, "should not send more blocks")
+		testutil.AssertChannelEmpty(t, td.completedRequestChan, "should not complete request while paused")
+
+		responseManager.ProcessRequests(td.ctx, td.p, pauseUpdate(t, td, false))
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should complete request")
+		require.True(t, gsmsg.IsTerminalSuccessCode(lastRequest.result), "request should succeed")
+	})
+
+	t.Run("a cancel that arrives as the response pauses ends it", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		cancelledListenerCalled := make(chan struct{}, 1)
+		td.cancelledListeners.Register(func(p peer.ID, request graphsync.RequestData) {
+			cancelledListenerCalled <- struct{}{}
+		})
+		blkIndex := 0
+		td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+			blkIndex++
+			if blkIndex == 1 {
+				responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{gsmsg.CancelRequest(td.requestID)})
+				responseManager.synchronize()
+				hookActions.PauseResponse()
+			}
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, cancelledListenerCalled, "should call cancelled listener")
+		testutil.AssertDoesReceive(td.ctx, t, td.cancelledRequests, "should stop tracking the response")
+		responseManager.synchronize()
+		require.Empty(t, responseManager.InProgressResponses())
+	})
+
+	t.Run("cannot resume a response the responder paused", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.PauseResponse()
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		testutil.AssertDoesReceive(td.ctx, t, td.pausedRequests, "should pause request")
+
+		responseManager.ProcessRequests(td.ctx, td.p, pauseUpdate(t, td, false))
+		responseManager.synchronize()
+		require.Len(t, responseManager.InProgressResponses(), 1)
+		require.True(t, responseManager.InProgressResponses()[0].Paused, "response should stay paused")
+
+		require.NoError(t, responseManager.UnpauseResponse(td.p, td.requestID))
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should complete request")
+		require.True(t, gsmsg.IsTerminalSuccessCode(lastRequest.result), "request should succeed")
+	})
+}
+
 func TestValidationAndExtensions(t *testing.T) {
 	t.Run("on its own, should fail validation", func(t *testing.T) {
 		td := newTestData(t)
@@ -555,6 +950,76 @@ func TestValidationAndExtensions(t *testing.T) {
 			require.True(t, set.Has(link.(cidlink.Link).Cid))
 		}
 	})
+	t.Run("partition extension", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		part := partition.Partition{Count: 3, Buckets: []int{0, 2}}
+		data, err := partition.EncodePartition(part)
+		require.NoError(t, err)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionPartition,
+					Data: data,
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should complete request")
+		require.True(t, gsmsg.IsTerminalSuccessCode(lastRequest.result), "request should succeed")
+		var receivedPartition partition.Partition
+		testutil.AssertReceive(td.ctx, t, td.partitions, &receivedPartition, "should use partition")
+		require.Equal(t, part, receivedPartition)
+	})
+	t.Run("budget extension", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		data, err := budget.EncodeBudget(graphsync.Budget{MaxBlocks: 3})
+		require.NoError(t, err)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionBudget,
+					Data: data,
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should complete request")
+		require.Equal(t, completedRequest{td.requestID, graphsync.RequestCompletedPartial}, lastRequest)
+		require.Len(t, td.sentResponses, 3, "should only send blocks within the budget")
+	})
+	t.Run("hooks can send additional peers", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners)
+		responseManager.Startup()
+		mirrors := []peer.AddrInfo{{ID: test.RandPeerIDFatal(t), Addrs: []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/4001")}}}
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.SendAdditionalPeers(mirrors...)
+			hookActions.TerminateWithError(errors.New("use a mirror"))
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		var lastRequest completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &lastRequest, "should complete request")
+		require.True(t, gsmsg.IsTerminalFailureCode(lastRequest.result), "should terminate with failure")
+		var receivedExtension sentExtension
+		testutil.AssertReceive(td.ctx, t, td.sentExtensions, &receivedExtension, "should send additional peers")
+		require.Equal(t, graphsync.ExtensionAdditionalPeers, receivedExtension.extension.Name)
+		sentPeers, err := additionalpeers.DecodeAdditionalPeers(receivedExtension.extension.Data)
+		require.NoError(t, err)
+		require.Equal(t, mirrors, sentPeers)
+	})
 	t.Run("test pause/resume", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
@@ -930,6 +1395,7 @@ type testData struct {
 	pausedRequests        chan pausedRequest
 	cancelledRequests     chan cancelledRequest
 	ignoredLinks          chan []ipld.Link
+	partitions            chan partition.Partition
 	peerManager           *fakePeerManager
 	queryQueue            *fakeQueryQueue
 	extensionData         []byte
@@ -949,6 +1415,8 @@ type testData struct {
 	updateHooks           *hooks.RequestUpdatedHooks
 	completedListeners    *hooks.CompletedResponseListeners
 	cancelledListeners    *hooks.RequestorCancelledListeners
+	networkErrorListeners *hooks.NetworkErrorListeners
+	connManager           *testutil.TestConnManager
 }
 
 func newTestData(t *testing.T) testData {
@@ -967,6 +1435,7 @@ func newTestData(t *testing.T) testData {
 	td.pausedRequests = make(chan pausedRequest, 1)
 	td.cancelledRequests = make(chan cancelledRequest, 1)
 	td.ignoredLinks = make(chan []ipld.Link, 1)
+	td.partitions = make(chan partition.Partition, 1)
 	fprs := &fakePeerResponseSender{
 		lastCompletedRequest: td.completedRequestChan,
 		sentResponses:        td.sentResponses,
@@ -974,6 +1443,7 @@ func newTestData(t *testing.T) testData {
 		pausedRequests:       td.pausedRequests,
 		cancelledRequests:    td.cancelledRequests,
 		ignoredLinks:         td.ignoredLinks,
+		partitions:           td.partitions,
 	}
 	td.peerManager = &fakePeerManager{peerResponseSender: fprs}
 	td.queryQueue = &fakeQueryQueue{}
@@ -1008,5 +1478,7 @@ func newTestData(t *testing.T) testData {
 	td.updateHooks = hooks.NewUpdateHooks()
 	td.completedListeners = hooks.NewCompletedResponseListeners()
 	td.cancelledListeners = hooks.NewRequestorCancelledListeners()
+	td.networkErrorListeners = hooks.NewNetworkErrorListeners()
+	td.connManager = testutil.NewTestConnManager()
 	return td
 }
@@ -0,0 +1,31 @@
+package retryafter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// EncodeRetryAfter encodes a delay into bytes for the retry after extension.
+// The delay is sent as a whole number of milliseconds.
+func EncodeRetryAfter(delay time.Duration) ([]byte, error) {
+	return ipldutil.EncodeNode(basicnode.NewInt(int(delay / time.Millisecond)))
+}
+
+// DecodeRetryAfter decodes a delay from data for the retry after extension
+func DecodeRetryAfter(data []byte) (time.Duration, error) {
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return 0, err
+	}
+	milliseconds, err := node.AsInt()
+	if err != nil {
+		return 0, err
+	}
+	if milliseconds < 0 {
+		return 0, errors.New("retry after cannot be negative")
+	}
+	return time.Duration(milliseconds) * time.Millisecond, nil
+}
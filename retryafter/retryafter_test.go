@@ -0,0 +1,20 @@
+package retryafter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEncodeRetryAfter(t *testing.T) {
+	delay := 1500 * time.Millisecond
+	encoded, err := EncodeRetryAfter(delay)
+	require.NoError(t, err, "encode errored")
+	decoded, err := DecodeRetryAfter(encoded)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, delay, decoded, "delay changed during encoding and decoding")
+
+	_, err = DecodeRetryAfter([]byte("not a delay"))
+	require.Error(t, err)
+}
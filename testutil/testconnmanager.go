@@ -0,0 +1,103 @@
+package testutil
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// TestConnManager is a connection manager that records which peers are
+// tagged and protected, and under which tags
+type TestConnManager struct {
+	connmgr.NullConnMgr
+	lk        sync.Mutex
+	protected map[peer.ID]map[string]struct{}
+	tags      map[peer.ID]map[string]int
+}
+
+// NewTestConnManager returns a connection manager with nothing protected
+func NewTestConnManager() *TestConnManager {
+	return &TestConnManager{
+		protected: make(map[peer.ID]map[string]struct{}),
+		tags:      make(map[peer.ID]map[string]int),
+	}
+}
+
+// TagPeer records a tag for a peer
+func (tcm *TestConnManager) TagPeer(p peer.ID, tag string, value int) {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	if tcm.tags[p] == nil {
+		tcm.tags[p] = make(map[string]int)
+	}
+	tcm.tags[p][tag] = value
+}
+
+// UntagPeer removes a tag from a peer
+func (tcm *TestConnManager) UntagPeer(p peer.ID, tag string) {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	delete(tcm.tags[p], tag)
+	if len(tcm.tags[p]) == 0 {
+		delete(tcm.tags, p)
+	}
+}
+
+// Protect protects a peer under a tag
+func (tcm *TestConnManager) Protect(p peer.ID, tag string) {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	if tcm.protected[p] == nil {
+		tcm.protected[p] = make(map[string]struct{})
+	}
+	tcm.protected[p][tag] = struct{}{}
+}
+
+// Unprotect removes a tag protecting a peer, returning whether the peer is
+// still protected by other tags
+func (tcm *TestConnManager) Unprotect(p peer.ID, tag string) bool {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	delete(tcm.protected[p], tag)
+	if len(tcm.protected[p]) == 0 {
+		delete(tcm.protected, p)
+		return false
+	}
+	return true
+}
+
+// IsProtected returns whether a peer is protected under the given tag, or
+// under any tag if the tag is empty
+func (tcm *TestConnManager) IsProtected(p peer.ID, tag string) bool {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	if tag == "" {
+		return len(tcm.protected[p]) > 0
+	}
+	_, ok := tcm.protected[p][tag]
+	return ok
+}
+
+// TagValue returns the value of a tag on a peer, and whether the tag is set
+func (tcm *TestConnManager) TagValue(p peer.ID, tag string) (int, bool) {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	value, ok := tcm.tags[p][tag]
+	return value, ok
+}
+
+type connManagedHost struct {
+	host.Host
+	cm connmgr.ConnManager
+}
+
+func (h *connManagedHost) ConnManager() connmgr.ConnManager {
+	return h.cm
+}
+
+// HostWithConnManager wraps a host so it uses the given connection manager
+func HostWithConnManager(h host.Host, cm connmgr.ConnManager) host.Host {
+	return &connManagedHost{h, cm}
+}